@@ -0,0 +1,292 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Tables that can be exported
+const (
+	EXPORT_SERVERS   = "servers"
+	EXPORT_STATUSES  = "statuses"
+	EXPORT_INCIDENTS = "incidents"
+)
+
+var EXPORT_TABLES = []string{EXPORT_SERVERS, EXPORT_STATUSES, EXPORT_INCIDENTS}
+
+// DEFAULT_EXPORT_DAYS is how far back exports go when no range is given
+const DEFAULT_EXPORT_DAYS = 30
+
+var QUERY_EXPORT_SERVERS = `
+SELECT
+	id,
+	guid,
+	name,
+	description,
+	emu,
+	host,
+	port,
+	type,
+	COALESCE(website_url, ''),
+	COALESCE(discord_url, ''),
+	is_listed,
+	is_online,
+	last_seen,
+	created_at,
+	updated_at
+FROM servers
+ORDER BY id
+`
+
+var QUERY_EXPORT_STATUSES = `
+SELECT
+	statuses.id,
+	statuses.server_id,
+	servers.guid,
+	statuses.created_at,
+	statuses.status,
+	statuses.rtt,
+	COALESCE(statuses.message, '')
+FROM statuses
+INNER JOIN servers ON servers.id = statuses.server_id
+WHERE
+	statuses.created_at >= ?
+AND
+	statuses.created_at < ?
+ORDER BY statuses.created_at, statuses.id
+`
+
+// Incidents that overlap the range at all are exported
+var QUERY_EXPORT_INCIDENTS = `
+SELECT
+	incidents.id,
+	incidents.server_id,
+	servers.guid,
+	incidents.kind,
+	incidents.started_at,
+	incidents.ended_at,
+	COALESCE(incidents.message, '')
+FROM incidents
+INNER JOIN servers ON servers.id = incidents.server_id
+WHERE
+	incidents.started_at < ?
+AND
+	(incidents.ended_at IS NULL OR incidents.ended_at >= ?)
+ORDER BY incidents.started_at, incidents.id
+`
+
+// ExportRange is the time range of an export, [From, To)
+type ExportRange struct {
+	From time.Time
+	To   time.Time
+}
+
+// ParseExportRange reads the from and to query parameters. Exports default to
+// the DEFAULT_EXPORT_DAYS days before to, which defaults to now.
+func ParseExportRange(values url.Values, now time.Time) (ExportRange, error) {
+	r := ExportRange{To: now}
+
+	if value := values.Get("to"); value != "" {
+		to, err := parseRangeTime(value)
+
+		if err != nil {
+			return r, fmt.Errorf("invalid to: %w", err)
+		}
+
+		r.To = to
+	}
+
+	r.From = r.To.AddDate(0, 0, -DEFAULT_EXPORT_DAYS)
+
+	if value := values.Get("from"); value != "" {
+		from, err := parseRangeTime(value)
+
+		if err != nil {
+			return r, fmt.Errorf("invalid from: %w", err)
+		}
+
+		r.From = from
+	}
+
+	if !r.From.Before(r.To) {
+		return r, fmt.Errorf("from (%s) must be before to (%s)", r.From.Format(time.RFC3339), r.To.Format(time.RFC3339))
+	}
+
+	return r, nil
+}
+
+// Exported rows use pointers rather than null types for nullable columns so
+// they can be written to Parquet as optional columns as well as to JSON
+
+// ExportServer is a server's metadata. Every server is exported, whatever the
+// range.
+type ExportServer struct {
+	ID          int64      `json:"id" parquet:"id"`
+	GUID        string     `json:"guid" parquet:"guid"`
+	Name        string     `json:"name" parquet:"name"`
+	Description string     `json:"description" parquet:"description"`
+	Emulator    string     `json:"emu" parquet:"emu"`
+	Host        string     `json:"host" parquet:"host"`
+	Port        string     `json:"port" parquet:"port"`
+	Type        string     `json:"type" parquet:"type"`
+	WebsiteURL  string     `json:"website_url" parquet:"website_url"`
+	DiscordURL  string     `json:"discord_url" parquet:"discord_url"`
+	IsListed    bool       `json:"is_listed" parquet:"is_listed"`
+	IsOnline    *bool      `json:"is_online" parquet:"is_online,optional"`
+	LastSeen    *time.Time `json:"last_seen" parquet:"last_seen,optional"`
+	CreatedAt   time.Time  `json:"created_at" parquet:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" parquet:"updated_at"`
+}
+
+// ExportStatus is a single check
+type ExportStatus struct {
+	ID         int64     `json:"id" parquet:"id"`
+	ServerID   int64     `json:"server_id" parquet:"server_id"`
+	ServerGUID string    `json:"server_guid" parquet:"server_guid"`
+	CreatedAt  time.Time `json:"created_at" parquet:"created_at"`
+	Up         bool      `json:"up" parquet:"up"`
+	RTT        *int64    `json:"rtt" parquet:"rtt,optional"`
+	Message    string    `json:"message" parquet:"message"`
+}
+
+// Validate checks a server has what's needed to import it
+func (s ExportServer) Validate() error {
+	if s.GUID == "" {
+		return fmt.Errorf("server has no guid")
+	}
+
+	return nil
+}
+
+// Validate checks a status has what's needed to import it
+func (s ExportStatus) Validate() error {
+	if s.CreatedAt.IsZero() || s.ServerGUID == "" {
+		return fmt.Errorf("status has no created_at or server_guid")
+	}
+
+	return nil
+}
+
+// ExportIncident is an outage or degraded period. Ongoing incidents have no
+// end.
+type ExportIncident struct {
+	ID         int64      `json:"id" parquet:"id"`
+	ServerID   int64      `json:"server_id" parquet:"server_id"`
+	ServerGUID string     `json:"server_guid" parquet:"server_guid"`
+	Kind       string     `json:"kind" parquet:"kind"`
+	StartedAt  time.Time  `json:"started_at" parquet:"started_at"`
+	EndedAt    *time.Time `json:"ended_at" parquet:"ended_at,optional"`
+	Message    string     `json:"message" parquet:"message"`
+}
+
+func unixPointer(value sql.NullInt64) *time.Time {
+	if !value.Valid {
+		return nil
+	}
+
+	t := time.Unix(value.Int64, 0).UTC()
+
+	return &t
+}
+
+// exportRows runs query and calls fn with each row as it's read, so exports
+// never hold more than a row in memory
+func exportRows[T any](ctx context.Context, db *sql.DB, query string, args []any, scan func(*sql.Rows) (T, error), fn func(T) error) error {
+	rows, err := db.QueryContext(ctx, query, args...)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		row, err := scan(rows)
+
+		if err != nil {
+			return err
+		}
+
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// ExportServers calls fn with every server, in ID order
+func ExportServers(ctx context.Context, db *sql.DB, fn func(ExportServer) error) error {
+	return exportRows(ctx, db, QUERY_EXPORT_SERVERS, nil, func(rows *sql.Rows) (ExportServer, error) {
+		var s ExportServer
+		var is_online sql.NullBool
+		var last_seen sql.NullInt64
+		var created_at, updated_at int64
+
+		err := rows.Scan(
+			&s.ID,
+			&s.GUID,
+			&s.Name,
+			&s.Description,
+			&s.Emulator,
+			&s.Host,
+			&s.Port,
+			&s.Type,
+			&s.WebsiteURL,
+			&s.DiscordURL,
+			&s.IsListed,
+			&is_online,
+			&last_seen,
+			&created_at,
+			&updated_at,
+		)
+
+		if is_online.Valid {
+			s.IsOnline = &is_online.Bool
+		}
+
+		s.LastSeen = unixPointer(last_seen)
+		s.CreatedAt = time.Unix(created_at, 0).UTC()
+		s.UpdatedAt = time.Unix(updated_at, 0).UTC()
+
+		return s, err
+	}, fn)
+}
+
+// ExportStatuses calls fn with every check in r, oldest first
+func ExportStatuses(ctx context.Context, db *sql.DB, r ExportRange, fn func(ExportStatus) error) error {
+	return exportRows(ctx, db, QUERY_EXPORT_STATUSES, []any{r.From.Unix(), r.To.Unix()}, func(rows *sql.Rows) (ExportStatus, error) {
+		var s ExportStatus
+		var created_at int64
+		var rtt sql.NullInt64
+
+		err := rows.Scan(&s.ID, &s.ServerID, &s.ServerGUID, &created_at, &s.Up, &rtt, &s.Message)
+
+		if rtt.Valid {
+			s.RTT = &rtt.Int64
+		}
+
+		s.CreatedAt = time.Unix(created_at, 0).UTC()
+
+		return s, err
+	}, fn)
+}
+
+// ExportIncidents calls fn with every incident that overlaps r, oldest first
+func ExportIncidents(ctx context.Context, db *sql.DB, r ExportRange, fn func(ExportIncident) error) error {
+	return exportRows(ctx, db, QUERY_EXPORT_INCIDENTS, []any{r.To.Unix(), r.From.Unix()}, func(rows *sql.Rows) (ExportIncident, error) {
+		var i ExportIncident
+		var started_at int64
+		var ended_at sql.NullInt64
+
+		err := rows.Scan(&i.ID, &i.ServerID, &i.ServerGUID, &i.Kind, &started_at, &ended_at, &i.Message)
+
+		i.StartedAt = time.Unix(started_at, 0).UTC()
+		i.EndedAt = unixPointer(ended_at)
+
+		return i, err
+	}, fn)
+}
@@ -0,0 +1,29 @@
+package api
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExportRange(t *testing.T) {
+	r, err := ParseExportRange(url.Values{}, testNow)
+
+	assert.NoError(t, err)
+	assert.Equal(t, testNow, r.To)
+	assert.Equal(t, testNow.AddDate(0, 0, -DEFAULT_EXPORT_DAYS), r.From)
+
+	// The default span is kept when only the end is given
+	r, err = ParseExportRange(url.Values{"to": {"2024-01-31"}}, testNow)
+
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), r.From)
+
+	_, err = ParseExportRange(url.Values{"from": {"2024-03-15"}}, testNow)
+	assert.Error(t, err)
+
+	_, err = ParseExportRange(url.Values{"to": {"soon"}}, testNow)
+	assert.Error(t, err)
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"database/sql"
+	"time"
+
+	"gopkg.in/guregu/null.v4"
+)
+
+// The most incidents returned for a server
+const MAX_INCIDENTS = 500
+
+var QUERY_INCIDENTS = `
+SELECT id, kind, started_at, ended_at, COALESCE(message, '')
+FROM incidents
+WHERE server_id = ?
+ORDER BY started_at DESC
+LIMIT ?
+`
+
+type IncidentApiResponse struct {
+	ServerName string            `json:"server"`
+	Count      int               `json:"count"`
+	Incidents  []IncidentApiItem `json:"incidents"`
+}
+
+// IncidentApiItem is an outage or degraded period. Ongoing incidents have no
+// end and their duration is up to now.
+type IncidentApiItem struct {
+	ID        int         `json:"id"`
+	Kind      string      `json:"kind"`
+	StartedAt string      `json:"started_at"`
+	EndedAt   null.String `json:"ended_at"`
+	Ongoing   bool        `json:"ongoing"`
+	Duration  int64       `json:"duration_seconds"`
+	Message   string      `json:"message"`
+}
+
+// Incidents returns up to limit of a server's most recent incidents, newest
+// first
+func Incidents(db *sql.DB, server_id int, limit int, now time.Time) (IncidentApiResponse, error) {
+	var response IncidentApiResponse
+
+	name, err := GetServerNameById(db, server_id)
+
+	if err != nil {
+		return response, err
+	}
+
+	response.ServerName = name
+	response.Incidents = []IncidentApiItem{}
+
+	rows, err := db.Query(QUERY_INCIDENTS, server_id, limit)
+
+	if err != nil {
+		return response, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var item IncidentApiItem
+		var started_at int64
+		var ended_at sql.NullInt64
+
+		err := rows.Scan(&item.ID, &item.Kind, &started_at, &ended_at, &item.Message)
+
+		if err != nil {
+			return response, err
+		}
+
+		item.StartedAt = time.Unix(started_at, 0).UTC().Format(time.RFC3339)
+		item.EndedAt = PrettyTimeOrNullString(ended_at)
+		item.Ongoing = !ended_at.Valid
+
+		if ended_at.Valid {
+			item.Duration = ended_at.Int64 - started_at
+		} else {
+			item.Duration = now.Unix() - started_at
+		}
+
+		response.Incidents = append(response.Incidents, item)
+	}
+
+	response.Count = len(response.Incidents)
+
+	return response, rows.Err()
+}
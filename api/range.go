@@ -0,0 +1,316 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	GRANULARITY_HOUR  string = "hour"
+	GRANULARITY_DAY   string = "day"
+	GRANULARITY_WEEK  string = "week"
+	GRANULARITY_MONTH string = "month"
+)
+
+// MAX_UPTIME_BUCKETS limits how many buckets a single uptime query can return,
+// e.g., about six weeks of hourly data or a few years of daily data
+const MAX_UPTIME_BUCKETS = 1000
+
+// DEFAULT_UPTIME_DAYS is how far back uptime queries go when no range is given
+const DEFAULT_UPTIME_DAYS = 14
+
+// UptimeRange describes a time range to query uptime for and how to bucket it.
+// Buckets are aligned to UTC hours, days, Mondays or the first of the month
+// and every bucket starting in [From, To) is returned.
+type UptimeRange struct {
+	From        time.Time
+	To          time.Time
+	Granularity string
+}
+
+// UptimeCalendarRange is one of the ranges offered on the statuses page
+type UptimeCalendarRange struct {
+	Key   string
+	Label string
+	Days  int
+}
+
+var UPTIME_CALENDAR_RANGES = []UptimeCalendarRange{
+	{Key: "1m", Label: "Last Month", Days: 30},
+	{Key: "3m", Label: "Last 3 Months", Days: 90},
+	{Key: "5m", Label: "Last 5 Months", Days: 150},
+	{Key: "1y", Label: "Last Year", Days: 365},
+}
+
+const DEFAULT_UPTIME_CALENDAR_RANGE = "5m"
+
+// DefaultUptimeRange is the last DEFAULT_UPTIME_DAYS days plus today, by day
+func DefaultUptimeRange(now time.Time) UptimeRange {
+	return UptimeRange{
+		From:        now.AddDate(0, 0, -DEFAULT_UPTIME_DAYS),
+		To:          now,
+		Granularity: GRANULARITY_DAY,
+	}
+}
+
+// CalendarUptimeRange returns the daily range for one of
+// UPTIME_CALENDAR_RANGES, starting on a Monday so it can be laid out as a grid
+// of weeks. Unknown keys get the default range.
+func CalendarUptimeRange(key string, now time.Time) (UptimeCalendarRange, UptimeRange) {
+	var selected UptimeCalendarRange
+
+	for _, r := range UPTIME_CALENDAR_RANGES {
+		if r.Key == key || (selected.Key == "" && r.Key == DEFAULT_UPTIME_CALENDAR_RANGE) {
+			selected = r
+		}
+	}
+
+	return selected, UptimeRange{
+		From:        bucketStart(now.AddDate(0, 0, -selected.Days), GRANULARITY_WEEK),
+		To:          now,
+		Granularity: GRANULARITY_DAY,
+	}
+}
+
+// parseRangeTime accepts either an RFC 3339 timestamp or a YYYY-MM-DD date
+func parseRangeTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t.UTC(), nil
+	}
+
+	return time.Time{}, fmt.Errorf("couldn't parse %q as an RFC 3339 timestamp or YYYY-MM-DD date", value)
+}
+
+// ParseUptimeRange reads the from, to and granularity query parameters,
+// falling back to DefaultUptimeRange for anything not given, and validates the
+// result
+func ParseUptimeRange(values url.Values, now time.Time) (UptimeRange, error) {
+	r := DefaultUptimeRange(now)
+
+	if value := values.Get("granularity"); value != "" {
+		r.Granularity = value
+	}
+
+	if value := values.Get("to"); value != "" {
+		to, err := parseRangeTime(value)
+
+		if err != nil {
+			return r, fmt.Errorf("invalid to: %w", err)
+		}
+
+		r.To = to
+
+		// Keep the default span when only the end of the range is given
+		if values.Get("from") == "" {
+			r.From = to.AddDate(0, 0, -DEFAULT_UPTIME_DAYS)
+		}
+	}
+
+	if value := values.Get("from"); value != "" {
+		from, err := parseRangeTime(value)
+
+		if err != nil {
+			return r, fmt.Errorf("invalid from: %w", err)
+		}
+
+		r.From = from
+	}
+
+	return r, r.Validate()
+}
+
+// Validate checks the granularity is known, the range isn't empty and that it
+// doesn't span more than MAX_UPTIME_BUCKETS buckets
+func (r UptimeRange) Validate() error {
+	switch r.Granularity {
+	case GRANULARITY_HOUR, GRANULARITY_DAY, GRANULARITY_WEEK, GRANULARITY_MONTH:
+	default:
+		return fmt.Errorf("invalid granularity %q, must be one of hour, day, week or month", r.Granularity)
+	}
+
+	if !r.From.Before(r.To) {
+		return fmt.Errorf("from (%s) must be before to (%s)", r.From.Format(time.RFC3339), r.To.Format(time.RFC3339))
+	}
+
+	n := 0
+
+	for t := bucketStart(r.From, r.Granularity); t.Before(r.To); t = nextBucket(t, r.Granularity) {
+		n++
+
+		if n > MAX_UPTIME_BUCKETS {
+			return fmt.Errorf("range is too large, at most %d buckets of granularity %s can be requested", MAX_UPTIME_BUCKETS, r.Granularity)
+		}
+	}
+
+	return nil
+}
+
+// Buckets returns the start of every bucket in the range
+func (r UptimeRange) Buckets() []time.Time {
+	var buckets []time.Time
+
+	for t := bucketStart(r.From, r.Granularity); t.Before(r.To); t = nextBucket(t, r.Granularity) {
+		buckets = append(buckets, t)
+	}
+
+	return buckets
+}
+
+// Query builds the SQL and arguments to aggregate the rollup tables into this
+// range's buckets for a single server. Hourly buckets read statuses_hourly and
+// everything else reads statuses_daily. Each result row is the bucket's start
+// as a Unix timestamp followed by the rollup columns summed over the bucket.
+// Buckets without any checks aren't returned.
+func (r UptimeRange) Query(server_id int) (string, []any) {
+	table := "statuses_daily"
+	bucket := "start"
+
+	switch r.Granularity {
+	case GRANULARITY_HOUR:
+		table = "statuses_hourly"
+	case GRANULARITY_WEEK:
+		// The Unix epoch was a Thursday so shift by three days to get Mondays
+		bucket = "start - (start + 3 * 86400) % (7 * 86400)"
+	case GRANULARITY_MONTH:
+		bucket = "CAST(strftime('%s', start, 'unixepoch', 'start of month') AS INTEGER)"
+	}
+
+	query := fmt.Sprintf(`
+	SELECT
+		%s AS bucket,
+		SUM(n),
+		SUM(n_up),
+		SUM(rtt_n),
+		SUM(rtt_sum),
+		MIN(rtt_min),
+		MAX(rtt_max)
+	FROM %s
+	WHERE
+		server_id = ?
+	AND
+		start >= ?
+	AND
+		start < ?
+	GROUP BY bucket
+	ORDER BY bucket;
+	`, bucket, table)
+
+	// Buckets are always whole so the query runs to the end of the last one
+	from := bucketStart(r.From, r.Granularity)
+	to := from
+
+	for to.Before(r.To) {
+		to = nextBucket(to, r.Granularity)
+	}
+
+	return query, []any{server_id, from.Unix(), to.Unix()}
+}
+
+// Label formats a bucket start for display and the API. Hourly buckets get a
+// full timestamp and everything else gets a date.
+func (r UptimeRange) Label(t time.Time) string {
+	if r.Granularity == GRANULARITY_HOUR {
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	return t.UTC().Format(time.DateOnly)
+}
+
+func bucketStart(t time.Time, granularity string) time.Time {
+	t = t.UTC()
+
+	switch granularity {
+	case GRANULARITY_HOUR:
+		return t.Truncate(time.Hour)
+	case GRANULARITY_WEEK:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case GRANULARITY_MONTH:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+}
+
+func nextBucket(t time.Time, granularity string) time.Time {
+	switch granularity {
+	case GRANULARITY_HOUR:
+		return t.Add(time.Hour)
+	case GRANULARITY_WEEK:
+		return t.AddDate(0, 0, 7)
+	case GRANULARITY_MONTH:
+		return t.AddDate(0, 1, 0)
+	default:
+		return t.AddDate(0, 0, 1)
+	}
+}
+
+// UptimeRows runs the range's query and returns one row per bucket, in order,
+// including buckets without any checks
+func UptimeRows(db *sql.DB, server_id int, r UptimeRange) ([]UptimeRow, error) {
+	query, args := r.Query(server_id)
+
+	rows, err := db.Query(query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	found := map[int64]UptimeRow{}
+
+	for rows.Next() {
+		var bucket int64
+		var n, n_up, rtt_n, rtt_sum int64
+		var row UptimeRow
+
+		err := rows.Scan(
+			&bucket,
+			&n,
+			&n_up,
+			&rtt_n,
+			&rtt_sum,
+			&row.RTTMin,
+			&row.RTTMax,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		row.N = int(n)
+
+		if n > 0 {
+			row.Uptime = float64(n_up) * 100 / float64(n)
+		}
+
+		if rtt_n > 0 {
+			row.RTTMean = sql.NullFloat64{Float64: float64(rtt_sum) / float64(rtt_n), Valid: true}
+		}
+
+		found[bucket] = row
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var result []UptimeRow
+
+	for _, t := range r.Buckets() {
+		row := found[t.Unix()]
+		row.Date = r.Label(t)
+
+		result = append(result, row)
+	}
+
+	return result, nil
+}
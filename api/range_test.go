@@ -0,0 +1,89 @@
+package api
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testNow = time.Date(2024, 3, 14, 15, 9, 26, 0, time.UTC)
+
+func TestParseUptimeRangeDefaults(t *testing.T) {
+	r, err := ParseUptimeRange(url.Values{}, testNow)
+
+	assert.NoError(t, err)
+	assert.Equal(t, GRANULARITY_DAY, r.Granularity)
+	assert.Len(t, r.Buckets(), DEFAULT_UPTIME_DAYS+1)
+	assert.Equal(t, "2024-02-29", r.Label(r.Buckets()[0]))
+	assert.Equal(t, "2024-03-14", r.Label(r.Buckets()[DEFAULT_UPTIME_DAYS]))
+}
+
+func TestParseUptimeRange(t *testing.T) {
+	r, err := ParseUptimeRange(url.Values{
+		"from":        {"2024-03-01T10:30:00Z"},
+		"to":          {"2024-03-01T13:00:00Z"},
+		"granularity": {"hour"},
+	}, testNow)
+
+	assert.NoError(t, err)
+
+	var labels []string
+
+	for _, b := range r.Buckets() {
+		labels = append(labels, r.Label(b))
+	}
+
+	assert.Equal(t, []string{"2024-03-01T10:00:00Z", "2024-03-01T11:00:00Z", "2024-03-01T12:00:00Z"}, labels)
+}
+
+func TestParseUptimeRangeWeeksAndMonths(t *testing.T) {
+	r, err := ParseUptimeRange(url.Values{
+		"from":        {"2024-03-01"},
+		"to":          {"2024-03-14"},
+		"granularity": {"week"},
+	}, testNow)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "2024-02-26", r.Label(r.Buckets()[0]))
+	assert.Len(t, r.Buckets(), 3)
+
+	r, err = ParseUptimeRange(url.Values{
+		"from":        {"2023-11-15"},
+		"granularity": {"month"},
+	}, testNow)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "2023-11-01", r.Label(r.Buckets()[0]))
+	assert.Len(t, r.Buckets(), 5)
+}
+
+func TestParseUptimeRangeErrors(t *testing.T) {
+	cases := []url.Values{
+		{"granularity": {"minute"}},
+		{"from": {"yesterday"}},
+		{"to": {"2024-13-01"}},
+		{"from": {"2024-03-10"}, "to": {"2024-03-01"}},
+		{"from": {"2020-01-01"}, "granularity": {"hour"}},
+		{"from": {"2000-01-01"}, "granularity": {"day"}},
+	}
+
+	for _, c := range cases {
+		_, err := ParseUptimeRange(c, testNow)
+		assert.Error(t, err, c.Encode())
+	}
+
+	// A long range is fine at a coarser granularity
+	_, err := ParseUptimeRange(url.Values{"from": {"2000-01-01"}, "granularity": {"month"}}, testNow)
+	assert.NoError(t, err)
+}
+
+func TestCalendarUptimeRange(t *testing.T) {
+	selected, r := CalendarUptimeRange("1y", testNow)
+	assert.Equal(t, "1y", selected.Key)
+	assert.Equal(t, time.Monday, r.From.Weekday())
+
+	selected, _ = CalendarUptimeRange("bogus", testNow)
+	assert.Equal(t, DEFAULT_UPTIME_CALENDAR_RANGE, selected.Key)
+}
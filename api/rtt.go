@@ -0,0 +1,265 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"gopkg.in/guregu/null.v4"
+)
+
+// RTT percentiles are calculated from successful checks only since failed
+// checks record how long it took to give up rather than a round trip time.
+// Percentiles use the nearest-rank method.
+var QUERY_RTT_PERCENTILES = `
+	WITH checks AS (
+		SELECT
+			created_at - created_at % ? AS bucket,
+			rtt
+		FROM statuses
+		WHERE
+			server_id = ?
+		AND
+			created_at >= ?
+		AND
+			created_at < ?
+		AND
+			status = 1
+		AND
+			rtt IS NOT NULL
+	),
+	ranked AS (
+		SELECT
+			bucket,
+			rtt,
+			ROW_NUMBER() OVER (PARTITION BY bucket ORDER BY rtt) AS rn,
+			COUNT(*) OVER (PARTITION BY bucket) AS n
+		FROM checks
+	)
+	SELECT
+		bucket,
+		n,
+		MIN(CASE WHEN rn >= 0.50 * n THEN rtt END) AS p50,
+		MIN(CASE WHEN rn >= 0.90 * n THEN rtt END) AS p90,
+		MIN(CASE WHEN rn >= 0.99 * n THEN rtt END) AS p99
+	FROM ranked
+	GROUP BY bucket
+	ORDER BY bucket;
+`
+
+type RTTResult struct {
+	Server      string       `json:"server"`
+	From        string       `json:"from"`
+	To          string       `json:"to"`
+	Granularity string       `json:"granularity"`
+	Count       int          `json:"count"`
+	RTTs        []RTTApiItem `json:"rtts"`
+}
+
+type RTTApiItem struct {
+	Date string   `json:"date"`
+	N    int      `json:"n"`
+	P50  null.Int `json:"p50"`
+	P90  null.Int `json:"p90"`
+	P99  null.Int `json:"p99"`
+}
+
+// ValidateRTTRange checks an uptime range is also suitable for RTT
+// percentiles, which are only available by hour or day
+func ValidateRTTRange(r UptimeRange) error {
+	if r.Granularity != GRANULARITY_HOUR && r.Granularity != GRANULARITY_DAY {
+		return fmt.Errorf("invalid granularity %q, must be one of hour or day", r.Granularity)
+	}
+
+	return nil
+}
+
+// RTTPercentiles returns p50/p90/p99 RTTs for each bucket in the range,
+// including buckets without any successful checks
+func RTTPercentiles(db *sql.DB, server_id int, name string, r UptimeRange) (RTTResult, error) {
+	var result RTTResult
+
+	if err := ValidateRTTRange(r); err != nil {
+		return result, err
+	}
+
+	buckets := r.Buckets()
+	seconds := int64(60 * 60)
+
+	if r.Granularity == GRANULARITY_DAY {
+		seconds = 60 * 60 * 24
+	}
+
+	from := bucketStart(r.From, r.Granularity)
+	to := from
+
+	if len(buckets) > 0 {
+		to = nextBucket(buckets[len(buckets)-1], r.Granularity)
+	}
+
+	rows, err := db.Query(QUERY_RTT_PERCENTILES, seconds, server_id, from.Unix(), to.Unix())
+
+	if err != nil {
+		return result, err
+	}
+
+	defer rows.Close()
+
+	found := map[int64]RTTApiItem{}
+
+	for rows.Next() {
+		var bucket int64
+		var item RTTApiItem
+
+		err := rows.Scan(&bucket, &item.N, &item.P50, &item.P90, &item.P99)
+
+		if err != nil {
+			return result, err
+		}
+
+		found[bucket] = item
+	}
+
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	for _, t := range buckets {
+		item := found[t.Unix()]
+		item.Date = r.Label(t)
+
+		result.RTTs = append(result.RTTs, item)
+	}
+
+	result.Server = name
+	result.From = r.From.UTC().Format(time.RFC3339)
+	result.To = r.To.UTC().Format(time.RFC3339)
+	result.Granularity = r.Granularity
+	result.Count = len(result.RTTs)
+
+	return result, nil
+}
+
+// LatencyChartRange is the range shown in the latency chart on the statuses
+// page
+func LatencyChartRange(now time.Time) UptimeRange {
+	return UptimeRange{
+		From:        now.AddDate(0, 0, -7),
+		To:          now,
+		Granularity: GRANULARITY_HOUR,
+	}
+}
+
+// LatencyChart holds everything the statuses page needs to draw an SVG line
+// chart of RTT percentiles. Paths are SVG path data and break wherever a
+// bucket has no data.
+type LatencyChart struct {
+	Width  int
+	Height int
+	Left   int
+	Bottom int
+	YMax   int
+	YMid   int
+	XStart string
+	XEnd   string
+	P50    string
+	P90    string
+	P99    string
+	Empty  bool
+}
+
+const (
+	LATENCY_CHART_WIDTH  = 600
+	LATENCY_CHART_HEIGHT = 160
+	LATENCY_CHART_LEFT   = 40
+	LATENCY_CHART_BOTTOM = 140
+)
+
+// niceCeiling rounds an RTT up to a round number for the chart's y axis
+func niceCeiling(value int64) int {
+	for _, step := range []int64{10, 50, 100, 500, 1000} {
+		if value <= step*10 {
+			return int((value + step - 1) / step * step)
+		}
+	}
+
+	return int((value + 4999) / 5000 * 5000)
+}
+
+func latencyPath(items []RTTApiItem, value func(RTTApiItem) null.Int, x func(int) float64, y func(int64) float64) string {
+	var b strings.Builder
+
+	drawing := false
+
+	for i, item := range items {
+		v := value(item)
+
+		if !v.Valid {
+			drawing = false
+			continue
+		}
+
+		command := "L"
+
+		if !drawing {
+			command = "M"
+			drawing = true
+		}
+
+		fmt.Fprintf(&b, "%s%.1f %.1f ", command, x(i), y(v.Int64))
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+// NewLatencyChart lays out RTT percentiles as an SVG line chart
+func NewLatencyChart(result RTTResult) LatencyChart {
+	chart := LatencyChart{
+		Width:  LATENCY_CHART_WIDTH,
+		Height: LATENCY_CHART_HEIGHT,
+		Left:   LATENCY_CHART_LEFT,
+		Bottom: LATENCY_CHART_BOTTOM,
+		Empty:  true,
+	}
+
+	var max int64
+
+	for _, item := range result.RTTs {
+		if item.P99.Valid {
+			chart.Empty = false
+			max = int64(math.Max(float64(max), float64(item.P99.Int64)))
+		}
+	}
+
+	if chart.Empty {
+		return chart
+	}
+
+	chart.YMax = niceCeiling(max)
+	chart.YMid = chart.YMax / 2
+
+	if len(result.RTTs) > 0 {
+		chart.XStart = result.RTTs[0].Date
+		chart.XEnd = result.RTTs[len(result.RTTs)-1].Date
+	}
+
+	plotWidth := float64(chart.Width - chart.Left)
+	step := plotWidth
+
+	if len(result.RTTs) > 1 {
+		step = plotWidth / float64(len(result.RTTs)-1)
+	}
+
+	x := func(i int) float64 { return float64(chart.Left) + float64(i)*step }
+	y := func(v int64) float64 {
+		return float64(chart.Bottom) - float64(v)/float64(chart.YMax)*float64(chart.Bottom-10)
+	}
+
+	chart.P50 = latencyPath(result.RTTs, func(i RTTApiItem) null.Int { return i.P50 }, x, y)
+	chart.P90 = latencyPath(result.RTTs, func(i RTTApiItem) null.Int { return i.P90 }, x, y)
+	chart.P99 = latencyPath(result.RTTs, func(i RTTApiItem) null.Int { return i.P99 }, x, y)
+
+	return chart
+}
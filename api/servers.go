@@ -5,6 +5,11 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/guregu/null.v4"
@@ -35,8 +40,10 @@ type ServerStatusRow struct {
 	Port         string
 	IsListed     bool
 	IsOnline     sql.NullBool
+	IsDegraded   bool
 	UpdatedAt    int
 	LastSeen     sql.NullInt64
+	RTT          sql.NullFloat64
 }
 
 type ServerAPIResponse struct {
@@ -46,12 +53,13 @@ type ServerAPIResponse struct {
 }
 
 type ServerAPIResponseServer struct {
-	ID      int                      `json:"-"`
-	GUID    string                   `json:"guid"`
-	Name    string                   `json:"name"`
-	Active  bool                     `json:"active"`
-	Address ServerAPIResponseAddress `json:"address"`
-	Status  ServerAPIResponseStatus  `json:"status"`
+	ID            int                      `json:"-"`
+	GUID          string                   `json:"guid"`
+	Name          string                   `json:"name"`
+	Active        bool                     `json:"active"`
+	Address       ServerAPIResponseAddress `json:"address"`
+	Status        ServerAPIResponseStatus  `json:"status"`
+	UptimeSummary UptimeSummary            `json:"uptime_summary"`
 }
 
 type ServerAPIResponseAddress struct {
@@ -59,23 +67,177 @@ type ServerAPIResponseAddress struct {
 	Port string `json:"port"`
 }
 
+// ServerAPIResponseStatus is a server's latest status. RTT is the mean round
+// trip time in ms of its successful checks over the last 24 hours.
 type ServerAPIResponseStatus struct {
 	IsOnline    null.Bool `json:"online"`
+	IsDegraded  bool         `json:"degraded"`
 	LastSeen    null.String  `json:"last_seen"`
 	LastChecked string       `json:"last_checked"`
+	RTT         null.Int     `json:"rtt"`
+}
+
+// ServerDetail is a server with its details from the server list
+type ServerDetail struct {
+	ServerAPIResponseServer
+	Description string `json:"description"`
+	Emulator    string `json:"emu"`
+	Type        string `json:"type"`
+	WebsiteURL  string `json:"website_url"`
+	DiscordURL  string `json:"discord_url"`
 }
 
 type ServerAPIResponseWithUptime struct {
-	ID      int                      `json:"id"`
-	GUID    string                   `json:"guid"`
-	Name    string                   `json:"name"`
-	Active  bool                     `json:"active"`
-	Address ServerAPIResponseAddress `json:"address"`
-	Status  ServerAPIResponseStatus  `json:"status"`
-	Uptime  []UptimeTemplateItem     `json:"uptime"`
+	ID            int                      `json:"id"`
+	GUID          string                   `json:"guid"`
+	Name          string                   `json:"name"`
+	Active        bool                     `json:"active"`
+	Address       ServerAPIResponseAddress `json:"address"`
+	Status        ServerAPIResponseStatus  `json:"status"`
+	UptimeSummary UptimeSummary            `json:"uptime_summary"`
+	Uptime        []UptimeTemplateItem     `json:"uptime"`
+}
+
+// SERVER_SORT_KEYS are the keys servers can be sorted by besides
+// UPTIME_SUMMARY_KEYS. "uptime" is short for "30d".
+var SERVER_SORT_KEYS = []string{"name", "uptime", "rtt", "last_seen"}
+
+// ServerFilter narrows down and sorts the server list. Empty fields match
+// every server and Search matches names and descriptions.
+type ServerFilter struct {
+	Emulator string
+	Type     string
+	Online   null.Bool
+	Search   string
+	Sort     string
+}
+
+// ParseServerFilter reads the emu, type, online, q and sort query parameters
+func ParseServerFilter(values url.Values) (ServerFilter, error) {
+	filter := ServerFilter{
+		Emulator: strings.TrimSpace(values.Get("emu")),
+		Type:     strings.TrimSpace(values.Get("type")),
+		Search:   strings.TrimSpace(values.Get("q")),
+		Sort:     values.Get("sort"),
+	}
+
+	if value := values.Get("online"); value != "" {
+		online, err := strconv.ParseBool(value)
+
+		if err != nil {
+			return filter, fmt.Errorf("invalid online %q, must be true or false", value)
+		}
+
+		filter.Online = null.BoolFrom(online)
+	}
+
+	if filter.Sort != "" && !slices.Contains(SERVER_SORT_KEYS, filter.Sort) && !slices.Contains(UPTIME_SUMMARY_KEYS, filter.Sort) {
+		return filter, fmt.Errorf("invalid sort %q, must be one of %s or %s", filter.Sort, strings.Join(SERVER_SORT_KEYS, ", "), strings.Join(UPTIME_SUMMARY_KEYS, ", "))
+	}
+
+	return filter, nil
+}
+
+// Values is the inverse of ParseServerFilter, leaving out empty fields
+func (f ServerFilter) Values() url.Values {
+	values := url.Values{}
+
+	for key, value := range map[string]string{"emu": f.Emulator, "type": f.Type, "q": f.Search, "sort": f.Sort} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+
+	if f.Online.Valid {
+		values.Set("online", strconv.FormatBool(f.Online.Bool))
+	}
+
+	return values
+}
+
+// SortURL links to the index page with the same filters sorted by key
+func (f ServerFilter) SortURL(key string) string {
+	f.Sort = key
+
+	return "/?" + f.Values().Encode()
+}
+
+// conditions returns the SQL conditions and arguments for everything but the
+// sort
+func (f ServerFilter) conditions() (string, []any) {
+	var conditions strings.Builder
+	var args []any
+
+	if f.Emulator != "" {
+		conditions.WriteString("\n\tAND lower(servers.emu) = lower(?)")
+		args = append(args, f.Emulator)
+	}
+
+	if f.Type != "" {
+		conditions.WriteString("\n\tAND lower(servers.type) = lower(?)")
+		args = append(args, f.Type)
+	}
+
+	if f.Online.Valid {
+		conditions.WriteString("\n\tAND servers.is_online IS ?")
+		args = append(args, f.Online.Bool)
+	}
+
+	if f.Search != "" {
+		// LIKE is case-insensitive but its wildcards need escaping
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(f.Search) + "%"
+
+		conditions.WriteString("\n\tAND (servers.name LIKE ? ESCAPE '\\' OR servers.description LIKE ? ESCAPE '\\')")
+		args = append(args, pattern, pattern)
+	}
+
+	return conditions.String(), args
 }
 
-func Server(db *sql.DB, id int) ServerTableRow {
+var QUERY_SERVER_FACETS = `
+SELECT DISTINCT emu, type
+FROM servers
+WHERE is_listed IS TRUE
+`
+
+// ServerFacets returns the distinct emulators and types of listed servers,
+// sorted, for filter controls
+func ServerFacets(db *sql.DB) ([]string, []string, error) {
+	rows, err := db.Query(QUERY_SERVER_FACETS)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+
+	var emus, types []string
+
+	for rows.Next() {
+		var emu, server_type string
+
+		if err := rows.Scan(&emu, &server_type); err != nil {
+			return nil, nil, err
+		}
+
+		if emu != "" && !slices.Contains(emus, emu) {
+			emus = append(emus, emu)
+		}
+
+		if server_type != "" && !slices.Contains(types, server_type) {
+			types = append(types, server_type)
+		}
+	}
+
+	slices.Sort(emus)
+	slices.Sort(types)
+
+	return emus, types, rows.Err()
+}
+
+// Server returns the server with the given ID, which is the zero value if
+// there isn't one
+func Server(db *sql.DB, id int) (ServerTableRow, error) {
 	var response ServerTableRow
 
 	stmt := `
@@ -88,9 +250,9 @@ func Server(db *sql.DB, id int) ServerTableRow {
 		host,
 		port,
 		type,
-		status,
-		website_url,
-		discord_url,
+		COALESCE(status, ''),
+		COALESCE(website_url, ''),
+		COALESCE(discord_url, ''),
 		is_listed,
 		created_at,
 		updated_at
@@ -101,40 +263,147 @@ func Server(db *sql.DB, id int) ServerTableRow {
 	LIMIT 1
 	`
 
-	rows, err := db.Query(stmt, id)
+	err := db.QueryRow(stmt, id).Scan(
+		&response.ID,
+		&response.GUID,
+		&response.Name,
+		&response.Description,
+		&response.Emulator,
+		&response.Host,
+		&response.Port,
+		&response.Type,
+		&response.Status,
+		&response.WebsiteURL,
+		&response.DiscordURL,
+		&response.IsListed,
+		&response.CreatedAt,
+		&response.UpdatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return ServerTableRow{}, nil
+	}
+
 	if err != nil {
-		log.Fatal(err)
+		return ServerTableRow{}, fmt.Errorf("error scanning server %d: %w", id, err)
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		err := rows.Scan(
-			&response.ID,
-			&response.GUID,
-			&response.Name,
-			&response.Description,
-			&response.Emulator,
-			&response.Host,
-			&response.Port,
-			&response.Type,
-			&response.Status,
-			&response.WebsiteURL,
-			&response.DiscordURL,
-			&response.IsListed,
-			&response.CreatedAt,
-			&response.UpdatedAt,
-		)
+	return response, nil
+}
+
+// Servers returns the listed servers that match filter, sorted by filter.Sort
+// or by name
+func Servers(db *sql.DB, filter ServerFilter) (ServerAPIResponse, error) {
+	conditions, args := filter.conditions()
+	items, err := serverStatuses(db, "servers.is_listed IS TRUE"+conditions, args)
+
+	if err != nil {
+		return ServerAPIResponse{}, err
+	}
+
+	SortServers(items, filter.Sort)
+
+	var finalResponse ServerAPIResponse
+
+	finalResponse.Servers = items
+	finalResponse.Count = len(items)
+	
+	// Set LastChecked if we have servers
+	if len(items) > 0 {
+		finalResponse.LastChecked = items[0].Status.LastChecked
+	} else {
+		finalResponse.LastChecked = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	return finalResponse, nil
+}
+
+// EachServer calls fn with each listed server that matches filter as it's
+// read, in the same order as Servers. Uptime sorts need every server's summary
+// so those servers are sorted before fn is called.
+func EachServer(db *sql.DB, filter ServerFilter, fn func(ServerAPIResponseServer) error) error {
+	order, ok := filter.orderBy()
+
+	if !ok {
+		response, err := Servers(db, filter)
 
 		if err != nil {
-			log.Fatalf("error scanning %v", err)
+			return err
+		}
+
+		for _, server := range response.Servers {
+			if err := fn(server); err != nil {
+				return err
+			}
 		}
+
+		return nil
 	}
 
-	return response
+	conditions, args := filter.conditions()
+
+	return eachServerStatus(db, 0, "servers.is_listed IS TRUE"+conditions, args, order, fn)
 }
 
-func Servers(db *sql.DB) ServerAPIResponse {
-	stmt := `
+// orderBy returns the ORDER BY clause that sorts servers the same way as
+// SortServers, or false for sorts that can't be done in SQL
+func (f ServerFilter) orderBy() (string, bool) {
+	switch f.Sort {
+	case "", "name":
+		return "lower(servers.name)", true
+	case "rtt":
+		return "rtt IS NULL, ROUND(rtt), lower(servers.name)", true
+	case "last_seen":
+		return "servers.last_seen IS NULL, servers.last_seen DESC, lower(servers.name)", true
+	}
+
+	return "", false
+}
+
+// ServerStatus returns the server with the given ID whether or not it's
+// listed, which is the zero value if there isn't one
+func ServerStatus(db *sql.DB, id int) (ServerAPIResponseServer, error) {
+	var item ServerAPIResponseServer
+
+	// Only this server's uptime is needed
+	err := eachServerStatus(db, id, "servers.id = ?", []any{id}, "servers.id", func(s ServerAPIResponseServer) error {
+		item = s
+		return nil
+	})
+
+	return item, err
+}
+
+// serverStatuses returns the servers matching where, with their latest status
+// and uptime summaries, sorted by name
+func serverStatuses(db *sql.DB, where string, args []any) ([]ServerAPIResponseServer, error) {
+	items := []ServerAPIResponseServer{}
+
+	err := eachServerStatus(db, 0, where, args, "lower(servers.name)", func(item ServerAPIResponseServer) error {
+		items = append(items, item)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// eachServerStatus calls fn with each server matching where, sorted by order,
+// as it's read. Uptime summaries are only calculated for server_id if it's
+// non-zero, in which case where shouldn't match any other server.
+func eachServerStatus(db *sql.DB, server_id int, where string, args []any, order string, fn func(ServerAPIResponseServer) error) error {
+	now := time.Now().UTC()
+
+	summaries, err := UptimeSummaries(db, server_id, now)
+
+	if err != nil {
+		return err
+	}
+
+	stmt := fmt.Sprintf(`
 	SELECT
 		servers.id,
 		servers.guid,
@@ -143,28 +412,45 @@ func Servers(db *sql.DB) ServerAPIResponse {
 		servers.port,
 		servers.is_listed,
 		servers.is_online,
+		EXISTS (
+			SELECT 1
+			FROM incidents
+			WHERE
+				incidents.server_id = servers.id
+			AND
+				incidents.kind = 'degraded'
+			AND
+				incidents.ended_at IS NULL
+		) AS is_degraded,
 		servers.updated_at,
-		servers.last_seen
+		servers.last_seen,
+		(
+			SELECT SUM(rtt_sum) * 1.0 / SUM(rtt_n)
+			FROM statuses_hourly
+			WHERE
+				statuses_hourly.server_id = servers.id
+			AND
+				statuses_hourly.start >= ?
+		) AS rtt
 	FROM
 		servers
 	WHERE
-		servers.is_listed IS TRUE
+		%s
 	GROUP BY servers.id
-	ORDER BY lower(servers.name);
-	`
+	ORDER BY %s;
+	`, where, order)
 
-	rows, err := db.Query(stmt)
+	rows, err := db.Query(stmt, append([]any{windowStart(now, 24*time.Hour)}, args...)...)
 
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("error querying servers: %w", err)
 	}
 
 	defer rows.Close()
 
-	var statuses []ServerStatusRow
-	var status ServerStatusRow
-
 	for rows.Next() {
+		var status ServerStatusRow
+
 		err := rows.Scan(
 			&status.ID,
 			&status.GUID,
@@ -173,65 +459,68 @@ func Servers(db *sql.DB) ServerAPIResponse {
 			&status.Port,
 			&status.IsListed,
 			&status.IsOnline,
+			&status.IsDegraded,
 			&status.UpdatedAt,
 			&status.LastSeen,
+			&status.RTT,
 		)
 
 		if err != nil {
-			log.Println(err)
-		} else {
-			statuses = append(statuses, status)
+			return fmt.Errorf("error scanning servers: %w", err)
 		}
-	}
-
-	var finalResponse ServerAPIResponse
-	var items []ServerAPIResponseServer
-	var item ServerAPIResponseServer
 
-	for i := range statuses {
-		isOnline := BoolOrNull(statuses[i].IsOnline)
-		lastSeenTime := PrettyTimeOrNullString(statuses[i].LastSeen)
-		lastChecked := time.Unix(int64(statuses[i].UpdatedAt), 0)
-		lastCheckedTime, err := lastChecked.UTC().MarshalText()
+		lastChecked, err := time.Unix(int64(status.UpdatedAt), 0).UTC().MarshalText()
 
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
-		item = ServerAPIResponseServer{
-			ID:     statuses[i].ID,
-			GUID:   statuses[i].GUID,
-			Name:   statuses[i].Name,
-			Active: statuses[i].IsListed,
+		var rtt null.Int
+
+		if status.RTT.Valid {
+			rtt = null.IntFrom(int64(math.Round(status.RTT.Float64)))
+		}
+
+		err = fn(ServerAPIResponseServer{
+			ID:     status.ID,
+			GUID:   status.GUID,
+			Name:   status.Name,
+			Active: status.IsListed,
 			Address: ServerAPIResponseAddress{
-				Host: statuses[i].Host,
-				Port: statuses[i].Port,
+				Host: status.Host,
+				Port: status.Port,
 			},
 			Status: ServerAPIResponseStatus{
-				IsOnline:    isOnline,
-				LastSeen:    lastSeenTime,
-				LastChecked: string(lastCheckedTime),
+				IsOnline:    BoolOrNull(status.IsOnline),
+				IsDegraded:  status.IsDegraded,
+				LastSeen:    PrettyTimeOrNullString(status.LastSeen),
+				LastChecked: string(lastChecked),
+				RTT:         rtt,
 			},
-		}
+			UptimeSummary: summaries[status.ID],
+		})
 
-		items = append(items, item)
+		if err != nil {
+			return err
+		}
 	}
 
-	finalResponse.Servers = items
-	finalResponse.Count = len(items)
-	
-	// Set LastChecked if we have servers
-	if len(items) > 0 {
-		finalResponse.LastChecked = items[0].Status.LastChecked
-	} else {
-		finalResponse.LastChecked = time.Now().UTC().Format(time.RFC3339)
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error querying servers: %w", err)
 	}
 
-	return finalResponse
+	return nil
 }
 
-func ServersWithUptimes(db *sql.DB) []ServerAPIResponseWithUptime {
-	servers := Servers(db)
+// ServersWithUptimes is Servers with each server's recent daily uptime
+func ServersWithUptimes(db *sql.DB, filter ServerFilter) ([]ServerAPIResponseWithUptime, error) {
+	servers, err := Servers(db, filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
 
 	var response []ServerAPIResponseWithUptime
 
@@ -244,52 +533,73 @@ func ServersWithUptimes(db *sql.DB) []ServerAPIResponseWithUptime {
 		server.Active = servers.Servers[i].Active
 		server.Address = servers.Servers[i].Address
 		server.Status = servers.Servers[i].Status
+		server.UptimeSummary = servers.Servers[i].UptimeSummary
 
 		// Add in uptime info
-		rows, err := db.Query(QUERY_UPTIME, server.ID)
+		rows, err := UptimeRows(db, server.ID, DefaultUptimeRange(now))
 
 		if err != nil {
-			log.Fatal(err)
+			log.Println(err)
 		}
 
-		defer rows.Close()
+		uptimes := UptimeTemplateItemsFromRows(rows)
 
-		var uptimes []UptimeTemplateItem
+		server.Uptime = uptimes
+		response = append(response, server)
+	}
 
-		for rows.Next() {
-			var uptime UptimeRow
-			var uptimeTmplItem UptimeTemplateItem
+	return response, nil
+}
 
-			err := rows.Scan(
-				&uptime.Date,
-				&uptime.Uptime,
-				&uptime.N,
-				&uptime.RTTMin,
-				&uptime.RTTMax,
-				&uptime.RTTMean,
-			)
+// SortServers sorts servers in place by one of SERVER_SORT_KEYS or
+// UPTIME_SUMMARY_KEYS. Uptimes and last seen times sort highest first and RTTs
+// lowest first, with servers without data last. Unknown keys leave the order
+// unchanged.
+func SortServers(servers []ServerAPIResponseServer, key string) {
+	if key == "uptime" {
+		key = "30d"
+	}
 
-			if err != nil {
-				log.Fatal(err)
+	switch {
+	case key == "name":
+		sort.SliceStable(servers, func(i, j int) bool {
+			return strings.ToLower(servers[i].Name) < strings.ToLower(servers[j].Name)
+		})
+	case key == "rtt":
+		sort.SliceStable(servers, func(i, j int) bool {
+			a := servers[i].Status.RTT
+			b := servers[j].Status.RTT
+
+			if a.Valid != b.Valid {
+				return a.Valid
 			}
 
-			uptimeTmplItem.Date = uptime.Date
-			uptimeTmplItem.Uptime = uptime.Uptime
-			uptimeTmplItem.UptimeFmt = fmt.Sprintf("%.3g", uptime.Uptime)
-			uptimeTmplItem.UptimeClass = GetUptimeClass(uptime.Uptime)
-			uptimeTmplItem.N = uptime.N
-			uptimeTmplItem.RTTMin = SQLNullInt64ToString(uptime.RTTMin)
-			uptimeTmplItem.RTTMax = SQLNullInt64ToString(uptime.RTTMax)
-			uptimeTmplItem.RTTMean = SQLFloat64ToIntString(uptime.RTTMean)
+			return a.Int64 < b.Int64
+		})
+	case key == "last_seen":
+		// Times are all formatted the same way so they sort as strings
+		sort.SliceStable(servers, func(i, j int) bool {
+			a := servers[i].Status.LastSeen
+			b := servers[j].Status.LastSeen
 
-			uptimes = append(uptimes, uptimeTmplItem)
-		}
+			if a.Valid != b.Valid {
+				return a.Valid
+			}
 
-		server.Uptime = uptimes
-		response = append(response, server)
-	}
+			return a.String > b.String
+		})
+	case slices.Contains(UPTIME_SUMMARY_KEYS, key):
+		sort.SliceStable(servers, func(i, j int) bool {
+			a := servers[i].UptimeSummary.Get(key)
+			b := servers[j].UptimeSummary.Get(key)
+
+			if a.Valid != b.Valid {
+				return a.Valid
+			}
 
-	return response
+			return a.Float64 > b.Float64
+		})
+	}
 }
 
 func SQLNullInt64ToString(input sql.NullInt64) string {
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v4"
+)
+
+func TestParseServerFilter(t *testing.T) {
+	values := url.Values{
+		"emu":    {"ACE"},
+		"type":   {"PvE"},
+		"online": {"false"},
+		"q":      {" frost "},
+		"sort":   {"rtt"},
+	}
+
+	filter, err := ParseServerFilter(values)
+
+	assert.NoError(t, err)
+	assert.Equal(t, ServerFilter{Emulator: "ACE", Type: "PvE", Online: null.BoolFrom(false), Search: "frost", Sort: "rtt"}, filter)
+
+	values.Set("q", "frost")
+	assert.Equal(t, values, filter.Values())
+	assert.Equal(t, "/?emu=ACE&online=false&q=frost&sort=24h&type=PvE", filter.SortURL("24h"))
+
+	for _, values := range []url.Values{
+		{"online": {"maybe"}},
+		{"sort": {"players"}},
+	} {
+		_, err := ParseServerFilter(values)
+		assert.Error(t, err, values.Encode())
+	}
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/guregu/null.v4"
+)
+
+// SLOConfig holds uptime objectives. Targets are percentages and are looked up
+// by server name first, then server type, then falling back to Default.
+type SLOConfig struct {
+	WindowDays int
+	Default    float64
+	ByName     map[string]float64
+	ByType     map[string]float64
+}
+
+const DEFAULT_SLO_TARGET = 99.0
+const DEFAULT_SLO_WINDOW_DAYS = 30
+
+// ParseSLOConfig parses a comma-separated list of objectives like
+// "Levistras=99.9,type:PvE=99.5,*=99" where "type:" prefixes apply to every
+// server of that type and "*" sets the default
+func ParseSLOConfig(targets string, windowDays int) (SLOConfig, error) {
+	cfg := SLOConfig{
+		WindowDays: windowDays,
+		Default:    DEFAULT_SLO_TARGET,
+		ByName:     map[string]float64{},
+		ByType:     map[string]float64{},
+	}
+
+	if cfg.WindowDays <= 0 {
+		return cfg, fmt.Errorf("SLO window must be at least one day, got %d", windowDays)
+	}
+
+	for _, entry := range strings.Split(targets, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		key, value, found := strings.Cut(entry, "=")
+
+		if !found {
+			return cfg, fmt.Errorf("couldn't parse SLO target %q, expected key=target", entry)
+		}
+
+		target, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+
+		if err != nil || target <= 0 || target > 100 {
+			return cfg, fmt.Errorf("couldn't parse SLO target %q, expected a percentage", entry)
+		}
+
+		key = strings.TrimSpace(key)
+
+		if key == "*" {
+			cfg.Default = target
+		} else if serverType, ok := strings.CutPrefix(key, "type:"); ok {
+			cfg.ByType[strings.ToLower(serverType)] = target
+		} else {
+			cfg.ByName[key] = target
+		}
+	}
+
+	return cfg, nil
+}
+
+// TargetFor returns the objective for a server
+func (c SLOConfig) TargetFor(name string, serverType string) float64 {
+	if target, ok := c.ByName[name]; ok {
+		return target
+	}
+
+	if target, ok := c.ByType[strings.ToLower(serverType)]; ok {
+		return target
+	}
+
+	return c.Default
+}
+
+type SLOApiResponse struct {
+	Count int         `json:"count"`
+	SLOs  []SLOStatus `json:"slos"`
+}
+
+type SLOStatus struct {
+	ServerID    int            `json:"-"`
+	Server      string         `json:"server"`
+	GUID        string         `json:"guid"`
+	Target      float64        `json:"target"`
+	WindowDays  int            `json:"window_days"`
+	Checks      int            `json:"checks"`
+	Failures    int            `json:"failures"`
+	Uptime      null.Float     `json:"uptime"`
+	Meeting     null.Bool      `json:"meeting"`
+	ErrorBudget SLOErrorBudget `json:"error_budget"`
+}
+
+// SLOErrorBudget describes how many failed checks the objective allows over
+// the window and how quickly they're being used up. Remaining is the fraction
+// of the budget left and goes negative once the objective is missed. Burn
+// rates are the observed failure rate divided by the allowed failure rate so
+// 1 means the budget will run out exactly at the end of the window.
+type SLOErrorBudget struct {
+	Allowed     float64    `json:"allowed_failures"`
+	Remaining   null.Float `json:"remaining"`
+	BurnRate    null.Float `json:"burn_rate"`
+	BurnRateDay null.Float `json:"burn_rate_24h"`
+}
+
+var QUERY_SLO = `
+	SELECT
+		servers.id,
+		servers.name,
+		servers.guid,
+		servers.type,
+		COALESCE(SUM(rollup.n), 0),
+		COALESCE(SUM(rollup.n_up), 0),
+		COALESCE(SUM(CASE WHEN rollup.start >= ? THEN rollup.n END), 0),
+		COALESCE(SUM(CASE WHEN rollup.start >= ? THEN rollup.n_up END), 0)
+	FROM servers
+	LEFT JOIN statuses_hourly AS rollup
+	ON
+		rollup.server_id = servers.id
+	AND
+		rollup.start >= ?
+	WHERE
+		(? = 0 AND servers.is_listed = 1)
+	OR
+		servers.id = ?
+	GROUP BY servers.id
+	ORDER BY lower(servers.name);
+`
+
+func burnRate(checks int, failures int, target float64) null.Float {
+	allowedRate := 1 - target/100
+
+	if checks == 0 || allowedRate <= 0 {
+		return null.Float{}
+	}
+
+	return null.FloatFrom(float64(failures) / float64(checks) / allowedRate)
+}
+
+// NewSLOStatus calculates attainment and error budget from check counts over
+// the whole window and over the last day
+func NewSLOStatus(target float64, windowDays int, checks int, up int, checksDay int, upDay int) SLOStatus {
+	status := SLOStatus{
+		Target:     target,
+		WindowDays: windowDays,
+		Checks:     checks,
+		Failures:   checks - up,
+	}
+
+	status.ErrorBudget.Allowed = float64(checks) * (1 - target/100)
+	status.ErrorBudget.BurnRate = burnRate(checks, checks-up, target)
+	status.ErrorBudget.BurnRateDay = burnRate(checksDay, checksDay-upDay, target)
+
+	if checks == 0 {
+		return status
+	}
+
+	uptime := float64(up) * 100 / float64(checks)
+
+	status.Uptime = null.FloatFrom(uptime)
+	status.Meeting = null.BoolFrom(uptime >= target)
+
+	if status.ErrorBudget.Allowed > 0 {
+		status.ErrorBudget.Remaining = null.FloatFrom(1 - float64(status.Failures)/status.ErrorBudget.Allowed)
+	}
+
+	return status
+}
+
+// SLOs calculates SLO attainment for every listed server, or just the server
+// with the given ID if server_id is non-zero
+func SLOs(db *sql.DB, cfg SLOConfig, server_id int, now time.Time) (SLOApiResponse, error) {
+	var response SLOApiResponse
+
+	windowStartTime := windowStart(now, time.Duration(cfg.WindowDays)*24*time.Hour)
+	dayStart := windowStart(now, 24*time.Hour)
+
+	rows, err := db.Query(QUERY_SLO, dayStart, dayStart, windowStartTime, server_id, server_id)
+
+	if err != nil {
+		return response, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, checks, up, checksDay, upDay int
+		var name, guid, serverType string
+
+		err := rows.Scan(&id, &name, &guid, &serverType, &checks, &up, &checksDay, &upDay)
+
+		if err != nil {
+			return response, err
+		}
+
+		status := NewSLOStatus(cfg.TargetFor(name, serverType), cfg.WindowDays, checks, up, checksDay, upDay)
+		status.ServerID = id
+		status.Server = name
+		status.GUID = guid
+
+		response.SLOs = append(response.SLOs, status)
+	}
+
+	response.Count = len(response.SLOs)
+
+	return response, rows.Err()
+}
+
+// BudgetFmt formats the remaining error budget as a percentage for templates
+func (s SLOStatus) BudgetFmt() string {
+	if !s.ErrorBudget.Remaining.Valid {
+		return "n/a"
+	}
+
+	return fmt.Sprintf("%.0f%%", math.Max(s.ErrorBudget.Remaining.Float64, 0)*100)
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSLOConfig(t *testing.T) {
+	cfg, err := ParseSLOConfig("Levistras=99.9, type:PvE=99.5,*=98", 30)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 99.9, cfg.TargetFor("Levistras", "PvE"))
+	assert.Equal(t, 99.5, cfg.TargetFor("Frostfell", "pve"))
+	assert.Equal(t, 98.0, cfg.TargetFor("Frostfell", "PvP"))
+
+	cfg, err = ParseSLOConfig("", 30)
+	assert.NoError(t, err)
+	assert.Equal(t, DEFAULT_SLO_TARGET, cfg.TargetFor("Anything", ""))
+
+	for _, bad := range []string{"Levistras", "Levistras=abc", "Levistras=101", "Levistras=0"} {
+		_, err = ParseSLOConfig(bad, 30)
+		assert.Error(t, err, bad)
+	}
+
+	_, err = ParseSLOConfig("", 0)
+	assert.Error(t, err)
+}
+
+func TestNewSLOStatus(t *testing.T) {
+	// 99% over 1000 checks allows 10 failures, 4 have been used
+	status := NewSLOStatus(99, 30, 1000, 996, 100, 98)
+
+	assert.Equal(t, 4, status.Failures)
+	assert.True(t, status.Meeting.Bool)
+	assert.InDelta(t, 10, status.ErrorBudget.Allowed, 1e-9)
+	assert.InDelta(t, 0.6, status.ErrorBudget.Remaining.Float64, 1e-9)
+	assert.InDelta(t, 0.4, status.ErrorBudget.BurnRate.Float64, 1e-9)
+	assert.InDelta(t, 2, status.ErrorBudget.BurnRateDay.Float64, 1e-9)
+	assert.Equal(t, "60%", status.BudgetFmt())
+
+	// Missing the objective overspends the budget
+	status = NewSLOStatus(99, 30, 1000, 980, 0, 0)
+
+	assert.False(t, status.Meeting.Bool)
+	assert.InDelta(t, -1, status.ErrorBudget.Remaining.Float64, 1e-9)
+	assert.False(t, status.ErrorBudget.BurnRateDay.Valid)
+	assert.Equal(t, "0%", status.BudgetFmt())
+
+	// No data means nothing to report
+	status = NewSLOStatus(99, 30, 0, 0, 0, 0)
+
+	assert.False(t, status.Meeting.Valid)
+	assert.False(t, status.Uptime.Valid)
+	assert.False(t, status.ErrorBudget.Remaining.Valid)
+
+	// A 100% objective has no budget at all
+	status = NewSLOStatus(100, 30, 10, 10, 10, 10)
+
+	assert.True(t, status.Meeting.Bool)
+	assert.False(t, status.ErrorBudget.BurnRate.Valid)
+}
@@ -1,9 +1,23 @@
 package api
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
+
+	"gopkg.in/guregu/null.v4"
+)
+
+// How many checks are returned when no limit is given and the most that can be
+// asked for at once
+const (
+	DEFAULT_STATUSES = 20
+	MAX_STATUSES     = 500
 )
 
 var QUERY_SERVER_BY_ID = `
@@ -20,18 +34,41 @@ WHERE name = ?
 LIMIT 1
 `
 
+var QUERY_SERVER_ID_BY_GUID = `
+SELECT id
+FROM servers
+WHERE guid = ?
+LIMIT 1
+`
+
+// QUERY_STATUSES is filled in with any extra conditions by StatusQuery.Query.
+// Checks are ordered by ID as well as time so the order is stable when two
+// share a second.
 var QUERY_STATUSES = `
-SELECT status, created_at, rtt, message
+SELECT id, status, created_at, rtt, message
+FROM statuses
+WHERE server_id = ?%s
+ORDER BY created_at DESC, id DESC
+LIMIT ?;
+`
+
+// QUERY_STATUSES_NEXT_CURSOR finds the last check on a page, which is
+// skipped to with OFFSET, along with the one after it if there's another page
+var QUERY_STATUSES_NEXT_CURSOR = `
+SELECT created_at, id
 FROM statuses
-WHERE server_id = ?
-ORDER BY created_at DESC
-LIMIT 20;
+WHERE server_id = ?%s
+ORDER BY created_at DESC, id DESC
+LIMIT 2 OFFSET ?;
 `
 
+// StatusApiResponse is one page of a server's checks, newest first.
+// NextCursor is null on the last page.
 type StatusApiResponse struct {
 	ServerName string                `json:"server"`
 	Count      int                   `json:"count"`
 	Statuses   []StatusApiStatusItem `json:"statuses"`
+	NextCursor null.String           `json:"next_cursor"`
 }
 
 type StatusApiStatusItem struct {
@@ -42,12 +79,204 @@ type StatusApiStatusItem struct {
 }
 
 type StatusesRow struct {
+	ID        int64
 	Status    int
 	CreatedAt int
 	RTT       sql.NullInt64
 	Message   sql.NullString
 }
 
+// StatusCursor is the last check on a page. The next page starts with the
+// check before it.
+type StatusCursor struct {
+	CreatedAt int64
+	ID        int64
+}
+
+// StatusQuery selects a page of a server's checks. Zero times leave the range
+// open on that side and Status is "up", "down" or empty for both.
+type StatusQuery struct {
+	Before *StatusCursor
+	From   time.Time
+	To     time.Time
+	Status string
+	Limit  int
+}
+
+// DefaultStatusQuery is the latest DEFAULT_STATUSES checks
+func DefaultStatusQuery() StatusQuery {
+	return StatusQuery{Limit: DEFAULT_STATUSES}
+}
+
+// String encodes the cursor for URLs. It's opaque to clients.
+func (c StatusCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.CreatedAt, c.ID)))
+}
+
+// ParseStatusCursor decodes a cursor made by StatusCursor.String
+func ParseStatusCursor(value string) (StatusCursor, error) {
+	var cursor StatusCursor
+
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+
+	if err != nil {
+		return cursor, fmt.Errorf("invalid cursor %q", value)
+	}
+
+	created_at, id, found := strings.Cut(string(decoded), ":")
+
+	if !found {
+		return cursor, fmt.Errorf("invalid cursor %q", value)
+	}
+
+	cursor.CreatedAt, err = strconv.ParseInt(created_at, 10, 64)
+
+	if err != nil {
+		return cursor, fmt.Errorf("invalid cursor %q", value)
+	}
+
+	cursor.ID, err = strconv.ParseInt(id, 10, 64)
+
+	if err != nil {
+		return cursor, fmt.Errorf("invalid cursor %q", value)
+	}
+
+	return cursor, nil
+}
+
+// ParseStatusQuery reads the cursor, from, to, status and limit query
+// parameters. from and to take the same formats as ParseUptimeRange.
+func ParseStatusQuery(values url.Values) (StatusQuery, error) {
+	q := DefaultStatusQuery()
+
+	if value := values.Get("cursor"); value != "" {
+		cursor, err := ParseStatusCursor(value)
+
+		if err != nil {
+			return q, err
+		}
+
+		q.Before = &cursor
+	}
+
+	if value := values.Get("from"); value != "" {
+		from, err := parseRangeTime(value)
+
+		if err != nil {
+			return q, fmt.Errorf("invalid from: %w", err)
+		}
+
+		q.From = from
+	}
+
+	if value := values.Get("to"); value != "" {
+		to, err := parseRangeTime(value)
+
+		if err != nil {
+			return q, fmt.Errorf("invalid to: %w", err)
+		}
+
+		q.To = to
+	}
+
+	if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+		return q, fmt.Errorf("from (%s) must be before to (%s)", q.From.Format(time.RFC3339), q.To.Format(time.RFC3339))
+	}
+
+	switch value := strings.ToLower(values.Get("status")); value {
+	case "", "up", "down":
+		q.Status = value
+	default:
+		return q, fmt.Errorf("invalid status %q, must be up or down", values.Get("status"))
+	}
+
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+
+		if err != nil || limit < 1 || limit > MAX_STATUSES {
+			return q, fmt.Errorf("limit must be a number from 1 to %d", MAX_STATUSES)
+		}
+
+		q.Limit = limit
+	}
+
+	return q, nil
+}
+
+// Values is the inverse of ParseStatusQuery, leaving out anything unset
+func (q StatusQuery) Values() url.Values {
+	values := url.Values{}
+
+	if q.Before != nil {
+		values.Set("cursor", q.Before.String())
+	}
+
+	if !q.From.IsZero() {
+		values.Set("from", q.From.UTC().Format(time.RFC3339))
+	}
+
+	if !q.To.IsZero() {
+		values.Set("to", q.To.UTC().Format(time.RFC3339))
+	}
+
+	if q.Status != "" {
+		values.Set("status", q.Status)
+	}
+
+	if q.Limit > 0 {
+		values.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	return values
+}
+
+// Query builds the SQL and arguments for a page of a server's checks. One more
+// check than the limit is asked for to tell whether there's another page.
+func (q StatusQuery) Query(server_id int) (string, []any) {
+	conditions, args := q.conditions(server_id)
+
+	return fmt.Sprintf(QUERY_STATUSES, conditions), append(args, q.limit()+1)
+}
+
+// conditions returns the WHERE conditions after the server's and the
+// arguments for them all
+func (q StatusQuery) conditions(server_id int) (string, []any) {
+	var conditions strings.Builder
+	args := []any{server_id}
+
+	if !q.From.IsZero() {
+		conditions.WriteString("\nAND created_at >= ?")
+		args = append(args, q.From.Unix())
+	}
+
+	if !q.To.IsZero() {
+		conditions.WriteString("\nAND created_at < ?")
+		args = append(args, q.To.Unix())
+	}
+
+	switch q.Status {
+	case "up":
+		conditions.WriteString("\nAND status = 1")
+	case "down":
+		conditions.WriteString("\nAND status = 0")
+	}
+
+	if q.Before != nil {
+		conditions.WriteString("\nAND (created_at < ? OR (created_at = ? AND id < ?))")
+		args = append(args, q.Before.CreatedAt, q.Before.CreatedAt, q.Before.ID)
+	}
+
+	return conditions.String(), args
+}
+
+func (q StatusQuery) limit() int {
+	if q.Limit < 1 {
+		return DEFAULT_STATUSES
+	}
+
+	return q.Limit
+}
+
 func GetServerNameById(db *sql.DB, id int) (string, error) {
 	result, err := db.Query(QUERY_SERVER_BY_ID, id)
 
@@ -92,69 +321,176 @@ func GetServerIdByName(db *sql.DB, name string) (int, error) {
 	return id, nil
 }
 
-func Statuses(db *sql.DB, server_id int) StatusApiResponse {
+// GetServerIdByGUID returns the ID of the server with the given GUID or zero
+// if there isn't one
+func GetServerIdByGUID(db *sql.DB, guid string) (int, error) {
+	var id int
+
+	err := db.QueryRow(QUERY_SERVER_ID_BY_GUID, guid).Scan(&id)
+
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return id, err
+}
+
+// Statuses returns a page of a server's checks, newest first
+func Statuses(db *sql.DB, server_id int, q StatusQuery) (StatusApiResponse, error) {
 	var response StatusApiResponse
 
 	// Find the server's name by ID first
 	server_name, getErr := GetServerNameById(db, server_id)
 
 	if getErr != nil {
-		return response
+		return response, getErr
 	}
 
 	response.ServerName = server_name
 
 	// Then grab the statuses
-	rows, err := db.Query(QUERY_STATUSES, server_id)
+	query, args := q.Query(server_id)
+	rows, err := db.Query(query, args...)
 
 	if err != nil {
-		log.Fatal(err)
+		return response, err
 	}
 
 	defer rows.Close()
 
-	var statuses []StatusApiStatusItem
+	statuses := []StatusApiStatusItem{}
+	var last StatusCursor
 
 	for rows.Next() {
-		var status StatusesRow
-		var statusItem StatusApiStatusItem
-
-		err := rows.Scan(
-			&status.Status,
-			&status.CreatedAt,
-			&status.RTT,
-			&status.Message,
-		)
+		statusItem, cursor, err := scanStatus(rows)
 
 		if err != nil {
-			log.Fatal(err)
+			return response, err
 		}
 
-		// Song and dance to convert the database row to JSON
-		createdAt := time.Unix(int64(status.CreatedAt), 0)
-		createdAtTime, err := createdAt.UTC().MarshalText()
+		// The extra check only says there's another page
+		if len(statuses) == q.limit() {
+			response.NextCursor = null.StringFrom(last.String())
+			break
+		}
+
+		statuses = append(statuses, statusItem)
+		last = cursor
+	}
+
+	response.Count = len(statuses)
+	response.Statuses = statuses
+
+	return response, rows.Err()
+}
+
+// EachStatus reads a page of a server's checks a row at a time. page is called
+// with the next page's cursor first so it can be sent ahead of the checks, and
+// then fn with each check. Both are read in one transaction so checks stored
+// in the meantime can't shift the page.
+func EachStatus(ctx context.Context, db *sql.DB, server_id int, q StatusQuery, page func(next null.String) error, fn func(StatusApiStatusItem) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	conditions, args := q.conditions(server_id)
+	cursors, err := tx.QueryContext(ctx, fmt.Sprintf(QUERY_STATUSES_NEXT_CURSOR, conditions), append(args, q.limit()-1)...)
+
+	if err != nil {
+		return err
+	}
+
+	var found []StatusCursor
 
-		statusItem.Message = status.Message.String
+	for cursors.Next() {
+		var cursor StatusCursor
 
-		if status.Status == 1 {
-			statusItem.Status = "UP"
-		} else {
-			statusItem.Status = "DOWN"
+		if err := cursors.Scan(&cursor.CreatedAt, &cursor.ID); err != nil {
+			cursors.Close()
+			return err
 		}
 
-		statusItem.CreatedAt = string(createdAtTime)
-		statusItem.RTT = int(status.RTT.Int64)
-		statusItem.Message = string(status.Message.String)
+		found = append(found, cursor)
+	}
+
+	cursors.Close()
+
+	if err := cursors.Err(); err != nil {
+		return err
+	}
+
+	var next null.String
+
+	if len(found) == 2 {
+		next = null.StringFrom(found[0].String())
+	}
+
+	if err := page(next); err != nil {
+		return err
+	}
+
+	query, args := q.Query(server_id)
+	rows, err := tx.QueryContext(ctx, query, args...)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for n := 0; n < q.limit() && rows.Next(); n++ {
+		status, _, err := scanStatus(rows)
 
 		if err != nil {
-			log.Println(err)
-		} else {
-			statuses = append(statuses, statusItem)
+			return err
+		}
+
+		if err := fn(status); err != nil {
+			return err
 		}
 	}
 
-	response.Count = len(statuses)
-	response.Statuses = statuses
+	return rows.Err()
+}
+
+// scanStatus reads a row of QUERY_STATUSES
+func scanStatus(rows *sql.Rows) (StatusApiStatusItem, StatusCursor, error) {
+	var status StatusesRow
+	var statusItem StatusApiStatusItem
+
+	err := rows.Scan(
+		&status.ID,
+		&status.Status,
+		&status.CreatedAt,
+		&status.RTT,
+		&status.Message,
+	)
+
+	if err != nil {
+		return statusItem, StatusCursor{}, err
+	}
+
+	// Song and dance to convert the database row to JSON
+	createdAt := time.Unix(int64(status.CreatedAt), 0)
+	createdAtTime, err := createdAt.UTC().MarshalText()
+
+	if err != nil {
+		return statusItem, StatusCursor{}, err
+	}
+
+	if status.Status == 1 {
+		statusItem.Status = "UP"
+	} else {
+		statusItem.Status = "DOWN"
+	}
+
+	statusItem.CreatedAt = string(createdAtTime)
+	statusItem.RTT = int(status.RTT.Int64)
+	statusItem.Message = status.Message.String
 
-	return response
+	return statusItem, StatusCursor{CreatedAt: int64(status.CreatedAt), ID: status.ID}, nil
 }
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusCursorRoundTrip(t *testing.T) {
+	cursor := StatusCursor{CreatedAt: 1710428966, ID: 42}
+	parsed, err := ParseStatusCursor(cursor.String())
+
+	assert.NoError(t, err)
+	assert.Equal(t, cursor, parsed)
+
+	for _, value := range []string{"nope", "MTIz", "YTpi"} {
+		_, err := ParseStatusCursor(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestParseStatusQuery(t *testing.T) {
+	q, err := ParseStatusQuery(url.Values{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultStatusQuery(), q)
+
+	q, err = ParseStatusQuery(url.Values{
+		"cursor": {StatusCursor{CreatedAt: 100, ID: 7}.String()},
+		"from":   {"2024-03-01"},
+		"to":     {"2024-03-02T12:00:00Z"},
+		"status": {"DOWN"},
+		"limit":  {"100"},
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, &StatusCursor{CreatedAt: 100, ID: 7}, q.Before)
+	assert.Equal(t, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), q.From)
+	assert.Equal(t, time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC), q.To)
+	assert.Equal(t, "down", q.Status)
+	assert.Equal(t, 100, q.Limit)
+
+	roundTrip, err := ParseStatusQuery(q.Values())
+
+	assert.NoError(t, err)
+	assert.Equal(t, q, roundTrip)
+
+	query, args := q.Query(1)
+
+	assert.Contains(t, query, "AND status = 0")
+	assert.Equal(t, []any{1, int64(1709251200), int64(1709380800), int64(100), int64(100), int64(7), 101}, args)
+}
+
+func TestParseStatusQueryErrors(t *testing.T) {
+	for _, values := range []url.Values{
+		{"cursor": {"nope"}},
+		{"from": {"yesterday"}},
+		{"from": {"2024-03-02"}, "to": {"2024-03-01"}},
+		{"status": {"degraded"}},
+		{"limit": {"0"}},
+		{"limit": {"501"}},
+	} {
+		_, err := ParseStatusQuery(values)
+		assert.Error(t, err, values.Encode())
+	}
+}
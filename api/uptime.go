@@ -3,8 +3,10 @@ package api
 import (
 	"database/sql"
 	"fmt"
-	"log"
 	"math"
+	"time"
+
+	"gopkg.in/guregu/null.v4"
 )
 
 type UptimeRow struct {
@@ -23,9 +25,13 @@ type RTT struct {
 }
 
 type UptimeResult struct {
-	Server  string          `json:"server"`
-	Count   int             `json:"count"`
-	Uptimes []UptimeApiItem `json:"uptimes"`
+	Server      string          `json:"server"`
+	Summary     UptimeSummary   `json:"summary"`
+	From        string          `json:"from"`
+	To          string          `json:"to"`
+	Granularity string          `json:"granularity"`
+	Count       int             `json:"count"`
+	Uptimes     []UptimeApiItem `json:"uptimes"`
 }
 
 type UptimeApiItem struct {
@@ -46,78 +52,6 @@ type UptimeTemplateItem struct {
 	RTTMean     string
 }
 
-var QUERY_UPTIME = `
-	WITH ts(day, level)
-	AS
-	(
-	SELECT date('now') AS day, 0 AS level
-		UNION ALL
-	SELECT date('now', '-' || level || ' day') AS day, level + 1 AS level FROM ts WHERE level < 14
-	)
-	SELECT
-		day,
-		COALESCE((sum(status) * 1.0 / COUNT(status)) * 100, 0) AS uptime,
-		COUNT(status) AS n,
-		MIN(rtt) as rtt_min,
-		MAX(rtt) as rtt_max,
-		AVG(rtt) as rtt_mean
-	FROM ts
-	LEFT JOIN statuses
-	ON
-		date(statuses.created_at, 'unixepoch') = ts.day
-	AND
-		statuses.server_id = ?
-	GROUP BY day;
-`
-
-var QUERY_UPTIME_3_MONTHS = `
-	WITH RECURSIVE week_grid(week_start, week_num, day_offset, current_day) AS (
-		-- Find the Monday that's roughly 5 months ago
-		SELECT
-			date('now', '-150 days', 'weekday 1') as week_start,
-			0 as week_num,
-			0 as day_offset,
-			date('now', '-150 days', 'weekday 1') as current_day
-
-		UNION ALL
-
-		-- Generate days until we reach today
-		SELECT
-			CASE WHEN day_offset = 6
-				THEN date(week_start, '+7 days')
-				ELSE week_start
-			END,
-			CASE WHEN day_offset = 6
-				THEN week_num + 1
-				ELSE week_num
-			END,
-			(day_offset + 1) % 7,
-			date(current_day, '+1 day')
-		FROM week_grid
-		WHERE current_day < date('now')
-	),
-	calendar_days AS (
-		SELECT
-			current_day as day,
-			week_num,
-			day_offset
-		FROM week_grid
-	)
-	SELECT
-		day,
-		COALESCE((sum(status) * 1.0 / COUNT(status)) * 100, 0) AS uptime,
-		COUNT(status) AS n,
-		MIN(rtt) as rtt_min,
-		MAX(rtt) as rtt_max,
-		AVG(rtt) as rtt_mean
-	FROM calendar_days
-	LEFT JOIN statuses ON
-		date(statuses.created_at, 'unixepoch') = calendar_days.day
-		AND statuses.server_id = ?
-	GROUP BY day, week_num, day_offset
-	ORDER BY week_num, day_offset;
-`
-
 const (
 	UPTIME_CLASS_HIGH string = "high"
 	UPTIME_CLASS_MID  string = "mid"
@@ -134,96 +68,230 @@ func GetUptimeClass(uptime float64) string {
 	}
 }
 
-// TODO: Handle the param properly
-// TODO: Handle not found
-func Uptime(db *sql.DB, server_id int, name string) UptimeResult {
-	rows, err := db.Query(QUERY_UPTIME, server_id)
+// UptimeResultFromRows converts the rows for a range into an API response
+func UptimeResultFromRows(name string, r UptimeRange, rows []UptimeRow) UptimeResult {
+	var result UptimeResult
+
+	for _, row := range rows {
+		var uptimeItem UptimeApiItem
+
+		uptimeItem.Date = row.Date
+		uptimeItem.Uptime = row.Uptime
+		uptimeItem.N = row.N
+		uptimeItem.RTT.Min = int(row.RTTMin.Int64)
+		uptimeItem.RTT.Max = int(row.RTTMax.Int64)
+		uptimeItem.RTT.Mean = int(math.Round(row.RTTMean.Float64))
+
+		result.Uptimes = append(result.Uptimes, uptimeItem)
+	}
+
+	result.Server = name
+	result.From = r.From.UTC().Format(time.RFC3339)
+	result.To = r.To.UTC().Format(time.RFC3339)
+	result.Granularity = r.Granularity
+	result.Count = len(result.Uptimes)
+
+	return result
+}
+
+// UptimeTemplateItemsFromRows converts rows into the form the templates use
+func UptimeTemplateItemsFromRows(rows []UptimeRow) []UptimeTemplateItem {
+	var uptimes []UptimeTemplateItem
+
+	for _, uptime := range rows {
+		var uptimeTmplItem UptimeTemplateItem
+
+		uptimeTmplItem.Date = uptime.Date
+		uptimeTmplItem.Uptime = uptime.Uptime
+		uptimeTmplItem.UptimeFmt = fmt.Sprintf("%.3g", uptime.Uptime)
+		uptimeTmplItem.UptimeClass = GetUptimeClass(uptime.Uptime)
+		uptimeTmplItem.N = uptime.N
+		uptimeTmplItem.RTTMin = SQLNullInt64ToString(uptime.RTTMin)
+		uptimeTmplItem.RTTMax = SQLNullInt64ToString(uptime.RTTMax)
+		uptimeTmplItem.RTTMean = SQLFloat64ToIntString(uptime.RTTMean)
+
+		uptimes = append(uptimes, uptimeTmplItem)
+	}
+
+	return uptimes
+}
+
+// Uptime returns a server's uptime over the given range along with its
+// uptime summary
+func Uptime(db *sql.DB, server_id int, name string, r UptimeRange) (UptimeResult, error) {
+	rows, err := UptimeRows(db, server_id, r)
 
 	if err != nil {
-		log.Fatal(err)
+		return UptimeResult{}, err
 	}
 
-	defer rows.Close()
+	result := UptimeResultFromRows(name, r, rows)
 
-	var result UptimeResult
-	var uptimes []UptimeApiItem
+	summaries, err := UptimeSummaries(db, server_id, time.Now().UTC())
 
-	for rows.Next() {
-		var uptime UptimeRow
-		var uptimeItem UptimeApiItem
+	if err != nil {
+		return UptimeResult{}, err
+	}
 
-		err := rows.Scan(
-			&uptime.Date,
-			&uptime.Uptime,
-			&uptime.N,
-			&uptime.RTTMin,
-			&uptime.RTTMax,
-			&uptime.RTTMean,
-		)
+	result.Summary = summaries[server_id]
 
-		// Coerce to UptimeAPIItem
-		uptimeItem.Date = uptime.Date
-		uptimeItem.Uptime = uptime.Uptime
-		uptimeItem.N = uptime.N
-		uptimeItem.RTT.Min = int(uptime.RTTMin.Int64)
-		uptimeItem.RTT.Max = int(uptime.RTTMax.Int64)
-		uptimeItem.RTT.Mean = int(math.Round(uptime.RTTMean.Float64))
+	return result, nil
+}
 
-		if err != nil {
-			log.Println(err)
-		} else {
-			uptimes = append(uptimes, uptimeItem)
+// UptimeCalendar returns daily uptime for one of UPTIME_CALENDAR_RANGES,
+// starting on a Monday, for the grid on the statuses page
+func UptimeCalendar(db *sql.DB, server_id int, key string) (UptimeCalendarRange, []UptimeTemplateItem, error) {
+	selected, r := CalendarUptimeRange(key, time.Now().UTC())
+
+	rows, err := UptimeRows(db, server_id, r)
+
+	if err != nil {
+		return selected, nil, err
+	}
+
+	return selected, UptimeTemplateItemsFromRows(rows), nil
+}
+
+// UptimeSummary holds a server's uptime percentage over each of the standard
+// trailing windows. A window is null when there were no checks in it.
+type UptimeSummary struct {
+	Day     null.Float `json:"24h"`
+	Week    null.Float `json:"7d"`
+	Month   null.Float `json:"30d"`
+	Quarter null.Float `json:"90d"`
+	All     null.Float `json:"all"`
+}
+
+type UptimeSummaryItem struct {
+	Key   string
+	Fmt   string
+	Class string
+}
+
+// UPTIME_SUMMARY_KEYS are the window keys in display order. They double as
+// sort keys on the index page.
+var UPTIME_SUMMARY_KEYS = []string{"24h", "7d", "30d", "90d", "all"}
+
+var QUERY_UPTIME_SUMMARIES = `
+	SELECT
+		servers.id,
+		windows.day,
+		windows.week,
+		windows.month,
+		windows.quarter,
+		totals.total
+	FROM servers
+	LEFT JOIN (
+		SELECT
+			server_id,
+			SUM(CASE WHEN start >= ? THEN n_up END) * 100.0 / SUM(CASE WHEN start >= ? THEN n END) AS day,
+			SUM(CASE WHEN start >= ? THEN n_up END) * 100.0 / SUM(CASE WHEN start >= ? THEN n END) AS week,
+			SUM(CASE WHEN start >= ? THEN n_up END) * 100.0 / SUM(CASE WHEN start >= ? THEN n END) AS month,
+			SUM(n_up) * 100.0 / SUM(n) AS quarter
+		FROM statuses_hourly
+		WHERE start >= ?
+		GROUP BY server_id
+	) AS windows ON windows.server_id = servers.id
+	LEFT JOIN (
+		SELECT
+			server_id,
+			SUM(n_up) * 100.0 / SUM(n) AS total
+		FROM statuses_daily
+		GROUP BY server_id
+	) AS totals ON totals.server_id = servers.id
+	WHERE (? = 0 OR servers.id = ?);
+`
+
+// Get returns the uptime for the window with the given key
+func (s UptimeSummary) Get(key string) null.Float {
+	switch key {
+	case "24h":
+		return s.Day
+	case "7d":
+		return s.Week
+	case "30d":
+		return s.Month
+	case "90d":
+		return s.Quarter
+	case "all":
+		return s.All
+	default:
+		return null.Float{}
+	}
+}
+
+// Items returns each window formatted for display in templates
+func (s UptimeSummary) Items() []UptimeSummaryItem {
+	var items []UptimeSummaryItem
+
+	for _, key := range UPTIME_SUMMARY_KEYS {
+		value := s.Get(key)
+		item := UptimeSummaryItem{Key: key, Fmt: "n/a"}
+
+		if value.Valid {
+			item.Fmt = fmt.Sprintf("%.1f", math.Floor(value.Float64*10)/10)
+			item.Class = GetUptimeClass(value.Float64)
 		}
+
+		items = append(items, item)
 	}
 
-	result.Server = name
-	result.Count = len(uptimes)
-	result.Uptimes = uptimes
+	return items
+}
 
-	return result
+// windowStart returns the start of the hourly bucket containing now - d so
+// that partially-covered hours at the start of a window are included
+func windowStart(now time.Time, d time.Duration) int64 {
+	start := now.Add(-d).Unix()
+
+	return start - start%3600
 }
 
-func UptimeThreeMonths(db *sql.DB, server_id int, name string) []UptimeTemplateItem {
-	rows, err := db.Query(QUERY_UPTIME_3_MONTHS, server_id)
+// UptimeSummaries calculates the uptime summary for every server, or just the
+// server with the given ID if server_id is non-zero, from the rollup tables.
+// The result is keyed by server ID.
+func UptimeSummaries(db *sql.DB, server_id int, now time.Time) (map[int]UptimeSummary, error) {
+	day := windowStart(now, 24*time.Hour)
+	week := windowStart(now, 7*24*time.Hour)
+	month := windowStart(now, 30*24*time.Hour)
+	quarter := windowStart(now, 90*24*time.Hour)
+
+	rows, err := db.Query(
+		QUERY_UPTIME_SUMMARIES,
+		day, day,
+		week, week,
+		month, month,
+		quarter,
+		server_id, server_id,
+	)
 
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	defer rows.Close()
 
-	var uptimes []UptimeTemplateItem
+	summaries := map[int]UptimeSummary{}
 
 	for rows.Next() {
-		var uptime UptimeRow
-		var uptimeTmplItem UptimeTemplateItem
+		var id int
+		var summary UptimeSummary
 
 		err := rows.Scan(
-			&uptime.Date,
-			&uptime.Uptime,
-			&uptime.N,
-			&uptime.RTTMin,
-			&uptime.RTTMax,
-			&uptime.RTTMean,
+			&id,
+			&summary.Day,
+			&summary.Week,
+			&summary.Month,
+			&summary.Quarter,
+			&summary.All,
 		)
 
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 
-		uptimeTmplItem.Date = uptime.Date
-		uptimeTmplItem.Uptime = uptime.Uptime
-		uptimeTmplItem.UptimeFmt = fmt.Sprintf("%.3g", uptime.Uptime)
-		uptimeTmplItem.UptimeClass = GetUptimeClass(uptime.Uptime)
-		uptimeTmplItem.N = uptime.N
-		uptimeTmplItem.RTTMin = SQLNullInt64ToString(uptime.RTTMin)
-		uptimeTmplItem.RTTMax = SQLNullInt64ToString(uptime.RTTMax)
-		uptimeTmplItem.RTTMean = SQLFloat64ToIntString(uptime.RTTMean)
-
-		uptimes = append(uptimes, uptimeTmplItem)
+		summaries[id] = summary
 	}
 
-	// Data is already in chronological order from the query
-
-	return uptimes
+	return summaries, rows.Err()
 }
@@ -1,18 +1,25 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
-	"io/ioutil"
 	"log"
 	"monitor/api"
+	"monitor/cli"
 	"monitor/lib"
+	"monitor/routes"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,9 +32,27 @@ import (
 )
 
 type App struct {
-	Port     string
-	Database *sql.DB
-	T        *template.Template
+	Port      string
+	Database  *sql.DB
+	T         *template.Template
+	SLOConfig api.SLOConfig
+	Notifiers []lib.Notifier
+	// Where check results and state changes are written
+	Sinks []lib.StatusSink
+	// Sends check results and state changes to /api/stream clients
+	Stream *lib.Broadcaster
+	// When and how often each notifier is sent events
+	NotificationPolicies lib.NotificationPolicies
+	// Verifies requests to the Discord interactions endpoint, which is
+	// disabled when this is nil
+	DiscordPublicKey ed25519.PublicKey
+	// Sends subscription confirmations, which are disabled when this is nil
+	Mailer *lib.Mailer
+	// Limits how often each IP address can subscribe
+	SubscribeLimiter *lib.RateLimiter
+	// Where and how often the database is backed up, which is disabled when
+	// this is nil
+	Backups *lib.BackupConfig
 }
 
 func (a App) Start(no_cron bool, sync_on_startup bool, check_on_startup bool) {
@@ -38,6 +63,12 @@ func (a App) Start(no_cron bool, sync_on_startup bool, check_on_startup bool) {
 		log.Fatalf("Error in AutoMigrate: %s", migrate_error)
 	}
 
+	notifiers_error := lib.InitNotifiers(a.Database, a.Notifiers)
+
+	if notifiers_error != nil {
+		log.Fatalf("Error initializing notifiers: %s", notifiers_error)
+	}
+
 	if sync_on_startup {
 		log.Println("Doing startup sync...")
 		lst, err := lib.Fetch()
@@ -52,7 +83,8 @@ func (a App) Start(no_cron bool, sync_on_startup bool, check_on_startup bool) {
 
 	if check_on_startup {
 		log.Println("Doing startup check...")
-		lib.Update(a.Database)
+		lib.Update(a.Database, a.Sinks)
+		lib.DeliverEvents(a.Database, a.Notifiers, a.NotificationPolicies, time.Now())
 		log.Println("...Done doing startup check")
 	}
 
@@ -60,10 +92,28 @@ func (a App) Start(no_cron bool, sync_on_startup bool, check_on_startup bool) {
 	if !no_cron {
 		c := cron.New()
 
-		c.AddFunc("@every 10m", func() {
-			lib.Update(a.Database)
+		c.AddFunc("@every "+lib.CHECK_INTERVAL.String(), func() {
+			lib.Update(a.Database, a.Sinks)
+			lib.DeliverEvents(a.Database, a.Notifiers, a.NotificationPolicies, time.Now())
 		})
 
+		if a.Backups != nil {
+			err := c.AddFunc(a.Backups.Schedule, func() {
+				backup, err := lib.RunBackup(context.Background(), a.Database, a.Backups, time.Now())
+
+				if err != nil {
+					log.Printf("Failed to back up database: %s", err)
+					return
+				}
+
+				log.Printf("Backed up database to %s (%d bytes, SHA-256 %s)", backup.Path, backup.Size, backup.SHA256)
+			})
+
+			if err != nil {
+				log.Fatalf("Invalid BACKUP_SCHEDULE: %s", err)
+			}
+		}
+
 		log.Println("Starting cron")
 		c.Start()
 	} else {
@@ -72,15 +122,27 @@ func (a App) Start(no_cron bool, sync_on_startup bool, check_on_startup bool) {
 
 	// web
 	http.Handle("/favicon.ico", http.NotFoundHandler())
-	http.Handle("/api/servers/", lib.LogReq(a.ApiServers))
-	http.Handle("/api/uptimes/", lib.LogReq(a.ApiUptimes))
-	http.Handle("/api/statuses/", lib.LogReq(a.ApiStatuses))
-	http.Handle("/api/", lib.LogReq(a.Api))
-	// http.Handle("/export/", lib.LogReq(a.Export))
+	http.Handle("/api/servers/", routes.Deprecated(lib.LogReq(a.ApiServers), func(r *http.Request) string { return "/api/v2/servers" }))
+	http.Handle("/api/uptimes/", routes.Deprecated(lib.LogReq(a.ApiUptimes), routes.ServerSuccessor("/api/uptimes/", "/uptimes")))
+	http.Handle("/api/statuses/", routes.Deprecated(lib.LogReq(a.ApiStatuses), routes.ServerSuccessor("/api/statuses/", "/statuses")))
+	http.Handle("/api/rtt/", routes.Deprecated(lib.LogReq(a.ApiRTT), routes.ServerSuccessor("/api/rtt/", "/rtt")))
+	http.Handle("/api/slo", routes.Deprecated(lib.LogReq(a.ApiSLO), func(r *http.Request) string { return "/api/v2/slo" }))
+	http.Handle("/api/slo/", routes.Deprecated(lib.LogReq(a.ApiSLO), routes.ServerSuccessor("/api/slo/", "/slo")))
+	http.Handle("/api/stream", lib.LogReq(lib.StreamHandler(a.Stream)))
+	http.Handle("/api/openapi.json", lib.LogReq(routes.OpenAPIHandler))
+	http.Handle("/api/docs", lib.LogReq(routes.DocsHandler))
+	http.Handle("/api/", lib.LogReq(routes.RoutesHandler))
+	routes.V2{DB: a.Database, SLOConfig: a.SLOConfig}.Register(http.DefaultServeMux)
+	http.Handle("/discord/interactions", lib.LogReq(lib.DiscordInteractionsHandler(a.Database, a.DiscordPublicKey, lib.BaseURL())))
+	http.Handle("/backups/latest", lib.LogReq(lib.BackupHandler(a.Backups)))
 	http.Handle("/about/", lib.LogReq(a.About))
 	http.Handle("/static/", lib.LogReq(lib.StaticHandler("static")))
 	http.Handle("/metrics/", promhttp.Handler())
 	http.Handle("/statuses/", lib.LogReq(a.Statuses))
+	http.Handle("/feeds/", lib.LogReq(a.Feed))
+	http.Handle("/subscriptions", lib.LogReq(a.Subscribe))
+	http.Handle("/subscriptions/confirm", lib.LogReq(a.ConfirmSubscription))
+	http.Handle("/subscriptions/unsubscribe", lib.LogReq(a.Unsubscribe))
 
 	http.Handle("/", lib.LogReq(a.Index))
 
@@ -94,13 +156,56 @@ func (a App) About(w http.ResponseWriter, r *http.Request) {
 	lib.RenderTemplate(w, "about.html", nil)
 }
 
-func (a App) Api(w http.ResponseWriter, r *http.Request) {
+// abortRows ends a CSV or NDJSON response that failed. It's a 500 if nothing
+// was sent yet and otherwise aborted so clients can tell it was cut short.
+func abortRows(w http.ResponseWriter, err error) {
+	if errors.Is(err, routes.ErrRowsSent) {
+		panic(http.ErrAbortHandler)
+	}
+
+	w.WriteHeader(500)
+}
+
+func (a App) ApiServers(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	data := struct {
-		Routes []string `json:"routes"`
-	}{
-		Routes: []string{"/api/servers", "/api/uptimes/:name", "/api/statuses/:name"},
+	filter, err := api.ParseServerFilter(r.URL.Query())
+
+	if err != nil {
+		log.Printf("Invalid servers filter for %s: %s. Returning HTTP 400.", r.URL, err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	format, err := routes.NegotiateFormat(r)
+
+	if err != nil {
+		log.Printf("Invalid format for %s: %s. Returning HTTP 400.", r.URL, err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	done := lib.TimeQuery(r.Context(), "servers")
+
+	if format != routes.FORMAT_JSON {
+		err := routes.WriteServers(w, a.Database, format, filter)
+		done()
+
+		if err != nil {
+			log.Printf("Failed to stream servers: %s", err)
+			abortRows(w, err)
+		}
+
+		return
+	}
+
+	data, err := api.Servers(a.Database, filter)
+	done()
+
+	if err != nil {
+		log.Printf("Failed to query servers: %s", err)
+		w.WriteHeader(500)
+		return
 	}
 
 	output, err := json.MarshalIndent(data, "", "  ")
@@ -113,30 +218,75 @@ func (a App) Api(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Length")
+	w.Header().Set("Vary", "Accept")
 
 	w.Write(output)
 }
 
-func (a App) Export(w http.ResponseWriter, r *http.Request) {
-	x, err := ioutil.ReadFile(lib.Env("DB_PATH", "./monitor.db"))
+func (a App) ApiUptimes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Pull out server id from URL
+	// TODO: Put into subroutine
+	re := regexp.MustCompile(`\/api\/uptimes\/(.+)`)
+	m := re.FindStringSubmatch(r.URL.Path)
+
+	if len(m) != 2 {
+		log.Printf("Failed to extract server_id from %s. Returning HTTP 400.", r.URL.Path)
+
+		w.WriteHeader(400)
+
+		return
+	}
+
+	// Find ID for server by name
+	server_id, err := api.GetServerIdByName(a.Database, m[1])
 
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Failed to parse server id from query result.")
+		w.WriteHeader(500)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(x)))
-	w.Header().Set("Content-Disposition", "attachment; filename=\"monitor.sqlite3\"")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if server_id == 0 {
+		log.Printf("Failed to find server_id for server with name %s. Returning HTTP 404.", m[1])
+		w.WriteHeader(404)
+		return
+	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write(x)
-}
+	uptime_range, err := api.ParseUptimeRange(r.URL.Query(), time.Now().UTC())
 
-func (a App) ApiServers(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		log.Printf("Invalid uptime range for %s: %s. Returning HTTP 400.", r.URL, err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
 
-	var data api.ServerAPIResponse = api.Servers(a.Database)
+	format, err := routes.NegotiateFormat(r)
+
+	if err != nil {
+		log.Printf("Invalid format for %s: %s. Returning HTTP 400.", r.URL, err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	done := lib.TimeQuery(r.Context(), "uptime")
+	data, err := api.Uptime(a.Database, server_id, m[1], uptime_range)
+	done()
+
+	if err != nil {
+		log.Printf("Failed to query uptime for server %s: %s", m[1], err)
+		w.WriteHeader(500)
+		return
+	}
+
+	if format != routes.FORMAT_JSON {
+		if err := routes.WriteUptimes(w, format, data); err != nil {
+			log.Printf("Failed to stream uptime for server %s: %s", m[1], err)
+		}
+
+		return
+	}
 
 	output, err := json.MarshalIndent(data, "", "  ")
 
@@ -148,16 +298,15 @@ func (a App) ApiServers(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Length")
+	w.Header().Set("Vary", "Accept")
 
 	w.Write(output)
 }
 
-func (a App) ApiUptimes(w http.ResponseWriter, r *http.Request) {
+func (a App) ApiRTT(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	// Pull out server id from URL
-	// TODO: Put into subroutine
-	re := regexp.MustCompile(`\/api\/uptimes\/(.+)`)
+	re := regexp.MustCompile(`\/api\/rtt\/(.+)`)
 	m := re.FindStringSubmatch(r.URL.Path)
 
 	if len(m) != 2 {
@@ -183,7 +332,77 @@ func (a App) ApiUptimes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var data api.UptimeResult = api.Uptime(a.Database, server_id, m[1])
+	rtt_range, err := api.ParseUptimeRange(r.URL.Query(), time.Now().UTC())
+
+	if err == nil {
+		err = api.ValidateRTTRange(rtt_range)
+	}
+
+	if err != nil {
+		log.Printf("Invalid RTT range for %s: %s. Returning HTTP 400.", r.URL, err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	done := lib.TimeQuery(r.Context(), "rtt_percentiles")
+	data, err := api.RTTPercentiles(a.Database, server_id, m[1], rtt_range)
+	done()
+
+	if err != nil {
+		log.Printf("Failed to query RTT percentiles for server %s: %s", m[1], err)
+		w.WriteHeader(500)
+		return
+	}
+
+	output, err := json.MarshalIndent(data, "", "  ")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Length")
+
+	w.Write(output)
+}
+
+func (a App) ApiSLO(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Either all servers or, with a name, just one
+	re := regexp.MustCompile(`\/api\/slo\/(.+)`)
+	m := re.FindStringSubmatch(r.URL.Path)
+
+	var server_id int
+	var err error
+
+	if len(m) == 2 {
+		server_id, err = api.GetServerIdByName(a.Database, m[1])
+
+		if err != nil {
+			log.Printf("Failed to parse server id from query result.")
+			w.WriteHeader(500)
+			return
+		}
+
+		if server_id == 0 {
+			log.Printf("Failed to find server_id for server with name %s. Returning HTTP 404.", m[1])
+			w.WriteHeader(404)
+			return
+		}
+	}
+
+	done := lib.TimeQuery(r.Context(), "slos")
+	data, err := api.SLOs(a.Database, a.SLOConfig, server_id, time.Now().UTC())
+	done()
+
+	if err != nil {
+		log.Printf("Failed to query SLOs: %s", err)
+		w.WriteHeader(500)
+		return
+	}
 
 	output, err := json.MarshalIndent(data, "", "  ")
 
@@ -228,7 +447,44 @@ func (a App) ApiStatuses(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var data api.StatusApiResponse = api.Statuses(a.Database, server_id)
+	status_query, err := api.ParseStatusQuery(r.URL.Query())
+
+	if err != nil {
+		log.Printf("Invalid statuses query for %s: %s. Returning HTTP 400.", r.URL, err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	format, err := routes.NegotiateFormat(r)
+
+	if err != nil {
+		log.Printf("Invalid format for %s: %s. Returning HTTP 400.", r.URL, err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	done := lib.TimeQuery(r.Context(), "statuses")
+
+	if format != routes.FORMAT_JSON {
+		err := routes.WriteStatuses(w, r, a.Database, server_id, status_query, format)
+		done()
+
+		if err != nil {
+			log.Printf("Failed to stream statuses for server %s: %s", m[1], err)
+			abortRows(w, err)
+		}
+
+		return
+	}
+
+	data, err := api.Statuses(a.Database, server_id, status_query)
+	done()
+
+	if err != nil {
+		log.Printf("Failed to query statuses for server %s: %s", m[1], err)
+		w.WriteHeader(500)
+		return
+	}
 
 	output, err := json.MarshalIndent(data, "", "  ")
 
@@ -240,6 +496,79 @@ func (a App) ApiStatuses(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Length")
+	w.Header().Set("Vary", "Accept")
+
+	w.Write(output)
+}
+
+// Feed serves an Atom feed of events for every server at /feeds/all.atom or
+// for one server at /feeds/:name.atom
+func (a App) Feed(w http.ResponseWriter, r *http.Request) {
+	re := regexp.MustCompile(`^\/feeds\/(.+)\.atom$`)
+	m := re.FindStringSubmatch(r.URL.Path)
+
+	if len(m) != 2 {
+		w.WriteHeader(404)
+		return
+	}
+
+	base_url := lib.BaseURL()
+	self := base_url + r.URL.EscapedPath()
+
+	var server_id int
+	var id, title string
+
+	if m[1] == "all" {
+		id = "feed/all"
+		title = "Asheron's Call Private Server Status Changes"
+	} else {
+		var err error
+
+		server_id, err = api.GetServerIdByName(a.Database, m[1])
+
+		if err != nil {
+			log.Printf("Failed to parse server id from query result.")
+			w.WriteHeader(500)
+			return
+		}
+
+		if server_id == 0 {
+			log.Printf("Failed to find server_id for server with name %s. Returning HTTP 404.", m[1])
+			w.WriteHeader(404)
+			return
+		}
+
+		// Use the GUID so the feed keeps its ID if the server is renamed
+		server, err := api.Server(a.Database, server_id)
+
+		if err != nil {
+			log.Printf("Failed to query server %s: %s", m[1], err)
+			w.WriteHeader(500)
+			return
+		}
+
+		id = "feed/server/" + server.GUID
+		title = fmt.Sprintf("%s Status Changes", server.Name)
+	}
+
+	events, err := lib.RecentEvents(a.Database, server_id, lib.FEED_SIZE)
+
+	if err != nil {
+		log.Printf("Failed to query events for feed %s: %s", r.URL.Path, err)
+		w.WriteHeader(500)
+		return
+	}
+
+	output, err := lib.NewAtomFeed(base_url, id, title, self, events).Marshal()
+
+	if err != nil {
+		log.Printf("Failed to render feed %s: %s", r.URL.Path, err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	w.Write(output)
 }
@@ -271,36 +600,323 @@ func (a App) Statuses(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var server api.ServerTableRow = api.Server(a.Database, server_id)
-	var statuses api.StatusApiResponse = api.Statuses(a.Database, server_id)
-	var threeMonthUptime []api.UptimeTemplateItem = api.UptimeThreeMonths(a.Database, server_id, server.Name)
+	server, err := api.Server(a.Database, server_id)
+
+	if err != nil {
+		log.Printf("Failed to query server %s: %s", m[1], err)
+		w.WriteHeader(500)
+		return
+	}
+
+	// Only paging is offered here, not the API's filters
+	status_query := api.DefaultStatusQuery()
+
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		cursor, err := api.ParseStatusCursor(value)
+
+		if err != nil {
+			log.Printf("Invalid cursor for %s: %s. Returning HTTP 400.", r.URL, err)
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		status_query.Before = &cursor
+	}
+
+	done := lib.TimeQuery(r.Context(), "statuses")
+	statuses, err := api.Statuses(a.Database, server_id, status_query)
+	done()
+
+	if err != nil {
+		log.Printf("Failed to query statuses for server %s: %s", m[1], err)
+	}
+
+	// Links to the next page and back to the first keep the selected range
+	var olderURL, newestURL string
+	params := r.URL.Query()
+
+	if statuses.NextCursor.Valid {
+		params.Set("cursor", statuses.NextCursor.String)
+		olderURL = "?" + params.Encode()
+	}
+
+	if status_query.Before != nil {
+		params.Del("cursor")
+		newestURL = "?" + params.Encode()
+	}
+
+	done = lib.TimeQuery(r.Context(), "uptime_calendar")
+	uptimeRange, uptimeCalendar, err := api.UptimeCalendar(a.Database, server_id, r.URL.Query().Get("range"))
+	done()
+
+	if err != nil {
+		log.Printf("Failed to query uptime calendar for server %s: %s", m[1], err)
+	}
+
+	done = lib.TimeQuery(r.Context(), "slos")
+	slos, err := api.SLOs(a.Database, a.SLOConfig, server_id, time.Now().UTC())
+	done()
+
+	if err != nil {
+		log.Printf("Failed to query SLO for server %s: %s", m[1], err)
+	}
+
+	var slo *api.SLOStatus
+
+	if len(slos.SLOs) == 1 {
+		slo = &slos.SLOs[0]
+	}
+
+	done = lib.TimeQuery(r.Context(), "rtt_percentiles")
+	rtts, err := api.RTTPercentiles(a.Database, server_id, server.Name, api.LatencyChartRange(time.Now().UTC()))
+	done()
+
+	if err != nil {
+		log.Printf("Failed to query RTT percentiles for server %s: %s", m[1], err)
+	}
 
 	data := struct {
-		Server            api.ServerTableRow
-		Statuses          api.StatusApiResponse
-		ThreeMonthUptime  []api.UptimeTemplateItem
+		Server         api.ServerTableRow
+		Statuses       api.StatusApiResponse
+		OlderURL       string
+		NewestURL      string
+		UptimeRange    api.UptimeCalendarRange
+		UptimeRanges   []api.UptimeCalendarRange
+		UptimeCalendar []api.UptimeTemplateItem
+		LatencyChart   api.LatencyChart
+		SLO            *api.SLOStatus
+		Subscriptions  bool
 	}{
-		Server:           server,
-		Statuses:         statuses,
-		ThreeMonthUptime: threeMonthUptime,
+		Server:         server,
+		Statuses:       statuses,
+		OlderURL:       olderURL,
+		NewestURL:      newestURL,
+		UptimeRange:    uptimeRange,
+		UptimeRanges:   api.UPTIME_CALENDAR_RANGES,
+		UptimeCalendar: uptimeCalendar,
+		LatencyChart:   api.NewLatencyChart(rtts),
+		SLO:            slo,
+		Subscriptions:  a.Mailer != nil,
 	}
 
 	lib.RenderTemplate(w, "statuses.html", data)
 }
 
+func renderSubscriptionMessage(w http.ResponseWriter, status int, title string, message string) {
+	renderSubscriptionForm(w, status, title, message, "", "")
+}
+
+// renderSubscriptionForm renders a message with a button that POSTs to action
+func renderSubscriptionForm(w http.ResponseWriter, status int, title string, message string, action string, button string) {
+	data := struct {
+		Title   string
+		Message string
+		Action  string
+		Button  string
+	}{
+		Title:   title,
+		Message: message,
+		Action:  action,
+		Button:  button,
+	}
+
+	w.WriteHeader(status)
+	lib.RenderTemplate(w, "subscriptions.html", data)
+}
+
+func (a App) Subscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(405)
+		return
+	}
+
+	if a.Mailer == nil {
+		renderSubscriptionMessage(w, 404, "Subscriptions unavailable", "Email subscriptions aren't enabled on this site.")
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if !a.SubscribeLimiter.Allow(ip, time.Now()) {
+		renderSubscriptionMessage(w, 429, "Couldn't subscribe", "You've subscribed too many times recently. Please try again later.")
+		return
+	}
+
+	email, err := lib.NormalizeEmail(r.PostFormValue("email"))
+
+	if err != nil {
+		renderSubscriptionMessage(w, 400, "Couldn't subscribe", "That doesn't look like an email address.")
+		return
+	}
+
+	var server_ids []int
+
+	for _, name := range r.PostForm["server"] {
+		server_id, err := api.GetServerIdByName(a.Database, name)
+
+		if err != nil {
+			log.Printf("Failed to look up server %s: %s", name, err)
+			w.WriteHeader(500)
+			return
+		}
+
+		if server_id == 0 {
+			renderSubscriptionMessage(w, 400, "Couldn't subscribe", fmt.Sprintf("There's no server named %s.", name))
+			return
+		}
+
+		server_ids = append(server_ids, server_id)
+	}
+
+	if len(server_ids) == 0 {
+		renderSubscriptionMessage(w, 400, "Couldn't subscribe", "Pick at least one server to subscribe to.")
+		return
+	}
+
+	token, pending, err := lib.Subscribe(a.Database, email, server_ids, time.Now().UTC().Unix())
+
+	if errors.Is(err, lib.ErrConfirmationPending) {
+		renderSubscriptionMessage(w, 429, "Check your email", fmt.Sprintf("We've already sent %s a link to confirm a subscription in the last hour. Open it or try again later.", email))
+		return
+	}
+
+	if err != nil {
+		log.Printf("Failed to save subscription: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	if len(pending) > 0 {
+		err = lib.SendConfirmation(a.Mailer, lib.BaseURL(), email, token, pending)
+
+		if err != nil {
+			log.Printf("Failed to send subscription confirmation: %s", err)
+			renderSubscriptionMessage(w, 500, "Couldn't subscribe", "We couldn't send you a confirmation email. Please try again later.")
+			return
+		}
+	}
+
+	// Say the same thing whether or not the address was already subscribed so
+	// this doesn't reveal who is
+	renderSubscriptionMessage(w, 200, "Check your email", fmt.Sprintf("If %s isn't already subscribed, we've sent it a link to confirm your subscription.", email))
+}
+
+func (a App) ConfirmSubscription(w http.ResponseWriter, r *http.Request) {
+	names, err := lib.ConfirmSubscriptions(a.Database, r.URL.Query().Get("token"), time.Now().UTC().Unix())
+
+	if err != nil {
+		log.Printf("Failed to confirm subscription: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	if len(names) == 0 {
+		renderSubscriptionMessage(w, 404, "Link not found", "This confirmation link is invalid or the subscription was cancelled.")
+		return
+	}
+
+	renderSubscriptionMessage(w, 200, "Subscription confirmed", fmt.Sprintf("You'll be emailed when %s goes down or comes back up.", strings.Join(names, ", ")))
+}
+
+// Unsubscribe asks for confirmation on GET and only unsubscribes on POST so
+// mail scanners and link prefetchers that follow the link don't unsubscribe
+// anyone. Mail clients unsubscribe in one click by POSTing to the same URL, as
+// the List-Unsubscribe-Post header tells them to.
+func (a App) Unsubscribe(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		name, err := lib.UnsubscribeServerName(a.Database, token)
+
+		if err != nil {
+			log.Printf("Failed to look up subscription: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+
+		if name == "" {
+			renderSubscriptionMessage(w, 404, "Link not found", "This unsubscribe link is invalid or you've already unsubscribed.")
+			return
+		}
+
+		renderSubscriptionForm(w, 200, "Unsubscribe", fmt.Sprintf("Stop getting emails about %s?", name), "/subscriptions/unsubscribe?token="+url.QueryEscape(token), "Unsubscribe")
+	case http.MethodPost:
+		name, err := lib.Unsubscribe(a.Database, token)
+
+		if err != nil {
+			log.Printf("Failed to unsubscribe: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+
+		if name == "" {
+			renderSubscriptionMessage(w, 404, "Link not found", "This unsubscribe link is invalid or you've already unsubscribed.")
+			return
+		}
+
+		renderSubscriptionMessage(w, 200, "Unsubscribed", fmt.Sprintf("You won't be emailed about %s any more.", name))
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		w.WriteHeader(405)
+	}
+}
+
 func (a App) Index(w http.ResponseWriter, r *http.Request) {
-	var servers []api.ServerAPIResponseWithUptime = api.ServersWithUptimes(a.Database)
+	filter, err := api.ParseServerFilter(r.URL.Query())
+
+	if err != nil {
+		log.Printf("Invalid servers filter for %s: %s. Returning HTTP 400.", r.URL, err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	done := lib.TimeQuery(r.Context(), "servers_with_uptimes")
+	servers, err := api.ServersWithUptimes(a.Database, filter)
+	done()
+
+	if err != nil {
+		log.Printf("Failed to query servers: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	done = lib.TimeQuery(r.Context(), "server_facets")
+	emus, types, err := api.ServerFacets(a.Database)
+	done()
+
+	if err != nil {
+		log.Printf("Failed to query server facets: %s", err)
+	}
+
+	done = lib.TimeQuery(r.Context(), "totals")
 	var last_updated = lib.QueryLastUpdated(a.Database)
 	var total_statuses = lib.CommafyNumber(lib.QueryTotalNumStatuses(a.Database))
 	var total_servers = lib.CommafyNumber(lib.QueryTotalNumServers(a.Database))
+	done()
 
 	data := struct {
 		Servers           []api.ServerAPIResponseWithUptime
+		SummaryKeys       []string
+		Filter            api.ServerFilter
+		Filtered          bool
+		Emulators         []string
+		Types             []string
 		LastUpdated       string
 		TotalStatusCount  string
 		TotalServersCount string
 	}{
 		Servers:           servers,
+		SummaryKeys:       api.UPTIME_SUMMARY_KEYS,
+		Filter:            filter,
+		Filtered:          filter != api.ServerFilter{Sort: filter.Sort},
+		Emulators:         emus,
+		Types:             types,
 		LastUpdated:       last_updated,
 		TotalStatusCount:  total_statuses,
 		TotalServersCount: total_servers,
@@ -337,6 +953,30 @@ func main() {
 		return
 	}
 
+	// Query another monitor's API and quit
+	if flag.Arg(0) == "query" {
+		os.Exit(cli.Query(context.Background(), flag.Args()[1:], os.Stdout, os.Stderr))
+	}
+
+	// Export the database's history and quit
+	if flag.Arg(0) == "export" {
+		os.Exit(cli.Export(context.Background(), flag.Args()[1:], os.Stdout, os.Stderr))
+	}
+
+	// Back up or restore the database and quit
+	if flag.Arg(0) == "backup" {
+		os.Exit(cli.Backup(context.Background(), flag.Args()[1:], os.Stdout, os.Stderr))
+	}
+
+	if flag.Arg(0) == "restore" {
+		os.Exit(cli.Restore(context.Background(), flag.Args()[1:], os.Stdout, os.Stderr))
+	}
+
+	// Merge another monitor's history into the database and quit
+	if flag.Arg(0) == "import" {
+		os.Exit(cli.Import(context.Background(), flag.Args()[1:], os.Stdout, os.Stderr))
+	}
+
 	// Sentry
 	err := sentry.Init(sentry.ClientOptions{
 		Dsn:              os.Getenv("SENTRY_DSN"),
@@ -364,19 +1004,89 @@ func main() {
 	// Serve (default) or handle args
 	args := os.Args[1:]
 
+	degradation, err := lib.DegradationConfigFromEnv()
+
+	if err != nil {
+		log.Fatalf("Invalid degradation settings: %s", err)
+	}
+
+	sinks, err := lib.SinksFromEnv(database, degradation)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mailer := lib.MailerFromEnv()
+	notifiers := lib.NotifiersFromEnv(database, mailer)
+	notification_policies, err := lib.ParseNotificationPolicies(lib.Env("NOTIFY_POLICY", ""))
+
+	if err != nil {
+		log.Fatalf("Invalid NOTIFY_POLICY: %s", err)
+	}
+
 	if len(args) == 1 && args[0] == "update" {
-		lib.Update(database)
+		lib.Update(database, sinks)
+		lib.DeliverEvents(database, notifiers, notification_policies, time.Now())
 
 		return
 	}
 
+	// Live updates
+	stream := lib.NewBroadcaster()
+	sinks = append(sinks, stream)
+
 	// Prometheus
 	prometheus.MustRegister(collectors.NewBuildInfoCollector())
+	prometheus.MustRegister(lib.MonitorCollectors...)
+
+	server_metrics := lib.NewServerMetrics(database)
+	prometheus.MustRegister(server_metrics)
+	sinks = append(sinks, server_metrics)
+
+	// SLOs
+	slo_window_days, err := strconv.Atoi(lib.Env("SLO_WINDOW_DAYS", fmt.Sprintf("%d", api.DEFAULT_SLO_WINDOW_DAYS)))
+
+	if err != nil {
+		log.Fatalf("Invalid SLO_WINDOW_DAYS: %s", err)
+	}
+
+	slo_config, err := api.ParseSLOConfig(lib.Env("SLO_TARGETS", ""), slo_window_days)
+
+	if err != nil {
+		log.Fatalf("Invalid SLO_TARGETS: %s", err)
+	}
+
+	// Discord interactions
+	var discord_public_key ed25519.PublicKey
+
+	if value := lib.Env("DISCORD_PUBLIC_KEY", ""); value != "" {
+		discord_public_key, err = lib.ParseDiscordPublicKey(value)
+
+		if err != nil {
+			log.Fatalf("Invalid DISCORD_PUBLIC_KEY: %s", err)
+		}
+	}
+
+	// Backups
+	backups, err := lib.BackupConfigFromEnv()
+
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Serve
 	app := App{
-		Port:     lib.Env("PORT", "8080"),
-		Database: database,
+		Port:                 lib.Env("PORT", "8080"),
+		Database:             database,
+		SLOConfig:            slo_config,
+		Notifiers:            notifiers,
+		Sinks:                sinks,
+		Stream:               stream,
+		NotificationPolicies: notification_policies,
+		DiscordPublicKey:     discord_public_key,
+		Mailer:               mailer,
+		SubscribeLimiter:     lib.NewRateLimiter(lib.SUBSCRIBE_IP_LIMIT, lib.SUBSCRIBE_IP_WINDOW),
+		Backups:              backups,
 	}
 
 	app.Start(*flag_no_cron, *flag_sync_on_startup, *flag_check_on_startup)
@@ -0,0 +1,138 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"monitor/lib"
+	"os"
+	"strconv"
+	"time"
+)
+
+const BACKUP_USAGE = `Usage: monitor backup [flags]
+
+Snapshots the database into -dir, writes a checksum file next to it and
+deletes all but the newest -keep backups. It's safe to run while the monitor
+is running.
+
+Flags:
+`
+
+const RESTORE_USAGE = `Usage: monitor restore [flags] [backup]
+
+Verifies a backup, the latest in -dir by default, and copies it over the
+database. The database being replaced, and its journal files, are kept with
+a .before-restore suffix, so move those out of the way before restoring again.
+Stop the monitor first.
+
+Flags:
+`
+
+// Backup runs monitor backup with args, which exclude "backup" itself, and
+// returns the exit code
+func Backup(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, BACKUP_USAGE)
+		flags.PrintDefaults()
+	}
+
+	db_path := flags.String("db", envOr("DB_PATH", "./monitor.db"), "The database to back up. Defaults to $DB_PATH if set.")
+	dir := flags.String("dir", envOr("BACKUP_DIR", ""), "Directory to write backups to. Defaults to $BACKUP_DIR if set.")
+	keep_default, err := strconv.Atoi(envOr("BACKUP_KEEP", strconv.Itoa(lib.DEFAULT_BACKUP_KEEP)))
+
+	if err != nil {
+		keep_default = lib.DEFAULT_BACKUP_KEEP
+	}
+
+	keep := flags.Int("keep", keep_default, "How many backups to keep. Defaults to $BACKUP_KEEP if set.")
+
+	if err := flags.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+
+	if *dir == "" || *keep < 1 {
+		fmt.Fprintln(stderr, "Set a -dir to back up to and -keep at least 1 backup")
+		return EXIT_USAGE
+	}
+
+	db, err := openDatabase(*db_path)
+
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		return EXIT_ERROR
+	}
+
+	defer db.Close()
+
+	backup, err := lib.RunBackup(ctx, db, &lib.BackupConfig{Dir: *dir, Keep: *keep}, time.Now())
+
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		return EXIT_ERROR
+	}
+
+	fmt.Fprintf(stdout, "%s  %s\n", backup.SHA256, backup.Path)
+
+	return EXIT_OK
+}
+
+// Restore runs monitor restore with args, which exclude "restore" itself, and
+// returns the exit code
+func Restore(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, RESTORE_USAGE)
+		flags.PrintDefaults()
+	}
+
+	db_path := flags.String("db", envOr("DB_PATH", "./monitor.db"), "The database to replace. Defaults to $DB_PATH if set.")
+	dir := flags.String("dir", envOr("BACKUP_DIR", ""), "Directory to restore the latest backup from. Defaults to $BACKUP_DIR if set.")
+
+	if err := flags.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+
+	path := flags.Arg(0)
+
+	if path == "" {
+		if *dir == "" {
+			fmt.Fprintln(stderr, "Give a backup to restore or a -dir to restore the latest backup from")
+			return EXIT_USAGE
+		}
+
+		latest, err := lib.LatestBackup(*dir)
+
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: %s in %s\n", err, *dir)
+			return EXIT_ERROR
+		}
+
+		path = latest.Path
+	}
+
+	if err := lib.RestoreBackup(ctx, path, *db_path); err != nil {
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		return EXIT_ERROR
+	}
+
+	fmt.Fprintf(stdout, "Restored %s to %s\n", path, *db_path)
+
+	return EXIT_OK
+}
+
+// openDatabase opens an existing database. Opening one that doesn't exist
+// would create it.
+func openDatabase(path string) (*sql.DB, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no database at %s", path)
+	}
+
+	return sql.Open("sqlite3", path)
+}
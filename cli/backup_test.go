@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	_, path := NewTestDatabase(t, JanuaryChecks...)
+	dir := t.TempDir()
+
+	code, out, errOut := RunTestCommand(t, Backup, "-db", path, "-dir", dir)
+
+	assert.Equal(t, EXIT_OK, code, errOut)
+	assert.Contains(t, out, filepath.Join(dir, "monitor-"))
+
+	// Restore the latest backup over a database that's been lost
+	assert.NoError(t, os.WriteFile(path, nil, 0644))
+
+	code, out, errOut = RunTestCommand(t, Restore, "-db", path, "-dir", dir)
+
+	assert.Equal(t, EXIT_OK, code, errOut)
+	assert.True(t, strings.HasPrefix(out, "Restored "))
+
+	code, out, _ = RunTestCommand(t, Export, "-db", path, "-table", "servers")
+
+	assert.Equal(t, EXIT_OK, code)
+	assert.Contains(t, out, "levistras-guid")
+}
+
+func TestBackupErrors(t *testing.T) {
+	_, path := NewTestDatabase(t, JanuaryChecks...)
+
+	cases := []struct {
+		run  func(context.Context, []string, io.Writer, io.Writer) int
+		args []string
+		code int
+	}{
+		{Backup, []string{"-db", path, "-dir", ""}, EXIT_USAGE},
+		{Backup, []string{"-db", path, "-dir", t.TempDir(), "-keep", "0"}, EXIT_USAGE},
+		{Backup, []string{"-db", filepath.Join(t.TempDir(), "nope.db"), "-dir", t.TempDir()}, EXIT_ERROR},
+		{Restore, []string{"-db", path, "-dir", ""}, EXIT_USAGE},
+		{Restore, []string{"-db", path, "-dir", t.TempDir()}, EXIT_ERROR},
+		{Restore, []string{"-db", path, path}, EXIT_ERROR},
+	}
+
+	for _, c := range cases {
+		code, _, errOut := RunTestCommand(t, c.run, c.args...)
+
+		assert.Equal(t, c.code, code, c.args)
+		assert.NotEmpty(t, errOut, c.args)
+	}
+}
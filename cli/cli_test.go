@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"monitor/lib"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// JanuaryChecks are noon on the 1st and 2nd of January 2024
+var JanuaryChecks = []time.Time{
+	time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+	time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC),
+}
+
+// NewTestDatabase creates a database with Levistras, which was checked
+// successfully at each of checks, and returns it along with its path
+func NewTestDatabase(t *testing.T, checks ...time.Time) (*sql.DB, string) {
+	path := filepath.Join(t.TempDir(), "monitor.db")
+	db, err := sql.Open("sqlite3", path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	if err := lib.AutoMigrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	lib.UpdateServersTable(db, lib.ServerList{Servers: []lib.ServerListItem{
+		{ID: "levistras-guid", Name: "Levistras", Emu: "ACE", Type: "PvE"},
+	}})
+
+	for _, created_at := range checks {
+		_, err := db.Exec("INSERT INTO statuses (server_id, created_at, status, rtt, message) VALUES (1, ?, 1, 40, '')", created_at.Unix())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return db, path
+}
+
+// RunTestCommand runs a subcommand, e.g., Export, and returns its exit code
+// and what it wrote to stdout and stderr
+func RunTestCommand(t *testing.T, command func(context.Context, []string, io.Writer, io.Writer) int, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+
+	code := command(context.Background(), args, &stdout, &stderr)
+
+	return code, stdout.String(), stderr.String()
+}
@@ -0,0 +1,160 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"monitor/api"
+	"monitor/routes"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const EXPORT_USAGE = `Usage: monitor export [flags]
+
+Exports servers, checks in a date range and incidents that overlap it from a
+monitor's database, e.g., to publish as a dataset. With -out, each table is
+written to its own file in that directory, e.g., statuses.parquet. Without
+it, the one table chosen with -table is written to stdout.
+
+Flags:
+`
+
+// Export runs monitor export with args, which exclude "export" itself, and
+// returns the exit code
+func Export(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, EXPORT_USAGE)
+		flags.PrintDefaults()
+	}
+
+	db_path := flags.String("db", envOr("DB_PATH", "./monitor.db"), "The database to export from. Defaults to $DB_PATH if set.")
+	from := flags.String("from", "", fmt.Sprintf("Start of the range, as an RFC 3339 timestamp or YYYY-MM-DD date. Defaults to %d days before -to.", api.DEFAULT_EXPORT_DAYS))
+	to := flags.String("to", "", "End of the range, which isn't included. Defaults to now.")
+	format := flags.String("format", routes.FORMAT_NDJSON, "Output format: ndjson, csv or parquet")
+	table := flags.String("table", "", "Only export servers, statuses or incidents. Needed without -out.")
+	out := flags.String("out", "", "Directory to write a file per table to")
+
+	if err := flags.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+
+	if !slices.Contains(routes.EXPORT_FORMATS, *format) {
+		fmt.Fprintf(stderr, "Unknown format %q, must be ndjson, csv or parquet\n", *format)
+		return EXIT_USAGE
+	}
+
+	tables := api.EXPORT_TABLES
+
+	if *table != "" {
+		if !slices.Contains(api.EXPORT_TABLES, *table) {
+			fmt.Fprintf(stderr, "Unknown table %q, must be servers, statuses or incidents\n", *table)
+			return EXIT_USAGE
+		}
+
+		tables = []string{*table}
+	} else if *out == "" {
+		fmt.Fprintln(stderr, "Choose a -table to write to stdout or an -out directory to write every table to")
+		return EXIT_USAGE
+	}
+
+	values := url.Values{}
+
+	if *from != "" {
+		values.Set("from", *from)
+	}
+
+	if *to != "" {
+		values.Set("to", *to)
+	}
+
+	export_range, err := api.ParseExportRange(values, time.Now().UTC())
+
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		return EXIT_USAGE
+	}
+
+	// Opening a database that doesn't exist would create an empty one
+	if _, err := os.Stat(*db_path); err != nil {
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		return EXIT_ERROR
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+*db_path+"?mode=ro")
+
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		return EXIT_ERROR
+	}
+
+	defer db.Close()
+
+	if *out == "" {
+		if _, err := routes.WriteExport(ctx, stdout, db, *table, *format, export_range); err != nil {
+			fmt.Fprintf(stderr, "Error: %s\n", err)
+			return EXIT_ERROR
+		}
+
+		return EXIT_OK
+	}
+
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		return EXIT_ERROR
+	}
+
+	for _, t := range tables {
+		path := filepath.Join(*out, t+"."+*format)
+		n, err := exportFile(ctx, db, path, t, *format, export_range)
+
+		if err != nil {
+			fmt.Fprintf(stderr, "Error exporting %s: %s\n", t, err)
+			return EXIT_ERROR
+		}
+
+		fmt.Fprintf(stderr, "Wrote %d %s to %s\n", n, t, path)
+	}
+
+	return EXIT_OK
+}
+
+// exportFile writes a table to path. It's written to a temporary file first so
+// a failed export never leaves a partial file at path.
+func exportFile(ctx context.Context, db *sql.DB, path string, table string, format string, r api.ExportRange) (int, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer os.Remove(f.Name())
+
+	// CreateTemp makes files only their owner can read
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return 0, err
+	}
+
+	n, err := routes.WriteExport(ctx, f, db, table, format, r)
+
+	if err != nil {
+		f.Close()
+		return n, err
+	}
+
+	if err := f.Close(); err != nil {
+		return n, err
+	}
+
+	return n, os.Rename(f.Name(), path)
+}
@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"encoding/csv"
+	"monitor/api"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportToStdout(t *testing.T) {
+	_, path := NewTestDatabase(t, JanuaryChecks...)
+
+	code, out, _ := RunTestCommand(t, Export, "-db", path, "-table", "statuses", "-format", "csv", "-from", "2024-01-02", "-to", "2024-01-03")
+
+	assert.Equal(t, EXIT_OK, code)
+
+	rows, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"id", "server_id", "server_guid", "created_at", "up", "rtt", "message"},
+		{"2", "1", "levistras-guid", "2024-01-02T12:00:00Z", "true", "40", ""},
+	}, rows)
+}
+
+func TestExportToDirectory(t *testing.T) {
+	_, path := NewTestDatabase(t, JanuaryChecks...)
+	out := filepath.Join(t.TempDir(), "dataset")
+
+	code, _, errOut := RunTestCommand(t, Export, "-db", path, "-out", out, "-format", "parquet", "-from", "2024-01-01", "-to", "2024-02-01")
+
+	assert.Equal(t, EXIT_OK, code, errOut)
+	assert.Contains(t, errOut, "Wrote 2 statuses to ")
+
+	entries, err := os.ReadDir(out)
+
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	f, err := os.Open(filepath.Join(out, "statuses.parquet"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	info, _ := f.Stat()
+	statuses, err := parquet.Read[api.ExportStatus](f, info.Size())
+
+	assert.NoError(t, err)
+	assert.Len(t, statuses, 2)
+	assert.Equal(t, "levistras-guid", statuses[1].ServerGUID)
+}
+
+func TestExportErrors(t *testing.T) {
+	_, path := NewTestDatabase(t, JanuaryChecks...)
+
+	cases := []struct {
+		args []string
+		code int
+	}{
+		{[]string{"-db", path}, EXIT_USAGE},
+		{[]string{"-db", path, "-table", "events"}, EXIT_USAGE},
+		{[]string{"-db", path, "-table", "statuses", "-format", "xml"}, EXIT_USAGE},
+		{[]string{"-db", path, "-table", "statuses", "-from", "yesterday"}, EXIT_USAGE},
+		{[]string{"-db", filepath.Join(t.TempDir(), "nope.db"), "-table", "statuses"}, EXIT_ERROR},
+	}
+
+	for _, c := range cases {
+		code, _, errOut := RunTestCommand(t, Export, c.args...)
+
+		assert.Equal(t, c.code, code, c.args)
+		assert.NotEmpty(t, errOut, c.args)
+	}
+}
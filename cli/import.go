@@ -0,0 +1,438 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"monitor/api"
+	"monitor/lib"
+	"monitor/routes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+const IMPORT_USAGE = `Usage: monitor import [flags] <source>...
+
+Merges servers and checks from other monitors into the database. Each source
+is another monitor's database, a file written by monitor export or
+/api/export, e.g., statuses.parquet, or a directory of them.
+
+Servers are matched by GUID and servers that are already in the database are
+left as they are. New servers are added unlisted for the next sync to list, so
+import after the monitor has synced the server list at least once or the
+listed ones are recorded as relisted. Checks are skipped if their server
+already has one at the same time, and counted as overlapping if they're
+within half a check interval of one, so gaps in its history are filled without
+doubling up on the checks around them. Incidents aren't imported. Stop the
+monitor first.
+
+Flags:
+`
+
+// Every SQLite database starts with this
+var SQLITE_HEADER = []byte("SQLite format 3\x00")
+
+// exportedFile is a file written by monitor export, named for its table, e.g.,
+// statuses.csv or statuses-2024-01-01-2024-02-01.ndjson
+type exportedFile struct {
+	path   string
+	table  string
+	format string
+}
+
+// Import runs monitor import with args, which exclude "import" itself, and
+// returns the exit code
+func Import(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, IMPORT_USAGE)
+		flags.PrintDefaults()
+	}
+
+	db_path := flags.String("db", envOr("DB_PATH", "./monitor.db"), "The database to import into. Defaults to $DB_PATH if set.")
+	dry_run := flags.Bool("dry-run", false, "Only print what would be imported")
+
+	if err := flags.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return EXIT_USAGE
+	}
+
+	var databases []string
+	var files []exportedFile
+
+	for _, source := range flags.Args() {
+		found_databases, found_files, err := findImportSources(source)
+
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: %s\n", err)
+			return EXIT_USAGE
+		}
+
+		databases = append(databases, found_databases...)
+		files = append(files, found_files...)
+	}
+
+	// Servers have to be imported before their checks
+	slices.SortStableFunc(files, func(a exportedFile, b exportedFile) int {
+		return slices.Index(api.EXPORT_TABLES, a.table) - slices.Index(api.EXPORT_TABLES, b.table)
+	})
+
+	db, err := openDatabase(*db_path)
+
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		return EXIT_ERROR
+	}
+
+	defer db.Close()
+
+	if err := lib.AutoMigrate(db); err != nil {
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		return EXIT_ERROR
+	}
+
+	im, err := lib.NewImporter(ctx, db)
+
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		return EXIT_ERROR
+	}
+
+	for _, path := range databases {
+		if err := importDatabase(ctx, im, path); err != nil {
+			im.Rollback()
+			fmt.Fprintf(stderr, "Error importing %s: %s\n", path, err)
+			return EXIT_ERROR
+		}
+	}
+
+	for _, f := range files {
+		if f.table == api.EXPORT_INCIDENTS {
+			fmt.Fprintf(stderr, "Skipping %s, incidents aren't imported\n", f.path)
+			continue
+		}
+
+		if err := importFile(im, f); err != nil {
+			im.Rollback()
+			fmt.Fprintf(stderr, "Error importing %s: %s\n", f.path, err)
+			return EXIT_ERROR
+		}
+	}
+
+	if err := im.Commit(*dry_run); err != nil {
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		return EXIT_ERROR
+	}
+
+	s := im.Summary
+
+	if *dry_run {
+		fmt.Fprintln(stdout, "Dry run, nothing was imported. The import would add:")
+	}
+
+	fmt.Fprintf(stdout, "Servers:  %d new, %d already present\n", s.ServersInserted, s.ServersMatched)
+	fmt.Fprintf(stdout, "Statuses: %d new, %d already present, %d overlapping, %d for unknown servers, out of %d\n", s.StatusesInserted, s.StatusesDuplicate, s.StatusesOverlapping, s.StatusesUnknownServer, s.StatusesRead)
+
+	return EXIT_OK
+}
+
+// findImportSources sorts a source into databases and export files. Other
+// files in directories are ignored.
+func findImportSources(source string) ([]string, []exportedFile, error) {
+	info, err := os.Stat(source)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !info.IsDir() {
+		if isDatabase(source) {
+			return []string{source}, nil, nil
+		}
+
+		f, ok := parseExportFilename(source)
+
+		if !ok {
+			return nil, nil, fmt.Errorf("%s isn't a monitor database or an export named for its table and format, e.g., statuses.csv", source)
+		}
+
+		return nil, []exportedFile{f}, nil
+	}
+
+	entries, err := os.ReadDir(source)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files []exportedFile
+
+	for _, entry := range entries {
+		if f, ok := parseExportFilename(filepath.Join(source, entry.Name())); ok && !entry.IsDir() {
+			files = append(files, f)
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("%s has no exports in it", source)
+	}
+
+	return nil, files, nil
+}
+
+func isDatabase(path string) bool {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return false
+	}
+
+	defer f.Close()
+
+	header := make([]byte, len(SQLITE_HEADER))
+	_, err = io.ReadFull(f, header)
+
+	return err == nil && bytes.Equal(header, SQLITE_HEADER)
+}
+
+func parseExportFilename(path string) (exportedFile, bool) {
+	name := filepath.Base(path)
+	format := strings.TrimPrefix(filepath.Ext(name), ".")
+
+	if !slices.Contains(routes.EXPORT_FORMATS, format) {
+		return exportedFile{}, false
+	}
+
+	for _, table := range api.EXPORT_TABLES {
+		if strings.HasPrefix(name, table+".") || strings.HasPrefix(name, table+"-") {
+			return exportedFile{path: path, table: table, format: format}, true
+		}
+	}
+
+	return exportedFile{}, false
+}
+
+// importDatabase imports from another monitor's database. Older databases
+// are migrated first, on a snapshot so the original is left alone.
+func importDatabase(ctx context.Context, im *lib.Importer, path string) error {
+	source, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+
+	if err != nil {
+		return err
+	}
+
+	defer source.Close()
+
+	snapshot := filepath.Join(os.TempDir(), fmt.Sprintf("monitor-import-%d.db", time.Now().UnixNano()))
+	defer os.Remove(snapshot)
+
+	if err := lib.Snapshot(ctx, source, snapshot); err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite3", snapshot)
+
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	if err := lib.AutoMigrate(db); err != nil {
+		return err
+	}
+
+	return im.ImportDatabase(ctx, db)
+}
+
+func importFile(im *lib.Importer, f exportedFile) error {
+	file, err := os.Open(f.path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	if f.table == api.EXPORT_SERVERS {
+		return readExport(file, f.format, parseServerRecord, im.ImportServer)
+	}
+
+	return readExport(file, f.format, parseStatusRecord, im.ImportStatus)
+}
+
+// readExport calls fn with each row of an export in format. parse reads a CSV
+// row, given as a map of its columns with the escaping WriteExport adds removed.
+func readExport[T any](file *os.File, format string, parse func(map[string]string) (T, error), fn func(T) error) error {
+	switch format {
+	case routes.FORMAT_NDJSON:
+		decoder := json.NewDecoder(file)
+
+		for {
+			var row T
+
+			if err := decoder.Decode(&row); errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+	case routes.FORMAT_CSV:
+		reader := csv.NewReader(file)
+		header, err := reader.Read()
+
+		if err != nil {
+			return err
+		}
+
+		for line := 2; ; line++ {
+			record, err := reader.Read()
+
+			if errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			columns := map[string]string{}
+
+			for i, name := range header {
+				columns[name] = routes.UnescapeCSVCell(record[i])
+			}
+
+			row, err := parse(columns)
+
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+	case routes.FORMAT_PARQUET:
+		reader := parquet.NewGenericReader[T](file)
+		defer reader.Close()
+
+		rows := make([]T, 1000)
+
+		for {
+			n, err := reader.Read(rows)
+
+			for _, row := range rows[:n] {
+				if err := fn(row); err != nil {
+					return err
+				}
+			}
+
+			if errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+
+	return fmt.Errorf("can't import %s files", format)
+}
+
+func parseCSVTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+
+	return &t, err
+}
+
+func parseServerRecord(columns map[string]string) (api.ExportServer, error) {
+	s := api.ExportServer{
+		GUID:        columns["guid"],
+		Name:        columns["name"],
+		Description: columns["description"],
+		Emulator:    columns["emu"],
+		Host:        columns["host"],
+		Port:        columns["port"],
+		Type:        columns["type"],
+		WebsiteURL:  columns["website_url"],
+		DiscordURL:  columns["discord_url"],
+		IsListed:    columns["is_listed"] == "true",
+	}
+
+	if value := columns["is_online"]; value != "" {
+		is_online := value == "true"
+		s.IsOnline = &is_online
+	}
+
+	var err error
+
+	if s.LastSeen, err = parseCSVTime(columns["last_seen"]); err != nil {
+		return s, err
+	}
+
+	for column, field := range map[string]*time.Time{"created_at": &s.CreatedAt, "updated_at": &s.UpdatedAt} {
+		t, err := parseCSVTime(columns[column])
+
+		if err != nil {
+			return s, err
+		}
+
+		if t != nil {
+			*field = *t
+		}
+	}
+
+	return s, s.Validate()
+}
+
+func parseStatusRecord(columns map[string]string) (api.ExportStatus, error) {
+	s := api.ExportStatus{
+		ServerGUID: columns["server_guid"],
+		Up:         columns["up"] == "true",
+		Message:    columns["message"],
+	}
+
+	created_at, err := parseCSVTime(columns["created_at"])
+
+	if err != nil {
+		return s, err
+	}
+
+	if created_at != nil {
+		s.CreatedAt = *created_at
+	}
+
+	if value := columns["rtt"]; value != "" {
+		rtt, err := strconv.ParseInt(value, 10, 64)
+
+		if err != nil {
+			return s, fmt.Errorf("invalid rtt: %w", err)
+		}
+
+		s.RTT = &rtt
+	}
+
+	return s, s.Validate()
+}
@@ -0,0 +1,142 @@
+package cli
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func CountTestRows(t *testing.T, path string, table string) int {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	var n int
+
+	if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+func TestImportDatabase(t *testing.T) {
+	_, dest := NewTestDatabase(t, JanuaryChecks...)
+
+	// The same checks, another a day later, and one two minutes before a check
+	// both databases have
+	_, source := NewTestDatabase(t, slices.Concat(JanuaryChecks, []time.Time{JanuaryChecks[1].AddDate(0, 0, 1), JanuaryChecks[1].Add(-2 * time.Minute)})...)
+
+	code, out, _ := RunTestCommand(t, Import, "-db", dest, "-dry-run", source)
+
+	assert.Equal(t, EXIT_OK, code)
+	assert.Contains(t, out, "Dry run")
+	assert.Contains(t, out, "Statuses: 1 new, 2 already present, 1 overlapping, 0 for unknown servers, out of 4")
+	assert.Equal(t, 2, CountTestRows(t, dest, "statuses"))
+
+	code, out, _ = RunTestCommand(t, Import, "-db", dest, source)
+
+	assert.Equal(t, EXIT_OK, code)
+	assert.NotContains(t, out, "Dry run")
+	assert.Contains(t, out, "Servers:  0 new, 1 already present")
+	assert.Equal(t, 3, CountTestRows(t, dest, "statuses"))
+	assert.Equal(t, 1, CountTestRows(t, dest, "servers"))
+}
+
+func TestImportExports(t *testing.T) {
+	for _, format := range []string{"ndjson", "csv", "parquet"} {
+		t.Run(format, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "dataset")
+
+			_, source := NewTestDatabase(t, JanuaryChecks...)
+
+			code, _, _ := RunTestCommand(t, Export, "-db", source, "-out", out, "-format", format, "-from", "2024-01-01", "-to", "2024-02-01")
+			assert.Equal(t, EXIT_OK, code)
+
+			dest := filepath.Join(t.TempDir(), "monitor.db")
+			assert.NoError(t, os.WriteFile(dest, nil, 0644))
+
+			code, out_text, err_text := RunTestCommand(t, Import, "-db", dest, out)
+
+			assert.Equal(t, EXIT_OK, code, err_text)
+			assert.Contains(t, err_text, "incidents aren't imported")
+			assert.Contains(t, out_text, "Servers:  1 new, 0 already present")
+			assert.Contains(t, out_text, "Statuses: 2 new, 0 already present, 0 overlapping, 0 for unknown servers, out of 2")
+			assert.Equal(t, 2, CountTestRows(t, dest, "statuses"))
+		})
+	}
+}
+
+func TestImportEscapedCSV(t *testing.T) {
+	db, source := NewTestDatabase(t, JanuaryChecks...)
+
+	_, err := db.Exec("UPDATE servers SET name = ?, description = ?", "=Levistras", "'quoted'")
+	assert.NoError(t, err)
+	_, err = db.Exec("UPDATE statuses SET message = '-1 ms'")
+	assert.NoError(t, err)
+
+	out := filepath.Join(t.TempDir(), "dataset")
+
+	code, _, _ := RunTestCommand(t, Export, "-db", source, "-out", out, "-format", "csv", "-from", "2024-01-01", "-to", "2024-02-01")
+	assert.Equal(t, EXIT_OK, code)
+
+	dest := filepath.Join(t.TempDir(), "monitor.db")
+	assert.NoError(t, os.WriteFile(dest, nil, 0644))
+
+	code, _, err_text := RunTestCommand(t, Import, "-db", dest, out)
+	assert.Equal(t, EXIT_OK, code, err_text)
+
+	db, err = sql.Open("sqlite3", dest)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	var name, description, message string
+
+	assert.NoError(t, db.QueryRow("SELECT name, description FROM servers").Scan(&name, &description))
+	assert.NoError(t, db.QueryRow("SELECT message FROM statuses LIMIT 1").Scan(&message))
+	assert.Equal(t, "=Levistras", name)
+	assert.Equal(t, "'quoted'", description)
+	assert.Equal(t, "-1 ms", message)
+}
+
+func TestImportInvalidRows(t *testing.T) {
+	_, dest := NewTestDatabase(t, JanuaryChecks...)
+	dir := t.TempDir()
+
+	// Rows are checked the same way whatever the format
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "statuses.ndjson"), []byte(`{"server_guid": "levistras-guid", "up": true}`+"\n"), 0644))
+
+	code, _, err_text := RunTestCommand(t, Import, "-db", dest, dir)
+
+	assert.Equal(t, EXIT_ERROR, code)
+	assert.Contains(t, err_text, "status has no created_at")
+	assert.Equal(t, 2, CountTestRows(t, dest, "statuses"))
+}
+
+func TestImportErrors(t *testing.T) {
+	_, dest := NewTestDatabase(t, JanuaryChecks...)
+
+	code, _, _ := RunTestCommand(t, Import, "-db", dest)
+	assert.Equal(t, EXIT_USAGE, code)
+
+	other := filepath.Join(t.TempDir(), "notes.txt")
+	assert.NoError(t, os.WriteFile(other, []byte("notes"), 0644))
+
+	code, _, errOut := RunTestCommand(t, Import, "-db", dest, other)
+	assert.Equal(t, EXIT_USAGE, code)
+	assert.Contains(t, errOut, "isn't a monitor database")
+
+	_, source := NewTestDatabase(t, JanuaryChecks...)
+
+	code, _, _ = RunTestCommand(t, Import, "-db", filepath.Join(t.TempDir(), "missing.db"), source)
+	assert.Equal(t, EXIT_ERROR, code)
+}
@@ -0,0 +1,492 @@
+// Package cli implements the monitor's subcommands that don't serve the web
+// app
+package cli
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"monitor/api"
+	"monitor/client"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/guregu/null.v4"
+)
+
+// Exit codes for monitor query. The server state codes are only used by the
+// servers and server commands and are for the worst state of the servers
+// shown.
+const (
+	EXIT_OK       = 0
+	EXIT_ERROR    = 1
+	EXIT_USAGE    = 2
+	EXIT_DOWN     = 3
+	EXIT_DEGRADED = 4
+)
+
+const (
+	FORMAT_TABLE = "table"
+	FORMAT_JSON  = "json"
+	FORMAT_CSV   = "csv"
+)
+
+const QUERY_USAGE = `Usage: monitor query [flags] <command> [args]
+
+Commands:
+  servers                List servers
+  server <id>            Show one server
+  uptimes <id>           Show a server's uptime over time
+  statuses <id>          Show a server's recent checks
+  incidents <id>         Show a server's recent outages and degraded periods
+
+<id> is a server's GUID or name. Run monitor query <command> -h for each
+command's flags.
+
+servers and server exit with 3 if any server shown is down or hasn't been
+checked, 4 if any is degraded and otherwise 0. Errors exit with 1 and usage
+errors with 2.
+
+Flags:
+`
+
+// table is a command's output as rows of strings for the table and CSV
+// formats. The JSON format prints the API response as is.
+type table struct {
+	header []string
+	rows   [][]string
+}
+
+// Query runs monitor query with args, which exclude "query" itself, and
+// returns the exit code
+func Query(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("query", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, QUERY_USAGE)
+		flags.PrintDefaults()
+	}
+
+	base_url := flags.String("url", envOr("MONITOR_URL", client.DEFAULT_BASE_URL), "The monitor to query. Defaults to $MONITOR_URL if set.")
+	format := flags.String("format", FORMAT_TABLE, "Output format: table, json or csv")
+	timeout := flags.Duration("timeout", 30*time.Second, "How long to wait for the monitor, including retries")
+
+	if err := flags.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+
+	switch *format {
+	case FORMAT_TABLE, FORMAT_JSON, FORMAT_CSV:
+	default:
+		fmt.Fprintf(stderr, "Unknown format %q, must be table, json or csv\n", *format)
+		return EXIT_USAGE
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return EXIT_USAGE
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	q := query{client: client.New(*base_url), format: *format, stdout: stdout, stderr: stderr}
+	command, rest := flags.Arg(0), flags.Args()[1:]
+
+	switch command {
+	case "servers":
+		return q.servers(ctx, rest)
+	case "server":
+		return q.server(ctx, rest)
+	case "uptimes":
+		return q.uptimes(ctx, rest)
+	case "statuses":
+		return q.statuses(ctx, rest)
+	case "incidents":
+		return q.incidents(ctx, rest)
+	}
+
+	fmt.Fprintf(stderr, "Unknown command %q\n\n", command)
+	flags.Usage()
+
+	return EXIT_USAGE
+}
+
+type query struct {
+	client *client.Client
+	format string
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func envOr(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// parse parses a command's flags and returns its server ID, if it takes one.
+// The ID can come before or after the flags.
+func (q query) parse(flags *flag.FlagSet, args []string, takes_id bool) (string, bool) {
+	flags.SetOutput(q.stderr)
+
+	var id string
+
+	if takes_id && len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		id, args = args[0], args[1:]
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return "", false
+	}
+
+	if takes_id && id == "" && flags.NArg() > 0 {
+		id = flags.Arg(0)
+	}
+
+	if takes_id && id == "" {
+		fmt.Fprintf(q.stderr, "%s needs a server GUID or name\n", flags.Name())
+		return "", false
+	}
+
+	return id, true
+}
+
+// fail prints an error and returns EXIT_ERROR
+func (q query) fail(err error) int {
+	fmt.Fprintf(q.stderr, "Error: %s\n", err)
+
+	return EXIT_ERROR
+}
+
+// print writes the response in the chosen format
+func (q query) print(response any, t table) error {
+	switch q.format {
+	case FORMAT_JSON:
+		encoder := json.NewEncoder(q.stdout)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(response)
+	case FORMAT_CSV:
+		w := csv.NewWriter(q.stdout)
+		w.Write(t.header)
+		w.WriteAll(t.rows)
+
+		return w.Error()
+	}
+
+	w := tabwriter.NewWriter(q.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.ToUpper(strings.Join(t.header, "\t")))
+
+	for _, row := range t.rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+
+	return w.Flush()
+}
+
+// serverState is up, degraded, down or unknown for servers that haven't been
+// checked
+func serverState(status api.ServerAPIResponseStatus) string {
+	switch {
+	case !status.IsOnline.Valid:
+		return "unknown"
+	case !status.IsOnline.Bool:
+		return "down"
+	case status.IsDegraded:
+		return "degraded"
+	}
+
+	return "up"
+}
+
+// exitCode is the exit code for the worst state of the servers
+func exitCode(statuses ...api.ServerAPIResponseStatus) int {
+	code := EXIT_OK
+
+	for _, status := range statuses {
+		switch serverState(status) {
+		case "down", "unknown":
+			return EXIT_DOWN
+		case "degraded":
+			code = EXIT_DEGRADED
+		}
+	}
+
+	return code
+}
+
+func formatNullInt(value null.Int) string {
+	if !value.Valid {
+		return ""
+	}
+
+	return strconv.FormatInt(value.Int64, 10)
+}
+
+func formatUptime(value null.Float) string {
+	if !value.Valid {
+		return ""
+	}
+
+	return strconv.FormatFloat(value.Float64, 'f', 2, 64)
+}
+
+func (q query) servers(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("servers", flag.ContinueOnError)
+	emu := flags.String("emu", "", "Only list servers running this emulator")
+	server_type := flags.String("type", "", "Only list servers of this type")
+	online := flags.String("online", "", "Only list servers that are up (true) or down (false)")
+	search := flags.String("search", "", "Only list servers whose name or description contains this")
+	sort := flags.String("sort", "", "Sort by name, uptime, rtt, last_seen or an uptime window (24h, 7d, 30d, 90d or all)")
+
+	if _, ok := q.parse(flags, args, false); !ok {
+		return EXIT_USAGE
+	}
+
+	filter := api.ServerFilter{Emulator: *emu, Type: *server_type, Search: *search, Sort: *sort}
+
+	if *online != "" {
+		value, err := strconv.ParseBool(*online)
+
+		if err != nil {
+			fmt.Fprintf(q.stderr, "Invalid -online %q, must be true or false\n", *online)
+			return EXIT_USAGE
+		}
+
+		filter.Online = null.BoolFrom(value)
+	}
+
+	response, err := q.client.Servers(ctx, filter)
+
+	if err != nil {
+		return q.fail(err)
+	}
+
+	t := table{header: []string{"guid", "name", "status", "rtt", "uptime_24h", "uptime_7d", "uptime_30d", "last_seen"}}
+	var statuses []api.ServerAPIResponseStatus
+
+	for _, s := range response.Servers {
+		t.rows = append(t.rows, []string{
+			s.GUID,
+			s.Name,
+			serverState(s.Status),
+			formatNullInt(s.Status.RTT),
+			formatUptime(s.UptimeSummary.Day),
+			formatUptime(s.UptimeSummary.Week),
+			formatUptime(s.UptimeSummary.Month),
+			s.Status.LastSeen.String,
+		})
+
+		statuses = append(statuses, s.Status)
+	}
+
+	if err := q.print(response, t); err != nil {
+		return q.fail(err)
+	}
+
+	return exitCode(statuses...)
+}
+
+func (q query) server(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	id, ok := q.parse(flags, args, true)
+
+	if !ok {
+		return EXIT_USAGE
+	}
+
+	s, err := q.client.Server(ctx, id)
+
+	if err != nil {
+		return q.fail(err)
+	}
+
+	t := table{
+		header: []string{"guid", "name", "emu", "type", "address", "status", "rtt", "uptime_30d", "last_seen"},
+		rows: [][]string{{
+			s.GUID,
+			s.Name,
+			s.Emulator,
+			s.Type,
+			s.Address.Host + ":" + s.Address.Port,
+			serverState(s.Status),
+			formatNullInt(s.Status.RTT),
+			formatUptime(s.UptimeSummary.Month),
+			s.Status.LastSeen.String,
+		}},
+	}
+
+	if err := q.print(s, t); err != nil {
+		return q.fail(err)
+	}
+
+	return exitCode(s.Status)
+}
+
+// parseTime accepts the same formats as the API so they can be checked before
+// sending
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.DateOnly, value)
+}
+
+func (q query) uptimes(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("uptimes", flag.ContinueOnError)
+	from := flags.String("from", "", "Start of the range, as an RFC 3339 timestamp or YYYY-MM-DD date")
+	to := flags.String("to", "", "End of the range, as an RFC 3339 timestamp or YYYY-MM-DD date")
+	granularity := flags.String("granularity", "", "hour, day, week or month")
+	id, ok := q.parse(flags, args, true)
+
+	if !ok {
+		return EXIT_USAGE
+	}
+
+	options := client.RangeOptions{Granularity: *granularity}
+	var err error
+
+	if options.From, err = parseTime(*from); err != nil {
+		fmt.Fprintf(q.stderr, "Invalid -from %q\n", *from)
+		return EXIT_USAGE
+	}
+
+	if options.To, err = parseTime(*to); err != nil {
+		fmt.Fprintf(q.stderr, "Invalid -to %q\n", *to)
+		return EXIT_USAGE
+	}
+
+	response, err := q.client.Uptimes(ctx, id, options)
+
+	if err != nil {
+		return q.fail(err)
+	}
+
+	t := table{header: []string{"date", "uptime", "checks", "rtt_mean", "rtt_min", "rtt_max"}}
+
+	for _, u := range response.Uptimes {
+		t.rows = append(t.rows, []string{
+			u.Date,
+			strconv.FormatFloat(u.Uptime, 'f', 2, 64),
+			strconv.Itoa(u.N),
+			strconv.Itoa(u.RTT.Mean),
+			strconv.Itoa(u.RTT.Min),
+			strconv.Itoa(u.RTT.Max),
+		})
+	}
+
+	if err := q.print(response, t); err != nil {
+		return q.fail(err)
+	}
+
+	return EXIT_OK
+}
+
+func (q query) statuses(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("statuses", flag.ContinueOnError)
+	from := flags.String("from", "", "Only show checks at or after this RFC 3339 timestamp or YYYY-MM-DD date")
+	to := flags.String("to", "", "Only show checks before this RFC 3339 timestamp or YYYY-MM-DD date")
+	status := flags.String("status", "", "Only show checks that were up or down")
+	limit := flags.Int("limit", api.DEFAULT_STATUSES, fmt.Sprintf("How many checks to show, at most %d", api.MAX_STATUSES))
+	cursor := flags.String("cursor", "", "Show the checks before this cursor from a previous page")
+	id, ok := q.parse(flags, args, true)
+
+	if !ok {
+		return EXIT_USAGE
+	}
+
+	sq := api.StatusQuery{Status: *status, Limit: *limit}
+	var err error
+
+	if sq.From, err = parseTime(*from); err != nil {
+		fmt.Fprintf(q.stderr, "Invalid -from %q\n", *from)
+		return EXIT_USAGE
+	}
+
+	if sq.To, err = parseTime(*to); err != nil {
+		fmt.Fprintf(q.stderr, "Invalid -to %q\n", *to)
+		return EXIT_USAGE
+	}
+
+	if *cursor != "" {
+		before, err := api.ParseStatusCursor(*cursor)
+
+		if err != nil {
+			fmt.Fprintf(q.stderr, "Invalid -cursor %q\n", *cursor)
+			return EXIT_USAGE
+		}
+
+		sq.Before = &before
+	}
+
+	response, err := q.client.Statuses(ctx, id, sq)
+
+	if err != nil {
+		return q.fail(err)
+	}
+
+	t := table{header: []string{"checked_at", "status", "rtt", "message"}}
+
+	for _, s := range response.Statuses {
+		t.rows = append(t.rows, []string{s.CreatedAt, strings.ToLower(s.Status), strconv.Itoa(s.RTT), s.Message})
+	}
+
+	if err := q.print(response, t); err != nil {
+		return q.fail(err)
+	}
+
+	// JSON has the cursor in it already and CSV is likely being piped
+	if q.format == FORMAT_TABLE && response.NextCursor.Valid {
+		fmt.Fprintf(q.stderr, "More checks: -cursor %s\n", response.NextCursor.String)
+	}
+
+	return EXIT_OK
+}
+
+func (q query) incidents(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("incidents", flag.ContinueOnError)
+	limit := flags.Int("limit", 0, fmt.Sprintf("How many incidents to show, at most %d", api.MAX_INCIDENTS))
+	id, ok := q.parse(flags, args, true)
+
+	if !ok {
+		return EXIT_USAGE
+	}
+
+	response, err := q.client.Incidents(ctx, id, *limit)
+
+	if err != nil {
+		return q.fail(err)
+	}
+
+	t := table{header: []string{"kind", "started_at", "ended_at", "duration", "message"}}
+
+	for _, i := range response.Incidents {
+		t.rows = append(t.rows, []string{
+			i.Kind,
+			i.StartedAt,
+			i.EndedAt.String,
+			(time.Duration(i.Duration) * time.Second).String(),
+			i.Message,
+		})
+	}
+
+	if err := q.print(response, t); err != nil {
+		return q.fail(err)
+	}
+
+	return EXIT_OK
+}
@@ -0,0 +1,141 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"monitor/api"
+	"monitor/lib"
+	"monitor/routes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// NewTestMonitor serves the real v2 API from a database with Levistras, which
+// is up and has been checked three times, and Frostfell, which is down
+func NewTestMonitor(t *testing.T) (*sql.DB, string) {
+	now := time.Now().UTC()
+	db, _ := NewTestDatabase(t, now, now.Add(-time.Hour), now.Add(-2*time.Hour))
+
+	lib.UpdateServersTable(db, lib.ServerList{Servers: []lib.ServerListItem{
+		{ID: "levistras-guid", Name: "Levistras", Emu: "ACE", Type: "PvE"},
+		{ID: "frostfell-guid", Name: "Frostfell", Emu: "GDLE", Type: "PvP"},
+	}})
+
+	if _, err := db.Exec("UPDATE servers SET is_online = (id = 1)"); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	routes.V2{DB: db, SLOConfig: api.SLOConfig{Default: 99, WindowDays: 30}}.Register(mux)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return db, server.URL
+}
+
+func TestQueryServers(t *testing.T) {
+	_, url := NewTestMonitor(t)
+
+	code, out, _ := RunTestCommand(t, Query, "-url", url, "servers")
+
+	assert.Equal(t, EXIT_DOWN, code)
+	assert.True(t, strings.HasPrefix(out, "GUID "), out)
+	assert.Contains(t, out, "Frostfell")
+	assert.Contains(t, out, "Levistras")
+
+	code, out, _ = RunTestCommand(t, Query, "-url", url, "-format", "csv", "servers", "-online", "true")
+
+	assert.Equal(t, EXIT_OK, code)
+
+	rows, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"guid", "name", "status", "rtt", "uptime_24h", "uptime_7d", "uptime_30d", "last_seen"},
+		{"levistras-guid", "Levistras", "up", "40", "100.00", "100.00", "100.00", ""},
+	}, rows)
+}
+
+func TestQueryServer(t *testing.T) {
+	db, url := NewTestMonitor(t)
+
+	code, out, _ := RunTestCommand(t, Query, "-url", url, "-format", "json", "server", "levistras-guid")
+
+	var server api.ServerDetail
+
+	assert.Equal(t, EXIT_OK, code)
+	assert.NoError(t, json.Unmarshal([]byte(out), &server))
+	assert.Equal(t, "Levistras", server.Name)
+	assert.Equal(t, "ACE", server.Emulator)
+
+	code, _, _ = RunTestCommand(t, Query, "-url", url, "server", "Frostfell")
+	assert.Equal(t, EXIT_DOWN, code)
+
+	_, err := db.Exec(`INSERT INTO incidents (server_id, kind, started_at) VALUES (1, 'degraded', ?)`, time.Now().Unix())
+	assert.NoError(t, err)
+
+	code, _, _ = RunTestCommand(t, Query, "-url", url, "server", "Levistras")
+	assert.Equal(t, EXIT_DEGRADED, code)
+}
+
+func TestQueryStatuses(t *testing.T) {
+	_, url := NewTestMonitor(t)
+
+	code, out, errOut := RunTestCommand(t, Query, "-url", url, "statuses", "Levistras", "-limit", "2")
+
+	assert.Equal(t, EXIT_OK, code)
+	assert.Len(t, strings.Split(strings.TrimSpace(out), "\n"), 3)
+	assert.Contains(t, errOut, "More checks: -cursor ")
+
+	cursor := strings.TrimSpace(strings.TrimPrefix(errOut, "More checks: -cursor "))
+	code, out, errOut = RunTestCommand(t, Query, "-url", url, "statuses", "-cursor", cursor, "-limit", "2", "Levistras")
+
+	assert.Equal(t, EXIT_OK, code)
+	assert.Len(t, strings.Split(strings.TrimSpace(out), "\n"), 2)
+	assert.Empty(t, errOut)
+}
+
+func TestQueryUptimesAndIncidents(t *testing.T) {
+	_, url := NewTestMonitor(t)
+
+	code, out, _ := RunTestCommand(t, Query, "-url", url, "-format", "csv", "uptimes", "Levistras", "-granularity", "week")
+
+	assert.Equal(t, EXIT_OK, code)
+	assert.True(t, strings.HasPrefix(out, "date,uptime,checks,rtt_mean,rtt_min,rtt_max\n"), out)
+
+	code, out, _ = RunTestCommand(t, Query, "-url", url, "incidents", "Levistras")
+
+	assert.Equal(t, EXIT_OK, code)
+	assert.Equal(t, "KIND  STARTED_AT  ENDED_AT  DURATION  MESSAGE\n", out)
+}
+
+func TestQueryErrors(t *testing.T) {
+	_, url := NewTestMonitor(t)
+
+	cases := []struct {
+		args []string
+		code int
+	}{
+		{[]string{"-url", url}, EXIT_USAGE},
+		{[]string{"-url", url, "players"}, EXIT_USAGE},
+		{[]string{"-url", url, "-format", "xml", "servers"}, EXIT_USAGE},
+		{[]string{"-url", url, "server"}, EXIT_USAGE},
+		{[]string{"-url", url, "statuses", "Levistras", "-from", "yesterday"}, EXIT_USAGE},
+		{[]string{"-url", url, "server", "Nowhere"}, EXIT_ERROR},
+		{[]string{"-url", url, "servers", "-sort", "players"}, EXIT_ERROR},
+	}
+
+	for _, c := range cases {
+		code, _, errOut := RunTestCommand(t, Query, c.args...)
+
+		assert.Equal(t, c.code, code, c.args)
+		assert.NotEmpty(t, errOut, c.args)
+	}
+}
@@ -0,0 +1,271 @@
+// Package client is a typed client for a monitor's v2 API. Responses are
+// decoded into the same types the api package serves them from.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"monitor/api"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DEFAULT_BASE_URL is the public monitor
+const DEFAULT_BASE_URL = "https://servers.treestats.net"
+
+// How many times requests are retried by default and how long to wait before
+// the first retry. The wait doubles after each retry.
+const (
+	DEFAULT_RETRIES = 3
+	DEFAULT_BACKOFF = 500 * time.Millisecond
+)
+
+var (
+	ErrBadRequest = errors.New("bad request")
+	ErrNotFound   = errors.New("not found")
+	ErrServer     = errors.New("server error")
+)
+
+// Error is an error response from the API. It matches ErrBadRequest,
+// ErrNotFound or ErrServer with errors.Is.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("monitor API returned HTTP %d", e.StatusCode)
+	}
+
+	return fmt.Sprintf("monitor API returned HTTP %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrServer:
+		return e.StatusCode >= 500
+	}
+
+	return false
+}
+
+// Client talks to a monitor's API. The zero value isn't usable, use New.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	UserAgent  string
+	Retries    int
+	Backoff    time.Duration
+}
+
+// New returns a client for the monitor at baseURL, e.g., DEFAULT_BASE_URL
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		UserAgent:  "ac-server-monitor-client",
+		Retries:    DEFAULT_RETRIES,
+		Backoff:    DEFAULT_BACKOFF,
+	}
+}
+
+// RangeOptions selects the range and granularity of uptimes. Zero values are
+// left to the API's defaults.
+type RangeOptions struct {
+	From        time.Time
+	To          time.Time
+	Granularity string
+}
+
+func (o RangeOptions) values() url.Values {
+	values := url.Values{}
+
+	if !o.From.IsZero() {
+		values.Set("from", o.From.UTC().Format(time.RFC3339))
+	}
+
+	if !o.To.IsZero() {
+		values.Set("to", o.To.UTC().Format(time.RFC3339))
+	}
+
+	if o.Granularity != "" {
+		values.Set("granularity", o.Granularity)
+	}
+
+	return values
+}
+
+// Servers lists the servers that match filter
+func (c *Client) Servers(ctx context.Context, filter api.ServerFilter) (api.ServerAPIResponse, error) {
+	var response api.ServerAPIResponse
+
+	return response, c.get(ctx, "/api/v2/servers", filter.Values(), &response)
+}
+
+// Server gets one server by GUID or name
+func (c *Client) Server(ctx context.Context, id string) (api.ServerDetail, error) {
+	var response api.ServerDetail
+
+	return response, c.get(ctx, serverPath(id, ""), nil, &response)
+}
+
+// Uptimes gets a server's uptime over time
+func (c *Client) Uptimes(ctx context.Context, id string, options RangeOptions) (api.UptimeResult, error) {
+	var response api.UptimeResult
+
+	return response, c.get(ctx, serverPath(id, "/uptimes"), options.values(), &response)
+}
+
+// Statuses gets a page of a server's checks, newest first. Use
+// NextStatusQuery to get the page after.
+func (c *Client) Statuses(ctx context.Context, id string, q api.StatusQuery) (api.StatusApiResponse, error) {
+	var response api.StatusApiResponse
+
+	return response, c.get(ctx, serverPath(id, "/statuses"), q.Values(), &response)
+}
+
+// NextStatusQuery returns the query for the page after page, or false if page
+// was the last one
+func NextStatusQuery(q api.StatusQuery, page api.StatusApiResponse) (api.StatusQuery, bool, error) {
+	if !page.NextCursor.Valid {
+		return q, false, nil
+	}
+
+	cursor, err := api.ParseStatusCursor(page.NextCursor.String)
+
+	if err != nil {
+		return q, false, err
+	}
+
+	q.Before = &cursor
+
+	return q, true, nil
+}
+
+// Incidents gets up to limit of a server's most recent incidents, or the
+// API's default number if limit is zero
+func (c *Client) Incidents(ctx context.Context, id string, limit int) (api.IncidentApiResponse, error) {
+	var response api.IncidentApiResponse
+	values := url.Values{}
+
+	if limit > 0 {
+		values.Set("limit", strconv.Itoa(limit))
+	}
+
+	return response, c.get(ctx, serverPath(id, "/incidents"), values, &response)
+}
+
+func serverPath(id string, suffix string) string {
+	return "/api/v2/servers/" + url.PathEscape(id) + suffix
+}
+
+// retryable is whether a response is worth trying again
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// get fetches path and decodes the JSON response into v, retrying failed
+// connections and temporary errors with exponential backoff
+func (c *Client) get(ctx context.Context, path string, values url.Values, v any) error {
+	target := c.BaseURL + path
+
+	if len(values) > 0 {
+		target += "?" + values.Encode()
+	}
+
+	wait := c.Backoff
+
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := c.do(ctx, target, v)
+
+		if err == nil || attempt >= c.Retries || retryAfter < 0 {
+			return err
+		}
+
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		wait *= 2
+	}
+}
+
+// do makes one request. On failure, it also returns how long the server asked
+// to wait before retrying, zero if it didn't say, or -1 if retrying won't help.
+func (c *Client) do(ctx context.Context, target string, v any) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+
+	if err != nil {
+		return -1, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", c.UserAgent)
+
+	res, err := c.HTTPClient.Do(req)
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+
+		return 0, err
+	}
+
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		apiErr := &Error{StatusCode: res.StatusCode}
+
+		var envelope struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+
+		if json.Unmarshal(body, &envelope) == nil {
+			apiErr.Code = envelope.Error.Code
+			apiErr.Message = envelope.Error.Message
+		}
+
+		if !retryable(res.StatusCode) {
+			return -1, apiErr
+		}
+
+		seconds, _ := strconv.Atoi(res.Header.Get("Retry-After"))
+
+		return time.Duration(seconds) * time.Second, apiErr
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return -1, fmt.Errorf("couldn't decode response from %s: %w", target, err)
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,192 @@
+package client
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"monitor/api"
+	"monitor/lib"
+	"monitor/routes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// NewTestServer serves the real v2 API from a database with one server,
+// Levistras, which has been checked five times
+func NewTestServer(t *testing.T) (*Client, *httptest.Server) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "monitor.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	if err := lib.AutoMigrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	lib.UpdateServersTable(db, lib.ServerList{Servers: []lib.ServerListItem{
+		{ID: "levistras-guid", Name: "Levistras", Emu: "ACE", Type: "PvE"},
+	}})
+
+	now := time.Now().UTC()
+
+	for i := range 5 {
+		_, err := db.Exec("INSERT INTO statuses (server_id, created_at, status, rtt, message) VALUES (1, ?, ?, 40, '')", now.Add(-time.Duration(i)*time.Hour).Unix(), i != 1)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	routes.V2{DB: db, SLOConfig: api.SLOConfig{Default: 99, WindowDays: 30}}.Register(mux)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	c := New(server.URL)
+	c.Backoff = time.Millisecond
+
+	return c, server
+}
+
+func TestClient(t *testing.T) {
+	c, _ := NewTestServer(t)
+	ctx := context.Background()
+
+	servers, err := c.Servers(ctx, api.ServerFilter{Emulator: "ACE"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, servers.Count)
+	assert.Equal(t, "levistras-guid", servers.Servers[0].GUID)
+
+	server, err := c.Server(ctx, "Levistras")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "levistras-guid", server.GUID)
+	assert.Equal(t, "PvE", server.Type)
+
+	uptimes, err := c.Uptimes(ctx, "levistras-guid", RangeOptions{From: time.Now().Add(-24 * time.Hour), Granularity: api.GRANULARITY_HOUR})
+
+	assert.NoError(t, err)
+	assert.Equal(t, api.GRANULARITY_HOUR, uptimes.Granularity)
+	assert.NotEmpty(t, uptimes.Uptimes)
+
+	incidents, err := c.Incidents(ctx, "levistras-guid", 10)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "Levistras", incidents.ServerName)
+}
+
+func TestClientPagesStatuses(t *testing.T) {
+	c, _ := NewTestServer(t)
+	ctx := context.Background()
+
+	q := api.StatusQuery{Limit: 2}
+	var statuses []api.StatusApiStatusItem
+
+	for {
+		page, err := c.Statuses(ctx, "levistras-guid", q)
+
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		statuses = append(statuses, page.Statuses...)
+
+		next, more, err := NextStatusQuery(q, page)
+
+		assert.NoError(t, err)
+
+		if !more {
+			break
+		}
+
+		q = next
+	}
+
+	assert.Len(t, statuses, 5)
+	assert.Equal(t, "DOWN", statuses[1].Status)
+
+	failures, err := c.Statuses(ctx, "levistras-guid", api.StatusQuery{Status: "down"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, failures.Count)
+}
+
+func TestClientErrors(t *testing.T) {
+	c, _ := NewTestServer(t)
+	ctx := context.Background()
+
+	_, err := c.Server(ctx, "Nowhere")
+
+	var apiErr *Error
+
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, "not_found", apiErr.Code)
+
+	_, err = c.Incidents(ctx, "Levistras", 100000)
+
+	assert.True(t, errors.Is(err, ErrBadRequest))
+	assert.False(t, errors.Is(err, ErrNotFound))
+}
+
+func TestClientRetries(t *testing.T) {
+	var requests atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte(`{"server": "Levistras", "count": 0, "incidents": []}`))
+	}))
+
+	defer server.Close()
+
+	c := New(server.URL)
+	c.Backoff = time.Millisecond
+
+	incidents, err := c.Incidents(context.Background(), "Levistras", 0)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "Levistras", incidents.ServerName)
+	assert.Equal(t, int32(3), requests.Load())
+
+	// Giving up returns the last error
+	requests.Store(0)
+	c.Retries = 1
+
+	_, err = c.Incidents(context.Background(), "Levistras", 0)
+
+	assert.True(t, errors.Is(err, ErrServer))
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestClientStopsRetryingWhenCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := New(server.URL).Servers(ctx, api.ServerFilter{})
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
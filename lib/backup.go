@@ -0,0 +1,427 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backups are snapshots of the database made with VACUUM INTO, which copies
+// from a single read transaction, so they're consistent even while checks are
+// being written. Each is named for when it was made, e.g.,
+// monitor-20240101T000000Z.db, and has a sha256sum-style checksum file next
+// to it.
+const (
+	BACKUP_PREFIX      = "monitor-"
+	BACKUP_EXT         = ".db"
+	BACKUP_TIME_FORMAT = "20060102T150405Z"
+	CHECKSUM_EXT       = ".sha256"
+)
+
+const (
+	DEFAULT_BACKUP_KEEP     = 7
+	DEFAULT_BACKUP_SCHEDULE = "@daily"
+)
+
+var ErrNoBackups = errors.New("no backups")
+
+// BackupConfig says where and how often to back up the database
+type BackupConfig struct {
+	Dir string
+	// How many backups to keep, deleting the oldest first
+	Keep int
+	// A cron spec for scheduled backups
+	Schedule string
+	// Authenticates downloads of the latest backup, which are disabled when
+	// this is empty
+	Token string
+}
+
+// Backup is a snapshot of the database on disk
+type Backup struct {
+	Path      string
+	CreatedAt time.Time
+	Size      int64
+	// Hex-encoded, or empty if the checksum file is missing
+	SHA256 string
+}
+
+// BackupConfigFromEnv configures backups from BACKUP_DIR, BACKUP_KEEP,
+// BACKUP_SCHEDULE and BACKUP_TOKEN, returning nil if BACKUP_DIR isn't set
+func BackupConfigFromEnv() (*BackupConfig, error) {
+	dir := Env("BACKUP_DIR", "")
+
+	if dir == "" {
+		return nil, nil
+	}
+
+	keep, err := strconv.Atoi(Env("BACKUP_KEEP", strconv.Itoa(DEFAULT_BACKUP_KEEP)))
+
+	if err != nil || keep < 1 {
+		return nil, fmt.Errorf("invalid BACKUP_KEEP, must be a number of backups of at least 1")
+	}
+
+	return &BackupConfig{
+		Dir:      dir,
+		Keep:     keep,
+		Schedule: Env("BACKUP_SCHEDULE", DEFAULT_BACKUP_SCHEDULE),
+		Token:    Env("BACKUP_TOKEN", ""),
+	}, nil
+}
+
+// Snapshot writes a consistent copy of db to path, which mustn't exist. The
+// copy is made next to path first so path only ever holds a whole snapshot.
+func Snapshot(ctx context.Context, db *sql.DB, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+
+	tmp := path + ".tmp"
+
+	// VACUUM INTO refuses to overwrite anything, e.g., a previous failed attempt
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, "VACUUM INTO ?", tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("couldn't snapshot database: %w", err)
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// fileSHA256 returns the hex-encoded SHA-256 of a file and its size
+func fileSHA256(path string) (string, int64, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// readChecksum reads a backup's checksum file, which is in the format
+// sha256sum -c expects
+func readChecksum(path string) (string, error) {
+	data, err := os.ReadFile(path + CHECKSUM_EXT)
+
+	if err != nil {
+		return "", err
+	}
+
+	sum, _, _ := strings.Cut(strings.TrimSpace(string(data)), " ")
+
+	return sum, nil
+}
+
+func writeChecksum(path string, sum string) error {
+	return os.WriteFile(path+CHECKSUM_EXT, []byte(fmt.Sprintf("%s  %s\n", sum, filepath.Base(path))), 0644)
+}
+
+// CreateBackup snapshots db into dir and writes its checksum
+func CreateBackup(ctx context.Context, db *sql.DB, dir string, now time.Time) (Backup, error) {
+	backup := Backup{CreatedAt: now.UTC().Truncate(time.Second)}
+	backup.Path = filepath.Join(dir, BACKUP_PREFIX+backup.CreatedAt.Format(BACKUP_TIME_FORMAT)+BACKUP_EXT)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return backup, err
+	}
+
+	if err := Snapshot(ctx, db, backup.Path); err != nil {
+		return backup, err
+	}
+
+	sum, size, err := fileSHA256(backup.Path)
+
+	if err != nil {
+		return backup, err
+	}
+
+	backup.SHA256 = sum
+	backup.Size = size
+
+	return backup, writeChecksum(backup.Path, sum)
+}
+
+// ListBackups returns the backups in dir, oldest first. Files that aren't
+// named like backups are ignored.
+func ListBackups(dir string) ([]Backup, error) {
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []Backup
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		if entry.IsDir() || !strings.HasPrefix(name, BACKUP_PREFIX) || !strings.HasSuffix(name, BACKUP_EXT) {
+			continue
+		}
+
+		created_at, err := time.Parse(BACKUP_TIME_FORMAT, strings.TrimSuffix(strings.TrimPrefix(name, BACKUP_PREFIX), BACKUP_EXT))
+
+		if err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+
+		if err != nil {
+			return nil, err
+		}
+
+		backup := Backup{Path: filepath.Join(dir, name), CreatedAt: created_at, Size: info.Size()}
+		backup.SHA256, _ = readChecksum(backup.Path)
+
+		backups = append(backups, backup)
+	}
+
+	slices.SortFunc(backups, func(a Backup, b Backup) int { return a.CreatedAt.Compare(b.CreatedAt) })
+
+	return backups, nil
+}
+
+// LatestBackup returns the newest backup in dir or ErrNoBackups
+func LatestBackup(dir string) (Backup, error) {
+	backups, err := ListBackups(dir)
+
+	if errors.Is(err, os.ErrNotExist) || (err == nil && len(backups) == 0) {
+		return Backup{}, ErrNoBackups
+	}
+
+	if err != nil {
+		return Backup{}, err
+	}
+
+	return backups[len(backups)-1], nil
+}
+
+// RotateBackups deletes all but the newest keep backups in dir and returns
+// the ones it deleted
+func RotateBackups(dir string, keep int) ([]Backup, error) {
+	backups, err := ListBackups(dir)
+
+	if err != nil || len(backups) <= keep {
+		return nil, err
+	}
+
+	removed := backups[:len(backups)-keep]
+
+	for _, backup := range removed {
+		if err := os.Remove(backup.Path); err != nil {
+			return nil, err
+		}
+
+		if err := os.Remove(backup.Path + CHECKSUM_EXT); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	return removed, nil
+}
+
+// RunBackup makes a backup as configured and rotates out old ones
+func RunBackup(ctx context.Context, db *sql.DB, config *BackupConfig, now time.Time) (Backup, error) {
+	backup, err := CreateBackup(ctx, db, config.Dir, now)
+
+	if err != nil {
+		return backup, err
+	}
+
+	lastBackup.Set(float64(backup.CreatedAt.Unix()))
+
+	removed, err := RotateBackups(config.Dir, config.Keep)
+
+	for _, old := range removed {
+		log.Printf("Deleted old backup %s", old.Path)
+	}
+
+	return backup, err
+}
+
+// VerifyBackup checks a backup against its checksum and that SQLite finds
+// nothing wrong with it
+func VerifyBackup(ctx context.Context, path string) error {
+	want, err := readChecksum(path)
+
+	if err != nil {
+		return fmt.Errorf("couldn't read checksum: %w", err)
+	}
+
+	got, _, err := fileSHA256(path)
+
+	if err != nil {
+		return err
+	}
+
+	if got != want {
+		return fmt.Errorf("%s has SHA-256 %s but its checksum file says %s", path, got, want)
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	var result string
+
+	if err := db.QueryRowContext(ctx, "PRAGMA integrity_check").Scan(&result); err != nil {
+		return fmt.Errorf("couldn't check %s: %w", path, err)
+	}
+
+	if result != "ok" {
+		return fmt.Errorf("%s failed SQLite's integrity check: %s", path, result)
+	}
+
+	return nil
+}
+
+// The database a restore replaces is kept with this suffix
+const BEFORE_RESTORE_EXT = ".before-restore"
+
+// RestoreBackup verifies a backup and copies it to dest. Whatever was at dest,
+// and its journal files, are kept alongside it with a .before-restore suffix,
+// so restoring is refused if an earlier restore's copy is still there. The
+// monitor mustn't be running while restoring.
+func RestoreBackup(ctx context.Context, path string, dest string) error {
+	kept := dest + BEFORE_RESTORE_EXT
+
+	// The database and the journal files SQLite keeps next to it
+	suffixes := []string{"", "-journal", "-wal", "-shm"}
+
+	for _, suffix := range suffixes {
+		if _, err := os.Stat(kept + suffix); err == nil {
+			return fmt.Errorf("%s is left over from an earlier restore, move it somewhere else first", kept+suffix)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	if err := VerifyBackup(ctx, path); err != nil {
+		return err
+	}
+
+	src, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer src.Close()
+
+	tmp := dest + ".restoring"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp)
+
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// Journal files go with the database they belong to so they can't be
+	// replayed into the restored one
+	for _, suffix := range suffixes {
+		if err := os.Rename(dest+suffix, kept+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return os.Rename(tmp, dest)
+}
+
+// BackupHandler serves the latest backup to requests with the configured token
+// as a bearer token. It's disabled if backups or the token aren't configured.
+func BackupHandler(config *BackupConfig) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config == nil || config.Token == "" {
+			http.Error(w, "Backup downloads aren't configured", http.StatusNotFound)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="backups"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		backup, err := LatestBackup(config.Dir)
+
+		if errors.Is(err, ErrNoBackups) {
+			http.Error(w, "No backups yet", http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			log.Printf("Failed to find latest backup: %s", err)
+			http.Error(w, "Couldn't find latest backup", http.StatusInternalServerError)
+			return
+		}
+
+		f, err := os.Open(backup.Path)
+
+		if err != nil {
+			// It may have just been rotated out
+			log.Printf("Failed to open latest backup: %s", err)
+			http.Error(w, "Couldn't open latest backup", http.StatusInternalServerError)
+			return
+		}
+
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "application/vnd.sqlite3")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(backup.Path)))
+		w.Header().Set("Cache-Control", "no-store")
+
+		if backup.SHA256 != "" {
+			w.Header().Set("X-Checksum-SHA256", backup.SHA256)
+		}
+
+		http.ServeContent(w, r, "", backup.CreatedAt, f)
+	}
+}
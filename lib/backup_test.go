@@ -0,0 +1,179 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func CountTestStatuses(t *testing.T, path string) int {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	var n int
+
+	if err := db.QueryRow("SELECT COUNT(*) FROM statuses").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+func TestCreateBackup(t *testing.T) {
+	db := OpenTestDB(t)
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	InsertTestStatus(t, db, 1, 100, true, 40)
+
+	backup, err := CreateBackup(ctx, db, dir, time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC))
+
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "monitor-20240101T030000Z.db"), backup.Path)
+	assert.Len(t, backup.SHA256, 64)
+	assert.NoError(t, VerifyBackup(ctx, backup.Path))
+	assert.Equal(t, 1, CountTestStatuses(t, backup.Path))
+
+	checksum, err := os.ReadFile(backup.Path + CHECKSUM_EXT)
+
+	assert.NoError(t, err)
+	assert.Equal(t, backup.SHA256+"  monitor-20240101T030000Z.db\n", string(checksum))
+
+	// Backups are never overwritten
+	_, err = CreateBackup(ctx, db, dir, time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC))
+	assert.Error(t, err)
+
+	// Corrupt backups fail verification
+	assert.NoError(t, os.WriteFile(backup.Path, []byte("not a database"), 0644))
+	assert.Error(t, VerifyBackup(ctx, backup.Path))
+}
+
+func TestRunBackupRotates(t *testing.T) {
+	db := OpenTestDB(t)
+	config := &BackupConfig{Dir: t.TempDir(), Keep: 2}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for day := range 4 {
+		_, err := RunBackup(context.Background(), db, config, start.AddDate(0, 0, day))
+		assert.NoError(t, err)
+	}
+
+	// Stray files are left alone
+	assert.NoError(t, os.WriteFile(filepath.Join(config.Dir, "notes.txt"), nil, 0644))
+
+	backups, err := ListBackups(config.Dir)
+
+	assert.NoError(t, err)
+	assert.Len(t, backups, 2)
+	assert.Equal(t, start.AddDate(0, 0, 2), backups[0].CreatedAt)
+
+	entries, _ := os.ReadDir(config.Dir)
+	assert.Len(t, entries, 5)
+
+	latest, err := LatestBackup(config.Dir)
+
+	assert.NoError(t, err)
+	assert.Equal(t, start.AddDate(0, 0, 3), latest.CreatedAt)
+
+	_, err = LatestBackup(t.TempDir())
+	assert.ErrorIs(t, err, ErrNoBackups)
+}
+
+func TestRestoreBackup(t *testing.T) {
+	db := OpenTestDB(t)
+	ctx := context.Background()
+
+	InsertTestStatus(t, db, 1, 100, true, 40)
+
+	backup, err := CreateBackup(ctx, db, t.TempDir(), time.Now())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "monitor.db")
+	assert.NoError(t, os.WriteFile(dest, []byte("the old database"), 0644))
+	assert.NoError(t, os.WriteFile(dest+"-journal", []byte("the old journal"), 0644))
+
+	assert.NoError(t, RestoreBackup(ctx, backup.Path, dest))
+	assert.Equal(t, 1, CountTestStatuses(t, dest))
+
+	// The old database is kept with its journal
+	old, err := os.ReadFile(dest + BEFORE_RESTORE_EXT)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "the old database", string(old))
+
+	old, err = os.ReadFile(dest + BEFORE_RESTORE_EXT + "-journal")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "the old journal", string(old))
+	assert.NoFileExists(t, dest+"-journal")
+
+	// Restoring again would replace the kept database so it's refused
+	err = RestoreBackup(ctx, backup.Path, dest)
+
+	assert.ErrorContains(t, err, BEFORE_RESTORE_EXT)
+
+	old, err = os.ReadFile(dest + BEFORE_RESTORE_EXT)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "the old database", string(old))
+	assert.Equal(t, 1, CountTestStatuses(t, dest))
+
+	assert.NoError(t, os.Remove(dest+BEFORE_RESTORE_EXT))
+	assert.NoError(t, os.Remove(dest+BEFORE_RESTORE_EXT+"-journal"))
+
+	// Backups without a checksum aren't restored
+	os.Remove(backup.Path + CHECKSUM_EXT)
+	assert.Error(t, RestoreBackup(ctx, backup.Path, dest))
+}
+
+func TestBackupHandler(t *testing.T) {
+	db := OpenTestDB(t)
+	config := &BackupConfig{Dir: t.TempDir(), Keep: 1, Token: "secret"}
+
+	get := func(config *BackupConfig, authorization string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/backups/latest", nil)
+
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		BackupHandler(config)(res, req)
+
+		return res
+	}
+
+	assert.Equal(t, http.StatusNotFound, get(nil, "Bearer secret").Code)
+	assert.Equal(t, http.StatusNotFound, get(&BackupConfig{Dir: config.Dir}, "Bearer ").Code)
+	assert.Equal(t, http.StatusUnauthorized, get(config, "").Code)
+	assert.Equal(t, http.StatusUnauthorized, get(config, "Bearer wrong").Code)
+	assert.Equal(t, http.StatusNotFound, get(config, "Bearer secret").Code)
+
+	backup, err := RunBackup(context.Background(), db, config, time.Now())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := get(config, "Bearer secret")
+	data, _ := os.ReadFile(backup.Path)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, backup.SHA256, res.Header().Get("X-Checksum-SHA256"))
+	assert.Equal(t, data, res.Body.Bytes())
+}
@@ -0,0 +1,204 @@
+package lib
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// DegradationConfig controls when a server that's up is considered degraded,
+// i.e., its recent RTT has risen well above its usual RTT
+type DegradationConfig struct {
+	// How many times the baseline the recent RTT has to be
+	Threshold float64
+	// How much higher than the baseline, in ms, the recent RTT has to be so
+	// small absolute changes on fast servers are ignored
+	MinDelta int64
+	// How far back counts as recent
+	Recent time.Duration
+	// How far back, before Recent, the baseline is calculated over
+	Baseline time.Duration
+	// How many successful checks each window needs before comparing them
+	MinRecentSamples   int
+	MinBaselineSamples int
+}
+
+// Degradation is the result of comparing a server's recent RTT to its
+// baseline. RTTs are medians in ms and zero when there weren't enough samples.
+type Degradation struct {
+	Degraded bool
+	Recent   int64
+	Baseline int64
+}
+
+// DEFAULT_DEGRADATION flags a server whose median RTT over the last hour has
+// at least doubled, and risen by at least 100 ms, compared to the week before
+var DEFAULT_DEGRADATION = DegradationConfig{
+	Threshold:          2,
+	MinDelta:           100,
+	Recent:             time.Hour,
+	Baseline:           7 * 24 * time.Hour,
+	MinRecentSamples:   3,
+	MinBaselineSamples: 24,
+}
+
+func envFloat(key string, defaultValue float64) (float64, error) {
+	value := Env(key, "")
+
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf("%s must be a positive number, not %q", key, value)
+	}
+
+	return parsed, nil
+}
+
+func envInt(key string, defaultValue int64) (int64, error) {
+	value := Env(key, "")
+
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	parsed, err := strconv.ParseInt(value, 10, 64)
+
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf("%s must be a positive whole number, not %q", key, value)
+	}
+
+	return parsed, nil
+}
+
+func envDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	value := Env(key, "")
+
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	parsed, err := time.ParseDuration(value)
+
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration, e.g., 1h, not %q", key, value)
+	}
+
+	return parsed, nil
+}
+
+// DegradationConfigFromEnv reads the detector's settings from the
+// environment, falling back to DEFAULT_DEGRADATION for any that aren't set
+func DegradationConfigFromEnv() (DegradationConfig, error) {
+	cfg := DEFAULT_DEGRADATION
+
+	var err error
+
+	if cfg.Threshold, err = envFloat("DEGRADED_THRESHOLD", cfg.Threshold); err != nil {
+		return cfg, err
+	}
+
+	if cfg.MinDelta, err = envInt("DEGRADED_MIN_DELTA_MS", cfg.MinDelta); err != nil {
+		return cfg, err
+	}
+
+	if cfg.Recent, err = envDuration("DEGRADED_RECENT_WINDOW", cfg.Recent); err != nil {
+		return cfg, err
+	}
+
+	if cfg.Baseline, err = envDuration("DEGRADED_BASELINE_WINDOW", cfg.Baseline); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// medianRTT returns the median RTT of successful checks in [from, to) and how
+// many checks it was calculated from
+func medianRTT(tx *sql.Tx, server_id int, from int64, to int64) (int64, int, error) {
+	var n int
+
+	err := tx.QueryRow(`
+		SELECT COUNT(*)
+		FROM statuses
+		WHERE server_id = ? AND created_at >= ? AND created_at < ? AND status = 1 AND rtt IS NOT NULL
+	`, server_id, from, to).Scan(&n)
+
+	if err != nil || n == 0 {
+		return 0, n, err
+	}
+
+	var median int64
+
+	err = tx.QueryRow(`
+		SELECT rtt
+		FROM statuses
+		WHERE server_id = ? AND created_at >= ? AND created_at < ? AND status = 1 AND rtt IS NOT NULL
+		ORDER BY rtt
+		LIMIT 1 OFFSET ?
+	`, server_id, from, to, n/2).Scan(&median)
+
+	return median, n, err
+}
+
+// DetectDegradation compares the median RTT of a server's recent successful
+// checks against the median over its rolling baseline window
+func DetectDegradation(tx *sql.Tx, server_id int, now int64, cfg DegradationConfig) (Degradation, error) {
+	var result Degradation
+
+	recentStart := now - int64(cfg.Recent.Seconds())
+	baselineStart := recentStart - int64(cfg.Baseline.Seconds())
+
+	recent, nRecent, err := medianRTT(tx, server_id, recentStart, now+1)
+
+	if err != nil {
+		return result, err
+	}
+
+	baseline, nBaseline, err := medianRTT(tx, server_id, baselineStart, recentStart)
+
+	if err != nil {
+		return result, err
+	}
+
+	if nRecent < cfg.MinRecentSamples || nBaseline < cfg.MinBaselineSamples {
+		return result, nil
+	}
+
+	result.Recent = recent
+	result.Baseline = baseline
+	result.Degraded = float64(recent) >= float64(baseline)*cfg.Threshold && recent-baseline >= cfg.MinDelta
+
+	return result, nil
+}
+
+// UpdateDegradedIncident runs the detector for a server and starts or ends its
+// degraded incident accordingly
+func UpdateDegradedIncident(tx *sql.Tx, server_id int, name string, now int64, cfg DegradationConfig) error {
+	degradation, err := DetectDegradation(tx, server_id, now, cfg)
+
+	if err != nil {
+		return err
+	}
+
+	if degradation.Degraded {
+		message := fmt.Sprintf("Median RTT over the last %s was %d ms compared to a baseline of %d ms.", cfg.Recent, degradation.Recent, degradation.Baseline)
+
+		started, err := StartIncident(tx, server_id, INCIDENT_DEGRADED, now, message)
+
+		if started {
+			log.Printf("Server %s is degraded. %s", name, message)
+		}
+
+		return err
+	}
+
+	_, err = EndIncident(tx, server_id, INCIDENT_DEGRADED, now)
+
+	return err
+}
@@ -0,0 +1,340 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Embed colors for each kind of event
+var discordColors = map[string]int{
+	EVENT_DOWN:     0xd81919,
+	EVENT_UP:       0x12a855,
+	EVENT_DELISTED: 0x888888,
+	EVENT_RELISTED: 0x0000c8,
+	EVENT_METADATA: 0xe0a000,
+}
+
+// Discord allows at most 10 embeds per message
+const discordMaxEmbeds = 10
+
+// Discord rejects embeds with descriptions longer than this many characters
+const discordMaxDescription = 4096
+
+// Discord limits each webhook to about five requests every two seconds so
+// space requests out at least this much
+const discordMinInterval = 400 * time.Millisecond
+
+// How many times to wait out a 429 before giving up on a request
+const discordMaxRateLimitRetries = 3
+
+// DiscordNotifier posts events as embeds to a Discord webhook. If Servers is
+// non-empty, only events for servers with those names (case-insensitively)
+// are posted.
+type DiscordNotifier struct {
+	URL     string
+	Servers map[string]bool
+	BaseURL string
+	Client  *http.Client
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+type DiscordMessage struct {
+	Username string         `json:"username,omitempty"`
+	Content  string         `json:"content,omitempty"`
+	Embeds   []DiscordEmbed `json:"embeds,omitempty"`
+}
+
+type DiscordEmbed struct {
+	Title       string              `json:"title"`
+	Description string              `json:"description,omitempty"`
+	URL         string              `json:"url,omitempty"`
+	Color       int                 `json:"color"`
+	Timestamp   string              `json:"timestamp,omitempty"`
+	Fields      []DiscordEmbedField `json:"fields,omitempty"`
+}
+
+type DiscordEmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+func NewDiscordNotifier(webhookURL string, servers []string, baseURL string) *DiscordNotifier {
+	filter := map[string]bool{}
+
+	for _, s := range servers {
+		if s = strings.TrimSpace(s); s != "" {
+			filter[strings.ToLower(s)] = true
+		}
+	}
+
+	return &DiscordNotifier{
+		URL:     webhookURL,
+		Servers: filter,
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// ParseDiscordWebhooks parses DISCORD_WEBHOOKS, which is a list of webhook
+// URLs separated by semicolons or newlines. Each URL can be followed by a | and
+// a comma-separated list of server names to only post about those servers,
+// e.g., "https://discord.com/api/webhooks/1/a|Levistras,Frostfell".
+func ParseDiscordWebhooks(value string, baseURL string) []*DiscordNotifier {
+	var notifiers []*DiscordNotifier
+
+	entries := strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == '\n' })
+
+	for _, entry := range entries {
+		webhookURL, servers, _ := strings.Cut(strings.TrimSpace(entry), "|")
+
+		if webhookURL == "" {
+			continue
+		}
+
+		var names []string
+
+		if servers != "" {
+			names = strings.Split(servers, ",")
+		}
+
+		notifiers = append(notifiers, NewDiscordNotifier(webhookURL, names, baseURL))
+	}
+
+	return notifiers
+}
+
+// Name identifies the webhook by its ID, e.g., "discord:123" for
+// https://discord.com/api/webhooks/123/token, since the rest of the URL is
+// its token. Other URLs are hashed.
+func (n *DiscordNotifier) Name() string {
+	if u, err := url.Parse(n.URL); err == nil {
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+
+		if len(parts) == 4 && parts[0] == "api" && parts[1] == "webhooks" && parts[2] != "" {
+			return "discord:" + parts[2]
+		}
+	}
+
+	return hashedNotifierName("discord", n.URL)
+}
+
+// Wants returns whether this notifier posts about the given server
+func (n *DiscordNotifier) Wants(server string) bool {
+	return len(n.Servers) == 0 || n.Servers[strings.ToLower(server)]
+}
+
+// FormatDuration formats a duration as, e.g., "2d 3h", "1h 20m" or "5m"
+func FormatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	days := int(d.Hours()) / 24
+	hours := int(d.Hours()) % 24
+	minutes := int(d.Minutes()) % 60
+
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	default:
+		return fmt.Sprintf("%dm", minutes)
+	}
+}
+
+// EventTitle describes an event in a short sentence
+func EventTitle(e Event) string {
+	switch e.Kind {
+	case EVENT_DOWN:
+		return fmt.Sprintf("%s is down", e.Server.Name)
+	case EVENT_UP:
+		return fmt.Sprintf("%s is back up", e.Server.Name)
+	case EVENT_DELISTED:
+		return fmt.Sprintf("%s was removed from the server list", e.Server.Name)
+	case EVENT_RELISTED:
+		return fmt.Sprintf("%s is back on the server list", e.Server.Name)
+	case EVENT_METADATA:
+		return fmt.Sprintf("%s's details changed", e.Server.Name)
+	default:
+		return fmt.Sprintf("%s: %s", e.Server.Name, e.Kind)
+	}
+}
+
+// StatusURL returns the link to a server's statuses page
+func StatusURL(baseURL string, server string) string {
+	return strings.TrimSuffix(baseURL, "/") + "/statuses/" + url.PathEscape(server)
+}
+
+func (n *DiscordNotifier) embed(e Event) DiscordEmbed {
+	embed := DiscordEmbed{
+		Title:     EventTitle(e),
+		URL:       StatusURL(n.BaseURL, e.Server.Name),
+		Color:     discordColors[e.Kind],
+		Timestamp: e.Time,
+		Fields: []DiscordEmbedField{
+			{Name: "Emulator", Value: e.Server.Emulator, Inline: true},
+			{Name: "Type", Value: e.Server.Type, Inline: true},
+		},
+	}
+
+	if e.Kind == EVENT_UP && e.SinceAt.Valid {
+		down := time.Duration(e.CreatedAt-e.SinceAt.Int64) * time.Second
+
+		embed.Fields = append(embed.Fields, DiscordEmbedField{Name: "Down for", Value: FormatDuration(down), Inline: true})
+	}
+
+	if e.Server.Discord != "" {
+		embed.Fields = append(embed.Fields, DiscordEmbedField{Name: "Discord", Value: e.Server.Discord})
+	}
+
+	if e.Message != "" {
+		embed.Description = e.Message
+	}
+
+	// Discord rejects embeds with empty field values
+	var fields []DiscordEmbedField
+
+	for _, f := range embed.Fields {
+		if f.Value != "" {
+			fields = append(fields, f)
+		}
+	}
+
+	embed.Fields = fields
+
+	return embed
+}
+
+// wait blocks until this webhook can be sent another request
+func (n *DiscordNotifier) wait() {
+	n.mu.Lock()
+	delay := time.Until(n.next)
+	n.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// holdOff stops requests being sent for the given duration
+func (n *DiscordNotifier) holdOff(d time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if next := time.Now().Add(d); next.After(n.next) {
+		n.next = next
+	}
+}
+
+// rateLimitDelay works out how long to wait after a response from the
+// X-RateLimit headers Discord sends
+func rateLimitDelay(resp *http.Response) time.Duration {
+	if resp.Header.Get("X-RateLimit-Remaining") != "0" {
+		return 0
+	}
+
+	seconds, err := strconv.ParseFloat(resp.Header.Get("X-RateLimit-Reset-After"), 64)
+
+	if err != nil {
+		return 0
+	}
+
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// retryAfter reads how long Discord wants us to wait from a 429 response
+func retryAfter(resp *http.Response) time.Duration {
+	var body struct {
+		RetryAfter float64 `json:"retry_after"`
+	}
+
+	if json.NewDecoder(resp.Body).Decode(&body) == nil && body.RetryAfter > 0 {
+		return time.Duration(body.RetryAfter * float64(time.Second))
+	}
+
+	if seconds, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil {
+		return time.Duration(seconds * float64(time.Second))
+	}
+
+	return time.Second
+}
+
+func (n *DiscordNotifier) post(message DiscordMessage) error {
+	body, err := json.Marshal(message)
+
+	if err != nil {
+		return PermanentError{Err: err}
+	}
+
+	for attempt := 0; ; attempt++ {
+		n.wait()
+
+		req, err := http.NewRequest(http.MethodPost, n.URL, bytes.NewReader(body))
+
+		if err != nil {
+			return PermanentError{Err: err}
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "ac-server-monitor/"+GetGitHash())
+
+		resp, err := n.Client.Do(req)
+
+		if err != nil {
+			return redactURL(err)
+		}
+
+		n.holdOff(max(discordMinInterval, rateLimitDelay(resp)))
+
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < discordMaxRateLimitRetries {
+			n.holdOff(retryAfter(resp))
+			resp.Body.Close()
+
+			continue
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+
+		statusErr := HTTPStatusError{Code: resp.StatusCode}
+
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return PermanentError{Err: statusErr}
+		}
+
+		return statusErr
+	}
+}
+
+func (n *DiscordNotifier) Notify(events []Event) error {
+	var embeds []DiscordEmbed
+
+	for _, e := range events {
+		if n.Wants(e.Server.Name) {
+			embeds = append(embeds, n.embed(e))
+		}
+	}
+
+	for start := 0; start < len(embeds); start += discordMaxEmbeds {
+		end := min(start+discordMaxEmbeds, len(embeds))
+
+		err := n.post(DiscordMessage{Username: "AC Server Monitor", Embeds: embeds[start:end]})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
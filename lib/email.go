@@ -0,0 +1,253 @@
+package lib
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Mailer sends plain text email through an SMTP server. STARTTLS is used when
+// the server offers it.
+type Mailer struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+// MailerFromEnv configures a Mailer from SMTP_ADDR, SMTP_FROM, SMTP_USERNAME and
+// SMTP_PASSWORD, returning nil if SMTP_ADDR isn't set
+func MailerFromEnv() *Mailer {
+	addr := Env("SMTP_ADDR", "")
+
+	if addr == "" {
+		return nil
+	}
+
+	return &Mailer{
+		Addr:     addr,
+		From:     Env("SMTP_FROM", "AC Server Monitor <monitor@localhost>"),
+		Username: Env("SMTP_USERNAME", ""),
+		Password: Env("SMTP_PASSWORD", ""),
+	}
+}
+
+// Send emails a plain text message to a single recipient with any extra
+// headers given
+func (m *Mailer) Send(to string, subject string, body string, headers map[string]string) error {
+	from, err := mail.ParseAddress(m.From)
+
+	if err != nil {
+		return PermanentError{Err: fmt.Errorf("invalid SMTP_FROM: %w", err)}
+	}
+
+	token, err := newToken()
+
+	if err != nil {
+		return err
+	}
+
+	_, domain, _ := strings.Cut(from.Address, "@")
+
+	var msg bytes.Buffer
+
+	fmt.Fprintf(&msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", token, domain)
+
+	for key, value := range headers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", key, value)
+	}
+
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+
+	if m.Username != "" {
+		host, _, _ := net.SplitHostPort(m.Addr)
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	return smtp.SendMail(m.Addr, auth, from.Address, []string{to}, msg.Bytes())
+}
+
+// SubscriptionURL returns the link for confirming or unsubscribing with a token
+func SubscriptionURL(baseURL string, action string, token string) string {
+	return strings.TrimSuffix(baseURL, "/") + "/subscriptions/" + action + "?token=" + url.QueryEscape(token)
+}
+
+// SendConfirmation emails the double opt-in link for new subscriptions
+func SendConfirmation(m *Mailer, baseURL string, email string, token string, servers []string) error {
+	body := fmt.Sprintf(`Someone, hopefully you, asked to be emailed when these Asheron's Call servers go down or come back up:
+
+%s
+
+To confirm, open this link:
+
+%s
+
+If this wasn't you, ignore this email and you won't hear from us again.
+`, "  "+strings.Join(servers, "\n  "), SubscriptionURL(baseURL, "confirm", token))
+
+	return m.Send(email, "Confirm your server status subscription", body, nil)
+}
+
+// Subscribers are only promised emails about servers going down and coming
+// back up
+var emailEventKinds = map[string]bool{
+	EVENT_DOWN: true,
+	EVENT_UP:   true,
+}
+
+// EmailNotifier emails each up or down event to the confirmed subscribers of
+// its server. Other events are dropped.
+type EmailNotifier struct {
+	DB      *sql.DB
+	Mailer  *Mailer
+	BaseURL string
+}
+
+func NewEmailNotifier(db *sql.DB, mailer *Mailer, baseURL string) *EmailNotifier {
+	return &EmailNotifier{
+		DB:      db,
+		Mailer:  mailer,
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+func (n *EmailNotifier) Name() string {
+	return "email"
+}
+
+// notification is an event along with the subscription it's being sent for
+type notification struct {
+	Event        Event
+	Subscription Subscription
+}
+
+func (n *EmailNotifier) body(notifications []notification) string {
+	var b strings.Builder
+
+	for i, item := range notifications {
+		e := item.Event
+
+		if i > 0 {
+			b.WriteString("\n---\n\n")
+		}
+
+		fmt.Fprintf(&b, "%s at %s.\n", EventTitle(e), e.Time)
+
+		if e.Kind == EVENT_UP && e.SinceAt.Valid {
+			fmt.Fprintf(&b, "It was down for %s.\n", FormatDuration(time.Duration(e.CreatedAt-e.SinceAt.Int64)*time.Second))
+		}
+
+		if e.Message != "" {
+			fmt.Fprintf(&b, "\n%s\n", e.Message)
+		}
+
+		fmt.Fprintf(&b, "\nStatus history: %s\n", StatusURL(n.BaseURL, e.Server.Name))
+	}
+
+	b.WriteString("\n")
+
+	unsubscribed := map[int]bool{}
+
+	for _, item := range notifications {
+		s := item.Subscription
+
+		if !unsubscribed[s.ID] {
+			fmt.Fprintf(&b, "To stop getting these emails for %s: %s\n", s.ServerName, SubscriptionURL(n.BaseURL, "unsubscribe", s.UnsubscribeToken))
+			unsubscribed[s.ID] = true
+		}
+	}
+
+	return b.String()
+}
+
+// send emails one subscriber about all of their events at once
+func (n *EmailNotifier) send(email string, notifications []notification) error {
+	subject := EventTitle(notifications[0].Event)
+
+	if len(notifications) > 1 {
+		subject = fmt.Sprintf("%d server status changes", len(notifications))
+	}
+
+	var headers map[string]string
+	first := notifications[0].Subscription
+
+	// One-click unsubscribing only works for a single subscription
+	if slices.IndexFunc(notifications, func(item notification) bool { return item.Subscription.ID != first.ID }) == -1 {
+		headers = map[string]string{
+			"List-Unsubscribe":      "<" + SubscriptionURL(n.BaseURL, "unsubscribe", first.UnsubscribeToken) + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		}
+	}
+
+	return n.Mailer.Send(email, subject, n.body(notifications), headers)
+}
+
+// Notify sends each subscriber one email covering all of their events.
+// Failures for individual subscribers are logged and only returned, so the
+// events are retried, if nobody could be emailed since retrying would
+// otherwise send duplicates.
+func (n *EmailNotifier) Notify(events []Event) error {
+	var emails []string
+	byEmail := map[string][]notification{}
+
+	for _, e := range events {
+		if !emailEventKinds[e.Kind] {
+			continue
+		}
+
+		subscribers, err := Subscribers(n.DB, e.Server.ID)
+
+		if err != nil {
+			return err
+		}
+
+		for _, s := range subscribers {
+			if _, found := byEmail[s.Email]; !found {
+				emails = append(emails, s.Email)
+			}
+
+			byEmail[s.Email] = append(byEmail[s.Email], notification{Event: e, Subscription: s})
+		}
+	}
+
+	var sent int
+	var lastErr error
+
+	for _, email := range emails {
+		err := n.send(email, byEmail[email])
+
+		if err != nil {
+			log.Printf("Failed to email %d notifications to a subscriber: %s", len(byEmail[email]), err)
+			lastErr = err
+
+			continue
+		}
+
+		sent++
+	}
+
+	if sent == 0 && lastErr != nil {
+		return lastErr
+	}
+
+	return nil
+}
@@ -0,0 +1,254 @@
+package lib
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"gopkg.in/guregu/null.v4"
+)
+
+// Kinds of state change recorded in the events table
+const (
+	EVENT_DOWN     = "down"
+	EVENT_UP       = "up"
+	EVENT_DELISTED = "delisted"
+	EVENT_RELISTED = "relisted"
+	EVENT_METADATA = "metadata"
+)
+
+// Event is a state change for a server. Since is when the previous state
+// began, e.g., when the outage started for an up event.
+type Event struct {
+	ID        int           `json:"id"`
+	Kind      string        `json:"kind"`
+	Time      string        `json:"time"`
+	Since     null.String   `json:"since"`
+	Message   string        `json:"message"`
+	Server    EventServer   `json:"server"`
+	CreatedAt int64         `json:"-"`
+	SinceAt   sql.NullInt64 `json:"-"`
+}
+
+type EventServer struct {
+	ID       int    `json:"-"`
+	GUID     string `json:"guid"`
+	Name     string `json:"name"`
+	Emulator string `json:"emu"`
+	Type     string `json:"type"`
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Discord  string `json:"discord_url"`
+}
+
+func formatEventTime(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format(time.RFC3339)
+}
+
+// RecordEvent adds a state change to the events table
+func RecordEvent(tx *sql.Tx, server_id int, kind string, now int64, since sql.NullInt64, message string) error {
+	_, err := StoreEvent(tx, NewEvent(EventServer{ID: server_id}, kind, now, since, message))
+
+	return err
+}
+
+// StoreEvent adds an event to the events table and returns it with its ID
+func StoreEvent(tx *sql.Tx, e Event) (Event, error) {
+	result, err := tx.Exec(`
+		INSERT INTO events (server_id, kind, created_at, since, message)
+		VALUES (?, ?, ?, ?, ?)
+	`, e.Server.ID, e.Kind, e.CreatedAt, e.SinceAt, e.Message)
+
+	if err != nil {
+		return e, err
+	}
+
+	id, err := result.LastInsertId()
+
+	if err != nil {
+		return e, err
+	}
+
+	e.ID = int(id)
+	log.Printf("Recorded %s event for server %d", e.Kind, e.Server.ID)
+
+	return e, nil
+}
+
+// QueryRower is satisfied by both *sql.DB and *sql.Tx
+type QueryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// NewEvent builds an event that hasn't been stored yet
+func NewEvent(server EventServer, kind string, now int64, since sql.NullInt64, message string) Event {
+	e := Event{
+		Kind:      kind,
+		Time:      formatEventTime(now),
+		Message:   message,
+		Server:    server,
+		CreatedAt: now,
+		SinceAt:   since,
+	}
+
+	if since.Valid {
+		e.Since = null.StringFrom(formatEventTime(since.Int64))
+	}
+
+	return e
+}
+
+// StatusTransition returns the event for a check that changed whether a
+// server is online, or nil if it didn't. Servers that haven't been checked
+// before don't get an event. This needs to run before the outage incident is
+// ended so recoveries can include when the outage started.
+func StatusTransition(q QueryRower, server EventServer, was_online sql.NullBool, up bool, now int64, message string) (*Event, error) {
+	if !was_online.Valid || was_online.Bool == up {
+		return nil, nil
+	}
+
+	if !up {
+		e := NewEvent(server, EVENT_DOWN, now, sql.NullInt64{}, message)
+
+		return &e, nil
+	}
+
+	var since sql.NullInt64
+
+	err := q.QueryRow(`
+		SELECT started_at
+		FROM incidents
+		WHERE server_id = ? AND kind = ? AND ended_at IS NULL
+		ORDER BY started_at DESC
+		LIMIT 1
+	`, server.ID, INCIDENT_OUTAGE).Scan(&since)
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	e := NewEvent(server, EVENT_UP, now, since, "")
+
+	return &e, nil
+}
+
+// RecordStatusTransition records an event if a check changed whether a server
+// is online
+func RecordStatusTransition(tx *sql.Tx, server_id int, was_online sql.NullBool, up bool, now int64, message string) error {
+	e, err := StatusTransition(tx, EventServer{ID: server_id}, was_online, up, now, message)
+
+	if err != nil || e == nil {
+		return err
+	}
+
+	return RecordEvent(tx, server_id, e.Kind, e.CreatedAt, e.SinceAt, e.Message)
+}
+
+// The columns scanEvents expects, in order
+var EVENT_COLUMNS = `
+	events.id,
+	events.kind,
+	events.created_at,
+	events.since,
+	COALESCE(events.message, ''),
+	servers.id,
+	servers.guid,
+	servers.name,
+	servers.emu,
+	servers.type,
+	servers.host,
+	servers.port,
+	COALESCE(servers.discord_url, '')
+`
+
+var QUERY_EVENTS = `
+	SELECT ` + EVENT_COLUMNS + `
+	FROM events
+	JOIN servers ON servers.id = events.server_id
+	WHERE events.id > ?
+	ORDER BY events.id
+	LIMIT ?;
+`
+
+func scanEvents(rows *sql.Rows) ([]Event, error) {
+	defer rows.Close()
+
+	var events []Event
+
+	for rows.Next() {
+		var e Event
+
+		err := rows.Scan(
+			&e.ID,
+			&e.Kind,
+			&e.CreatedAt,
+			&e.SinceAt,
+			&e.Message,
+			&e.Server.ID,
+			&e.Server.GUID,
+			&e.Server.Name,
+			&e.Server.Emulator,
+			&e.Server.Type,
+			&e.Server.Host,
+			&e.Server.Port,
+			&e.Server.Discord,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		e.Time = formatEventTime(e.CreatedAt)
+
+		if e.SinceAt.Valid {
+			e.Since = null.StringFrom(formatEventTime(e.SinceAt.Int64))
+		}
+
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// EventsAfter returns up to limit events with IDs greater than after, oldest
+// first
+func EventsAfter(db *sql.DB, after int, limit int) ([]Event, error) {
+	rows, err := db.Query(QUERY_EVENTS, after, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanEvents(rows)
+}
+
+var QUERY_RECENT_EVENTS = `
+	SELECT ` + EVENT_COLUMNS + `
+	FROM events
+	JOIN servers ON servers.id = events.server_id
+	WHERE ? = 0 OR events.server_id = ?
+	ORDER BY events.id DESC
+	LIMIT ?;
+`
+
+// RecentEvents returns up to limit of the latest events, newest first, for
+// every server or just the server with the given ID if server_id is non-zero
+func RecentEvents(db *sql.DB, server_id int, limit int) ([]Event, error) {
+	rows, err := db.Query(QUERY_RECENT_EVENTS, server_id, server_id, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanEvents(rows)
+}
+
+// LatestEventID returns the ID of the most recent event or zero if there are
+// none
+func LatestEventID(db *sql.DB) (int, error) {
+	var id int
+
+	err := db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM events").Scan(&id)
+
+	return id, err
+}
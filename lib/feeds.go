@@ -0,0 +1,134 @@
+package lib
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// How many events each feed lists
+const FEED_SIZE = 50
+
+// The date in tag URIs, which only has to stay the same so IDs do
+const FEED_TAG_DATE = "2022"
+
+type AtomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  AtomPerson  `xml:"author"`
+	Links   []AtomLink  `xml:"link"`
+	Entries []AtomEntry `xml:"entry"`
+}
+
+type AtomPerson struct {
+	Name string `xml:"name"`
+}
+
+type AtomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type AtomEntry struct {
+	ID        string       `xml:"id"`
+	Title     string       `xml:"title"`
+	Updated   string       `xml:"updated"`
+	Published string       `xml:"published"`
+	Link      AtomLink     `xml:"link"`
+	Category  AtomCategory `xml:"category"`
+	Content   AtomText     `xml:"content"`
+}
+
+type AtomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type AtomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// FeedTag returns a tag URI (RFC 4151) for the given path, e.g.,
+// "tag:servers.treestats.net,2022:event/123"
+func FeedTag(baseURL string, path string) string {
+	host := baseURL
+
+	if u, err := url.Parse(baseURL); err == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+
+	return fmt.Sprintf("tag:%s,%s:%s", host, FEED_TAG_DATE, path)
+}
+
+// EventSummary describes an event in a few sentences for feeds
+func EventSummary(e Event) string {
+	var lines []string
+
+	switch e.Kind {
+	case EVENT_UP:
+		if e.SinceAt.Valid {
+			lines = append(lines, fmt.Sprintf("%s was down for %s.", e.Server.Name, FormatDuration(time.Duration(e.CreatedAt-e.SinceAt.Int64)*time.Second)))
+		}
+	case EVENT_DOWN:
+		lines = append(lines, fmt.Sprintf("%s stopped responding to checks.", e.Server.Name))
+	}
+
+	if e.Message != "" {
+		lines = append(lines, e.Message)
+	}
+
+	if len(lines) == 0 {
+		return EventTitle(e) + "."
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// NewAtomFeed builds a feed of events, which should be newest first. id is
+// the feed's tag path and self is the feed's own URL.
+func NewAtomFeed(baseURL string, id string, title string, self string, events []Event) AtomFeed {
+	feed := AtomFeed{
+		ID:      FeedTag(baseURL, id),
+		Title:   title,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Author:  AtomPerson{Name: "AC Server Monitor"},
+		Links: []AtomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: self},
+			{Rel: "alternate", Type: "text/html", Href: baseURL},
+		},
+	}
+
+	if len(events) > 0 {
+		feed.Updated = events[0].Time
+	}
+
+	for _, e := range events {
+		feed.Entries = append(feed.Entries, AtomEntry{
+			ID:        FeedTag(baseURL, fmt.Sprintf("event/%d", e.ID)),
+			Title:     EventTitle(e),
+			Updated:   e.Time,
+			Published: e.Time,
+			Link:      AtomLink{Rel: "alternate", Type: "text/html", Href: StatusURL(baseURL, e.Server.Name)},
+			Category:  AtomCategory{Term: e.Kind},
+			Content:   AtomText{Type: "text", Body: EventSummary(e)},
+		})
+	}
+
+	return feed
+}
+
+// Marshal renders the feed as an XML document
+func (f AtomFeed) Marshal() ([]byte, error) {
+	body, err := xml.MarshalIndent(f, "", "  ")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), body...), nil
+}
@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataChangeEvents(t *testing.T) {
+	db := OpenTestDB(t)
+	list := GenerateTestServerList()
+
+	UpdateServersTable(db, list)
+
+	list.Servers[0].Host = "play.example.com"
+	list.Servers[0].Discord = "https://discord.gg/example"
+	UpdateServersTable(db, list)
+
+	// Nothing changed this time
+	UpdateServersTable(db, list)
+
+	events, err := EventsAfter(db, 0, 10)
+
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, EVENT_METADATA, events[0].Kind)
+	assert.Equal(t, "UpServer", events[0].Server.Name)
+	assert.Equal(t, "Host changed from \"\" to \"play.example.com\".\nDiscord changed from \"\" to \"https://discord.gg/example\".", events[0].Message)
+}
+
+func TestAtomFeed(t *testing.T) {
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+
+	RecordTestEvent(t, db, 1, EVENT_DOWN)
+	RecordTestEvent(t, db, 2, EVENT_DELISTED)
+	RecordTestEvent(t, db, 1, EVENT_UP)
+
+	events, err := RecentEvents(db, 1, FEED_SIZE)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+
+	output, err := NewAtomFeed("https://example.com", "feed/server/UpServer", "UpServer Status Changes", "https://example.com/feeds/UpServer.atom", events).Marshal()
+	assert.NoError(t, err)
+
+	var feed AtomFeed
+	assert.NoError(t, xml.Unmarshal(output, &feed))
+
+	assert.Equal(t, "tag:example.com,2022:feed/server/UpServer", feed.ID)
+	assert.Len(t, feed.Entries, 2)
+	assert.Equal(t, "tag:example.com,2022:event/3", feed.Entries[0].ID)
+	assert.Equal(t, "UpServer is back up", feed.Entries[0].Title)
+	assert.Equal(t, "up", feed.Entries[0].Category.Term)
+	assert.Equal(t, "https://example.com/statuses/UpServer", feed.Entries[0].Link.Href)
+	assert.Equal(t, "UpServer stopped responding to checks.", feed.Entries[1].Content.Body)
+	assert.Equal(t, feed.Entries[0].Updated, feed.Updated)
+
+	events, err = RecentEvents(db, 0, FEED_SIZE)
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+}
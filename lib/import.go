@@ -0,0 +1,253 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"monitor/api"
+	"time"
+)
+
+// ImportSummary counts what an import did, or would have done in a dry run
+type ImportSummary struct {
+	ServersMatched  int
+	ServersInserted int
+	StatusesRead    int
+	// Statuses imported for servers that weren't already in the database or
+	// imported first are skipped
+	StatusesUnknownServer int
+	// Statuses are duplicates if their server already has a check at the same
+	// second
+	StatusesDuplicate int
+	// Statuses are overlapping if they're within half a check interval of a
+	// check their server already has, since another monitor was checking it
+	// at the same time
+	StatusesOverlapping int
+	StatusesInserted    int
+}
+
+// Importer merges servers and statuses from elsewhere, e.g., another
+// monitor's database or an export, into db. Everything happens in one
+// transaction that's only committed by Commit.
+type Importer struct {
+	Summary ImportSummary
+
+	tx *sql.Tx
+	// Server IDs in db by GUID
+	servers      map[string]int
+	touched      map[int]bool
+	nearest      *sql.Stmt
+	insertStatus *sql.Stmt
+}
+
+// How far the closest check to a time is, or NULL if none are within range
+var QUERY_IMPORT_NEAREST_STATUS = `
+SELECT MIN(ABS(created_at - ?))
+FROM statuses
+WHERE
+	server_id = ?
+AND
+	created_at > ?
+AND
+	created_at < ?
+`
+
+var QUERY_IMPORT_INSERT_STATUS = `
+INSERT INTO statuses (server_id, created_at, status, rtt, message)
+VALUES (?, ?, ?, ?, ?)
+`
+
+// Imported checks can be newer than what was there, so last_seen is the
+// latest successful check either way
+var QUERY_IMPORT_UPDATE_LAST_SEEN = `
+UPDATE servers
+SET last_seen = MAX(COALESCE(latest, last_seen), COALESCE(last_seen, latest))
+FROM (
+	SELECT MAX(created_at) AS latest
+	FROM statuses
+	WHERE
+		server_id = ?
+	AND
+		status = 1
+)
+WHERE id = ?
+`
+
+// NewImporter starts an import into db
+func NewImporter(ctx context.Context, db *sql.DB) (*Importer, error) {
+	tx, err := db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	im := &Importer{tx: tx, servers: map[string]int{}, touched: map[int]bool{}}
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, guid FROM servers")
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var guid string
+
+		if err := rows.Scan(&id, &guid); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		im.servers[guid] = id
+	}
+
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	im.nearest, err = tx.PrepareContext(ctx, QUERY_IMPORT_NEAREST_STATUS)
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	im.insertStatus, err = tx.PrepareContext(ctx, QUERY_IMPORT_INSERT_STATUS)
+
+	if err != nil {
+		im.nearest.Close()
+		tx.Rollback()
+		return nil, err
+	}
+
+	return im, nil
+}
+
+// ImportServer adds a server unless one with the same GUID is already there,
+// in which case that one is left as it is. Servers are added unlisted and
+// left for the next sync to list if they're on the server list, so servers
+// the other monitor saw listed aren't recorded as delisted.
+func (im *Importer) ImportServer(s api.ExportServer) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+
+	if _, ok := im.servers[s.GUID]; ok {
+		im.Summary.ServersMatched++
+		return nil
+	}
+
+	var last_seen sql.NullInt64
+
+	if s.LastSeen != nil {
+		last_seen = sql.NullInt64{Int64: s.LastSeen.Unix(), Valid: true}
+	}
+
+	result, err := im.tx.Exec(`
+		INSERT INTO servers (guid, name, description, emu, host, port, type, website_url, discord_url, is_listed, is_online, last_seen, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, s.GUID, s.Name, s.Description, s.Emulator, s.Host, s.Port, s.Type, s.WebsiteURL, s.DiscordURL, false, s.IsOnline, last_seen, s.CreatedAt.Unix(), s.UpdatedAt.Unix())
+
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+
+	if err != nil {
+		return err
+	}
+
+	im.servers[s.GUID] = int(id)
+	im.Summary.ServersInserted++
+
+	return nil
+}
+
+// ImportStatus adds a check unless its server already has one at the same
+// time or close to it, so gaps in its history are filled without doubling up
+// on the checks around them. Checks are matched to servers by GUID.
+func (im *Importer) ImportStatus(s api.ExportStatus) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+
+	im.Summary.StatusesRead++
+
+	server_id, ok := im.servers[s.ServerGUID]
+
+	if !ok {
+		im.Summary.StatusesUnknownServer++
+		return nil
+	}
+
+	created_at := s.CreatedAt.Unix()
+	window := int64(CHECK_INTERVAL/time.Second) / 2
+
+	var distance sql.NullInt64
+
+	if err := im.nearest.QueryRow(created_at, server_id, created_at-window, created_at+window).Scan(&distance); err != nil {
+		return err
+	}
+
+	if distance.Valid && distance.Int64 == 0 {
+		im.Summary.StatusesDuplicate++
+		return nil
+	}
+
+	if distance.Valid {
+		im.Summary.StatusesOverlapping++
+		return nil
+	}
+
+	if _, err := im.insertStatus.Exec(server_id, created_at, s.Up, s.RTT, s.Message); err != nil {
+		return err
+	}
+
+	im.Summary.StatusesInserted++
+	im.touched[server_id] = true
+
+	return nil
+}
+
+// Commit finishes the import, or rolls it back if dry_run is set
+func (im *Importer) Commit(dry_run bool) error {
+	defer im.nearest.Close()
+	defer im.insertStatus.Close()
+
+	for server_id := range im.touched {
+		if _, err := im.tx.Exec(QUERY_IMPORT_UPDATE_LAST_SEEN, server_id, server_id); err != nil {
+			im.tx.Rollback()
+			return err
+		}
+	}
+
+	if dry_run {
+		return im.tx.Rollback()
+	}
+
+	return im.tx.Commit()
+}
+
+// Rollback abandons the import
+func (im *Importer) Rollback() error {
+	im.nearest.Close()
+	im.insertStatus.Close()
+
+	return im.tx.Rollback()
+}
+
+// ALL_TIME is an export range covering every check
+var ALL_TIME = api.ExportRange{From: time.Unix(0, 0), To: time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+// ImportDatabase imports every server and then every status from source
+func (im *Importer) ImportDatabase(ctx context.Context, source *sql.DB) error {
+	if err := api.ExportServers(ctx, source, im.ImportServer); err != nil {
+		return err
+	}
+
+	return api.ExportStatuses(ctx, source, ALL_TIME, im.ImportStatus)
+}
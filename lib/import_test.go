@@ -0,0 +1,135 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"monitor/api"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func LastSeenByGUID(t *testing.T, db *sql.DB, guid string) sql.NullInt64 {
+	var last_seen sql.NullInt64
+
+	if err := db.QueryRow("SELECT last_seen FROM servers WHERE guid = ?", guid).Scan(&last_seen); err != nil {
+		t.Fatal(err)
+	}
+
+	return last_seen
+}
+
+func TestImportDatabase(t *testing.T) {
+	ctx := context.Background()
+
+	// Both monitors know UpServer, but under different IDs, and both checked
+	// it at 1000 and around 5000, with a gap in dest's checks between
+	dest := OpenTestDB(t)
+	UpdateServersTable(dest, ServerList{Servers: []ServerListItem{{ID: "OtherServer", Name: "OtherServer"}}})
+	UpdateServersTable(dest, GenerateTestServerList())
+	InsertTestStatus(t, dest, 2, 1000, true, 40)
+	InsertTestStatus(t, dest, 2, 5000, true, 40)
+	SetLastSeen(t, dest, "UpServer", 5000)
+
+	source := OpenTestDB(t)
+	UpdateServersTable(source, GenerateTestServerList())
+	InsertTestStatus(t, source, 1, 400, true, 40)
+	InsertTestStatus(t, source, 1, 1000, true, 40)
+	// Within half a check interval of dest's checks
+	InsertTestStatus(t, source, 1, 1200, true, 40)
+	InsertTestStatus(t, source, 1, 4900, true, 40)
+	// In the gap
+	InsertTestStatus(t, source, 1, 3000, true, 40)
+	InsertTestStatus(t, source, 1, 5600, false, nil)
+	InsertTestStatus(t, source, 2, 1000, true, 50)
+	UpdateServersTable(source, ServerList{Servers: []ServerListItem{{ID: "SourceServer", Name: "SourceServer"}}})
+	InsertTestStatus(t, source, 3, 1000, true, 60)
+
+	im, err := NewImporter(ctx, dest)
+	assert.NoError(t, err)
+	assert.NoError(t, im.ImportDatabase(ctx, source))
+	assert.NoError(t, im.Commit(false))
+
+	assert.Equal(t, ImportSummary{
+		ServersMatched:      2,
+		ServersInserted:     1,
+		StatusesRead:        8,
+		StatusesDuplicate:   1,
+		StatusesOverlapping: 2,
+		StatusesInserted:    5,
+	}, im.Summary)
+
+	AssertNRows(t, dest, "servers", 4)
+	AssertNRows(t, dest, "statuses", 7)
+
+	// Checks follow their server's GUID rather than its ID
+	var n int
+	assert.NoError(t, dest.QueryRow("SELECT COUNT(*) FROM statuses WHERE server_id = 2").Scan(&n))
+	assert.Equal(t, 5, n)
+	assert.NoError(t, dest.QueryRow("SELECT COUNT(*) FROM statuses WHERE server_id = 2 AND created_at = 3000").Scan(&n))
+	assert.Equal(t, 1, n)
+
+	// last_seen only moves forward, to the latest successful check
+	assert.Equal(t, int64(5000), LastSeenByGUID(t, dest, "UpServer").Int64)
+	assert.Equal(t, int64(1000), LastSeenByGUID(t, dest, "DownServer").Int64)
+	assert.Equal(t, int64(1000), LastSeenByGUID(t, dest, "SourceServer").Int64)
+
+	// Imported servers are left for the next sync to list, and servers that
+	// were already there keep their listing
+	var is_listed bool
+	assert.NoError(t, dest.QueryRow("SELECT is_listed FROM servers WHERE guid = 'SourceServer'").Scan(&is_listed))
+	assert.False(t, is_listed)
+	assert.NoError(t, dest.QueryRow("SELECT is_listed FROM servers WHERE guid = 'UpServer'").Scan(&is_listed))
+	assert.True(t, is_listed)
+
+	// Importing again changes nothing
+	im, err = NewImporter(ctx, dest)
+	assert.NoError(t, err)
+	assert.NoError(t, im.ImportDatabase(ctx, source))
+	assert.NoError(t, im.Commit(false))
+
+	assert.Equal(t, 0, im.Summary.StatusesInserted)
+	assert.Equal(t, 6, im.Summary.StatusesDuplicate)
+	assert.Equal(t, 2, im.Summary.StatusesOverlapping)
+	AssertNRows(t, dest, "statuses", 7)
+}
+
+func TestImportDryRun(t *testing.T) {
+	ctx := context.Background()
+	db := OpenTestDB(t)
+
+	im, err := NewImporter(ctx, db)
+	assert.NoError(t, err)
+
+	assert.NoError(t, im.ImportServer(api.ExportServer{GUID: "new-guid", Name: "New"}))
+	assert.NoError(t, im.ImportStatus(api.ExportStatus{ServerGUID: "new-guid", CreatedAt: time.Unix(100, 0), Up: true}))
+	assert.NoError(t, im.ImportStatus(api.ExportStatus{ServerGUID: "unknown-guid", CreatedAt: time.Unix(100, 0), Up: true}))
+	assert.NoError(t, im.Commit(true))
+
+	assert.Equal(t, ImportSummary{
+		ServersInserted:       1,
+		StatusesRead:          2,
+		StatusesUnknownServer: 1,
+		StatusesInserted:      1,
+	}, im.Summary)
+
+	AssertNRows(t, db, "servers", 0)
+	AssertNRows(t, db, "statuses", 0)
+}
+
+func TestImportInvalidRows(t *testing.T) {
+	ctx := context.Background()
+	db := OpenTestDB(t)
+
+	im, err := NewImporter(ctx, db)
+	assert.NoError(t, err)
+	defer im.Rollback()
+
+	assert.Error(t, im.ImportServer(api.ExportServer{Name: "No GUID"}))
+	assert.NoError(t, im.ImportServer(api.ExportServer{GUID: "new-guid", Name: "New"}))
+	assert.Error(t, im.ImportStatus(api.ExportStatus{ServerGUID: "new-guid", Up: true}))
+	assert.Error(t, im.ImportStatus(api.ExportStatus{CreatedAt: time.Unix(100, 0), Up: true}))
+	assert.Equal(t, 1, im.Summary.ServersInserted)
+	assert.Equal(t, 0, im.Summary.StatusesRead)
+}
@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"database/sql"
+	"log"
+)
+
+const (
+	INCIDENT_OUTAGE   = "outage"
+	INCIDENT_DEGRADED = "degraded"
+)
+
+// OpenIncident returns the ID of the server's open incident of the given
+// kind, or zero if there isn't one
+func OpenIncident(tx *sql.Tx, server_id int, kind string) (int, error) {
+	var id int
+
+	err := tx.QueryRow(`
+		SELECT id
+		FROM incidents
+		WHERE server_id = ? AND kind = ? AND ended_at IS NULL
+		ORDER BY started_at DESC
+		LIMIT 1
+	`, server_id, kind).Scan(&id)
+
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return id, err
+}
+
+// StartIncident opens a new incident unless one of the same kind is already
+// open for the server. It returns whether a new incident was opened.
+func StartIncident(tx *sql.Tx, server_id int, kind string, now int64, message string) (bool, error) {
+	id, err := OpenIncident(tx, server_id, kind)
+
+	if err != nil || id > 0 {
+		return false, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO incidents (server_id, kind, started_at, message)
+		VALUES (?, ?, ?, ?)
+	`, server_id, kind, now, message)
+
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("Started %s incident for server %d: %s", kind, server_id, message)
+
+	return true, nil
+}
+
+// EndIncident closes the server's open incident of the given kind, if there is
+// one. It returns whether an incident was closed.
+func EndIncident(tx *sql.Tx, server_id int, kind string, now int64) (bool, error) {
+	id, err := OpenIncident(tx, server_id, kind)
+
+	if err != nil || id == 0 {
+		return false, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE incidents
+		SET ended_at = ?
+		WHERE id = ?
+	`, now, id)
+
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("Ended %s incident for server %d", kind, server_id)
+
+	return true, nil
+}
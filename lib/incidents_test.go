@@ -0,0 +1,206 @@
+package lib
+
+import (
+	"database/sql"
+	"monitor/api"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func InTestTx(t *testing.T, db *sql.DB, f func(tx *sql.Tx) error) {
+	tx, err := db.Begin()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f(tx)
+	assert.NoError(t, err)
+
+	assert.NoError(t, tx.Commit())
+}
+
+func CountIncidents(t *testing.T, db *sql.DB, kind string, open bool) int {
+	var n int
+
+	err := db.QueryRow(`
+		SELECT COUNT(*)
+		FROM incidents
+		WHERE kind = ? AND (ended_at IS NULL) = ?
+	`, kind, open).Scan(&n)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+func TestOutageIncidents(t *testing.T) {
+	db := OpenTestDB(t)
+	cfg := DEFAULT_DEGRADATION
+
+	InTestTx(t, db, func(tx *sql.Tx) error { return UpdateIncidents(tx, 1, "Test", 100, false, "down", cfg) })
+	InTestTx(t, db, func(tx *sql.Tx) error { return UpdateIncidents(tx, 1, "Test", 200, false, "still down", cfg) })
+
+	assert.Equal(t, 1, CountIncidents(t, db, INCIDENT_OUTAGE, true))
+
+	InTestTx(t, db, func(tx *sql.Tx) error { return UpdateIncidents(tx, 1, "Test", 300, true, "", cfg) })
+
+	assert.Equal(t, 0, CountIncidents(t, db, INCIDENT_OUTAGE, true))
+	assert.Equal(t, 1, CountIncidents(t, db, INCIDENT_OUTAGE, false))
+
+	var started, ended int64
+	err := db.QueryRow("SELECT started_at, ended_at FROM incidents").Scan(&started, &ended)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), started)
+	assert.Equal(t, int64(300), ended)
+}
+
+func TestOutageEndsDegradation(t *testing.T) {
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+	cfg := DEFAULT_DEGRADATION
+
+	InTestTx(t, db, func(tx *sql.Tx) error {
+		_, err := StartIncident(tx, 1, INCIDENT_DEGRADED, 100, "slow")
+		return err
+	})
+
+	// Going down ends the degraded incident where the outage starts
+	InsertTestStatus(t, db, 1, 200, false, nil)
+	InTestTx(t, db, func(tx *sql.Tx) error { return UpdateIncidents(tx, 1, "UpServer", 200, false, "down", cfg) })
+
+	assert.Equal(t, 0, CountIncidents(t, db, INCIDENT_DEGRADED, true))
+	assert.Equal(t, 1, CountIncidents(t, db, INCIDENT_OUTAGE, true))
+
+	var ended int64
+	assert.NoError(t, db.QueryRow("SELECT ended_at FROM incidents WHERE kind = ?", INCIDENT_DEGRADED).Scan(&ended))
+	assert.Equal(t, int64(200), ended)
+
+	response, err := api.Servers(db, api.ServerFilter{})
+	assert.NoError(t, err)
+	assert.False(t, response.Servers[1].Status.IsDegraded)
+
+	// And coming back up without enough checks to tell doesn't start another
+	InsertTestStatus(t, db, 1, 300, true, 40)
+	InTestTx(t, db, func(tx *sql.Tx) error { return UpdateIncidents(tx, 1, "UpServer", 300, true, "", cfg) })
+
+	assert.Equal(t, 0, CountIncidents(t, db, INCIDENT_OUTAGE, true))
+	assert.Equal(t, 0, CountIncidents(t, db, INCIDENT_DEGRADED, true))
+	assert.Equal(t, 1, CountIncidents(t, db, INCIDENT_DEGRADED, false))
+}
+
+func TestBackfillOutageIncidents(t *testing.T) {
+	db := OpenTestDB(t)
+
+	for i, status := range []bool{true, false, false, true, true, false, true, false} {
+		InsertTestStatus(t, db, 1, int64(i*10), status, 10)
+	}
+
+	// Another server that was down from its first check, interleaved with the
+	// first
+	for i, status := range []bool{false, false, true} {
+		InsertTestStatus(t, db, 2, int64(i*10+5), status, 10)
+	}
+
+	_, err := db.Exec("DROP TABLE incidents")
+	assert.NoError(t, err)
+	assert.NoError(t, AutoMigrate(db))
+
+	assert.Equal(t, 3, CountIncidents(t, db, INCIDENT_OUTAGE, false))
+	assert.Equal(t, 1, CountIncidents(t, db, INCIDENT_OUTAGE, true))
+
+	var started, ended int64
+	err = db.QueryRow("SELECT started_at, ended_at FROM incidents WHERE server_id = 1 ORDER BY started_at LIMIT 1").Scan(&started, &ended)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), started)
+	assert.Equal(t, int64(30), ended)
+
+	err = db.QueryRow("SELECT started_at, ended_at FROM incidents WHERE server_id = 2").Scan(&started, &ended)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), started)
+	assert.Equal(t, int64(25), ended)
+}
+
+func TestDegradation(t *testing.T) {
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+	cfg := DEFAULT_DEGRADATION
+
+	now := time.Now().UTC().Unix()
+
+	// A day of 40 ms checks every ten minutes
+	for i := int64(1); i <= 144; i++ {
+		InsertTestStatus(t, db, 1, now-3600-i*600, true, 40)
+	}
+
+	// Recent checks that are only a little slower aren't a problem
+	for i := int64(0); i < 3; i++ {
+		InsertTestStatus(t, db, 1, now-i*600, true, 70)
+	}
+
+	InTestTx(t, db, func(tx *sql.Tx) error {
+		result, err := DetectDegradation(tx, 1, now, cfg)
+		assert.False(t, result.Degraded)
+		assert.Equal(t, int64(40), result.Baseline)
+		assert.Equal(t, int64(70), result.Recent)
+
+		return err
+	})
+
+	// But ten times slower is
+	for i := int64(0); i < 5; i++ {
+		InsertTestStatus(t, db, 1, now-i*600-1, true, 400)
+	}
+
+	InTestTx(t, db, func(tx *sql.Tx) error { return UpdateIncidents(tx, 1, "UpServer", now, true, "", cfg) })
+
+	assert.Equal(t, 1, CountIncidents(t, db, INCIDENT_DEGRADED, true))
+
+	response, err := api.Servers(db, api.ServerFilter{})
+	assert.NoError(t, err)
+	assert.True(t, response.Servers[1].Status.IsDegraded)
+	assert.False(t, response.Servers[0].Status.IsDegraded)
+
+	// Once latency is back to normal the incident ends
+	for i := int64(0); i < 3; i++ {
+		InsertTestStatus(t, db, 1, now+7200-i*600, true, 40)
+	}
+
+	InTestTx(t, db, func(tx *sql.Tx) error { return UpdateIncidents(tx, 1, "UpServer", now+7200, true, "", cfg) })
+
+	assert.Equal(t, 0, CountIncidents(t, db, INCIDENT_DEGRADED, true))
+}
+
+func TestDegradationConfigFromEnv(t *testing.T) {
+	cfg, err := DegradationConfigFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, DEFAULT_DEGRADATION, cfg)
+
+	t.Setenv("DEGRADED_THRESHOLD", "1.5")
+	t.Setenv("DEGRADED_RECENT_WINDOW", "30m")
+
+	cfg, err = DegradationConfigFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, 1.5, cfg.Threshold)
+	assert.Equal(t, 30*time.Minute, cfg.Recent)
+	assert.Equal(t, DEFAULT_DEGRADATION.Baseline, cfg.Baseline)
+
+	// Typos and values that aren't positive are rejected
+	for key, value := range map[string]string{
+		"DEGRADED_THRESHOLD":       "2x",
+		"DEGRADED_MIN_DELTA_MS":    "-100",
+		"DEGRADED_RECENT_WINDOW":   "1 hour",
+		"DEGRADED_BASELINE_WINDOW": "0s",
+	} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, value)
+
+			_, err := DegradationConfigFromEnv()
+			assert.ErrorContains(t, err, key)
+		})
+	}
+}
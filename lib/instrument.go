@@ -0,0 +1,244 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics about the monitor itself, as opposed to the servers it checks
+var (
+	fetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "monitor_fetch_duration_seconds",
+		Help: "How long fetching the community server list took.",
+	}, []string{"result"})
+
+	updateDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "monitor_update_duration_seconds",
+		Help:    "How long each update, from fetching the list to the last check finishing, took.",
+		Buckets: []float64{1, 2.5, 5, 10, 30, 60, 120, 300},
+	})
+
+	lastUpdate = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "monitor_last_update_timestamp_seconds",
+		Help: "When the last update finished, as a Unix timestamp.",
+	})
+
+	checksInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "monitor_checks_in_flight",
+		Help: "How many server checks are running.",
+	})
+
+	checkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "monitor_check_duration_seconds",
+		Help:    "How long checking a server took, including retries.",
+		Buckets: RTT_BUCKETS,
+	}, []string{"result"})
+
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "monitor_db_query_duration_seconds",
+		Help:    "How long database queries made while serving requests took.",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5},
+	}, []string{"query"})
+
+	templateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "monitor_template_render_duration_seconds",
+		Help:    "How long rendering each template took.",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5},
+	}, []string{"template"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "monitor_http_request_duration_seconds",
+		Help: "How long HTTP requests took, by route and status code.",
+	}, []string{"route", "code"})
+
+	lastBackup = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "monitor_last_backup_timestamp_seconds",
+		Help: "When the last backup finished, as a Unix timestamp.",
+	})
+)
+
+// MonitorCollectors are the metrics about the monitor itself, for registering
+// with Prometheus
+var MonitorCollectors = []prometheus.Collector{
+	fetchDuration,
+	updateDuration,
+	lastUpdate,
+	checksInFlight,
+	checkDuration,
+	queryDuration,
+	templateDuration,
+	requestDuration,
+	lastBackup,
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+
+	return "ok"
+}
+
+// StartSpan starts a Sentry span, which is a transaction if ctx doesn't
+// already have one
+func StartSpan(ctx context.Context, op string, description string) *sentry.Span {
+	span := sentry.StartSpan(ctx, op)
+	span.Description = description
+
+	return span
+}
+
+// TimeQuery starts timing a database query for Prometheus and as a Sentry
+// span in ctx's transaction, returning a function to call when it's done
+func TimeQuery(ctx context.Context, name string) func() {
+	span := StartSpan(ctx, "db.query", name)
+	start := time.Now()
+
+	return func() {
+		span.Finish()
+		queryDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	}
+}
+
+// withServerHub returns a context with its own Sentry hub that tags
+// everything reported through it with the server
+func withServerHub(ctx context.Context, s *ServerListItem) (context.Context, *sentry.Hub) {
+	hub := sentry.CurrentHub().Clone()
+
+	hub.ConfigureScope(func(scope *sentry.Scope) {
+		scope.SetTag("server", s.Name)
+		scope.SetContext("server", map[string]interface{}{
+			"guid": s.ID,
+			"name": s.Name,
+			"emu":  s.Emu,
+			"type": s.Type,
+			"host": s.Host,
+			"port": s.Port,
+		})
+	})
+
+	return sentry.SetHubOnContext(ctx, hub), hub
+}
+
+// captureException reports an error to Sentry through ctx's hub, which has
+// the server's details if it came from withServerHub
+func captureException(ctx context.Context, err error) {
+	hub := sentry.GetHubFromContext(ctx)
+
+	if hub == nil {
+		hub = sentry.CurrentHub()
+	}
+
+	hub.CaptureException(err)
+}
+
+// reportPanic sends a panic to Sentry before letting it carry on, so it
+// still crashes whatever it would have crashed. Deferred calls have to
+// recover themselves so this takes what recover returned.
+func reportPanic(hub *sentry.Hub, recovered any) {
+	if recovered == nil {
+		return
+	}
+
+	hub.Recover(recovered)
+	hub.Flush(2 * time.Second)
+
+	panic(recovered)
+}
+
+// statusRecorder remembers the status code a handler wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g., to
+// flush event streams
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrument wraps a handler in a Sentry transaction named after its route
+// and records its duration. Panics are reported to Sentry and answered with a
+// 500 instead of dropping the connection, except for http.ErrAbortHandler,
+// which handlers use to drop it on purpose.
+func instrument(f func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hub := sentry.CurrentHub().Clone()
+		ctx := sentry.SetHubOnContext(r.Context(), hub)
+
+		route := r.Pattern
+
+		if route == "" {
+			route = r.URL.Path
+		}
+
+		span := sentry.StartSpan(ctx, "http.server",
+			sentry.TransactionName(fmt.Sprintf("%s %s", r.Method, route)),
+			sentry.ContinueFromRequest(r),
+		)
+
+		r = r.WithContext(span.Context())
+		hub.Scope().SetRequest(r)
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+
+		defer func() {
+			err := recover()
+			aborted := err == http.ErrAbortHandler
+
+			if err != nil && !aborted {
+				hub.RecoverWithContext(context.WithValue(r.Context(), sentry.RequestContextKey, r), err)
+				log.Printf("Panic serving %s: %v", r.URL.Path, err)
+
+				if recorder.status == 0 {
+					http.Error(recorder, "Internal Server Error", http.StatusInternalServerError)
+				}
+			}
+
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+
+			if recorder.status >= 500 || aborted {
+				span.Status = sentry.SpanStatusInternalError
+			} else {
+				span.Status = sentry.SpanStatusOK
+			}
+
+			span.SetTag("http.status_code", fmt.Sprintf("%d", recorder.status))
+			span.Finish()
+
+			requestDuration.WithLabelValues(route, fmt.Sprintf("%d", recorder.status)).Observe(time.Since(start).Seconds())
+
+			if aborted {
+				panic(err)
+			}
+		}()
+
+		f(recorder, r)
+	}
+}
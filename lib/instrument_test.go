@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// HasTestSeries returns whether a collector has a series with all the labels
+func HasTestSeries(t *testing.T, c prometheus.Collector, labels map[string]string) bool {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+
+	families, err := registry.Gather()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			matched := 0
+
+			for _, pair := range metric.GetLabel() {
+				if value, ok := labels[pair.GetName()]; ok && value == pair.GetValue() {
+					matched++
+				}
+			}
+
+			if matched == len(labels) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func TestLogReqRecoversPanics(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/panic/{name}", LogReq(func(w http.ResponseWriter, r *http.Request) {
+		panic("oops")
+	}))
+
+	res := httptest.NewRecorder()
+	mux.ServeHTTP(res, httptest.NewRequest("GET", "/panic/UpServer", nil))
+
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+
+	// Requests are labelled with their route rather than their path
+	assert.True(t, HasTestSeries(t, requestDuration, map[string]string{"route": "/panic/{name}", "code": "500"}))
+}
+
+func TestLogReqLetsHandlersAbort(t *testing.T) {
+	handler := LogReq(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		panic(http.ErrAbortHandler)
+	})
+
+	res := httptest.NewRecorder()
+
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		handler.ServeHTTP(res, httptest.NewRequest("GET", "/", nil))
+	})
+}
+
+func TestLogReqCanFlush(t *testing.T) {
+	handler := LogReq(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		assert.NoError(t, http.NewResponseController(w).Flush())
+	})
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, http.StatusAccepted, res.Code)
+	assert.True(t, res.Flushed)
+}
+
+func TestTimeQuery(t *testing.T) {
+	done := TimeQuery(context.Background(), "test")
+	done()
+
+	assert.True(t, HasTestSeries(t, queryDuration, map[string]string{"query": "test"}))
+	assert.False(t, HasTestSeries(t, queryDuration, map[string]string{"query": "other"}))
+}
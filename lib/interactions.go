@@ -0,0 +1,416 @@
+package lib
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"monitor/api"
+)
+
+// Interaction and response types from Discord's interactions API
+const (
+	INTERACTION_PING         = 1
+	INTERACTION_COMMAND      = 2
+	INTERACTION_AUTOCOMPLETE = 4
+
+	INTERACTION_RESPONSE_PONG         = 1
+	INTERACTION_RESPONSE_MESSAGE      = 4
+	INTERACTION_RESPONSE_AUTOCOMPLETE = 8
+
+	// Only the user who ran the command sees the message
+	INTERACTION_FLAG_EPHEMERAL = 1 << 6
+)
+
+// The slash command this endpoint answers
+const DISCORD_COMMAND = "acstatus"
+
+// ErrInvalidInteraction is returned for interactions we can't answer, as
+// opposed to failing to answer them
+var ErrInvalidInteraction = errors.New("invalid interaction")
+
+// Discord allows at most 25 autocomplete choices
+const discordMaxChoices = 25
+
+// Interaction is the subset of an incoming Discord interaction we use
+type Interaction struct {
+	Type int             `json:"type"`
+	Data InteractionData `json:"data"`
+}
+
+type InteractionData struct {
+	Name    string              `json:"name"`
+	Options []InteractionOption `json:"options"`
+}
+
+type InteractionOption struct {
+	Name    string `json:"name"`
+	Value   any    `json:"value"`
+	Focused bool   `json:"focused"`
+}
+
+type InteractionResponse struct {
+	Type int                      `json:"type"`
+	Data *InteractionResponseData `json:"data,omitempty"`
+}
+
+type InteractionResponseData struct {
+	Content string          `json:"content,omitempty"`
+	Embeds  []DiscordEmbed  `json:"embeds,omitempty"`
+	Flags   int             `json:"flags,omitempty"`
+	Choices []CommandChoice `json:"choices,omitempty"`
+}
+
+type CommandChoice struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// ParseDiscordPublicKey parses the hex-encoded public key Discord shows on an
+// application's settings page
+func ParseDiscordPublicKey(value string) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(value))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("expected a %d byte public key, got %d bytes", ed25519.PublicKeySize, len(key))
+	}
+
+	return ed25519.PublicKey(key), nil
+}
+
+// VerifyDiscordSignature checks the X-Signature-Ed25519 header Discord sends,
+// which signs the X-Signature-Timestamp header followed by the raw body
+func VerifyDiscordSignature(key ed25519.PublicKey, signature string, timestamp string, body []byte) bool {
+	sig, err := hex.DecodeString(signature)
+
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+
+	return ed25519.Verify(key, append([]byte(timestamp), body...), sig)
+}
+
+func (i Interaction) option(name string) (InteractionOption, bool) {
+	for _, o := range i.Data.Options {
+		if o.Name == name {
+			return o, true
+		}
+	}
+
+	return InteractionOption{}, false
+}
+
+func ephemeral(content string) InteractionResponse {
+	return InteractionResponse{
+		Type: INTERACTION_RESPONSE_MESSAGE,
+		Data: &InteractionResponseData{Content: content, Flags: INTERACTION_FLAG_EPHEMERAL},
+	}
+}
+
+func serverState(s api.ServerAPIResponseServer) string {
+	switch {
+	case !s.Status.IsOnline.Valid:
+		return "Unknown"
+	case !s.Status.IsOnline.Bool:
+		return "Down"
+	case s.Status.IsDegraded:
+		return "Up (degraded)"
+	default:
+		return "Up"
+	}
+}
+
+// uptimeSquares draws daily uptime as a row of colored squares
+func uptimeSquares(uptimes []api.UptimeApiItem) string {
+	var b strings.Builder
+
+	for _, u := range uptimes {
+		switch {
+		case u.N == 0:
+			b.WriteString("⬛")
+		case api.GetUptimeClass(u.Uptime) == api.UPTIME_CLASS_HIGH:
+			b.WriteString("🟩")
+		case api.GetUptimeClass(u.Uptime) == api.UPTIME_CLASS_MID:
+			b.WriteString("🟧")
+		default:
+			b.WriteString("🟥")
+		}
+	}
+
+	return b.String()
+}
+
+// joinLines joins as many lines as fit in max characters, ending with more's
+// line for the rest if they don't all fit
+func joinLines(lines []string, max int, more func(n int) string) string {
+	var b strings.Builder
+	length := 0
+
+	for i, line := range lines {
+		if i > 0 {
+			line = "\n" + line
+		}
+
+		needed := length + utf8.RuneCountInString(line)
+
+		// Leave room for saying how many more there are
+		if i < len(lines)-1 {
+			needed += utf8.RuneCountInString("\n" + more(len(lines)-i-1))
+		}
+
+		if needed > max {
+			if i > 0 {
+				b.WriteString("\n")
+			}
+
+			b.WriteString(more(len(lines) - i))
+
+			break
+		}
+
+		b.WriteString(line)
+		length += utf8.RuneCountInString(line)
+	}
+
+	return b.String()
+}
+
+func downResponse(servers api.ServerAPIResponse, baseURL string) InteractionResponse {
+	var lines []string
+
+	for _, s := range servers.Servers {
+		if s.Status.IsOnline.Valid && !s.Status.IsOnline.Bool {
+			line := fmt.Sprintf("[%s](%s)", s.Name, StatusURL(baseURL, s.Name))
+
+			if s.Status.LastSeen.Valid {
+				line += fmt.Sprintf(", last seen %s", s.Status.LastSeen.String)
+			}
+
+			lines = append(lines, line)
+		}
+	}
+
+	embed := DiscordEmbed{
+		Title: fmt.Sprintf("%d of %d servers are down", len(lines), servers.Count),
+		URL:   baseURL,
+		Color: discordColors[EVENT_DOWN],
+	}
+
+	if len(lines) == 0 {
+		embed.Title = "All servers are up"
+		embed.Color = discordColors[EVENT_UP]
+	} else {
+		embed.Description = joinLines(lines, discordMaxDescription, func(n int) string {
+			return fmt.Sprintf("[…and %d more](%s)", n, baseURL)
+		})
+	}
+
+	return InteractionResponse{
+		Type: INTERACTION_RESPONSE_MESSAGE,
+		Data: &InteractionResponseData{Embeds: []DiscordEmbed{embed}},
+	}
+}
+
+func serverResponse(db *sql.DB, s api.ServerAPIResponseServer, baseURL string) (InteractionResponse, error) {
+	uptime, err := api.Uptime(db, s.ID, s.Name, api.DefaultUptimeRange(time.Now().UTC()))
+
+	if err != nil {
+		return InteractionResponse{}, err
+	}
+
+	color := discordColors[EVENT_UP]
+
+	if s.Status.IsOnline.Valid && !s.Status.IsOnline.Bool {
+		color = discordColors[EVENT_DOWN]
+	}
+
+	embed := DiscordEmbed{
+		Title: s.Name,
+		URL:   StatusURL(baseURL, s.Name),
+		Color: color,
+		Fields: []DiscordEmbedField{
+			{Name: "Status", Value: serverState(s), Inline: true},
+			{Name: "Address", Value: fmt.Sprintf("%s:%s", s.Address.Host, s.Address.Port), Inline: true},
+		},
+	}
+
+	if s.Status.LastSeen.Valid {
+		embed.Fields = append(embed.Fields, DiscordEmbedField{Name: "Last seen", Value: s.Status.LastSeen.String, Inline: true})
+	}
+
+	var summary []string
+
+	for _, item := range uptime.Summary.Items() {
+		value := item.Fmt
+
+		if item.Class != "" {
+			value += "%"
+		}
+
+		summary = append(summary, fmt.Sprintf("%s: %s", item.Key, value))
+	}
+
+	embed.Fields = append(embed.Fields,
+		DiscordEmbedField{Name: "Uptime", Value: strings.Join(summary, " · ")},
+		DiscordEmbedField{Name: fmt.Sprintf("Last %d days", api.DEFAULT_UPTIME_DAYS), Value: uptimeSquares(uptime.Uptimes)},
+	)
+
+	return InteractionResponse{
+		Type: INTERACTION_RESPONSE_MESSAGE,
+		Data: &InteractionResponseData{Embeds: []DiscordEmbed{embed}},
+	}, nil
+}
+
+// findServer looks a server up by name, case-insensitively, falling back to
+// the only server whose name starts with the query
+func findServer(servers []api.ServerAPIResponseServer, query string) (api.ServerAPIResponseServer, bool) {
+	var matches []api.ServerAPIResponseServer
+
+	for _, s := range servers {
+		if strings.EqualFold(s.Name, query) {
+			return s, true
+		}
+
+		if strings.HasPrefix(strings.ToLower(s.Name), strings.ToLower(query)) {
+			matches = append(matches, s)
+		}
+	}
+
+	if len(matches) == 1 {
+		return matches[0], true
+	}
+
+	return api.ServerAPIResponseServer{}, false
+}
+
+// autocompleteResponse suggests servers whose names contain the query, with
+// prefix matches first, after the "down" option
+func autocompleteResponse(servers []api.ServerAPIResponseServer, query string) InteractionResponse {
+	query = strings.ToLower(query)
+
+	var matches []CommandChoice
+
+	for _, s := range servers {
+		if strings.Contains(strings.ToLower(s.Name), query) {
+			matches = append(matches, CommandChoice{Name: s.Name, Value: s.Name})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return strings.HasPrefix(strings.ToLower(matches[i].Name), query) &&
+			!strings.HasPrefix(strings.ToLower(matches[j].Name), query)
+	})
+
+	choices := append([]CommandChoice{{Name: "down", Value: "down"}}, matches...)
+
+	return InteractionResponse{
+		Type: INTERACTION_RESPONSE_AUTOCOMPLETE,
+		Data: &InteractionResponseData{Choices: choices[:min(len(choices), discordMaxChoices)]},
+	}
+}
+
+// HandleInteraction answers a verified interaction
+func HandleInteraction(db *sql.DB, interaction Interaction, baseURL string) (InteractionResponse, error) {
+	if interaction.Type == INTERACTION_PING {
+		return InteractionResponse{Type: INTERACTION_RESPONSE_PONG}, nil
+	}
+
+	if interaction.Data.Name != DISCORD_COMMAND {
+		return ephemeral(fmt.Sprintf("Unknown command %q.", interaction.Data.Name)), nil
+	}
+
+	option, _ := interaction.option("server")
+	query, _ := option.Value.(string)
+	query = strings.TrimSpace(query)
+
+	servers, err := api.Servers(db, api.ServerFilter{})
+
+	if err != nil {
+		return InteractionResponse{}, err
+	}
+
+	switch interaction.Type {
+	case INTERACTION_AUTOCOMPLETE:
+		return autocompleteResponse(servers.Servers, query), nil
+	case INTERACTION_COMMAND:
+		if query == "" || strings.EqualFold(query, "down") {
+			return downResponse(servers, baseURL), nil
+		}
+
+		server, found := findServer(servers.Servers, query)
+
+		if !found {
+			return ephemeral(fmt.Sprintf("Couldn't find a server named %q.", query)), nil
+		}
+
+		return serverResponse(db, server, baseURL)
+	default:
+		return InteractionResponse{}, fmt.Errorf("%w: unsupported type %d", ErrInvalidInteraction, interaction.Type)
+	}
+}
+
+// DiscordInteractionsHandler serves Discord's interactions endpoint, rejecting
+// requests that aren't signed with the application's key
+func DiscordInteractionsHandler(db *sql.DB, key ed25519.PublicKey, baseURL string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if key == nil {
+			http.Error(w, "Discord interactions aren't configured", http.StatusNotFound)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+
+		if err != nil {
+			http.Error(w, "Couldn't read request", http.StatusBadRequest)
+			return
+		}
+
+		if !VerifyDiscordSignature(key, r.Header.Get("X-Signature-Ed25519"), r.Header.Get("X-Signature-Timestamp"), body) {
+			http.Error(w, "Invalid request signature", http.StatusUnauthorized)
+			return
+		}
+
+		var interaction Interaction
+
+		if err := json.Unmarshal(body, &interaction); err != nil {
+			http.Error(w, "Couldn't parse interaction", http.StatusBadRequest)
+			return
+		}
+
+		response, err := HandleInteraction(db, interaction, baseURL)
+
+		if errors.Is(err, ErrInvalidInteraction) {
+			http.Error(w, "Couldn't handle interaction", http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			log.Printf("Failed to handle interaction: %s", err)
+			http.Error(w, "Couldn't handle interaction", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
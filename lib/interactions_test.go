@@ -0,0 +1,135 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"monitor/api"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v4"
+)
+
+func SendTestInteraction(t *testing.T, handler http.HandlerFunc, key ed25519.PrivateKey, body string) *httptest.ResponseRecorder {
+	timestamp := "1700000000"
+	signature := ed25519.Sign(key, append([]byte(timestamp), body...))
+
+	req := httptest.NewRequest(http.MethodPost, "/discord/interactions", bytes.NewBufferString(body))
+	req.Header.Set("X-Signature-Ed25519", hex.EncodeToString(signature))
+	req.Header.Set("X-Signature-Timestamp", timestamp)
+
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	return w
+}
+
+func DecodeTestInteractionResponse(t *testing.T, w *httptest.ResponseRecorder) InteractionResponse {
+	var response InteractionResponse
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+	return response
+}
+
+func TestDiscordInteractions(t *testing.T) {
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+
+	_, err := db.Exec("UPDATE servers SET is_online = (name = 'UpServer'), host = 'localhost', port = '9000'")
+	assert.NoError(t, err)
+
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	parsed, err := ParseDiscordPublicKey(hex.EncodeToString(public))
+	assert.NoError(t, err)
+	assert.Equal(t, public, parsed)
+
+	handler := http.HandlerFunc(DiscordInteractionsHandler(db, public, "https://example.com"))
+
+	// Requests signed with another key are rejected
+	_, other, _ := ed25519.GenerateKey(nil)
+	w := SendTestInteraction(t, handler, other, `{"type": 1}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	response := DecodeTestInteractionResponse(t, SendTestInteraction(t, handler, private, `{"type": 1}`))
+	assert.Equal(t, INTERACTION_RESPONSE_PONG, response.Type)
+
+	// Interactions we don't know how to answer are the client's fault
+	w = SendTestInteraction(t, handler, private, `{"type": 3, "data": {"name": "acstatus"}}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	response = DecodeTestInteractionResponse(t, SendTestInteraction(t, handler, private,
+		`{"type": 2, "data": {"name": "acstatus", "options": [{"name": "server", "value": "down"}]}}`))
+	assert.Equal(t, INTERACTION_RESPONSE_MESSAGE, response.Type)
+	assert.Equal(t, "1 of 2 servers are down", response.Data.Embeds[0].Title)
+	assert.Contains(t, response.Data.Embeds[0].Description, "[DownServer](https://example.com/statuses/DownServer)")
+
+	// Unique prefixes are enough to find a server
+	response = DecodeTestInteractionResponse(t, SendTestInteraction(t, handler, private,
+		`{"type": 2, "data": {"name": "acstatus", "options": [{"name": "server", "value": "up"}]}}`))
+	embed := response.Data.Embeds[0]
+	assert.Equal(t, "UpServer", embed.Title)
+	assert.Contains(t, embed.Fields, DiscordEmbedField{Name: "Status", Value: "Up", Inline: true})
+	assert.Contains(t, embed.Fields, DiscordEmbedField{Name: "Address", Value: "localhost:9000", Inline: true})
+
+	response = DecodeTestInteractionResponse(t, SendTestInteraction(t, handler, private,
+		`{"type": 2, "data": {"name": "acstatus", "options": [{"name": "server", "value": "Nowhere"}]}}`))
+	assert.Equal(t, INTERACTION_FLAG_EPHEMERAL, response.Data.Flags)
+
+	response = DecodeTestInteractionResponse(t, SendTestInteraction(t, handler, private,
+		`{"type": 4, "data": {"name": "acstatus", "options": [{"name": "server", "value": "serv", "focused": true}]}}`))
+	assert.Equal(t, INTERACTION_RESPONSE_AUTOCOMPLETE, response.Type)
+	assert.Equal(t, []CommandChoice{
+		{Name: "down", Value: "down"},
+		{Name: "DownServer", Value: "DownServer"},
+		{Name: "UpServer", Value: "UpServer"},
+	}, response.Data.Choices)
+}
+
+func TestDownResponseFitsInEmbed(t *testing.T) {
+	servers := api.ServerAPIResponse{Count: 100}
+
+	for i := 0; i < 100; i++ {
+		s := api.ServerAPIResponseServer{Name: fmt.Sprintf("Down Server Number %d", i)}
+		s.Status.IsOnline = null.BoolFrom(false)
+		s.Status.LastSeen = null.StringFrom("2024-01-01T00:00:00Z")
+		servers.Servers = append(servers.Servers, s)
+	}
+
+	embed := downResponse(servers, "https://example.com").Data.Embeds[0]
+	lines := strings.Split(embed.Description, "\n")
+	last := lines[len(lines)-1]
+
+	assert.Equal(t, "100 of 100 servers are down", embed.Title)
+	assert.LessOrEqual(t, utf8.RuneCountInString(embed.Description), discordMaxDescription)
+	assert.Equal(t, fmt.Sprintf("[…and %d more](https://example.com)", 100-len(lines)+1), last)
+	assert.Contains(t, lines[0], "[Down Server Number 0]")
+}
+
+func TestDiscordInteractionsFailingInternally(t *testing.T) {
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	handler := http.HandlerFunc(DiscordInteractionsHandler(db, public, "https://example.com"))
+
+	// Failing to look servers up is our fault, not the client's
+	_, err = db.Exec("DROP TABLE statuses_hourly")
+	assert.NoError(t, err)
+
+	w := SendTestInteraction(t, handler, private,
+		`{"type": 2, "data": {"name": "acstatus", "options": [{"name": "server", "value": "down"}]}}`)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
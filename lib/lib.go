@@ -20,8 +20,15 @@ func Env(key, defaultValue string) string {
 	return val
 }
 
+// BaseURL is where the monitor is publicly reachable, for building links in
+// notifications
+func BaseURL() string {
+	return strings.TrimSuffix(Env("BASE_URL", "https://servers.treestats.net"), "/")
+}
+
+// LogReq logs and instruments requests to a handler
 func LogReq(f func(w http.ResponseWriter, r *http.Request)) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return instrument(func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("%s", r.URL.Path)
 
 		f(w, r)
@@ -45,7 +52,10 @@ func RenderTemplate(w http.ResponseWriter, name string, data any) {
 		return
 	}
 
+	start := time.Now()
 	err = t.ExecuteTemplate(w, name, data)
+	templateDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error %s", err.Error()), 500)
 		return
@@ -100,9 +100,10 @@ func TestLastSeen(t *testing.T) {
 	SetLastSeen(t, db, "UpServer", future)
 
 	// Verify API response result
-	response := api.Servers(db)
-	assert.Equal(t, response.Servers[0].Status.LastSeen, api.PrettyTimeOrNullString(sql.NullInt64{now, true}))
-	assert.Equal(t, response.Servers[1].Status.LastSeen, api.PrettyTimeOrNullString(sql.NullInt64{future, true}))
+	response, err := api.Servers(db, api.ServerFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, response.Servers[0].Status.LastSeen, api.PrettyTimeOrNullString(sql.NullInt64{Int64: now, Valid: true}))
+	assert.Equal(t, response.Servers[1].Status.LastSeen, api.PrettyTimeOrNullString(sql.NullInt64{Int64: future, Valid: true}))
 }
 
 func TestBufferToPrettyString(t *testing.T) {
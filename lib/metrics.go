@@ -0,0 +1,176 @@
+package lib
+
+import (
+	"database/sql"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The labels on every per-server metric
+var SERVER_METRIC_LABELS = []string{"guid", "name", "emu", "type"}
+
+// Buckets for check round trip times, in seconds. Checks time out after a few
+// seconds and can be retried so the largest buckets are for retried checks.
+var RTT_BUCKETS = []float64{0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// One row per server with its latest check, and how many checks have failed
+// since it was last up
+var QUERY_SERVER_METRICS = `
+	SELECT
+		servers.guid,
+		servers.name,
+		servers.emu,
+		servers.type,
+		servers.is_listed,
+		servers.is_online,
+		(
+			SELECT MAX(created_at)
+			FROM statuses
+			WHERE statuses.server_id = servers.id
+		) AS last_checked,
+		(
+			SELECT COUNT(*)
+			FROM statuses
+			WHERE statuses.server_id = servers.id
+				AND statuses.status = 0
+				AND statuses.created_at > COALESCE(servers.last_seen, 0)
+		) AS consecutive_failures
+	FROM servers
+`
+
+// ServerMetrics exports the state of every server to Prometheus. Most values
+// are read from the database on each scrape, so they're right whichever
+// process did the checks, but RTT histograms can only be built from checks
+// this process sees so it's also a StatusSink.
+type ServerMetrics struct {
+	DB *sql.DB
+
+	rtt          *prometheus.HistogramVec
+	up           *prometheus.Desc
+	lastChecked  *prometheus.Desc
+	failures     *prometheus.Desc
+	listed       *prometheus.Desc
+	listedTotals *prometheus.Desc
+}
+
+func NewServerMetrics(db *sql.DB) *ServerMetrics {
+	return &ServerMetrics{
+		DB: db,
+		rtt: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ac_server_rtt_seconds",
+			Help:    "Round trip time of successful checks, including retries.",
+			Buckets: RTT_BUCKETS,
+		}, SERVER_METRIC_LABELS),
+		up: prometheus.NewDesc(
+			"ac_server_up",
+			"Whether the server responded to its last check.",
+			SERVER_METRIC_LABELS, nil,
+		),
+		lastChecked: prometheus.NewDesc(
+			"ac_server_last_check_timestamp_seconds",
+			"When the server was last checked, as a Unix timestamp.",
+			SERVER_METRIC_LABELS, nil,
+		),
+		failures: prometheus.NewDesc(
+			"ac_server_consecutive_failures",
+			"How many checks in a row have failed since the server was last up.",
+			SERVER_METRIC_LABELS, nil,
+		),
+		listed: prometheus.NewDesc(
+			"ac_server_listed",
+			"Whether the server is in the community server list.",
+			SERVER_METRIC_LABELS, nil,
+		),
+		listedTotals: prometheus.NewDesc(
+			"ac_servers",
+			"How many known servers are listed and unlisted.",
+			[]string{"state"}, nil,
+		),
+	}
+}
+
+func (m *ServerMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.rtt.Describe(ch)
+	ch <- m.up
+	ch <- m.lastChecked
+	ch <- m.failures
+	ch <- m.listed
+	ch <- m.listedTotals
+}
+
+func (m *ServerMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.rtt.Collect(ch)
+
+	rows, err := m.DB.Query(QUERY_SERVER_METRICS)
+
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(m.up, err)
+		return
+	}
+
+	defer rows.Close()
+
+	var listed, unlisted int
+
+	for rows.Next() {
+		var guid, name, emu, kind string
+		var is_listed bool
+		var is_online sql.NullBool
+		var last_checked sql.NullInt64
+		var failures int
+
+		err := rows.Scan(&guid, &name, &emu, &kind, &is_listed, &is_online, &last_checked, &failures)
+
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(m.up, err)
+			return
+		}
+
+		labels := []string{guid, name, emu, kind}
+
+		ch <- prometheus.MustNewConstMetric(m.listed, prometheus.GaugeValue, boolToFloat(is_listed), labels...)
+
+		if is_listed {
+			listed++
+		} else {
+			unlisted++
+		}
+
+		// Servers that haven't been checked yet have no status to report
+		if !last_checked.Valid {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(m.up, prometheus.GaugeValue, boolToFloat(is_online.Valid && is_online.Bool), labels...)
+		ch <- prometheus.MustNewConstMetric(m.lastChecked, prometheus.GaugeValue, float64(last_checked.Int64), labels...)
+		ch <- prometheus.MustNewConstMetric(m.failures, prometheus.GaugeValue, float64(failures), labels...)
+	}
+
+	if err := rows.Err(); err != nil {
+		ch <- prometheus.NewInvalidMetric(m.up, err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(m.listedTotals, prometheus.GaugeValue, float64(listed), "listed")
+	ch <- prometheus.MustNewConstMetric(m.listedTotals, prometheus.GaugeValue, float64(unlisted), "unlisted")
+}
+
+func (m *ServerMetrics) WriteCheck(r CheckResult) error {
+	if r.Up {
+		m.rtt.WithLabelValues(r.Server.GUID, r.Server.Name, r.Server.Emulator, r.Server.Type).Observe(float64(r.RTT) / 1000)
+	}
+
+	return nil
+}
+
+func (m *ServerMetrics) WriteStateChange(e Event) error {
+	return nil
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerMetrics(t *testing.T) {
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+
+	metrics := NewServerMetrics(db)
+	sinks := []StatusSink{&SQLiteSink{DB: db}, metrics}
+
+	up := EventServer{ID: 1, GUID: "UpServer", Name: "UpServer"}
+	down := EventServer{ID: 2, GUID: "DownServer", Name: "DownServer"}
+
+	WriteCheck(sinks, CheckResult{Server: up, Up: false, CreatedAt: 100}, nil)
+	WriteCheck(sinks, CheckResult{Server: up, Up: true, RTT: 42, CreatedAt: 200}, nil)
+	WriteCheck(sinks, CheckResult{Server: down, Up: true, RTT: 1500, CreatedAt: 100}, nil)
+	WriteCheck(sinks, CheckResult{Server: down, Up: false, CreatedAt: 200}, nil)
+	WriteCheck(sinks, CheckResult{Server: down, Up: false, CreatedAt: 300}, nil)
+
+	// Drop DownServer from the list
+	list := GenerateTestServerList()
+	list.Servers = list.Servers[:1]
+	UpdateServersTable(db, list)
+
+	expected := `
+# HELP ac_server_consecutive_failures How many checks in a row have failed since the server was last up.
+# TYPE ac_server_consecutive_failures gauge
+ac_server_consecutive_failures{emu="",guid="DownServer",name="DownServer",type=""} 2
+ac_server_consecutive_failures{emu="",guid="UpServer",name="UpServer",type=""} 0
+# HELP ac_server_last_check_timestamp_seconds When the server was last checked, as a Unix timestamp.
+# TYPE ac_server_last_check_timestamp_seconds gauge
+ac_server_last_check_timestamp_seconds{emu="",guid="DownServer",name="DownServer",type=""} 300
+ac_server_last_check_timestamp_seconds{emu="",guid="UpServer",name="UpServer",type=""} 200
+# HELP ac_server_listed Whether the server is in the community server list.
+# TYPE ac_server_listed gauge
+ac_server_listed{emu="",guid="DownServer",name="DownServer",type=""} 0
+ac_server_listed{emu="",guid="UpServer",name="UpServer",type=""} 1
+# HELP ac_server_up Whether the server responded to its last check.
+# TYPE ac_server_up gauge
+ac_server_up{emu="",guid="DownServer",name="DownServer",type=""} 0
+ac_server_up{emu="",guid="UpServer",name="UpServer",type=""} 1
+# HELP ac_servers How many known servers are listed and unlisted.
+# TYPE ac_servers gauge
+ac_servers{state="listed"} 1
+ac_servers{state="unlisted"} 1
+`
+
+	err := testutil.CollectAndCompare(metrics, strings.NewReader(expected),
+		"ac_server_consecutive_failures",
+		"ac_server_last_check_timestamp_seconds",
+		"ac_server_listed",
+		"ac_server_up",
+		"ac_servers",
+	)
+
+	assert.NoError(t, err)
+
+	// Only successful checks are timed
+	assert.NoError(t, testutil.CollectAndCompare(metrics, strings.NewReader(`
+# HELP ac_server_rtt_seconds Round trip time of successful checks, including retries.
+# TYPE ac_server_rtt_seconds histogram
+ac_server_rtt_seconds_bucket{emu="",guid="UpServer",name="UpServer",type="",le="0.025"} 0
+ac_server_rtt_seconds_bucket{emu="",guid="UpServer",name="UpServer",type="",le="0.05"} 1
+ac_server_rtt_seconds_bucket{emu="",guid="UpServer",name="UpServer",type="",le="0.1"} 1
+ac_server_rtt_seconds_bucket{emu="",guid="UpServer",name="UpServer",type="",le="0.25"} 1
+ac_server_rtt_seconds_bucket{emu="",guid="UpServer",name="UpServer",type="",le="0.5"} 1
+ac_server_rtt_seconds_bucket{emu="",guid="UpServer",name="UpServer",type="",le="1"} 1
+ac_server_rtt_seconds_bucket{emu="",guid="UpServer",name="UpServer",type="",le="2.5"} 1
+ac_server_rtt_seconds_bucket{emu="",guid="UpServer",name="UpServer",type="",le="5"} 1
+ac_server_rtt_seconds_bucket{emu="",guid="UpServer",name="UpServer",type="",le="10"} 1
+ac_server_rtt_seconds_bucket{emu="",guid="UpServer",name="UpServer",type="",le="30"} 1
+ac_server_rtt_seconds_bucket{emu="",guid="UpServer",name="UpServer",type="",le="+Inf"} 1
+ac_server_rtt_seconds_sum{emu="",guid="UpServer",name="UpServer",type=""} 0.042
+ac_server_rtt_seconds_count{emu="",guid="UpServer",name="UpServer",type=""} 1
+ac_server_rtt_seconds_bucket{emu="",guid="DownServer",name="DownServer",type="",le="0.025"} 0
+ac_server_rtt_seconds_bucket{emu="",guid="DownServer",name="DownServer",type="",le="0.05"} 0
+ac_server_rtt_seconds_bucket{emu="",guid="DownServer",name="DownServer",type="",le="0.1"} 0
+ac_server_rtt_seconds_bucket{emu="",guid="DownServer",name="DownServer",type="",le="0.25"} 0
+ac_server_rtt_seconds_bucket{emu="",guid="DownServer",name="DownServer",type="",le="0.5"} 0
+ac_server_rtt_seconds_bucket{emu="",guid="DownServer",name="DownServer",type="",le="1"} 0
+ac_server_rtt_seconds_bucket{emu="",guid="DownServer",name="DownServer",type="",le="2.5"} 1
+ac_server_rtt_seconds_bucket{emu="",guid="DownServer",name="DownServer",type="",le="5"} 1
+ac_server_rtt_seconds_bucket{emu="",guid="DownServer",name="DownServer",type="",le="10"} 1
+ac_server_rtt_seconds_bucket{emu="",guid="DownServer",name="DownServer",type="",le="30"} 1
+ac_server_rtt_seconds_bucket{emu="",guid="DownServer",name="DownServer",type="",le="+Inf"} 1
+ac_server_rtt_seconds_sum{emu="",guid="DownServer",name="DownServer",type=""} 1.5
+ac_server_rtt_seconds_count{emu="",guid="DownServer",name="DownServer",type=""} 1
+`), "ac_server_rtt_seconds"))
+}
@@ -2,7 +2,9 @@ package lib
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"strings"
 )
 
 func CreateServersTable(db *sql.DB) (sql.Result, error) {
@@ -179,6 +181,302 @@ func CreateStatusesServerIdCreatedAtIndex(db *sql.DB) (sql.Result, error) {
 	return db.Exec(createIndexStatement)
 }
 
+// createRollupTable creates a table of per-server status aggregates bucketed
+// into periods of the given number of seconds, backfills it from statuses if
+// it's empty, and installs a trigger to keep it current as statuses are
+// inserted. Uptime queries read these instead of scanning statuses.
+func createRollupTable(db *sql.DB, table string, seconds int) (sql.Result, error) {
+	statement := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %[1]s (
+		server_id INTEGER NOT NULL,
+		start INTEGER NOT NULL,
+		n INTEGER NOT NULL,
+		n_up INTEGER NOT NULL,
+		rtt_n INTEGER NOT NULL,
+		rtt_sum INTEGER NOT NULL,
+		rtt_min INTEGER,
+		rtt_max INTEGER,
+		PRIMARY KEY (server_id, start)
+	);
+
+	CREATE INDEX IF NOT EXISTS %[1]s_start ON %[1]s (start);
+
+	INSERT INTO %[1]s (server_id, start, n, n_up, rtt_n, rtt_sum, rtt_min, rtt_max)
+	SELECT
+		server_id,
+		created_at - created_at %% %[2]d,
+		COUNT(*),
+		SUM(status),
+		COUNT(rtt),
+		COALESCE(SUM(rtt), 0),
+		MIN(rtt),
+		MAX(rtt)
+	FROM statuses
+	WHERE NOT EXISTS (SELECT 1 FROM %[1]s)
+	GROUP BY 1, 2;
+
+	CREATE TRIGGER IF NOT EXISTS %[1]s_insert AFTER INSERT ON statuses
+	BEGIN
+		INSERT INTO %[1]s (server_id, start, n, n_up, rtt_n, rtt_sum, rtt_min, rtt_max)
+		VALUES (
+			NEW.server_id,
+			NEW.created_at - NEW.created_at %% %[2]d,
+			1,
+			NEW.status,
+			NEW.rtt IS NOT NULL,
+			COALESCE(NEW.rtt, 0),
+			NEW.rtt,
+			NEW.rtt
+		)
+		ON CONFLICT (server_id, start) DO UPDATE SET
+			n = n + 1,
+			n_up = n_up + excluded.n_up,
+			rtt_n = rtt_n + excluded.rtt_n,
+			rtt_sum = rtt_sum + excluded.rtt_sum,
+			rtt_min = MIN(COALESCE(rtt_min, excluded.rtt_min), COALESCE(excluded.rtt_min, rtt_min)),
+			rtt_max = MAX(COALESCE(rtt_max, excluded.rtt_max), COALESCE(excluded.rtt_max, rtt_max));
+	END;
+	`, table, seconds)
+
+	return db.Exec(statement)
+}
+
+func CreateStatusesHourlyTable(db *sql.DB) (sql.Result, error) {
+	log.Println("CreateStatusesHourlyTable")
+
+	return createRollupTable(db, "statuses_hourly", 60*60)
+}
+
+func CreateStatusesDailyTable(db *sql.DB) (sql.Result, error) {
+	log.Println("CreateStatusesDailyTable")
+
+	return createRollupTable(db, "statuses_daily", 60*60*24)
+}
+
+func CreateIncidentsTable(db *sql.DB) (sql.Result, error) {
+	log.Println("CreateIncidentsTable")
+
+	createTableStatement := `
+	CREATE TABLE IF NOT EXISTS incidents (
+		id INTEGER NOT NULL PRIMARY KEY,
+		server_id INTEGER NOT NULL,
+		kind TEXT NOT NULL,
+		started_at INTEGER NOT NULL,
+		ended_at INTEGER,
+		message TEXT
+	);
+
+	CREATE INDEX IF NOT EXISTS incidents_server_id_started_at ON incidents (server_id, started_at DESC);
+	CREATE INDEX IF NOT EXISTS incidents_open ON incidents (server_id, kind) WHERE ended_at IS NULL;
+	`
+
+	return db.Exec(createTableStatement)
+}
+
+func BackfillOutageIncidents(db *sql.DB) (sql.Result, error) {
+	// Reconstructs outages from existing statuses the first time incidents
+	// are tracked. Each run of failed checks becomes an outage that ends at the
+	// next successful check, or is still open if there hasn't been one.
+	//
+	// This is one pass over statuses: counting successful checks so far splits
+	// each server's history into islands that start with a success, so an
+	// island's failures end at the start of the next island.
+	log.Println("BackfillOutageIncidents")
+
+	statement := `
+	INSERT INTO incidents (server_id, kind, started_at, ended_at, message)
+	SELECT
+		server_id,
+		'outage',
+		started_at,
+		recovered_at,
+		NULL
+	FROM (
+		SELECT
+			server_id,
+			MIN(CASE WHEN status = 0 THEN created_at END) AS started_at,
+			LEAD(MIN(created_at)) OVER (PARTITION BY server_id ORDER BY island) AS recovered_at
+		FROM (
+			SELECT
+				server_id,
+				created_at,
+				status,
+				SUM(status = 1) OVER (PARTITION BY server_id ORDER BY created_at, id) AS island
+			FROM statuses
+		)
+		GROUP BY server_id, island
+	)
+	WHERE
+		started_at IS NOT NULL
+	AND
+		NOT EXISTS (SELECT 1 FROM incidents);
+	`
+
+	return db.Exec(statement)
+}
+
+func CreateEventsTable(db *sql.DB) (sql.Result, error) {
+	log.Println("CreateEventsTable")
+
+	createTableStatement := `
+	CREATE TABLE IF NOT EXISTS events (
+		id INTEGER NOT NULL PRIMARY KEY,
+		server_id INTEGER NOT NULL,
+		kind TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		since INTEGER,
+		message TEXT
+	);
+
+	CREATE INDEX IF NOT EXISTS events_server_id_created_at ON events (server_id, created_at DESC);
+	`
+
+	return db.Exec(createTableStatement)
+}
+
+func CreateNotificationTables(db *sql.DB) (sql.Result, error) {
+	log.Println("CreateNotificationTables")
+
+	createTableStatement := `
+	CREATE TABLE IF NOT EXISTS notification_cursors (
+		notifier TEXT NOT NULL PRIMARY KEY,
+		event_id INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS notification_deliveries (
+		id INTEGER NOT NULL PRIMARY KEY,
+		notifier TEXT NOT NULL,
+		event_id INTEGER NOT NULL,
+		attempt INTEGER NOT NULL,
+		success INTEGER NOT NULL,
+		status_code INTEGER,
+		error TEXT,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS notification_deliveries_event_id ON notification_deliveries (event_id);
+	`
+
+	return db.Exec(createTableStatement)
+}
+
+func CreateSubscriptionsTable(db *sql.DB) (sql.Result, error) {
+	log.Println("CreateSubscriptionsTable")
+
+	createTableStatement := `
+	CREATE TABLE IF NOT EXISTS subscriptions (
+		id INTEGER NOT NULL PRIMARY KEY,
+		email TEXT NOT NULL,
+		server_id INTEGER NOT NULL,
+		confirm_token TEXT NOT NULL,
+		unsubscribe_token TEXT NOT NULL UNIQUE,
+		created_at INTEGER NOT NULL,
+		confirmed_at INTEGER,
+		UNIQUE (email, server_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS subscriptions_confirm_token ON subscriptions (confirm_token);
+	CREATE INDEX IF NOT EXISTS subscriptions_server_id ON subscriptions (server_id) WHERE confirmed_at IS NOT NULL;
+	`
+
+	return db.Exec(createTableStatement)
+}
+
+func CreateNotificationQueueTable(db *sql.DB) (sql.Result, error) {
+	log.Println("CreateNotificationQueueTable")
+
+	createTableStatement := `
+	CREATE TABLE IF NOT EXISTS notification_queue (
+		notifier TEXT NOT NULL,
+		event_id INTEGER NOT NULL,
+		due_at INTEGER NOT NULL,
+		PRIMARY KEY (notifier, event_id)
+	);
+	`
+
+	return db.Exec(createTableStatement)
+}
+
+func RenameURLNotifiers(db *sql.DB) error {
+	// Notifiers used to be named for their URLs, which often include a secret,
+	// e.g., Discord webhook tokens. This renames them everywhere they're
+	// stored and scrubs their URLs from logged delivery errors.
+	log.Println("RenameURLNotifiers")
+
+	rows, err := db.Query(`
+	SELECT notifier FROM notification_cursors WHERE notifier LIKE '%://%'
+	UNION
+	SELECT notifier FROM notification_deliveries WHERE notifier LIKE '%://%'
+	UNION
+	SELECT notifier FROM notification_queue WHERE notifier LIKE '%://%'
+	`)
+
+	if err != nil {
+		return err
+	}
+
+	var names []string
+
+	for rows.Next() {
+		var name string
+
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+
+		names = append(names, name)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	for _, name := range names {
+		renamed, ok := RenameLegacyNotifier(name)
+
+		if !ok {
+			continue
+		}
+
+		for _, table := range []string{"notification_cursors", "notification_deliveries", "notification_queue"} {
+			_, err := tx.Exec(fmt.Sprintf("UPDATE OR REPLACE %s SET notifier = ? WHERE notifier = ?", table), renamed, name)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		_, rawURL, _ := strings.Cut(name, ":")
+
+		_, err := tx.Exec(`
+		UPDATE notification_deliveries
+		SET error = REPLACE(error, ?, ?)
+		WHERE notifier = ? AND error IS NOT NULL
+		`, rawURL, redactedURL(rawURL), renamed)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 func AutoMigrate(db *sql.DB) error {
 	log.Println("AutoMigrating...")
 
@@ -242,6 +540,60 @@ func AutoMigrate(db *sql.DB) error {
 		return err
 	}
 
+	_, err = CreateStatusesHourlyTable(db)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = CreateStatusesDailyTable(db)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = CreateIncidentsTable(db)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = BackfillOutageIncidents(db)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = CreateEventsTable(db)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = CreateNotificationTables(db)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = CreateSubscriptionsTable(db)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = CreateNotificationQueueTable(db)
+
+	if err != nil {
+		return err
+	}
+
+	err = RenameURLNotifiers(db)
+
+	if err != nil {
+		return err
+	}
+
 	log.Println("...AutoMigration Done")
 
 	return nil
@@ -0,0 +1,305 @@
+package lib
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notifier delivers events somewhere outside the monitor. Name identifies the
+// notifier in the delivery log and must be stable across restarts since it's
+// also used to remember which events have been delivered. It's logged and
+// stored in the database, and so in backups, so it mustn't contain secrets.
+type Notifier interface {
+	Name() string
+	Notify(events []Event) error
+}
+
+// PermanentError wraps notifier errors that retrying won't fix, e.g., a
+// webhook URL that returns 404
+type PermanentError struct {
+	Err error
+}
+
+func (e PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// StatusCoder is implemented by errors that carry an HTTP status code so it
+// can be recorded in the delivery log
+type StatusCoder interface {
+	StatusCode() int
+}
+
+// Backoff controls how failed deliveries are retried. The delay doubles after
+// each attempt up to Max.
+type Backoff struct {
+	Attempts int
+	Initial  time.Duration
+	Max      time.Duration
+}
+
+var DeliveryBackoff = Backoff{
+	Attempts: 5,
+	Initial:  2 * time.Second,
+	Max:      time.Minute,
+}
+
+// How many events to deliver to each notifier per run
+const deliveryBatchSize = 100
+
+// NotifiersFromEnv builds the notifiers configured in the environment. Email
+// subscriptions are only notified if mailer isn't nil.
+func NotifiersFromEnv(db *sql.DB, mailer *Mailer) []Notifier {
+	var notifiers []Notifier
+
+	secret := Env("WEBHOOK_SECRET", "")
+
+	for _, url := range strings.FieldsFunc(Env("WEBHOOK_URLS", ""), isListSeparator) {
+		notifiers = append(notifiers, NewWebhookNotifier(url, secret))
+	}
+
+	for _, n := range ParseDiscordWebhooks(Env("DISCORD_WEBHOOKS", ""), BaseURL()) {
+		notifiers = append(notifiers, n)
+	}
+
+	if mailer != nil {
+		notifiers = append(notifiers, NewEmailNotifier(db, mailer, BaseURL()))
+	}
+
+	return notifiers
+}
+
+// RenameLegacyNotifier returns the current name of a notifier that was named
+// for its full URL before notifier names stopped including secrets, e.g.,
+// "discord:https://discord.com/api/webhooks/123/token"
+func RenameLegacyNotifier(name string) (string, bool) {
+	kind, rawURL, _ := strings.Cut(name, ":")
+
+	if !strings.Contains(rawURL, "://") {
+		return name, false
+	}
+
+	switch kind {
+	case "webhook":
+		return NewWebhookNotifier(rawURL, "").Name(), true
+	case "discord":
+		return NewDiscordNotifier(rawURL, nil, "").Name(), true
+	}
+
+	return name, false
+}
+
+func isListSeparator(r rune) bool {
+	return r == ',' || r == ' ' || r == '\n'
+}
+
+func notificationCursor(db *sql.DB, notifier string) (int, bool, error) {
+	var event_id int
+
+	err := db.QueryRow(`
+		SELECT event_id
+		FROM notification_cursors
+		WHERE notifier = ?
+	`, notifier).Scan(&event_id)
+
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+
+	return event_id, err == nil, err
+}
+
+func setNotificationCursor(db *sql.DB, notifier string, event_id int) error {
+	_, err := db.Exec(`
+		INSERT INTO notification_cursors (notifier, event_id)
+		VALUES (?, ?)
+		ON CONFLICT (notifier) DO UPDATE SET event_id = excluded.event_id
+	`, notifier, event_id)
+
+	return err
+}
+
+// InitNotifiers starts any notifiers that haven't been seen before at the
+// latest event so configuring a new one doesn't send it the whole history
+func InitNotifiers(db *sql.DB, notifiers []Notifier) error {
+	latest, err := LatestEventID(db)
+
+	if err != nil {
+		return err
+	}
+
+	for _, n := range notifiers {
+		_, found, err := notificationCursor(db, n.Name())
+
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			log.Printf("Starting notifier %s at event %d", n.Name(), latest)
+
+			err = setNotificationCursor(db, n.Name(), latest)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func logDelivery(db *sql.DB, notifier string, events []Event, attempt int, deliveryErr error) {
+	var status_code sql.NullInt64
+	var message sql.NullString
+
+	if deliveryErr != nil {
+		message = sql.NullString{String: deliveryErr.Error(), Valid: true}
+	}
+
+	var coder StatusCoder
+
+	if errors.As(deliveryErr, &coder) {
+		status_code = sql.NullInt64{Int64: int64(coder.StatusCode()), Valid: true}
+	}
+
+	now := time.Now().UTC().Unix()
+
+	for _, e := range events {
+		_, err := db.Exec(`
+			INSERT INTO notification_deliveries (notifier, event_id, attempt, success, status_code, error, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, notifier, e.ID, attempt, deliveryErr == nil, status_code, message, now)
+
+		if err != nil {
+			log.Printf("Failed to log delivery of event %d to %s: %s", e.ID, notifier, err)
+		}
+	}
+}
+
+// deliver sends events to a notifier, retrying with exponential backoff, and
+// logs every attempt
+func deliver(db *sql.DB, n Notifier, events []Event, backoff Backoff) error {
+	delay := backoff.Initial
+
+	var err error
+
+	for attempt := 1; attempt <= backoff.Attempts; attempt++ {
+		err = n.Notify(events)
+		logDelivery(db, n.Name(), events, attempt, err)
+
+		if err == nil {
+			return nil
+		}
+
+		log.Printf("Attempt %d to notify %s failed: %s", attempt, n.Name(), err)
+
+		var permanent PermanentError
+
+		if errors.As(err, &permanent) || attempt == backoff.Attempts {
+			break
+		}
+
+		time.Sleep(delay)
+		delay = min(delay*2, backoff.Max)
+	}
+
+	return err
+}
+
+// Held while events are being delivered. Retries can make a run outlast the
+// interval it's scheduled at and overlapping runs would send events twice.
+var delivering sync.Mutex
+
+// DeliverEvents queues the events recorded since each notifier was last run
+// according to its policy and then sends it everything that's due in one
+// batch. Events that still fail after retrying stay queued for the next run,
+// unless the notifier returned a PermanentError, in which case they're dropped
+// since sending them again won't help; the delivery log has the details. Runs
+// are skipped if the previous one is still going.
+func DeliverEvents(db *sql.DB, notifiers []Notifier, policies NotificationPolicies, now time.Time) {
+	if !delivering.TryLock() {
+		log.Println("Skipping event delivery, the previous run is still going")
+		return
+	}
+
+	defer delivering.Unlock()
+
+	for _, n := range notifiers {
+		cursor, found, err := notificationCursor(db, n.Name())
+
+		if err == nil && !found {
+			// Nothing to deliver yet to a notifier we've never seen
+			err = InitNotifiers(db, []Notifier{n})
+
+			if err == nil {
+				continue
+			}
+		}
+
+		if err != nil {
+			log.Printf("Failed to get notification cursor for %s: %s", n.Name(), err)
+			continue
+		}
+
+		policy := policies.For(n.Name())
+
+		events, err := EventsAfter(db, cursor, deliveryBatchSize)
+
+		if err != nil {
+			log.Printf("Failed to get events for %s: %s", n.Name(), err)
+			continue
+		}
+
+		for _, e := range events {
+			err := enqueue(db, n.Name(), policy, e)
+
+			if err == nil {
+				err = setNotificationCursor(db, n.Name(), e.ID)
+			}
+
+			if err != nil {
+				log.Printf("Failed to queue event %d for %s: %s", e.ID, n.Name(), err)
+				break
+			}
+		}
+
+		ready, err := readyEvents(db, n.Name(), policy, now.UTC().Unix())
+
+		if err != nil {
+			log.Printf("Failed to get queued events for %s: %s", n.Name(), err)
+			continue
+		}
+
+		if len(ready) == 0 {
+			continue
+		}
+
+		err = deliver(db, n, ready, DeliveryBackoff)
+
+		var permanent PermanentError
+
+		if err != nil && !errors.As(err, &permanent) {
+			log.Printf("Failed to deliver %d events to %s, trying again next run: %s", len(ready), n.Name(), err)
+			continue
+		}
+
+		if err != nil {
+			log.Printf("Giving up on delivering %d events to %s: %s", len(ready), n.Name(), err)
+		}
+
+		err = dequeue(db, n.Name(), ready)
+
+		if err != nil {
+			log.Printf("Failed to remove delivered events from the queue for %s: %s", n.Name(), err)
+		}
+	}
+}
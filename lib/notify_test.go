@@ -0,0 +1,497 @@
+package lib
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func UseTestBackoff(t *testing.T) {
+	previous := DeliveryBackoff
+	DeliveryBackoff = Backoff{Attempts: 3, Initial: time.Millisecond, Max: time.Millisecond}
+	t.Cleanup(func() { DeliveryBackoff = previous })
+}
+
+func RecordTestEvent(t *testing.T, db *sql.DB, server_id int, kind string) {
+	InTestTx(t, db, func(tx *sql.Tx) error {
+		return RecordEvent(tx, server_id, kind, time.Now().UTC().Unix(), sql.NullInt64{}, "")
+	})
+}
+
+func TestStatusTransitionEvents(t *testing.T) {
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+
+	unknown := sql.NullBool{}
+	online := sql.NullBool{Bool: true, Valid: true}
+	offline := sql.NullBool{Bool: false, Valid: true}
+
+	InTestTx(t, db, func(tx *sql.Tx) error { return RecordStatusTransition(tx, 1, unknown, true, 100, "") })
+	InTestTx(t, db, func(tx *sql.Tx) error { return RecordStatusTransition(tx, 1, online, true, 200, "") })
+	InTestTx(t, db, func(tx *sql.Tx) error {
+		if err := RecordStatusTransition(tx, 1, online, false, 300, "timeout"); err != nil {
+			return err
+		}
+
+		_, err := StartIncident(tx, 1, INCIDENT_OUTAGE, 300, "timeout")
+
+		return err
+	})
+	InTestTx(t, db, func(tx *sql.Tx) error { return RecordStatusTransition(tx, 1, offline, true, 400, "") })
+
+	events, err := EventsAfter(db, 0, 10)
+
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, EVENT_DOWN, events[0].Kind)
+	assert.Equal(t, "timeout", events[0].Message)
+	assert.Equal(t, "UpServer", events[0].Server.Name)
+	assert.Equal(t, EVENT_UP, events[1].Kind)
+	assert.Equal(t, int64(300), events[1].SinceAt.Int64)
+	assert.Equal(t, "1970-01-01T00:05:00Z", events[1].Since.String)
+}
+
+func TestListingTransitionEvents(t *testing.T) {
+	db := OpenTestDB(t)
+	list := GenerateTestServerList()
+
+	UpdateServersTable(db, list)
+
+	// DownServer drops off the list and then comes back
+	UpdateServersTable(db, ServerList{Servers: list.Servers[:1]})
+	UpdateServersTable(db, list)
+
+	events, err := EventsAfter(db, 0, 10)
+
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, EVENT_DELISTED, events[0].Kind)
+	assert.Equal(t, "DownServer", events[0].Server.Name)
+	assert.Equal(t, EVENT_RELISTED, events[1].Kind)
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	UseTestBackoff(t)
+
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+
+	var mu sync.Mutex
+	var attempts int
+	var received []Event
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		attempts++
+
+		// Fail the first attempt to exercise retries
+		if attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		signature := SignWebhook("hunter2", r.Header.Get("X-Monitor-Timestamp"), body)
+
+		if r.Header.Get("X-Monitor-Signature") != signature {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var payload WebhookPayload
+		json.Unmarshal(body, &payload)
+		received = append(received, payload.Events...)
+	}))
+	defer server.Close()
+
+	notifiers := []Notifier{NewWebhookNotifier(server.URL, "hunter2")}
+
+	// Events from before a notifier is set up aren't sent
+	RecordTestEvent(t, db, 1, EVENT_DOWN)
+	assert.NoError(t, InitNotifiers(db, notifiers))
+
+	RecordTestEvent(t, db, 2, EVENT_DOWN)
+	DeliverEvents(db, notifiers, NotificationPolicies{}, time.Now())
+
+	assert.Len(t, received, 1)
+	assert.Equal(t, "DownServer", received[0].Server.Name)
+	assert.Equal(t, 2, attempts)
+
+	var logged, succeeded int
+	err := db.QueryRow("SELECT COUNT(*), SUM(success) FROM notification_deliveries").Scan(&logged, &succeeded)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, logged)
+	assert.Equal(t, 1, succeeded)
+
+	// Nothing new to send
+	DeliverEvents(db, notifiers, NotificationPolicies{}, time.Now())
+	assert.Len(t, received, 1)
+
+	// A bad secret is rejected and not retried since it's a client error
+	notifiers = []Notifier{NewWebhookNotifier(server.URL+"/other", "wrong")}
+	assert.NoError(t, InitNotifiers(db, notifiers))
+
+	RecordTestEvent(t, db, 1, EVENT_UP)
+	attempts = 0
+	DeliverEvents(db, notifiers, NotificationPolicies{}, time.Now())
+
+	assert.Equal(t, 2, attempts)
+
+	var status_code int
+	err = db.QueryRow("SELECT status_code FROM notification_deliveries ORDER BY id DESC LIMIT 1").Scan(&status_code)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, status_code)
+}
+
+func TestNotifierNamesHideURLs(t *testing.T) {
+	n := NewWebhookNotifier("http://127.0.0.1:1/hook?token=secret", "")
+
+	assert.Regexp(t, `^webhook:127\.0\.0\.1:1/[0-9a-f]{12}$`, n.Name())
+	assert.NotEqual(t, NewWebhookNotifier("http://127.0.0.1:1/hook?token=other", "").Name(), n.Name())
+
+	// Nothing's listening so this fails with an error that would include the
+	// URL
+	err := n.Notify(nil)
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "secret")
+}
+
+func TestRenameURLNotifiers(t *testing.T) {
+	db := OpenTestDB(t)
+	legacy := "webhook:https://example.com/hook?token=secret"
+
+	_, err := db.Exec("INSERT INTO notification_cursors (notifier, event_id) VALUES ('discord:https://discord.com/api/webhooks/123/token', 7)")
+	assert.NoError(t, err)
+
+	_, err = db.Exec(`
+		INSERT INTO notification_cursors (notifier, event_id) VALUES (?, 5);
+		INSERT INTO notification_queue (notifier, event_id, due_at) VALUES (?, 6, 0);
+		INSERT INTO notification_deliveries (notifier, event_id, attempt, success, error, created_at)
+		VALUES (?, 5, 1, 0, 'Post "https://example.com/hook?token=secret": EOF', 0);
+	`, legacy, legacy, legacy)
+	assert.NoError(t, err)
+
+	assert.NoError(t, AutoMigrate(db))
+
+	renamed := NewWebhookNotifier("https://example.com/hook?token=secret", "").Name()
+
+	cursor, found, err := notificationCursor(db, renamed)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 5, cursor)
+
+	var queued int
+	assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM notification_queue WHERE notifier = ?", renamed).Scan(&queued))
+	assert.Equal(t, 1, queued)
+
+	var message string
+	assert.NoError(t, db.QueryRow("SELECT error FROM notification_deliveries WHERE notifier = ?", renamed).Scan(&message))
+	assert.Equal(t, `Post "https://example.com/...": EOF`, message)
+
+	cursor, found, err = notificationCursor(db, "discord:123")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 7, cursor)
+}
+
+func TestDeliverEventsSkipsOverlappingRuns(t *testing.T) {
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+
+	var received int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { received++ }))
+	defer server.Close()
+
+	notifiers := []Notifier{NewWebhookNotifier(server.URL, "")}
+	policies := NotificationPolicies{Default: NotificationPolicy{}}
+	assert.NoError(t, InitNotifiers(db, notifiers))
+	RecordTestEvent(t, db, 1, EVENT_DOWN)
+
+	// As if a previous run were still retrying
+	delivering.Lock()
+	DeliverEvents(db, notifiers, policies, time.Now())
+	delivering.Unlock()
+
+	assert.Equal(t, 0, received)
+
+	DeliverEvents(db, notifiers, policies, time.Now())
+	assert.Equal(t, 1, received)
+}
+
+func TestParseDiscordWebhooks(t *testing.T) {
+	notifiers := ParseDiscordWebhooks("https://discord.com/api/webhooks/123/token; https://discord.test/b|Levistras, Reefcull's Realm\n", "https://example.com/")
+
+	assert.Len(t, notifiers, 2)
+	assert.Equal(t, "discord:123", notifiers[0].Name())
+	assert.Regexp(t, `^discord:discord\.test/[0-9a-f]{12}$`, notifiers[1].Name())
+	assert.True(t, notifiers[0].Wants("Anything"))
+	assert.True(t, notifiers[1].Wants("levistras"))
+	assert.True(t, notifiers[1].Wants("Reefcull's Realm"))
+	assert.False(t, notifiers[1].Wants("Frostfell"))
+	assert.Equal(t, "https://example.com", notifiers[1].BaseURL)
+}
+
+func TestDiscordNotifier(t *testing.T) {
+	var attempts int
+	var received []DiscordMessage
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+
+		// Rate limit the first attempt
+		if attempts == 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"message": "You are being rate limited.", "retry_after": 0.01, "global": false}`))
+			return
+		}
+
+		var message DiscordMessage
+		json.NewDecoder(r.Body).Decode(&message)
+		received = append(received, message)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	n := NewDiscordNotifier(server.URL, []string{"UpServer"}, "https://example.com")
+
+	down := Event{Kind: EVENT_DOWN, Server: EventServer{Name: "DownServer"}}
+	up := Event{
+		Kind:      EVENT_UP,
+		Time:      "2024-01-01T12:10:00Z",
+		CreatedAt: 5400,
+		SinceAt:   sql.NullInt64{Int64: 0, Valid: true},
+		Server:    EventServer{Name: "UpServer", Emulator: "ACE", Discord: "https://discord.gg/test"},
+	}
+
+	assert.NoError(t, n.Notify([]Event{down}))
+	assert.Equal(t, 0, attempts)
+
+	assert.NoError(t, n.Notify([]Event{down, up}))
+	assert.Equal(t, 2, attempts)
+	assert.Len(t, received, 1)
+
+	embed := received[0].Embeds[0]
+	assert.Len(t, received[0].Embeds, 1)
+	assert.Equal(t, "UpServer is back up", embed.Title)
+	assert.Equal(t, "https://example.com/statuses/UpServer", embed.URL)
+	assert.Contains(t, embed.Fields, DiscordEmbedField{Name: "Emulator", Value: "ACE", Inline: true})
+	assert.Contains(t, embed.Fields, DiscordEmbedField{Name: "Down for", Value: "1h 30m", Inline: true})
+	assert.Contains(t, embed.Fields, DiscordEmbedField{Name: "Discord", Value: "https://discord.gg/test"})
+}
+
+func TestFormatDuration(t *testing.T) {
+	assert.Equal(t, "0m", FormatDuration(10*time.Second))
+	assert.Equal(t, "5m", FormatDuration(5*time.Minute))
+	assert.Equal(t, "2h 1m", FormatDuration(121*time.Minute))
+	assert.Equal(t, "3d 4h", FormatDuration(76*time.Hour+20*time.Minute))
+}
+
+// RecordingNotifier remembers each batch of events it's sent
+type RecordingNotifier struct {
+	Batches [][]Event
+}
+
+func (n *RecordingNotifier) Name() string {
+	return "recording"
+}
+
+func (n *RecordingNotifier) Notify(events []Event) error {
+	n.Batches = append(n.Batches, events)
+	return nil
+}
+
+func (n *RecordingNotifier) Kinds() [][]string {
+	var kinds [][]string
+
+	for _, batch := range n.Batches {
+		var batchKinds []string
+
+		for _, e := range batch {
+			batchKinds = append(batchKinds, e.Server.Name+" "+e.Kind)
+		}
+
+		kinds = append(kinds, batchKinds)
+	}
+
+	return kinds
+}
+
+// FailingNotifier fails with Err until it's cleared and then records batches
+type FailingNotifier struct {
+	RecordingNotifier
+	Err error
+}
+
+func (n *FailingNotifier) Notify(events []Event) error {
+	if n.Err != nil {
+		return n.Err
+	}
+
+	return n.RecordingNotifier.Notify(events)
+}
+
+func TestDeliverEventsKeepsFailedEvents(t *testing.T) {
+	UseTestBackoff(t)
+
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+
+	n := &FailingNotifier{Err: errors.New("unavailable")}
+	assert.NoError(t, InitNotifiers(db, []Notifier{n}))
+
+	// Events that fail to send are kept for the next run
+	RecordTestEvent(t, db, 2, EVENT_DOWN)
+	DeliverEvents(db, []Notifier{n}, NotificationPolicies{}, time.Now())
+
+	assert.Empty(t, n.Batches)
+	AssertNRows(t, db, "notification_queue", 1)
+
+	n.Err = nil
+	RecordTestEvent(t, db, 1, EVENT_DOWN)
+	DeliverEvents(db, []Notifier{n}, NotificationPolicies{}, time.Now())
+
+	assert.Equal(t, [][]string{{"DownServer down", "UpServer down"}}, n.Kinds())
+	AssertNRows(t, db, "notification_queue", 0)
+
+	// But not if sending them again won't help
+	n.Err = PermanentError{Err: errors.New("not found")}
+	RecordTestEvent(t, db, 2, EVENT_UP)
+	DeliverEvents(db, []Notifier{n}, NotificationPolicies{}, time.Now())
+
+	AssertNRows(t, db, "notification_queue", 0)
+}
+
+func RecordTestEventAt(t *testing.T, db *sql.DB, server_id int, kind string, at time.Time) {
+	InTestTx(t, db, func(tx *sql.Tx) error {
+		return RecordEvent(tx, server_id, kind, at.Unix(), sql.NullInt64{}, "")
+	})
+}
+
+func TestParseNotificationPolicies(t *testing.T) {
+	policies, err := ParseNotificationPolicies("*=cooldown:1h; email=digest:8 ;webhook:https://example.com/?a=b=min_outage:0s,cooldown:5m")
+
+	assert.NoError(t, err)
+	assert.Equal(t, NotificationPolicy{Cooldown: time.Hour, MinOutage: DefaultNotificationPolicy.MinOutage}, policies.For("discord:1"))
+	assert.Equal(t, NotificationPolicy{Cooldown: time.Hour, MinOutage: DefaultNotificationPolicy.MinOutage, Digest: true, DigestHour: 8}, policies.For("email"))
+	assert.Equal(t, NotificationPolicy{Cooldown: 5 * time.Minute}, policies.For(NewWebhookNotifier("https://example.com/?a=b", "").Name()))
+
+	// Whitespace around keys doesn't change which option they set
+	policies, err = ParseNotificationPolicies("email= cooldown :10m")
+	assert.NoError(t, err)
+	assert.Equal(t, NotificationPolicy{Cooldown: 10 * time.Minute, MinOutage: DefaultNotificationPolicy.MinOutage}, policies.For("email"))
+
+	_, err = ParseNotificationPolicies("email=digest:24")
+	assert.Error(t, err)
+
+	_, err = ParseNotificationPolicies("email=often:yes")
+	assert.Error(t, err)
+
+	_, err = ParseNotificationPolicies("cooldown:1h")
+	assert.Error(t, err)
+}
+
+func TestNotificationMinOutage(t *testing.T) {
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+
+	n := &RecordingNotifier{}
+	policies := NotificationPolicies{Default: NotificationPolicy{MinOutage: 10 * time.Minute}}
+	start := time.Now()
+
+	assert.NoError(t, InitNotifiers(db, []Notifier{n}))
+
+	// A blip shorter than the minimum outage isn't mentioned
+	RecordTestEventAt(t, db, 1, EVENT_DOWN, start)
+	DeliverEvents(db, []Notifier{n}, policies, start.Add(time.Minute))
+	RecordTestEventAt(t, db, 1, EVENT_UP, start.Add(5*time.Minute))
+	DeliverEvents(db, []Notifier{n}, policies, start.Add(6*time.Minute))
+
+	assert.Empty(t, n.Batches)
+
+	// Longer outages are, and servers that go down together are grouped
+	RecordTestEventAt(t, db, 1, EVENT_DOWN, start.Add(20*time.Minute))
+	RecordTestEventAt(t, db, 2, EVENT_DOWN, start.Add(20*time.Minute))
+	DeliverEvents(db, []Notifier{n}, policies, start.Add(25*time.Minute))
+
+	assert.Empty(t, n.Batches)
+
+	DeliverEvents(db, []Notifier{n}, policies, start.Add(30*time.Minute))
+	RecordTestEventAt(t, db, 1, EVENT_UP, start.Add(40*time.Minute))
+	DeliverEvents(db, []Notifier{n}, policies, start.Add(40*time.Minute))
+
+	assert.Equal(t, [][]string{{"UpServer down", "DownServer down"}, {"UpServer up"}}, n.Kinds())
+}
+
+func TestNotificationCooldown(t *testing.T) {
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+
+	n := &RecordingNotifier{}
+	policies := NotificationPolicies{Default: NotificationPolicy{Cooldown: 30 * time.Minute}}
+	start := time.Now()
+
+	assert.NoError(t, InitNotifiers(db, []Notifier{n}))
+
+	RecordTestEventAt(t, db, 1, EVENT_DOWN, start)
+	DeliverEvents(db, []Notifier{n}, policies, start)
+
+	// Recoveries aren't held back but another alert is until the cooldown
+	// ends, and is dropped if the server recovers before then
+	RecordTestEventAt(t, db, 1, EVENT_UP, start.Add(time.Minute))
+	DeliverEvents(db, []Notifier{n}, policies, start.Add(time.Minute))
+	RecordTestEventAt(t, db, 1, EVENT_DOWN, start.Add(2*time.Minute))
+	DeliverEvents(db, []Notifier{n}, policies, start.Add(2*time.Minute))
+	RecordTestEventAt(t, db, 1, EVENT_UP, start.Add(3*time.Minute))
+	RecordTestEventAt(t, db, 1, EVENT_DOWN, start.Add(4*time.Minute))
+	DeliverEvents(db, []Notifier{n}, policies, start.Add(4*time.Minute))
+
+	assert.Equal(t, [][]string{{"UpServer down"}, {"UpServer up"}}, n.Kinds())
+
+	DeliverEvents(db, []Notifier{n}, policies, start.Add(31*time.Minute))
+
+	assert.Equal(t, [][]string{{"UpServer down"}, {"UpServer up"}, {"UpServer down"}}, n.Kinds())
+}
+
+func TestNotificationDigest(t *testing.T) {
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+
+	n := &RecordingNotifier{}
+	start := time.Now().UTC()
+	digestHour := start.Add(2 * time.Hour).Hour()
+	digest := time.Date(start.Year(), start.Month(), start.Day(), digestHour, 0, 0, 0, time.UTC)
+
+	if digest.Before(start) {
+		digest = digest.AddDate(0, 0, 1)
+	}
+
+	policies := NotificationPolicies{Default: NotificationPolicy{MinOutage: 10 * time.Minute, Digest: true, DigestHour: digestHour}}
+
+	assert.NoError(t, InitNotifiers(db, []Notifier{n}))
+
+	// Blips are left out of digests but longer outages aren't even if they're
+	// over by the time it's sent
+	RecordTestEventAt(t, db, 1, EVENT_DOWN, start)
+	RecordTestEventAt(t, db, 1, EVENT_UP, start.Add(time.Minute))
+	RecordTestEventAt(t, db, 2, EVENT_DOWN, start.Add(2*time.Minute))
+	RecordTestEventAt(t, db, 2, EVENT_UP, start.Add(30*time.Minute))
+	DeliverEvents(db, []Notifier{n}, policies, digest.Add(-time.Minute))
+
+	assert.Empty(t, n.Batches)
+
+	DeliverEvents(db, []Notifier{n}, policies, digest)
+
+	assert.Equal(t, [][]string{{"DownServer down", "DownServer up"}}, n.Kinds())
+}
@@ -0,0 +1,309 @@
+package lib
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NotificationPolicy controls when a notifier is sent events.
+//
+// Cooldown is how long after a server was last notified about before another
+// alert for it, i.e., a down or delisted event, is sent. Recoveries aren't held
+// back so the all-clear is never delayed.
+//
+// MinOutage is how long a server has to stay down, or delisted, before the
+// alert is sent. If it comes back first, the alert and the recovery cancel out
+// and neither is sent.
+//
+// With Digest set, events are held and sent together once a day at DigestHour
+// (UTC) instead. Cooldowns don't apply to digests.
+type NotificationPolicy struct {
+	Cooldown   time.Duration
+	MinOutage  time.Duration
+	Digest     bool
+	DigestHour int
+}
+
+// DefaultNotificationPolicy waits for a server to fail two checks in a row
+// before alerting and alerts about each server at most every half hour
+var DefaultNotificationPolicy = NotificationPolicy{
+	Cooldown:  30 * time.Minute,
+	MinOutage: 10 * time.Minute,
+}
+
+// NotificationPolicies holds the policy for every notifier. Overrides are keyed
+// by "*", a notifier kind like "discord", or a full notifier name like
+// "discord:123" and are applied in that order. Webhooks can also be given by
+// URL, e.g., "discord:https://...".
+type NotificationPolicies struct {
+	Default   NotificationPolicy
+	Overrides map[string][]policyOption
+}
+
+type policyOption func(p *NotificationPolicy)
+
+// Events that alert about a problem, and the events that resolve them
+var notificationOpposites = map[string]string{
+	EVENT_DOWN:     EVENT_UP,
+	EVENT_UP:       EVENT_DOWN,
+	EVENT_DELISTED: EVENT_RELISTED,
+	EVENT_RELISTED: EVENT_DELISTED,
+}
+
+func isAlert(kind string) bool {
+	return kind == EVENT_DOWN || kind == EVENT_DELISTED
+}
+
+func parsePolicyOption(option string) (policyOption, error) {
+	key, value, found := strings.Cut(strings.TrimSpace(option), ":")
+
+	if !found {
+		return nil, fmt.Errorf("couldn't parse notification policy option %q, expected key:value", option)
+	}
+
+	key = strings.TrimSpace(key)
+	value = strings.TrimSpace(value)
+
+	switch key {
+	case "cooldown", "min_outage":
+		d, err := time.ParseDuration(value)
+
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("couldn't parse notification policy option %q, expected a duration", option)
+		}
+
+		if key == "cooldown" {
+			return func(p *NotificationPolicy) { p.Cooldown = d }, nil
+		}
+
+		return func(p *NotificationPolicy) { p.MinOutage = d }, nil
+	case "digest":
+		if value == "off" {
+			return func(p *NotificationPolicy) { p.Digest = false }, nil
+		}
+
+		hour, err := strconv.Atoi(value)
+
+		if err != nil || hour < 0 || hour > 23 {
+			return nil, fmt.Errorf("couldn't parse notification policy option %q, expected an hour from 0 to 23 or off", option)
+		}
+
+		return func(p *NotificationPolicy) { p.Digest = true; p.DigestHour = hour }, nil
+	default:
+		return nil, fmt.Errorf("unknown notification policy option %q", key)
+	}
+}
+
+// ParseNotificationPolicies parses a semicolon-separated list of overrides
+// like "*=cooldown:1h,min_outage:20m;email=digest:8" on top of
+// DefaultNotificationPolicy
+func ParseNotificationPolicies(value string) (NotificationPolicies, error) {
+	policies := NotificationPolicies{
+		Default:   DefaultNotificationPolicy,
+		Overrides: map[string][]policyOption{},
+	}
+
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		// Notifier names can contain = in URLs but options can't
+		i := strings.LastIndex(entry, "=")
+
+		if i <= 0 {
+			return policies, fmt.Errorf("couldn't parse notification policy %q, expected notifier=options", entry)
+		}
+
+		match := strings.TrimSpace(entry[:i])
+
+		// Notifiers used to be named for their URLs
+		match, _ = RenameLegacyNotifier(match)
+
+		for _, option := range strings.Split(entry[i+1:], ",") {
+			parsed, err := parsePolicyOption(option)
+
+			if err != nil {
+				return policies, err
+			}
+
+			policies.Overrides[match] = append(policies.Overrides[match], parsed)
+		}
+	}
+
+	return policies, nil
+}
+
+// For returns the policy for the notifier with the given name
+func (p NotificationPolicies) For(name string) NotificationPolicy {
+	policy := p.Default
+	kind, _, _ := strings.Cut(name, ":")
+
+	matches := []string{"*", kind}
+
+	if name != kind {
+		matches = append(matches, name)
+	}
+
+	for _, match := range matches {
+		for _, option := range p.Overrides[match] {
+			option(&policy)
+		}
+	}
+
+	return policy
+}
+
+// nextDigest returns the first digest time after ts
+func (p NotificationPolicy) nextDigest(ts int64) int64 {
+	t := time.Unix(ts, 0).UTC()
+	digest := time.Date(t.Year(), t.Month(), t.Day(), p.DigestHour, 0, 0, 0, time.UTC)
+
+	if !digest.After(t) {
+		digest = digest.AddDate(0, 0, 1)
+	}
+
+	return digest.Unix()
+}
+
+// cancels returns whether an event resolves a pending one so neither needs
+// sending. Outside of digests that's whenever the first is still pending
+// since it's being held by the minimum outage or a cooldown. Digests report
+// everything that happened during the day except for blips shorter than the
+// minimum outage.
+func (p NotificationPolicy) cancels(pending Event, e Event) bool {
+	if notificationOpposites[pending.Kind] != e.Kind {
+		return false
+	}
+
+	return !p.Digest || e.CreatedAt-pending.CreatedAt < int64(p.MinOutage.Seconds())
+}
+
+// dueAt returns when an event should be sent, ignoring cooldowns
+func (p NotificationPolicy) dueAt(e Event) int64 {
+	due := e.CreatedAt
+
+	if isAlert(e.Kind) {
+		due += int64(p.MinOutage.Seconds())
+	}
+
+	if p.Digest {
+		due = p.nextDigest(due)
+	}
+
+	return due
+}
+
+var QUERY_QUEUED_EVENTS = `
+	SELECT ` + EVENT_COLUMNS + `
+	FROM notification_queue AS queue
+	JOIN events ON events.id = queue.event_id
+	JOIN servers ON servers.id = events.server_id
+	WHERE
+		queue.notifier = ?
+	AND
+		(? = 0 OR events.server_id = ?)
+	AND
+		queue.due_at <= ?
+	ORDER BY events.id;
+`
+
+func queuedEvents(db *sql.DB, notifier string, server_id int, due_before int64) ([]Event, error) {
+	rows, err := db.Query(QUERY_QUEUED_EVENTS, notifier, server_id, server_id, due_before)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanEvents(rows)
+}
+
+func dequeue(db *sql.DB, notifier string, events []Event) error {
+	for _, e := range events {
+		_, err := db.Exec("DELETE FROM notification_queue WHERE notifier = ? AND event_id = ?", notifier, e.ID)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// enqueue queues an event for a notifier unless it cancels out an event
+// that's still waiting to be sent
+func enqueue(db *sql.DB, notifier string, policy NotificationPolicy, e Event) error {
+	pending, err := queuedEvents(db, notifier, e.Server.ID, 1<<62)
+
+	if err != nil {
+		return err
+	}
+
+	if len(pending) > 0 {
+		last := pending[len(pending)-1]
+
+		if policy.cancels(last, e) {
+			log.Printf("Not notifying %s about %s %s and %s since they cancel out", notifier, e.Server.Name, last.Kind, e.Kind)
+
+			return dequeue(db, notifier, []Event{last})
+		}
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO notification_queue (notifier, event_id, due_at)
+		VALUES (?, ?, ?)
+	`, notifier, e.ID, policy.dueAt(e))
+
+	return err
+}
+
+// lastNotified returns when a notifier was last successfully sent an event
+// about a server, or zero if it never has been
+func lastNotified(db *sql.DB, notifier string, server_id int) (int64, error) {
+	var last int64
+
+	err := db.QueryRow(`
+		SELECT COALESCE(MAX(deliveries.created_at), 0)
+		FROM notification_deliveries AS deliveries
+		JOIN events ON events.id = deliveries.event_id
+		WHERE deliveries.notifier = ? AND deliveries.success = 1 AND events.server_id = ?
+	`, notifier, server_id).Scan(&last)
+
+	return last, err
+}
+
+// readyEvents returns the queued events that are due to be sent now, holding
+// back alerts for servers that are still cooling down
+func readyEvents(db *sql.DB, notifier string, policy NotificationPolicy, now int64) ([]Event, error) {
+	due, err := queuedEvents(db, notifier, 0, now)
+
+	if err != nil || policy.Digest || policy.Cooldown == 0 {
+		return due, err
+	}
+
+	var ready []Event
+
+	for _, e := range due {
+		if isAlert(e.Kind) {
+			last, err := lastNotified(db, notifier, e.Server.ID)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if last > 0 && now < last+int64(policy.Cooldown.Seconds()) {
+				continue
+			}
+		}
+
+		ready = append(ready, e)
+	}
+
+	return ready, nil
+}
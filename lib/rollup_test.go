@@ -0,0 +1,306 @@
+package lib
+
+import (
+	"database/sql"
+	"monitor/api"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v4"
+)
+
+// OpenTestDB opens a freshly migrated database in a temporary directory
+func OpenTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "monitor.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	err = AutoMigrate(db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func InsertTestStatus(t *testing.T, db *sql.DB, server_id int, created_at int64, status bool, rtt any) {
+	_, err := db.Exec(`
+		INSERT INTO statuses (server_id, created_at, status, rtt, message)
+		VALUES (?, ?, ?, ?, '')
+	`, server_id, created_at, status, rtt)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRollupsTrackInserts(t *testing.T) {
+	db := OpenTestDB(t)
+	hour := int64(1700000000 - 1700000000%3600)
+
+	InsertTestStatus(t, db, 1, hour+10, true, 50)
+	InsertTestStatus(t, db, 1, hour+20, true, 30)
+	InsertTestStatus(t, db, 1, hour+30, false, nil)
+	InsertTestStatus(t, db, 1, hour+3600, true, 70)
+
+	var n, n_up, rtt_n, rtt_sum, rtt_min, rtt_max int
+
+	err := db.QueryRow(`
+		SELECT n, n_up, rtt_n, rtt_sum, rtt_min, rtt_max
+		FROM statuses_hourly
+		WHERE server_id = 1 AND start = ?
+	`, hour).Scan(&n, &n_up, &rtt_n, &rtt_sum, &rtt_min, &rtt_max)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int{3, 2, 2, 80, 30, 50}, []int{n, n_up, rtt_n, rtt_sum, rtt_min, rtt_max})
+
+	err = db.QueryRow(`
+		SELECT SUM(n), SUM(n_up)
+		FROM statuses_daily
+		WHERE server_id = 1
+	`).Scan(&n, &n_up)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, 3, n_up)
+}
+
+func TestRollupsBackfill(t *testing.T) {
+	db := OpenTestDB(t)
+
+	InsertTestStatus(t, db, 1, 1700000000, true, 10)
+	InsertTestStatus(t, db, 1, 1700000001, false, nil)
+
+	// Simulate an existing database from before the rollup tables existed
+	_, err := db.Exec(`
+		DROP TABLE statuses_hourly;
+		DROP TABLE statuses_daily;
+	`)
+	assert.NoError(t, err)
+
+	err = AutoMigrate(db)
+	assert.NoError(t, err)
+
+	var n, n_up int
+	err = db.QueryRow("SELECT SUM(n), SUM(n_up) FROM statuses_hourly").Scan(&n, &n_up)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 1, n_up)
+
+	// Running the migration again shouldn't double count
+	err = AutoMigrate(db)
+	assert.NoError(t, err)
+
+	err = db.QueryRow("SELECT SUM(n), SUM(n_up) FROM statuses_daily").Scan(&n, &n_up)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 1, n_up)
+}
+
+func TestUptimeSummaries(t *testing.T) {
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+
+	now := time.Now().UTC()
+	ago := func(d time.Duration) int64 { return now.Add(-d).Unix() }
+
+	// UpServer (id 1) was down once 10 days ago, DownServer (id 2) has been
+	// down for the last day
+	InsertTestStatus(t, db, 1, ago(time.Hour), true, 10)
+	InsertTestStatus(t, db, 1, ago(10*24*time.Hour), false, nil)
+	InsertTestStatus(t, db, 1, ago(100*24*time.Hour), true, 10)
+	InsertTestStatus(t, db, 2, ago(time.Hour), false, nil)
+	InsertTestStatus(t, db, 2, ago(3*24*time.Hour), true, 10)
+
+	summaries, err := api.UptimeSummaries(db, 0, now)
+	assert.NoError(t, err)
+
+	up := summaries[1]
+	assert.Equal(t, 100.0, up.Day.Float64)
+	assert.Equal(t, 100.0, up.Week.Float64)
+	assert.Equal(t, 50.0, up.Month.Float64)
+	assert.Equal(t, 50.0, up.Quarter.Float64)
+	assert.InDelta(t, 66.67, up.All.Float64, 0.01)
+
+	down := summaries[2]
+	assert.Equal(t, 0.0, down.Day.Float64)
+	assert.Equal(t, 50.0, down.Week.Float64)
+
+	// Filtering to a single server
+	summaries, err = api.UptimeSummaries(db, 2, now)
+	assert.NoError(t, err)
+	assert.Len(t, summaries, 1)
+
+	// Which is all a single server's status needs
+	server, err := api.ServerStatus(db, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, summaries[2], server.UptimeSummary)
+
+	// Servers without any checks in a window get null
+	InsertTestStatus(t, db, 3, ago(40*24*time.Hour), true, 10)
+	_, err = db.Exec(`INSERT INTO servers (id, guid, name, description, emu, host, port, type, is_listed, created_at, updated_at)
+		VALUES (3, 'Old', 'Old', '', '', '', '', '', 1, 0, 0)`)
+	assert.NoError(t, err)
+
+	summaries, err = api.UptimeSummaries(db, 3, now)
+	assert.NoError(t, err)
+	assert.False(t, summaries[3].Day.Valid)
+	assert.False(t, summaries[3].Month.Valid)
+	assert.True(t, summaries[3].Quarter.Valid)
+	assert.True(t, summaries[3].All.Valid)
+}
+
+func TestSortServers(t *testing.T) {
+	servers := []api.ServerAPIResponseServer{
+		{Name: "b", Status: api.ServerAPIResponseStatus{RTT: null.IntFrom(80)}},
+		{Name: "a", UptimeSummary: api.UptimeSummary{Day: null.FloatFrom(50)}, Status: api.ServerAPIResponseStatus{LastSeen: null.StringFrom("2024-03-01T00:00:00Z")}},
+		{Name: "C", UptimeSummary: api.UptimeSummary{Day: null.FloatFrom(99)}, Status: api.ServerAPIResponseStatus{RTT: null.IntFrom(20), LastSeen: null.StringFrom("2024-03-02T00:00:00Z")}},
+	}
+
+	api.SortServers(servers, "24h")
+	assert.Equal(t, []string{"C", "a", "b"}, serverNames(servers))
+
+	api.SortServers(servers, "name")
+	assert.Equal(t, []string{"a", "b", "C"}, serverNames(servers))
+
+	api.SortServers(servers, "rtt")
+	assert.Equal(t, []string{"C", "b", "a"}, serverNames(servers))
+
+	api.SortServers(servers, "last_seen")
+	assert.Equal(t, []string{"C", "a", "b"}, serverNames(servers))
+}
+
+func serverNames(servers []api.ServerAPIResponseServer) []string {
+	var names []string
+
+	for _, s := range servers {
+		names = append(names, s.Name)
+	}
+
+	return names
+}
+
+func TestServersFilter(t *testing.T) {
+	db := OpenTestDB(t)
+	now := time.Now().UTC()
+
+	UpdateServersTable(db, GenerateTestServerList())
+
+	_, err := db.Exec(`UPDATE servers SET emu = 'ACE', type = 'PvE', description = 'A 100% classic server', is_online = 1 WHERE id = 1`)
+	assert.NoError(t, err)
+	_, err = db.Exec(`UPDATE servers SET emu = 'GDLE', type = 'PvP', is_online = 0 WHERE id = 2`)
+	assert.NoError(t, err)
+
+	InsertTestStatus(t, db, 1, now.Add(-time.Hour).Unix(), true, 40)
+	InsertTestStatus(t, db, 2, now.Add(-time.Hour).Unix(), true, 20)
+	InsertTestStatus(t, db, 2, now.Add(-48*time.Hour).Unix(), true, 1000)
+
+	cases := []struct {
+		filter api.ServerFilter
+		names  []string
+	}{
+		{api.ServerFilter{}, []string{"DownServer", "UpServer"}},
+		{api.ServerFilter{Emulator: "ace"}, []string{"UpServer"}},
+		{api.ServerFilter{Type: "PvP"}, []string{"DownServer"}},
+		{api.ServerFilter{Online: null.BoolFrom(false)}, []string{"DownServer"}},
+		{api.ServerFilter{Search: "classic"}, []string{"UpServer"}},
+		{api.ServerFilter{Search: "100%"}, []string{"UpServer"}},
+		{api.ServerFilter{Search: "0%c"}, nil},
+		{api.ServerFilter{Sort: "rtt"}, []string{"DownServer", "UpServer"}},
+		{api.ServerFilter{Emulator: "ACE", Type: "PvP"}, nil},
+	}
+
+	for _, c := range cases {
+		response, err := api.Servers(db, c.filter)
+
+		assert.NoError(t, err)
+
+		assert.Equal(t, len(c.names), response.Count, c.filter)
+		assert.Equal(t, c.names, serverNames(response.Servers), c.filter)
+	}
+
+	// Only the last day's checks count towards the RTT
+	response, err := api.Servers(db, api.ServerFilter{Type: "PvP"})
+	assert.NoError(t, err)
+	assert.Equal(t, null.IntFrom(20), response.Servers[0].Status.RTT)
+}
+
+func TestEachServer(t *testing.T) {
+	db := OpenTestDB(t)
+	now := time.Now().UTC()
+
+	UpdateServersTable(db, GenerateTestServerList())
+
+	// UpServer is faster and was seen more recently so those sorts put it first
+	InsertTestStatus(t, db, 1, now.Add(-time.Hour).Unix(), true, 10)
+	InsertTestStatus(t, db, 2, now.Add(-2*time.Hour).Unix(), true, 40)
+	InsertTestStatus(t, db, 2, now.Add(-time.Hour).Unix(), false, 0)
+	SetLastSeen(t, db, "UpServer", now.Add(-time.Hour).Unix())
+	SetLastSeen(t, db, "DownServer", now.Add(-2*time.Hour).Unix())
+
+	// Servers are streamed in the same order Servers sorts them in
+	for _, key := range append(append([]string{""}, api.SERVER_SORT_KEYS...), api.UPTIME_SUMMARY_KEYS...) {
+		filter := api.ServerFilter{Sort: key}
+		response, err := api.Servers(db, filter)
+		assert.NoError(t, err)
+
+		var streamed []api.ServerAPIResponseServer
+
+		err = api.EachServer(db, filter, func(s api.ServerAPIResponseServer) error {
+			streamed = append(streamed, s)
+			return nil
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, response.Servers, streamed, key)
+	}
+
+	response, err := api.Servers(db, api.ServerFilter{Sort: "rtt"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"UpServer", "DownServer"}, serverNames(response.Servers))
+}
+
+func TestUptimeRows(t *testing.T) {
+	db := OpenTestDB(t)
+	day := time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)
+
+	InsertTestStatus(t, db, 1, day.Add(time.Hour).Unix(), true, 10)
+	InsertTestStatus(t, db, 1, day.Add(2*time.Hour).Unix(), false, nil)
+	InsertTestStatus(t, db, 1, day.AddDate(0, 0, 2).Unix(), true, 30)
+	InsertTestStatus(t, db, 2, day.Unix(), false, nil)
+
+	r := api.UptimeRange{From: day, To: day.AddDate(0, 0, 3), Granularity: api.GRANULARITY_DAY}
+	rows, err := api.UptimeRows(db, 1, r)
+
+	assert.NoError(t, err)
+	assert.Len(t, rows, 3)
+	assert.Equal(t, "2024-03-11", rows[0].Date)
+	assert.Equal(t, 50.0, rows[0].Uptime)
+	assert.Equal(t, 2, rows[0].N)
+	assert.Equal(t, 10.0, rows[0].RTTMean.Float64)
+	assert.Equal(t, 0, rows[1].N)
+	assert.False(t, rows[1].RTTMean.Valid)
+	assert.Equal(t, 100.0, rows[2].Uptime)
+
+	r.Granularity = api.GRANULARITY_WEEK
+	rows, err = api.UptimeRows(db, 1, r)
+
+	assert.NoError(t, err)
+	assert.Len(t, rows, 1)
+	assert.Equal(t, 3, rows[0].N)
+	assert.Equal(t, int64(30), rows[0].RTTMax.Int64)
+
+	r = api.UptimeRange{From: day, To: day.Add(3 * time.Hour), Granularity: api.GRANULARITY_HOUR}
+	rows, err = api.UptimeRows(db, 1, r)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 1}, []int{rows[0].N, rows[1].N, rows[2].N})
+	assert.Equal(t, "2024-03-11T02:00:00Z", rows[2].Date)
+}
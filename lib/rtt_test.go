@@ -0,0 +1,55 @@
+package lib
+
+import (
+	"monitor/api"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRTTPercentiles(t *testing.T) {
+	db := OpenTestDB(t)
+	hour := time.Date(2024, 3, 11, 5, 0, 0, 0, time.UTC)
+
+	// 1..100 ms in the first hour, plus a failure that shouldn't count
+	for i := 1; i <= 100; i++ {
+		InsertTestStatus(t, db, 1, hour.Add(time.Duration(i)*time.Second).Unix(), true, 101-i)
+	}
+
+	InsertTestStatus(t, db, 1, hour.Add(time.Minute).Unix(), false, 40000)
+
+	// A single check in the third hour
+	InsertTestStatus(t, db, 1, hour.Add(2*time.Hour).Unix(), true, 42)
+
+	r := api.UptimeRange{From: hour, To: hour.Add(3 * time.Hour), Granularity: api.GRANULARITY_HOUR}
+	result, err := api.RTTPercentiles(db, 1, "Test", r)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, result.Count)
+
+	first := result.RTTs[0]
+	assert.Equal(t, 100, first.N)
+	assert.Equal(t, int64(50), first.P50.Int64)
+	assert.Equal(t, int64(90), first.P90.Int64)
+	assert.Equal(t, int64(99), first.P99.Int64)
+
+	assert.Equal(t, 0, result.RTTs[1].N)
+	assert.False(t, result.RTTs[1].P50.Valid)
+
+	last := result.RTTs[2]
+	assert.Equal(t, int64(42), last.P50.Int64)
+	assert.Equal(t, int64(42), last.P99.Int64)
+
+	chart := api.NewLatencyChart(result)
+	assert.False(t, chart.Empty)
+	assert.Equal(t, 100, chart.YMax)
+
+	// The gap in the middle should start a new subpath
+	assert.Equal(t, 2, strings.Count(chart.P50, "M"))
+
+	r.Granularity = api.GRANULARITY_WEEK
+	_, err = api.RTTPercentiles(db, 1, "Test", r)
+	assert.Error(t, err)
+}
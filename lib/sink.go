@@ -0,0 +1,201 @@
+package lib
+
+import (
+	"database/sql"
+	"log"
+)
+
+// CheckResult is the outcome of checking one server. RTT is how long the
+// check took in ms, including retries, whether or not it succeeded. Degraded
+// is only set once the check has been stored.
+type CheckResult struct {
+	Server    EventServer `json:"server"`
+	Time      string      `json:"time"`
+	Up        bool        `json:"up"`
+	RTT       int64       `json:"rtt"`
+	Attempts  int         `json:"attempts"`
+	Message   string      `json:"message"`
+	Degraded  bool        `json:"degraded"`
+	CreatedAt int64       `json:"-"`
+}
+
+// StatusSink receives every check result and state change. Sinks are written
+// to in order and each is sent a check before the state change it caused.
+type StatusSink interface {
+	WriteCheck(result CheckResult) error
+	WriteStateChange(change Event) error
+}
+
+// CheckStore is implemented by the sink that stores checks for the rest of
+// the monitor. It stores a check and the state change it caused together,
+// gives the change its ID and sets whether the server is degraded, which the
+// other sinks are sent.
+type CheckStore interface {
+	StoreCheck(result *CheckResult, change *Event) error
+}
+
+// SQLiteSink stores check results and state changes in the database the rest
+// of the monitor reads from, and keeps incidents up to date as it goes
+type SQLiteSink struct {
+	DB          *sql.DB
+	Degradation DegradationConfig
+}
+
+// SinksFromEnv builds the sinks configured in the environment. Results are
+// always stored in SQLite, which detects degradation as configured.
+func SinksFromEnv(db *sql.DB, degradation DegradationConfig) ([]StatusSink, error) {
+	sinks := []StatusSink{&SQLiteSink{DB: db, Degradation: degradation}}
+
+	mqtt, err := MQTTSinkFromEnv()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if mqtt != nil {
+		sinks = append(sinks, mqtt)
+	}
+
+	return sinks, nil
+}
+
+func (s *SQLiteSink) WriteCheck(r CheckResult) error {
+	return s.StoreCheck(&r, nil)
+}
+
+// StoreCheck stores a check, and the state change it caused if it isn't nil,
+// in one transaction so neither is stored without the other. The change's ID
+// and whether the server is degraded are set once it's committed.
+func (s *SQLiteSink) StoreCheck(r *CheckResult, change *Event) error {
+	tx, err := s.DB.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO statuses (server_id, created_at, status, rtt, message)
+		VALUES (?, ?, ?, ?, ?)
+	`, r.Server.ID, r.CreatedAt, r.Up, r.RTT, r.Message)
+
+	if err != nil {
+		return err
+	}
+
+	// Update last_seen value in servers table if up
+	if r.Up {
+		err = UpdateServerLastSeen(tx, r.Server.ID, r.CreatedAt)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// Update is_online with what we found
+	err = UpdateServerIsOnline(tx, r.Server.ID, r.Up)
+
+	if err != nil {
+		return err
+	}
+
+	var stored Event
+
+	if change != nil {
+		stored, err = StoreEvent(tx, *change)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// Track outages and latency degradation as incidents
+	err = UpdateIncidents(tx, r.Server.ID, r.Server.Name, r.CreatedAt, r.Up, r.Message, s.Degradation)
+
+	if err != nil {
+		return err
+	}
+
+	degraded, err := OpenIncident(tx, r.Server.ID, INCIDENT_DEGRADED)
+
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return err
+	}
+
+	r.Degraded = r.Up && degraded != 0
+
+	if change != nil {
+		change.ID = stored.ID
+	}
+
+	return nil
+}
+
+// WriteStateChange records the change in the events table. Changes found
+// while syncing the server list are recorded as part of the sync so they
+// already have an ID and are skipped.
+func (s *SQLiteSink) WriteStateChange(e Event) error {
+	if e.ID != 0 {
+		return nil
+	}
+
+	tx, err := s.DB.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	err = RecordEvent(tx, e.Server.ID, e.Kind, e.CreatedAt, e.SinceAt, e.Message)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// WriteCheck sends a result, and the state change it caused if change isn't
+// nil, to every sink, logging any that fail. A CheckStore stores both
+// together and is expected to come first so later sinks get the change with
+// its ID.
+func WriteCheck(sinks []StatusSink, r CheckResult, change *Event) {
+	for _, sink := range sinks {
+		if store, ok := sink.(CheckStore); ok {
+			if err := store.StoreCheck(&r, change); err != nil {
+				log.Printf("Failed to store check for server %s in %T: %s", r.Server.Name, sink, err)
+			}
+
+			continue
+		}
+
+		if err := sink.WriteCheck(r); err != nil {
+			log.Printf("Failed to write check for server %s to %T: %s", r.Server.Name, sink, err)
+		}
+
+		if change == nil {
+			continue
+		}
+
+		if err := sink.WriteStateChange(*change); err != nil {
+			log.Printf("Failed to write %s state change for server %s to %T: %s", change.Kind, change.Server.Name, sink, err)
+		}
+	}
+}
+
+// WriteStateChange sends a state change to every sink, logging any that fail
+func WriteStateChange(sinks []StatusSink, e Event) {
+	for _, sink := range sinks {
+		if err := sink.WriteStateChange(e); err != nil {
+			log.Printf("Failed to write %s state change for server %s to %T: %s", e.Kind, e.Server.Name, sink, err)
+		}
+	}
+}
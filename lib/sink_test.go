@@ -0,0 +1,279 @@
+package lib
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+// RecordingSink remembers everything written to it
+type RecordingSink struct {
+	Checks  []CheckResult
+	Changes []Event
+}
+
+func (s *RecordingSink) WriteCheck(r CheckResult) error {
+	s.Checks = append(s.Checks, r)
+	return nil
+}
+
+func (s *RecordingSink) WriteStateChange(e Event) error {
+	s.Changes = append(s.Changes, e)
+	return nil
+}
+
+func TestSQLiteSink(t *testing.T) {
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+
+	sink := &SQLiteSink{DB: db, Degradation: DegradationConfig{}}
+	recorder := &RecordingSink{}
+	sinks := []StatusSink{sink, recorder}
+	server := EventServer{ID: 1, Name: "UpServer"}
+
+	down := NewEvent(server, EVENT_DOWN, 100, sql.NullInt64{}, "timeout")
+	WriteCheck(sinks, CheckResult{Server: server, Up: false, Message: "timeout", CreatedAt: 100}, &down)
+	WriteCheck(sinks, CheckResult{Server: server, Up: true, RTT: 42, CreatedAt: 200}, nil)
+
+	var count int
+	var is_online bool
+	var last_seen int64
+
+	assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM statuses WHERE server_id = 1").Scan(&count))
+	assert.NoError(t, db.QueryRow("SELECT is_online, last_seen FROM servers WHERE id = 1").Scan(&is_online, &last_seen))
+	assert.Equal(t, 2, count)
+	assert.True(t, is_online)
+	assert.Equal(t, int64(200), last_seen)
+
+	// The outage incident was opened by the first check and closed by the second
+	assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM incidents WHERE server_id = 1 AND ended_at = 200").Scan(&count))
+	assert.Equal(t, 1, count)
+
+	// The change was stored with its check and the other sinks got its ID
+	events, err := EventsAfter(db, 0, 10)
+
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Len(t, recorder.Checks, 2)
+	assert.Len(t, recorder.Changes, 1)
+	assert.NotZero(t, recorder.Changes[0].ID)
+	assert.Equal(t, events[0].ID, recorder.Changes[0].ID)
+
+	// Only changes that haven't been stored already are recorded
+	WriteStateChange([]StatusSink{sink}, NewEvent(server, EVENT_UP, 200, sql.NullInt64{Int64: 100, Valid: true}, ""))
+	RecordTestEvent(t, db, 2, EVENT_DELISTED)
+
+	events, err = EventsAfter(db, 0, 10)
+
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+
+	WriteStateChange([]StatusSink{sink}, events[2])
+
+	events, err = EventsAfter(db, 0, 10)
+
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+	assert.Equal(t, EVENT_UP, events[1].Kind)
+	assert.Equal(t, int64(100), events[1].SinceAt.Int64)
+}
+
+func TestSQLiteSinkReportsDegradation(t *testing.T) {
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+
+	sink := &SQLiteSink{DB: db, Degradation: DEFAULT_DEGRADATION}
+	recorder := &RecordingSink{}
+	sinks := []StatusSink{sink, recorder}
+	server := EventServer{ID: 1, Name: "UpServer"}
+
+	now := time.Now().UTC().Unix()
+
+	// A day of 40 ms checks every ten minutes and then a slow hour
+	for i := int64(1); i <= 144; i++ {
+		InsertTestStatus(t, db, 1, now-3600-i*600, true, 40)
+	}
+
+	for i := int64(1); i < 5; i++ {
+		InsertTestStatus(t, db, 1, now-i*600, true, 400)
+	}
+
+	WriteCheck(sinks, CheckResult{Server: server, Up: true, RTT: 400, CreatedAt: now}, nil)
+	WriteCheck(sinks, CheckResult{Server: server, Up: false, CreatedAt: now + 600}, nil)
+
+	assert.Len(t, recorder.Checks, 2)
+	assert.True(t, recorder.Checks[0].Degraded)
+	assert.False(t, recorder.Checks[1].Degraded)
+}
+
+func TestSQLiteSinkIsAtomic(t *testing.T) {
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+
+	sink := &SQLiteSink{DB: db, Degradation: DegradationConfig{}}
+	server := EventServer{ID: 1, Name: "UpServer"}
+
+	// If the change can't be stored, neither is the check
+	_, err := db.Exec("DROP TABLE events")
+	assert.NoError(t, err)
+
+	down := NewEvent(server, EVENT_DOWN, 100, sql.NullInt64{}, "timeout")
+	assert.Error(t, sink.StoreCheck(&CheckResult{Server: server, Up: false, CreatedAt: 100}, &down))
+	assert.Zero(t, down.ID)
+
+	AssertNRows(t, db, "statuses", 0)
+	AssertNRows(t, db, "incidents", 0)
+}
+
+func TestSQLiteSinkRollsBackIncidentFailures(t *testing.T) {
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+
+	sink := &SQLiteSink{DB: db, Degradation: DegradationConfig{}}
+	server := EventServer{ID: 1, Name: "UpServer"}
+
+	// If incidents can't be updated, neither the check nor its change is stored
+	_, err := db.Exec("CREATE TRIGGER fail_incidents BEFORE INSERT ON incidents BEGIN SELECT RAISE(ABORT, 'no incidents'); END")
+	assert.NoError(t, err)
+
+	down := NewEvent(server, EVENT_DOWN, 100, sql.NullInt64{}, "timeout")
+	assert.Error(t, sink.StoreCheck(&CheckResult{Server: server, Up: false, CreatedAt: 100}, &down))
+	assert.Zero(t, down.ID)
+
+	AssertNRows(t, db, "statuses", 0)
+	AssertNRows(t, db, "events", 0)
+}
+
+// fakeMQTTPublish is a PUBLISH packet received by a fake broker
+type fakeMQTTPublish struct {
+	Topic   string
+	Retain  bool
+	Payload []byte
+}
+
+// StartTestMQTTBroker accepts connections, acknowledges CONNECT packets and
+// pings, and records PUBLISH packets
+func StartTestMQTTBroker(t *testing.T) (string, func() []fakeMQTTPublish) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	var mu sync.Mutex
+	var published []fakeMQTTPublish
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				for {
+					packet, err := packets.ReadPacket(conn)
+
+					if err != nil {
+						return
+					}
+
+					switch p := packet.(type) {
+					case *packets.ConnectPacket:
+						packets.NewControlPacket(packets.Connack).Write(conn)
+					case *packets.PingreqPacket:
+						packets.NewControlPacket(packets.Pingresp).Write(conn)
+					case *packets.PublishPacket:
+						mu.Lock()
+						published = append(published, fakeMQTTPublish{Topic: p.TopicName, Retain: p.Retain, Payload: p.Payload})
+						mu.Unlock()
+					case *packets.DisconnectPacket:
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), func() []fakeMQTTPublish {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return append([]fakeMQTTPublish(nil), published...)
+	}
+}
+
+func TestMQTTSink(t *testing.T) {
+	addr, published := StartTestMQTTBroker(t)
+
+	t.Setenv("MQTT_URL", "mqtt://user:secret@"+addr)
+	t.Setenv("MQTT_TOPIC_PREFIX", "ac/")
+
+	sink, err := MQTTSinkFromEnv()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "ac", sink.Prefix)
+
+	defer sink.Close()
+
+	options := sink.Client.OptionsReader()
+	assert.Equal(t, "user", options.Username())
+	assert.Equal(t, "secret", options.Password())
+
+	// It connects in the background
+	assert.Eventually(t, sink.Client.IsConnectionOpen, time.Second, 10*time.Millisecond)
+
+	server := EventServer{ID: 1, GUID: "abc", Name: "UpServer"}
+
+	assert.NoError(t, sink.WriteCheck(CheckResult{Server: server, Time: "2022-01-01T00:00:00Z", Up: true, RTT: 42}))
+	assert.NoError(t, sink.WriteStateChange(NewEvent(server, EVENT_DOWN, 100, sql.NullInt64{}, "timeout")))
+
+	assert.Eventually(t, func() bool { return len(published()) == 2 }, time.Second, 10*time.Millisecond)
+
+	messages := published()
+
+	var status MQTTStatus
+	assert.NoError(t, json.Unmarshal(messages[0].Payload, &status))
+	assert.Equal(t, "ac/servers/abc/status", messages[0].Topic)
+	assert.True(t, messages[0].Retain)
+	assert.True(t, status.Online)
+	assert.Equal(t, int64(42), status.RTT.Int64)
+
+	var event Event
+	assert.NoError(t, json.Unmarshal(messages[1].Payload, &event))
+	assert.Equal(t, "ac/servers/abc/events", messages[1].Topic)
+	assert.False(t, messages[1].Retain)
+	assert.Equal(t, EVENT_DOWN, event.Kind)
+	assert.Equal(t, "timeout", event.Message)
+}
+
+func TestMQTTSinkFromEnv(t *testing.T) {
+	t.Setenv("MQTT_URL", "")
+
+	sink, err := MQTTSinkFromEnv()
+
+	assert.NoError(t, err)
+	assert.Nil(t, sink)
+
+	options, err := MQTTOptionsFromURL("mqtts://broker.example.com")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "ssl://broker.example.com:8883", options.Servers[0].String())
+
+	t.Setenv("MQTT_URL", "http://broker.example.com")
+
+	_, err = MQTTSinkFromEnv()
+
+	assert.Error(t, err)
+}
@@ -0,0 +1,207 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How many messages are kept for clients resuming with Last-Event-ID. A full
+// round of checks is one message per server plus any state changes.
+const STREAM_BUFFER_SIZE = 1024
+
+// How often a comment is sent to keep idle connections open through proxies
+const STREAM_KEEPALIVE = 15 * time.Second
+
+// How many messages can be waiting for a client before it's disconnected. It
+// can reconnect and resume from where it got to.
+const STREAM_CLIENT_BUFFER = 256
+
+// StreamMessage is one server-sent event
+type StreamMessage struct {
+	ID    int64
+	Event string
+	Data  []byte
+}
+
+// Broadcaster is a StatusSink that fans check results and state changes out
+// to /api/stream clients. It keeps the most recent messages in a ring buffer
+// so clients can resume after reconnecting.
+type Broadcaster struct {
+	mu      sync.Mutex
+	next    int64
+	buffer  []StreamMessage
+	start   int
+	clients map[chan StreamMessage]bool
+}
+
+// NewBroadcaster creates a Broadcaster. IDs start from the current time in
+// milliseconds so IDs from before a restart sort before any new ones.
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{
+		next:    time.Now().UnixMilli(),
+		clients: map[chan StreamMessage]bool{},
+	}
+}
+
+func (b *Broadcaster) publish(event string, value any) error {
+	data, err := json.Marshal(value)
+
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	msg := StreamMessage{ID: b.next, Event: event, Data: data}
+	b.next++
+
+	if len(b.buffer) < STREAM_BUFFER_SIZE {
+		b.buffer = append(b.buffer, msg)
+	} else {
+		b.buffer[b.start] = msg
+		b.start = (b.start + 1) % STREAM_BUFFER_SIZE
+	}
+
+	for client := range b.clients {
+		select {
+		case client <- msg:
+		default:
+			// Drop clients that can't keep up rather than holding up checks
+			delete(b.clients, client)
+			close(client)
+		}
+	}
+
+	return nil
+}
+
+func (b *Broadcaster) WriteCheck(r CheckResult) error {
+	return b.publish("check", r)
+}
+
+func (b *Broadcaster) WriteStateChange(e Event) error {
+	return b.publish("change", e)
+}
+
+// Subscribe returns the buffered messages after the given ID and a channel of
+// new messages, which is closed if the client falls too far behind. An ID of
+// zero or less means no messages are replayed.
+func (b *Broadcaster) Subscribe(after int64) ([]StreamMessage, chan StreamMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var backlog []StreamMessage
+
+	if after > 0 {
+		for i := range b.buffer {
+			msg := b.buffer[(b.start+i)%len(b.buffer)]
+
+			if msg.ID > after {
+				backlog = append(backlog, msg)
+			}
+		}
+	}
+
+	client := make(chan StreamMessage, STREAM_CLIENT_BUFFER)
+	b.clients[client] = true
+
+	return backlog, client
+}
+
+// Unsubscribe stops sending messages to a client
+func (b *Broadcaster) Unsubscribe(client chan StreamMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.clients[client] {
+		delete(b.clients, client)
+		close(client)
+	}
+}
+
+func writeStreamMessage(w http.ResponseWriter, msg StreamMessage) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", msg.ID, msg.Event, msg.Data)
+
+	return err
+}
+
+// StreamHandler serves server-sent events from the broadcaster. "check"
+// events carry a CheckResult and "change" events carry an Event. Clients can
+// resume with the Last-Event-ID header or, since EventSource can't set
+// headers on the first request, a lastEventId query parameter.
+func StreamHandler(b *Broadcaster) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+
+		last := r.Header.Get("Last-Event-ID")
+
+		if last == "" {
+			last = r.URL.Query().Get("lastEventId")
+		}
+
+		var after int64
+
+		if last != "" {
+			var err error
+			after, err = strconv.ParseInt(last, 10, 64)
+
+			if err != nil {
+				http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// The stream stays open far longer than any write timeout
+		rc.SetWriteDeadline(time.Time{})
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+
+		backlog, client := b.Subscribe(after)
+		defer b.Unsubscribe(client)
+
+		fmt.Fprintf(w, "retry: %d\n\n", 10*time.Second/time.Millisecond)
+
+		for _, msg := range backlog {
+			writeStreamMessage(w, msg)
+		}
+
+		if err := rc.Flush(); err != nil {
+			log.Printf("Streaming isn't supported: %s", err)
+			return
+		}
+
+		keepalive := time.NewTicker(STREAM_KEEPALIVE)
+		defer keepalive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case msg, ok := <-client:
+				if !ok {
+					return
+				}
+
+				if err := writeStreamMessage(w, msg); err != nil {
+					return
+				}
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+			}
+
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
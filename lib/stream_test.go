@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroadcasterResume(t *testing.T) {
+	b := NewBroadcaster()
+	server := EventServer{ID: 1, GUID: "abc", Name: "UpServer"}
+
+	for i := 0; i < STREAM_BUFFER_SIZE+10; i++ {
+		assert.NoError(t, b.WriteCheck(CheckResult{Server: server, Up: true}))
+	}
+
+	first := b.buffer[b.start].ID
+
+	backlog, client := b.Subscribe(0)
+	assert.Empty(t, backlog)
+	b.Unsubscribe(client)
+
+	// Only the most recent messages are kept
+	backlog, client = b.Subscribe(1)
+	assert.Len(t, backlog, STREAM_BUFFER_SIZE)
+	assert.Equal(t, first, backlog[0].ID)
+	b.Unsubscribe(client)
+
+	backlog, client = b.Subscribe(first + STREAM_BUFFER_SIZE - 3)
+	assert.Len(t, backlog, 2)
+	assert.Equal(t, "check", backlog[0].Event)
+
+	assert.NoError(t, b.WriteStateChange(NewEvent(server, EVENT_DOWN, 100, sql.NullInt64{}, "timeout")))
+
+	msg := <-client
+	assert.Equal(t, "change", msg.Event)
+	assert.Contains(t, string(msg.Data), `"kind":"down"`)
+	b.Unsubscribe(client)
+}
+
+func TestBroadcasterDropsSlowClients(t *testing.T) {
+	b := NewBroadcaster()
+	_, client := b.Subscribe(0)
+
+	for i := 0; i < STREAM_CLIENT_BUFFER+1; i++ {
+		b.WriteCheck(CheckResult{})
+	}
+
+	var received int
+
+	for range client {
+		received++
+	}
+
+	assert.Equal(t, STREAM_CLIENT_BUFFER, received)
+
+	// Unsubscribing after being dropped is fine
+	b.Unsubscribe(client)
+}
+
+// readTestStreamEvent reads lines up to the end of the next event that has data
+func readTestStreamEvent(t *testing.T, r *bufio.Reader) []string {
+	var lines []string
+
+	for {
+		line, err := r.ReadString('\n')
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+
+		if line == "" {
+			if len(lines) > 0 && strings.HasPrefix(lines[len(lines)-1], "data: ") {
+				return lines
+			}
+
+			lines = nil
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	b := NewBroadcaster()
+	server := EventServer{ID: 1, GUID: "abc", Name: "UpServer"}
+
+	b.WriteCheck(CheckResult{Server: server, Up: false})
+	b.WriteCheck(CheckResult{Server: server, Up: true, RTT: 42})
+
+	ts := httptest.NewServer(http.HandlerFunc(StreamHandler(b)))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL, nil)
+	req.Header.Set("Last-Event-ID", "1")
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	r := bufio.NewReader(res.Body)
+
+	// Both buffered checks are replayed
+	lines := readTestStreamEvent(t, r)
+	assert.Equal(t, "event: check", lines[1])
+	assert.Contains(t, lines[2], `"up":false`)
+
+	lines = readTestStreamEvent(t, r)
+	assert.Contains(t, lines[2], `"rtt":42`)
+
+	// Then new messages are sent as they happen
+	b.WriteStateChange(NewEvent(server, EVENT_UP, 100, sql.NullInt64{}, ""))
+
+	lines = readTestStreamEvent(t, r)
+	assert.Equal(t, "event: change", lines[1])
+	assert.Contains(t, lines[2], `"guid":"abc"`)
+
+	res, err = http.Get(ts.URL + "?lastEventId=nope")
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
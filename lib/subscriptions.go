@@ -0,0 +1,307 @@
+package lib
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subscription is a confirmed request to be emailed about a server's state
+// changes
+type Subscription struct {
+	ID               int
+	Email            string
+	ServerID         int
+	ServerName       string
+	UnsubscribeToken string
+}
+
+var ErrInvalidEmail = errors.New("invalid email address")
+
+// ErrConfirmationPending is returned when an address was sent a confirmation
+// less than CONFIRMATION_INTERVAL ago that it hasn't opened yet
+var ErrConfirmationPending = errors.New("confirmation already sent")
+
+// Limits on subscribing so the form can't be used to flood an inbox through
+// our mail server
+const (
+	// Each address is sent at most one confirmation in this long
+	CONFIRMATION_INTERVAL = time.Hour
+	// How many times each IP address can subscribe in SUBSCRIBE_IP_WINDOW
+	SUBSCRIBE_IP_LIMIT  = 5
+	SUBSCRIBE_IP_WINDOW = time.Hour
+)
+
+// newToken returns a random token for confirmation and unsubscribe links
+func newToken() (string, error) {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// NormalizeEmail checks an address is a bare email address, i.e., without a
+// display name, and lowercases it so subscriptions aren't duplicated
+func NormalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	address, err := mail.ParseAddress(email)
+
+	if err != nil || address.Address != email {
+		return "", ErrInvalidEmail
+	}
+
+	return strings.ToLower(address.Address), nil
+}
+
+// Subscribe adds unconfirmed subscriptions for an email address to each of the
+// given servers. Every pending subscription made by this call shares one
+// confirmation token, which is returned along with the names of the servers
+// awaiting confirmation. Servers the address is already confirmed for are
+// left alone so no names are returned if there's nothing to confirm. It
+// returns ErrConfirmationPending rather than make a new token while the last
+// one sent to the address is still fresh.
+func Subscribe(db *sql.DB, email string, server_ids []int, now int64) (string, []string, error) {
+	token, err := newToken()
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer tx.Rollback()
+
+	var fresh int
+
+	err = tx.QueryRow(`
+		SELECT COUNT(*)
+		FROM subscriptions
+		WHERE email = ? AND confirmed_at IS NULL AND created_at > ?
+	`, email, now-int64(CONFIRMATION_INTERVAL.Seconds())).Scan(&fresh)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	if fresh > 0 {
+		return "", nil, ErrConfirmationPending
+	}
+
+	for _, server_id := range server_ids {
+		unsubscribe_token, err := newToken()
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO subscriptions (email, server_id, confirm_token, unsubscribe_token, created_at)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (email, server_id) DO UPDATE SET confirm_token = excluded.confirm_token, created_at = excluded.created_at
+			WHERE confirmed_at IS NULL
+		`, email, server_id, token, unsubscribe_token, now)
+
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	rows, err := tx.Query(`
+		SELECT servers.name
+		FROM subscriptions
+		JOIN servers ON servers.id = subscriptions.server_id
+		WHERE subscriptions.confirm_token = ?
+		ORDER BY lower(servers.name)
+	`, token)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	var pending []string
+
+	for rows.Next() {
+		var name string
+
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return "", nil, err
+		}
+
+		pending = append(pending, name)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return "", nil, err
+	}
+
+	return token, pending, tx.Commit()
+}
+
+// RateLimiter allows each key, e.g., an IP address, a number of requests in a
+// sliding window. The zero value isn't usable but a nil *RateLimiter allows
+// everything.
+type RateLimiter struct {
+	Limit  int
+	Window time.Duration
+
+	mu   sync.Mutex
+	hits map[string][]time.Time
+}
+
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{Limit: limit, Window: window, hits: map[string][]time.Time{}}
+}
+
+// Allow records a request for key at now and reports whether it's within the
+// limit. Requests over the limit aren't counted.
+func (l *RateLimiter) Allow(key string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Forget keys that have gone quiet so the map doesn't grow forever
+	for other, hits := range l.hits {
+		if !hits[len(hits)-1].After(now.Add(-l.Window)) {
+			delete(l.hits, other)
+		}
+	}
+
+	hits := l.hits[key]
+
+	for len(hits) > 0 && !hits[0].After(now.Add(-l.Window)) {
+		hits = hits[1:]
+	}
+
+	if len(hits) >= l.Limit {
+		l.hits[key] = hits
+		return false
+	}
+
+	l.hits[key] = append(hits, now)
+
+	return true
+}
+
+// ConfirmSubscriptions confirms every subscription with the given token and
+// returns the names of their servers. Confirming twice is harmless.
+func ConfirmSubscriptions(db *sql.DB, token string, now int64) ([]string, error) {
+	_, err := db.Exec(`
+		UPDATE subscriptions
+		SET confirmed_at = ?
+		WHERE confirm_token = ? AND confirmed_at IS NULL
+	`, now, token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT servers.name
+		FROM subscriptions
+		JOIN servers ON servers.id = subscriptions.server_id
+		WHERE subscriptions.confirm_token = ?
+		ORDER BY lower(servers.name)
+	`, token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var names []string
+
+	for rows.Next() {
+		var name string
+
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+// UnsubscribeServerName returns the name of the server the subscription with
+// the given token is for, or an empty string if there's no such subscription
+func UnsubscribeServerName(db *sql.DB, token string) (string, error) {
+	var name string
+
+	err := db.QueryRow(`
+		SELECT servers.name
+		FROM subscriptions
+		JOIN servers ON servers.id = subscriptions.server_id
+		WHERE subscriptions.unsubscribe_token = ?
+	`, token).Scan(&name)
+
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return name, err
+}
+
+// Unsubscribe deletes the subscription with the given token and returns the
+// name of its server, or an empty string if there was no such subscription
+func Unsubscribe(db *sql.DB, token string) (string, error) {
+	name, err := UnsubscribeServerName(db, token)
+
+	if err != nil || name == "" {
+		return "", err
+	}
+
+	_, err = db.Exec("DELETE FROM subscriptions WHERE unsubscribe_token = ?", token)
+
+	return name, err
+}
+
+// Subscribers returns the confirmed subscriptions for a server
+func Subscribers(db *sql.DB, server_id int) ([]Subscription, error) {
+	rows, err := db.Query(`
+		SELECT subscriptions.id, subscriptions.email, servers.id, servers.name, subscriptions.unsubscribe_token
+		FROM subscriptions
+		JOIN servers ON servers.id = subscriptions.server_id
+		WHERE subscriptions.server_id = ? AND subscriptions.confirmed_at IS NOT NULL
+		ORDER BY subscriptions.id
+	`, server_id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var subscriptions []Subscription
+
+	for rows.Next() {
+		var s Subscription
+
+		if err := rows.Scan(&s.ID, &s.Email, &s.ServerID, &s.ServerName, &s.UnsubscribeToken); err != nil {
+			return nil, err
+		}
+
+		subscriptions = append(subscriptions, s)
+	}
+
+	return subscriptions, rows.Err()
+}
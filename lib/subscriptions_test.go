@@ -0,0 +1,284 @@
+package lib
+
+import (
+	"bufio"
+	"database/sql"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSMTPServer is a minimal SMTP sink that records the messages it's sent
+type TestSMTPServer struct {
+	Addr string
+
+	mu       sync.Mutex
+	messages []TestEmail
+}
+
+type TestEmail struct {
+	To   string
+	Data string
+}
+
+func StartTestSMTPServer(t *testing.T) *TestSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	server := &TestSMTPServer{Addr: listener.Addr().String()}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go server.handle(conn)
+		}
+	}()
+
+	return server
+}
+
+func (s *TestSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	var email TestEmail
+
+	reply("220 localhost ESMTP")
+
+	for {
+		line, err := r.ReadString('\n')
+
+		if err != nil {
+			return
+		}
+
+		command := strings.ToUpper(strings.TrimSpace(line))
+
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			email.To = strings.Trim(strings.TrimSpace(line)[len("RCPT TO:"):], "<>")
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 Go ahead")
+
+			var data strings.Builder
+
+			for {
+				line, err := r.ReadString('\n')
+
+				if err != nil || line == ".\r\n" {
+					break
+				}
+
+				data.WriteString(line)
+			}
+
+			email.Data = data.String()
+
+			s.mu.Lock()
+			s.messages = append(s.messages, email)
+			s.mu.Unlock()
+
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func (s *TestSMTPServer) Messages() []TestEmail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]TestEmail{}, s.messages...)
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	email, err := NormalizeEmail(" Someone@Example.com ")
+	assert.NoError(t, err)
+	assert.Equal(t, "someone@example.com", email)
+
+	_, err = NormalizeEmail("Someone <someone@example.com>")
+	assert.ErrorIs(t, err, ErrInvalidEmail)
+
+	_, err = NormalizeEmail("nope")
+	assert.ErrorIs(t, err, ErrInvalidEmail)
+}
+
+func TestSubscriptions(t *testing.T) {
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+
+	token, pending, err := Subscribe(db, "someone@example.com", []int{1, 2}, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"DownServer", "UpServer"}, pending)
+
+	// Unconfirmed subscriptions don't get emails
+	subscribers, err := Subscribers(db, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, subscribers)
+
+	names, err := ConfirmSubscriptions(db, token, 200)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"DownServer", "UpServer"}, names)
+
+	subscribers, err = Subscribers(db, 1)
+	assert.NoError(t, err)
+	assert.Len(t, subscribers, 1)
+	assert.Equal(t, "UpServer", subscribers[0].ServerName)
+
+	// Subscribing again to a confirmed server needs no confirmation
+	_, pending, err = Subscribe(db, "someone@example.com", []int{1}, 300)
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+
+	names, err = ConfirmSubscriptions(db, "bogus", 300)
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+
+	// Looking up the subscription doesn't unsubscribe
+	name, err := UnsubscribeServerName(db, subscribers[0].UnsubscribeToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "UpServer", name)
+
+	name, err = Unsubscribe(db, subscribers[0].UnsubscribeToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "UpServer", name)
+
+	name, err = Unsubscribe(db, subscribers[0].UnsubscribeToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "", name)
+
+	name, err = UnsubscribeServerName(db, subscribers[0].UnsubscribeToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "", name)
+
+	subscribers, err = Subscribers(db, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, subscribers)
+}
+
+func TestSubscribeLimits(t *testing.T) {
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+
+	first, _, err := Subscribe(db, "someone@example.com", []int{1}, 100)
+	assert.NoError(t, err)
+
+	// No more confirmations are sent to the address while the last one's fresh
+	_, _, err = Subscribe(db, "someone@example.com", []int{1, 2}, 200)
+	assert.ErrorIs(t, err, ErrConfirmationPending)
+
+	// But they are to other addresses
+	_, pending, err := Subscribe(db, "other@example.com", []int{1}, 200)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"UpServer"}, pending)
+
+	// And once it's stale a new token replaces it
+	later := 100 + int64(CONFIRMATION_INTERVAL.Seconds())
+	second, pending, err := Subscribe(db, "someone@example.com", []int{1, 2}, later)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"DownServer", "UpServer"}, pending)
+	assert.NotEqual(t, first, second)
+
+	names, err := ConfirmSubscriptions(db, first, later)
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+
+	_, _, err = Subscribe(db, "someone@example.com", []int{1}, later+1)
+	assert.ErrorIs(t, err, ErrConfirmationPending)
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(2, time.Hour)
+	now := time.Unix(1000, 0)
+
+	assert.True(t, l.Allow("1.2.3.4", now))
+	assert.True(t, l.Allow("1.2.3.4", now.Add(time.Minute)))
+	assert.False(t, l.Allow("1.2.3.4", now.Add(2*time.Minute)))
+	assert.True(t, l.Allow("5.6.7.8", now.Add(2*time.Minute)))
+
+	// Requests that were turned away don't count against the next window
+	assert.True(t, l.Allow("1.2.3.4", now.Add(time.Hour+time.Second)))
+	assert.False(t, l.Allow("1.2.3.4", now.Add(time.Hour+2*time.Second)))
+	assert.True(t, l.Allow("1.2.3.4", now.Add(2*time.Hour+time.Minute)))
+
+	var nothing *RateLimiter
+	assert.True(t, nothing.Allow("1.2.3.4", now))
+}
+
+func TestEmailNotifier(t *testing.T) {
+	db := OpenTestDB(t)
+	UpdateServersTable(db, GenerateTestServerList())
+
+	smtpServer := StartTestSMTPServer(t)
+	mailer := &Mailer{Addr: smtpServer.Addr, From: "Monitor <monitor@example.com>"}
+
+	token, pending, err := Subscribe(db, "someone@example.com", []int{2}, 100)
+	assert.NoError(t, err)
+	assert.NoError(t, SendConfirmation(mailer, "https://example.com", "someone@example.com", token, pending))
+
+	messages := smtpServer.Messages()
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "someone@example.com", messages[0].To)
+	assert.Contains(t, messages[0].Data, "https://example.com/subscriptions/confirm?token="+token)
+
+	_, err = ConfirmSubscriptions(db, token, 200)
+	assert.NoError(t, err)
+
+	// Someone who never confirmed isn't emailed
+	_, _, err = Subscribe(db, "other@example.com", []int{2}, 100)
+	assert.NoError(t, err)
+
+	notifier := NewEmailNotifier(db, mailer, "https://example.com")
+
+	InTestTx(t, db, func(tx *sql.Tx) error {
+		return RecordEvent(tx, 2, EVENT_UP, 7200, sql.NullInt64{Int64: 3600, Valid: true}, "")
+	})
+
+	events, err := EventsAfter(db, 0, 10)
+	assert.NoError(t, err)
+	assert.NoError(t, notifier.Notify(events))
+
+	messages = smtpServer.Messages()
+	assert.Len(t, messages, 2)
+	assert.Equal(t, "someone@example.com", messages[1].To)
+	assert.Contains(t, messages[1].Data, "Subject: DownServer is back up")
+	assert.Contains(t, messages[1].Data, "It was down for 1h 0m.")
+	assert.Contains(t, messages[1].Data, "List-Unsubscribe: <https://example.com/subscriptions/unsubscribe?token=")
+
+	// Subscribers only hear about servers going down and coming back up
+	InTestTx(t, db, func(tx *sql.Tx) error { return RecordEvent(tx, 2, EVENT_METADATA, 7300, sql.NullInt64{}, "") })
+	InTestTx(t, db, func(tx *sql.Tx) error { return RecordEvent(tx, 2, EVENT_DELISTED, 7400, sql.NullInt64{}, "") })
+
+	others, err := EventsAfter(db, events[len(events)-1].ID, 10)
+	assert.NoError(t, err)
+	assert.Len(t, others, 2)
+	assert.NoError(t, notifier.Notify(others))
+	assert.Len(t, smtpServer.Messages(), 2)
+
+	// Nobody could be emailed so the notifier fails and the event is retried
+	notifier.Mailer = &Mailer{Addr: "127.0.0.1:1", From: "monitor@example.com"}
+	assert.Error(t, notifier.Notify(events))
+}
@@ -1,12 +1,15 @@
 package lib
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/getsentry/sentry-go"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -50,9 +53,75 @@ func CreateServerRecord(tx *sql.Tx, s *ServerListItem) error {
 	return err
 }
 
+// RecordMetadataChanges records an event describing any changes to a listed
+// server's details, e.g., a new host or Discord link, compared to what's
+// stored for it
+func RecordMetadataChanges(tx *sql.Tx, s *ServerListItem, now int64) error {
+	var id int
+	var name, description, emu, host, port, serverType, website, discord string
+
+	err := tx.QueryRow(`
+		SELECT
+			id,
+			COALESCE(name, ''),
+			COALESCE(description, ''),
+			COALESCE(emu, ''),
+			COALESCE(host, ''),
+			COALESCE(port, ''),
+			COALESCE(type, ''),
+			COALESCE(website_url, ''),
+			COALESCE(discord_url, '')
+		FROM servers
+		WHERE guid = ?
+	`, s.ID).Scan(&id, &name, &description, &emu, &host, &port, &serverType, &website, &discord)
+
+	if err == sql.ErrNoRows {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fields := []struct {
+		Label string
+		Old   string
+		New   string
+	}{
+		{"Name", name, s.Name},
+		{"Description", description, s.Description},
+		{"Emulator", emu, s.Emu},
+		{"Host", host, s.Host},
+		{"Port", port, s.Port},
+		{"Type", serverType, s.Type},
+		{"Website", website, s.Website},
+		{"Discord", discord, s.Discord},
+	}
+
+	var changes []string
+
+	for _, f := range fields {
+		if f.Old != f.New {
+			changes = append(changes, fmt.Sprintf("%s changed from %q to %q.", f.Label, f.Old, f.New))
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+
+	return RecordEvent(tx, id, EVENT_METADATA, now, sql.NullInt64{}, strings.Join(changes, "\n"))
+}
+
 func UpdateServerRecord(tx *sql.Tx, s *ServerListItem) error {
 	now := time.Now().UTC().Unix()
 
+	err := RecordMetadataChanges(tx, s, now)
+
+	if err != nil {
+		return err
+	}
+
 	queryString := `
 		UPDATE servers
 		SET
@@ -71,7 +140,7 @@ func UpdateServerRecord(tx *sql.Tx, s *ServerListItem) error {
 		WHERE guid = ?;
 	`
 
-	_, err := tx.Exec(
+	_, err = tx.Exec(
 		queryString,
 		s.ID,
 		s.Name,
@@ -159,12 +228,14 @@ func CreateOrUpdateServer(tx *sql.Tx, s *ServerListItem) error {
 	return err
 }
 
-func UpdateStatusForServer(db *sql.DB, s *ServerListItem) error {
+// UpdateStatusForServer checks a server and writes the result to the sinks.
+// The check is timed as a span in ctx's Sentry transaction.
+func UpdateStatusForServer(ctx context.Context, db *sql.DB, s *ServerListItem, sinks []StatusSink) error {
 	now := time.Now().UTC().Unix()
 
 	// Get the server's ID
 	res, err := db.Query(`
-		SELECT id
+		SELECT id, is_online
 		FROM servers
 		WHERE guid = ?
 		LIMIT 1
@@ -175,38 +246,47 @@ func UpdateStatusForServer(db *sql.DB, s *ServerListItem) error {
 	}
 
 	var id int
+	var was_online sql.NullBool
 
 	for res.Next() {
-		err := res.Scan(&id)
+		err := res.Scan(&id, &was_online)
 
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 
+	res.Close()
+
 	if id <= 0 {
 		log.Fatalf("Failed to find server for status with guid %s", s.ID)
 	}
 
-	// Add a new row
-	tx, err := db.Begin()
-
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	defer tx.Commit()
-
 	// Actually check server
 	server := Server{
 		Host: s.Host,
 		Port: s.Port,
 	}
 
+	span := StartSpan(ctx, "monitor.check", s.Name)
+	span.SetTag("server", s.Name)
+	checksInFlight.Inc()
+
 	rtt_start := time.Now().UTC().UnixMilli()
 	up, nattempts, err := CheckWithRetry(server, 20, 2*time.Second)
 	rtt := time.Now().UTC().UnixMilli() - rtt_start
 
+	checksInFlight.Dec()
+	checkDuration.WithLabelValues(resultLabel(err)).Observe(float64(rtt) / 1000)
+
+	if err != nil {
+		span.Status = sentry.SpanStatusUnavailable
+	} else {
+		span.Status = sentry.SpanStatusOK
+	}
+
+	span.Finish()
+
 	if err != nil {
 		up = false
 		message := fmt.Sprintf("Check for server %s failed after %d attempt(s) with error message `%s` .", s.Name, nattempts, err)
@@ -215,41 +295,71 @@ func UpdateStatusForServer(db *sql.DB, s *ServerListItem) error {
 		log.Printf("Check for server %s succeeded in %d ms after %d attempt(s)", s.Name, rtt, nattempts)
 	}
 
-	// Add new row to statuses table
-	query := `
-	INSERT INTO statuses (server_id, created_at, status, rtt, message)
-	VALUES (?, ?, ?, ?, ?)
-	`
-
 	var message string
 
 	if err != nil {
 		message = err.Error()
 	}
 
-	_, txErr := tx.Exec(query, id, now, up, rtt, message)
+	result := CheckResult{
+		Server: EventServer{
+			ID:       id,
+			GUID:     s.ID,
+			Name:     s.Name,
+			Emulator: s.Emu,
+			Type:     s.Type,
+			Host:     s.Host,
+			Port:     s.Port,
+			Discord:  s.Discord,
+		},
+		Time:      formatEventTime(now),
+		Up:        up,
+		RTT:       rtt,
+		Attempts:  nattempts,
+		Message:   message,
+		CreatedAt: now,
+	}
+
+	// Work out whether this check changed whether the server is up before the
+	// result is stored
+	change, transitionErr := StatusTransition(db, result.Server, was_online, up, now, message)
 
-	if txErr != nil {
-		log.Fatal(txErr)
+	if transitionErr != nil {
+		log.Printf("Failed to check for a state change for server %s: %s", s.Name, transitionErr)
+		captureException(ctx, transitionErr)
 	}
 
-	// Update last_seen value in servers table if up
-	if up {
-		updateServerLastSeenResult := UpdateServerLastSeen(tx, id, now)
+	// Report check errors once per outage rather than on every failed check
+	if change != nil && change.Kind == EVENT_DOWN && err != nil {
+		captureException(ctx, err)
+	}
+
+	WriteCheck(sinks, result, change)
+
+	return nil
+}
+
+func UpdateIncidents(tx *sql.Tx, server_id int, name string, now int64, up bool, message string, cfg DegradationConfig) error {
+	if !up {
+		// A server that's down isn't also degraded
+		_, err := EndIncident(tx, server_id, INCIDENT_DEGRADED, now)
 
-		if updateServerLastSeenResult != nil {
-			log.Fatal(updateServerLastSeenResult)
+		if err != nil {
+			return err
 		}
+
+		_, err = StartIncident(tx, server_id, INCIDENT_OUTAGE, now, message)
+
+		return err
 	}
 
-	// Update is_online with what we found
-	updateServerIsOnlineResult := UpdateServerIsOnline(tx, id, up)
+	_, err := EndIncident(tx, server_id, INCIDENT_OUTAGE, now)
 
-	if updateServerIsOnlineResult != nil {
-		log.Fatal(updateServerIsOnlineResult)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return UpdateDegradedIncident(tx, server_id, name, now, cfg)
 }
 
 func UpdateServersTable(db *sql.DB, list ServerList) {
@@ -261,6 +371,13 @@ func UpdateServersTable(db *sql.DB, list ServerList) {
 		log.Fatal(err)
 	}
 
+	// Remember which servers were listed so we can tell which changed
+	was_listed, err := listedServers(tx)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Set each item in the list to not-in-list
 	_, err = tx.Exec(`
 		UPDATE servers
@@ -279,21 +396,130 @@ func UpdateServersTable(db *sql.DB, list ServerList) {
 			log.Fatal(upsertErr)
 		}
 	}
+
+	is_listed, err := listedServers(tx)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	listingErr := RecordListingTransitions(tx, was_listed, is_listed, time.Now().UTC().Unix())
+
+	if listingErr != nil {
+		log.Printf("Failed to record listing changes: %s", listingErr)
+	}
 }
 
-func Update(db *sql.DB) error {
+// listedServers returns whether each known server is listed, keyed by ID
+func listedServers(tx *sql.Tx) (map[int]bool, error) {
+	rows, err := tx.Query(`
+		SELECT id, is_listed
+		FROM servers
+	`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	listed := map[int]bool{}
+
+	for rows.Next() {
+		var id int
+		var is_listed bool
+
+		if err := rows.Scan(&id, &is_listed); err != nil {
+			return nil, err
+		}
+
+		listed[id] = is_listed
+	}
+
+	return listed, rows.Err()
+}
+
+// RecordListingTransitions records an event for every server that has been
+// removed from or returned to the server list. Servers seen for the first
+// time don't get an event.
+func RecordListingTransitions(tx *sql.Tx, before map[int]bool, after map[int]bool, now int64) error {
+	for id, listed := range after {
+		was_listed, existed := before[id]
+
+		if !existed || was_listed == listed {
+			continue
+		}
+
+		kind := EVENT_DELISTED
+
+		if listed {
+			kind = EVENT_RELISTED
+		}
+
+		err := RecordEvent(tx, id, kind, now, sql.NullInt64{}, "")
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CHECK_INTERVAL is how often Update is run to check every server
+const CHECK_INTERVAL = 10 * time.Minute
+
+func Update(db *sql.DB, sinks []StatusSink) error {
 	log.Print("Beginning update...")
 
+	start := time.Now()
+
+	hub := sentry.CurrentHub().Clone()
+	update := sentry.StartSpan(sentry.SetHubOnContext(context.Background(), hub), "monitor.update", sentry.TransactionName("update"))
+	defer update.Finish()
+
 	// Fetch latest list
+	fetch := StartSpan(update.Context(), "http.client", "Fetch server list")
 	lst, err := Fetch()
+	fetch.Finish()
+
+	fetchDuration.WithLabelValues(resultLabel(err)).Observe(fetch.EndTime.Sub(fetch.StartTime).Seconds())
 
 	if err != nil {
+		hub.CaptureException(err)
+		hub.Flush(2 * time.Second)
+
 		log.Fatalf("Error fetching server list in update: %s", err)
 	}
 
-	// First we sync the list with the servers table
+	// First we sync the list with the servers table and pass on any listing or
+	// metadata changes that were recorded
+	latest, err := LatestEventID(db)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	UpdateServersTable(db, lst)
 
+	for {
+		changes, err := EventsAfter(db, latest, deliveryBatchSize)
+
+		if err != nil {
+			log.Printf("Failed to get changes from syncing the server list: %s", err)
+			break
+		}
+
+		if len(changes) == 0 {
+			break
+		}
+
+		for _, change := range changes {
+			WriteStateChange(sinks, change)
+			latest = change.ID
+		}
+	}
+
 	// Then we get statuses for each server in the list (in parallel)
 	var wg sync.WaitGroup
 	
@@ -302,7 +528,11 @@ func Update(db *sql.DB) error {
 		
 		go func(server *ServerListItem) {
 			defer wg.Done()
-			updateStatusError := UpdateStatusForServer(db, server)
+
+			ctx, hub := withServerHub(update.Context(), server)
+			defer func() { reportPanic(hub, recover()) }()
+
+			updateStatusError := UpdateStatusForServer(ctx, db, server, sinks)
 
 			if updateStatusError != nil {
 				log.Fatal(updateStatusError)
@@ -312,6 +542,9 @@ func Update(db *sql.DB) error {
 	
 	wg.Wait()
 
+	updateDuration.Observe(time.Since(start).Seconds())
+	lastUpdate.SetToCurrentTime()
+
 	log.Print("Done with update.")
 
 	return nil
@@ -0,0 +1,158 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// WebhookNotifier POSTs events as JSON to a URL. When a secret is set, each
+// request is signed so receivers can check it came from us: the
+// X-Monitor-Signature header is "sha256=" followed by the hex HMAC-SHA256 of
+// the X-Monitor-Timestamp header, a period, and the request body.
+type WebhookNotifier struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+type WebhookPayload struct {
+	Events []Event `json:"events"`
+}
+
+// HTTPStatusError is returned when a notification endpoint responds with
+// anything other than a 2xx status
+type HTTPStatusError struct {
+	Code int
+	Body string
+}
+
+func (e HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %d: %s", e.Code, e.Body)
+}
+
+func (e HTTPStatusError) StatusCode() int {
+	return e.Code
+}
+
+func NewWebhookNotifier(url string, secret string) *WebhookNotifier {
+	return &WebhookNotifier{
+		URL:    url,
+		Secret: secret,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Name identifies the webhook by its host and a hash of its URL since URLs
+// often carry a secret
+func (n *WebhookNotifier) Name() string {
+	return hashedNotifierName("webhook", n.URL)
+}
+
+// SignWebhook returns the signature for a payload sent at the given Unix
+// timestamp
+func SignWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// hashedNotifierName names a notifier for a URL without including the URL,
+// e.g., "webhook:example.com/1a2b3c4d5e6f"
+func hashedNotifierName(kind string, rawURL string) string {
+	sum := sha256.Sum256([]byte(rawURL))
+	host := ""
+
+	if u, err := url.Parse(rawURL); err == nil {
+		host = u.Host
+	}
+
+	return kind + ":" + host + "/" + hex.EncodeToString(sum[:6])
+}
+
+// redactedURL strips everything but the scheme and host from a URL so it can
+// be logged
+func redactedURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+
+	if err != nil {
+		return "<url>"
+	}
+
+	return u.Scheme + "://" + u.Host + "/..."
+}
+
+// redactURL redacts the URL in an error from an HTTP client, which includes
+// the whole URL
+func redactURL(err error) error {
+	var urlErr *url.Error
+
+	if errors.As(err, &urlErr) {
+		urlErr.URL = redactedURL(urlErr.URL)
+	}
+
+	return err
+}
+
+// postJSON sends a JSON body and turns non-2xx responses into an
+// HTTPStatusError. Client errors other than 408 and 429 are permanent.
+func postJSON(client *http.Client, req *http.Request) error {
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ac-server-monitor/"+GetGitHash())
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return redactURL(err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	statusErr := HTTPStatusError{Code: resp.StatusCode, Body: string(body)}
+
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != 408 && resp.StatusCode != 429 {
+		return PermanentError{Err: statusErr}
+	}
+
+	return statusErr
+}
+
+func (n *WebhookNotifier) Notify(events []Event) error {
+	body, err := json.Marshal(WebhookPayload{Events: events})
+
+	if err != nil {
+		return PermanentError{Err: err}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.URL, bytes.NewReader(body))
+
+	if err != nil {
+		return PermanentError{Err: err}
+	}
+
+	timestamp := strconv.FormatInt(time.Now().UTC().Unix(), 10)
+	req.Header.Set("X-Monitor-Timestamp", timestamp)
+
+	if n.Secret != "" {
+		req.Header.Set("X-Monitor-Signature", SignWebhook(n.Secret, timestamp, body))
+	}
+
+	return postJSON(n.Client, req)
+}
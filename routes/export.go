@@ -0,0 +1,272 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"monitor/api"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// FORMAT_PARQUET is only offered by exports
+const FORMAT_PARQUET = "parquet"
+
+const PARQUET_MEDIA_TYPE = "application/vnd.apache.parquet"
+
+var EXPORT_FORMATS = []string{FORMAT_NDJSON, FORMAT_CSV, FORMAT_PARQUET}
+
+var exportMediaTypes = map[string]string{
+	"text/csv":             FORMAT_CSV,
+	"application/x-ndjson": FORMAT_NDJSON,
+	"application/ndjson":   FORMAT_NDJSON,
+	PARQUET_MEDIA_TYPE:     FORMAT_PARQUET,
+}
+
+// MAX_EXPORT_DAYS limits the range of a single export over the API. monitor
+// export has no limit.
+const MAX_EXPORT_DAYS = 366
+
+// Parquet buffers a row group in memory before writing it, so this bounds how
+// much memory an export uses
+const EXPORT_ROWS_PER_ROW_GROUP = 50_000
+
+// NegotiateExportFormat picks an export's format like NegotiateFormat, but
+// offers Parquet instead of JSON and defaults to NDJSON
+func NegotiateExportFormat(r *http.Request) (string, error) {
+	if value := r.URL.Query().Get("format"); value != "" {
+		if !slices.Contains(EXPORT_FORMATS, value) {
+			return "", fmt.Errorf("invalid format %q, must be one of ndjson, csv or parquet", value)
+		}
+
+		return value, nil
+	}
+
+	return negotiateAccept(r, exportMediaTypes, FORMAT_NDJSON), nil
+}
+
+// exportTable writes the rows rows calls back with as format. header and
+// record give the CSV columns.
+func exportTable[T any](w io.Writer, format string, header []string, record func(T) []string, rows func(func(T) error) error) (int, error) {
+	var write func(T) error
+	var close func() error
+
+	switch format {
+	case FORMAT_CSV:
+		cw := csv.NewWriter(w)
+
+		if err := cw.Write(header); err != nil {
+			return 0, err
+		}
+
+		write = func(v T) error { return cw.Write(record(v)) }
+		close = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case FORMAT_NDJSON:
+		enc := json.NewEncoder(w)
+
+		write = func(v T) error { return enc.Encode(v) }
+		close = func() error { return nil }
+	case FORMAT_PARQUET:
+		pw := parquet.NewGenericWriter[T](w,
+			parquet.Compression(&parquet.Snappy),
+			parquet.MaxRowsPerRowGroup(EXPORT_ROWS_PER_ROW_GROUP),
+			parquet.CreatedBy("ac-server-monitor", "", ""),
+		)
+
+		write = func(v T) error {
+			_, err := pw.Write([]T{v})
+			return err
+		}
+		close = pw.Close
+	default:
+		return 0, fmt.Errorf("can't export as %q", format)
+	}
+
+	n := 0
+
+	err := rows(func(v T) error {
+		n++
+		return write(v)
+	})
+
+	if err != nil {
+		return n, err
+	}
+
+	return n, close()
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func formatTimePointer(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	return formatTime(*t)
+}
+
+var EXPORT_SERVER_CSV_HEADER = []string{"id", "guid", "name", "description", "emu", "host", "port", "type", "website_url", "discord_url", "is_listed", "is_online", "last_seen", "created_at", "updated_at"}
+
+var EXPORT_STATUS_CSV_HEADER = []string{"id", "server_id", "server_guid", "created_at", "up", "rtt", "message"}
+
+var EXPORT_INCIDENT_CSV_HEADER = []string{"id", "server_id", "server_guid", "kind", "started_at", "ended_at", "message"}
+
+// WriteExport writes one table's rows in r to w as format and returns how
+// many it wrote. Text in CSV is escaped with EscapeCSVCell.
+func WriteExport(ctx context.Context, w io.Writer, db *sql.DB, table string, format string, r api.ExportRange) (int, error) {
+	switch table {
+	case api.EXPORT_SERVERS:
+		return exportTable(w, format, EXPORT_SERVER_CSV_HEADER, func(s api.ExportServer) []string {
+			is_online := ""
+
+			if s.IsOnline != nil {
+				is_online = strconv.FormatBool(*s.IsOnline)
+			}
+
+			return []string{
+				strconv.FormatInt(s.ID, 10),
+				EscapeCSVCell(s.GUID),
+				EscapeCSVCell(s.Name),
+				EscapeCSVCell(s.Description),
+				EscapeCSVCell(s.Emulator),
+				EscapeCSVCell(s.Host),
+				EscapeCSVCell(s.Port),
+				EscapeCSVCell(s.Type),
+				EscapeCSVCell(s.WebsiteURL),
+				EscapeCSVCell(s.DiscordURL),
+				strconv.FormatBool(s.IsListed),
+				is_online,
+				formatTimePointer(s.LastSeen),
+				formatTime(s.CreatedAt),
+				formatTime(s.UpdatedAt),
+			}
+		}, func(fn func(api.ExportServer) error) error {
+			return api.ExportServers(ctx, db, fn)
+		})
+	case api.EXPORT_STATUSES:
+		return exportTable(w, format, EXPORT_STATUS_CSV_HEADER, func(s api.ExportStatus) []string {
+			rtt := ""
+
+			if s.RTT != nil {
+				rtt = strconv.FormatInt(*s.RTT, 10)
+			}
+
+			return []string{
+				strconv.FormatInt(s.ID, 10),
+				strconv.FormatInt(s.ServerID, 10),
+				EscapeCSVCell(s.ServerGUID),
+				formatTime(s.CreatedAt),
+				strconv.FormatBool(s.Up),
+				rtt,
+				EscapeCSVCell(s.Message),
+			}
+		}, func(fn func(api.ExportStatus) error) error {
+			return api.ExportStatuses(ctx, db, r, fn)
+		})
+	case api.EXPORT_INCIDENTS:
+		return exportTable(w, format, EXPORT_INCIDENT_CSV_HEADER, func(i api.ExportIncident) []string {
+			return []string{
+				strconv.FormatInt(i.ID, 10),
+				strconv.FormatInt(i.ServerID, 10),
+				EscapeCSVCell(i.ServerGUID),
+				i.Kind,
+				formatTime(i.StartedAt),
+				formatTimePointer(i.EndedAt),
+				EscapeCSVCell(i.Message),
+			}
+		}, func(fn func(api.ExportIncident) error) error {
+			return api.ExportIncidents(ctx, db, r, fn)
+		})
+	}
+
+	return 0, fmt.Errorf("invalid table %q, must be one of servers, statuses or incidents", table)
+}
+
+// Export streams one table's history for a date range as NDJSON, CSV or
+// Parquet
+func (v V2) Export(w http.ResponseWriter, r *http.Request) {
+	table := r.URL.Query().Get("table")
+
+	if !slices.Contains(api.EXPORT_TABLES, table) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid table %q, must be one of servers, statuses or incidents", table))
+		return
+	}
+
+	export_range, err := api.ParseExportRange(r.URL.Query(), time.Now().UTC())
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if export_range.To.Sub(export_range.From) > MAX_EXPORT_DAYS*24*time.Hour {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("range is too large, at most %d days can be exported at once", MAX_EXPORT_DAYS))
+		return
+	}
+
+	format, err := NegotiateExportFormat(r)
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	content_types := map[string]string{
+		FORMAT_NDJSON:  "application/x-ndjson",
+		FORMAT_CSV:     "text/csv; charset=utf-8",
+		FORMAT_PARQUET: PARQUET_MEDIA_TYPE,
+	}
+
+	filename := fmt.Sprintf("%s-%s-%s.%s", table, export_range.From.Format(time.DateOnly), export_range.To.Format(time.DateOnly), format)
+
+	w.Header().Set("Content-Type", content_types[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET")
+	w.Header().Set("Vary", "Accept")
+
+	sent := &sentWriter{w: w}
+	_, err = WriteExport(r.Context(), sent, v.DB, table, format, export_range)
+
+	if err == nil {
+		return
+	}
+
+	if sent.n == 0 {
+		w.Header().Del("Content-Disposition")
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Clients can't tell a truncated CSV or NDJSON file from a whole one, so
+	// abort the response rather than finishing it
+	logRowsError(err)
+	panic(http.ErrAbortHandler)
+}
+
+// sentWriter counts the bytes written to w to tell whether a response has
+// started
+type sentWriter struct {
+	w io.Writer
+	n int
+}
+
+func (s *sentWriter) Write(b []byte) (int, error) {
+	n, err := s.w.Write(b)
+	s.n += n
+
+	return n, err
+}
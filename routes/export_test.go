@@ -0,0 +1,188 @@
+package routes
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"monitor/api"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// NewTestExport is NewTestV2 with checks on the 1st, 2nd and 3rd of January
+// 2024, which failed on the 2nd, and an incident for the outage
+func NewTestExport(t *testing.T) (*sql.DB, *http.ServeMux) {
+	db, mux := NewTestV2(t)
+
+	for day := 1; day <= 3; day++ {
+		created_at := time.Date(2024, 1, day, 12, 0, 0, 0, time.UTC).Unix()
+		_, err := db.Exec("INSERT INTO statuses (server_id, created_at, status, rtt, message) VALUES (1, ?, ?, ?, ?)", created_at, day != 2, 40+day, "")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := db.Exec("INSERT INTO incidents (server_id, kind, started_at, ended_at, message) VALUES (1, 'outage', ?, ?, 'Timeout')",
+		time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC).Unix(), time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC).Unix())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db, mux
+}
+
+func TestExportNDJSON(t *testing.T) {
+	_, mux := NewTestExport(t)
+	doc := NewOpenAPI()
+	ndjson := doc.Paths["/api/export"]["get"].Responses["200"].Content["application/x-ndjson"].Schema
+
+	for table, n := range map[string]int{"servers": 1, "statuses": 2, "incidents": 1} {
+		res := GetTestJSON(t, mux, "/api/export?table="+table+"&from=2024-01-02&to=2024-01-04", nil)
+		lines := strings.Split(strings.TrimSpace(res.Body.String()), "\n")
+
+		assert.Equal(t, http.StatusOK, res.Code, table)
+		assert.Equal(t, "application/x-ndjson", res.Header().Get("Content-Type"))
+		assert.Equal(t, `attachment; filename="`+table+`-2024-01-02-2024-01-04.ndjson"`, res.Header().Get("Content-Disposition"))
+		assert.Len(t, lines, n, table)
+
+		for _, line := range lines {
+			var v any
+
+			assert.NoError(t, json.Unmarshal([]byte(line), &v))
+			assert.Empty(t, ValidateTestSchema(doc, ndjson, v, table), table)
+		}
+	}
+
+	var status api.ExportStatus
+	res := GetTestJSON(t, mux, "/api/export?table=statuses&from=2024-01-02&to=2024-01-03", &status)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "levistras-guid", status.ServerGUID)
+	assert.Equal(t, time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC), status.CreatedAt)
+	assert.False(t, status.Up)
+	assert.Equal(t, int64(42), *status.RTT)
+}
+
+func TestExportCSV(t *testing.T) {
+	_, mux := NewTestExport(t)
+
+	res := GetTestJSON(t, mux, "/api/export?table=incidents&format=csv&from=2024-01-01&to=2024-01-31", nil)
+	rows, err := csv.NewReader(res.Body).ReadAll()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "text/csv; charset=utf-8", res.Header().Get("Content-Type"))
+	assert.Equal(t, [][]string{
+		EXPORT_INCIDENT_CSV_HEADER,
+		{"1", "1", "levistras-guid", "outage", "2024-01-02T12:00:00Z", "2024-01-03T12:00:00Z", "Timeout"},
+	}, rows)
+}
+
+func TestExportCSVEscapesFormulas(t *testing.T) {
+	db, mux := NewTestExport(t)
+
+	_, err := db.Exec("UPDATE servers SET name = '=cmd()', description = '@SUM(A1)'")
+	assert.NoError(t, err)
+	_, err = db.Exec("UPDATE incidents SET message = '+1'")
+	assert.NoError(t, err)
+
+	res := GetTestJSON(t, mux, "/api/export?table=servers&format=csv", nil)
+	rows, err := csv.NewReader(res.Body).ReadAll()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "'=cmd()", rows[1][2])
+	assert.Equal(t, "'@SUM(A1)", rows[1][3])
+
+	res = GetTestJSON(t, mux, "/api/export?table=incidents&format=csv&from=2024-01-01&to=2024-01-31", nil)
+	rows, err = csv.NewReader(res.Body).ReadAll()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "'+1", rows[1][6])
+}
+
+func TestExportFailures(t *testing.T) {
+	db, mux := NewTestExport(t)
+
+	// A check that can't be read, after the others
+	_, err := db.Exec("INSERT INTO statuses (server_id, created_at, status, rtt, message) VALUES (1, ?, 'x', 0, '')", time.Date(2024, 1, 4, 12, 0, 0, 0, time.UTC).Unix())
+	assert.NoError(t, err)
+
+	// Nothing's been sent yet when CSV fails on the first rows, so it's an
+	// error response
+	var body APIError
+	res := GetTestJSON(t, mux, "/api/export?table=statuses&format=csv&from=2024-01-01&to=2024-01-31", &body)
+
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+	assert.Equal(t, "internal_error", body.Error.Code)
+	assert.Empty(t, res.Header().Get("Content-Disposition"))
+
+	// But NDJSON has, so the response is aborted instead of ending normally
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	res2, err := http.Get(server.URL + "/api/export?table=statuses&format=ndjson&from=2024-01-01&to=2024-01-31")
+
+	if err == nil {
+		_, err = io.ReadAll(res2.Body)
+		res2.Body.Close()
+	}
+
+	assert.Error(t, err)
+}
+
+func TestExportParquet(t *testing.T) {
+	_, mux := NewTestExport(t)
+
+	res := GetTestJSON(t, mux, "/api/export?table=statuses&format=parquet&from=2024-01-01&to=2024-01-31", nil)
+
+	assert.Equal(t, PARQUET_MEDIA_TYPE, res.Header().Get("Content-Type"))
+
+	rows, err := parquet.Read[api.ExportStatus](bytes.NewReader(res.Body.Bytes()), int64(res.Body.Len()))
+
+	assert.NoError(t, err)
+	assert.Len(t, rows, 3)
+	assert.Equal(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), rows[0].CreatedAt.UTC())
+	assert.Equal(t, []bool{true, false, true}, []bool{rows[0].Up, rows[1].Up, rows[2].Up})
+	assert.Equal(t, int64(43), *rows[2].RTT)
+
+	// Accept works too and servers have optional columns
+	res = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/export?table=servers", nil)
+	req.Header.Set("Accept", PARQUET_MEDIA_TYPE)
+	mux.ServeHTTP(res, req)
+
+	servers, err := parquet.Read[api.ExportServer](bytes.NewReader(res.Body.Bytes()), int64(res.Body.Len()))
+
+	assert.NoError(t, err)
+	assert.Len(t, servers, 1)
+	assert.Equal(t, "Levistras", servers[0].Name)
+	assert.Nil(t, servers[0].LastSeen)
+}
+
+func TestExportErrors(t *testing.T) {
+	_, mux := NewTestExport(t)
+
+	for _, path := range []string{
+		"/api/export",
+		"/api/export?table=events",
+		"/api/export?table=statuses&format=json",
+		"/api/export?table=statuses&from=yesterday",
+		"/api/export?table=statuses&from=2024-02-01&to=2024-01-01",
+		"/api/export?table=statuses&from=2020-01-01&to=2024-01-01",
+	} {
+		var body APIError
+		res := GetTestJSON(t, mux, path, &body)
+
+		assert.Equal(t, http.StatusBadRequest, res.Code, path)
+		assert.NotEmpty(t, body.Error.Message, path)
+	}
+}
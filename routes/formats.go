@@ -0,0 +1,331 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"monitor/api"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/guregu/null.v4"
+)
+
+// Formats list endpoints can respond in. CSV and NDJSON are streamed a row at
+// a time.
+const (
+	FORMAT_JSON   = "json"
+	FORMAT_CSV    = "csv"
+	FORMAT_NDJSON = "ndjson"
+)
+
+// How many rows are written between flushes
+const ROWS_PER_FLUSH = 100
+
+var formatMediaTypes = map[string]string{
+	"application/json":     FORMAT_JSON,
+	"text/csv":             FORMAT_CSV,
+	"application/x-ndjson": FORMAT_NDJSON,
+	"application/ndjson":   FORMAT_NDJSON,
+}
+
+// NegotiateFormat picks a list response's format from the format parameter
+// or, failing that, the most preferred type in the Accept header that we
+// support. Anything else gets JSON.
+func NegotiateFormat(r *http.Request) (string, error) {
+	if value := r.URL.Query().Get("format"); value != "" {
+		switch value {
+		case FORMAT_JSON, FORMAT_CSV, FORMAT_NDJSON:
+			return value, nil
+		}
+
+		return "", fmt.Errorf("invalid format %q, must be one of json, csv or ndjson", value)
+	}
+
+	return negotiateAccept(r, formatMediaTypes, FORMAT_JSON), nil
+}
+
+// negotiateAccept returns the format of the most preferred type in the Accept
+// header that's in media_types, or fallback if there isn't one
+func negotiateAccept(r *http.Request, media_types map[string]string, fallback string) string {
+	type accepted struct {
+		format string
+		q      float64
+	}
+
+	var candidates []accepted
+
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		media_type, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+
+		if err != nil {
+			continue
+		}
+
+		format, ok := media_types[media_type]
+
+		if !ok {
+			continue
+		}
+
+		q := 1.0
+
+		if value, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+
+		if q > 0 {
+			candidates = append(candidates, accepted{format, q})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+
+	if len(candidates) > 0 {
+		return candidates[0].format
+	}
+
+	return fallback
+}
+
+// RowWriter streams a list as CSV, with a header row, or as NDJSON, one JSON
+// object per line, flushing as it goes. Nothing is sent until the first row or
+// flush so errors before then can still get an error response.
+type RowWriter struct {
+	w       http.ResponseWriter
+	format  string
+	name    string
+	header  []string
+	csv     *csv.Writer
+	json    *json.Encoder
+	rc      *http.ResponseController
+	rows    int
+	started bool
+}
+
+// ErrRowsSent wraps errors streaming rows after the response has started, when
+// it's too late to send an error response
+var ErrRowsSent = errors.New("response already started")
+
+// NewRowWriter prepares a CSV or NDJSON response. name is used for the CSV's
+// filename.
+func NewRowWriter(w http.ResponseWriter, format string, name string, header []string) *RowWriter {
+	return &RowWriter{w: w, format: format, name: name, header: header, rc: http.NewResponseController(w)}
+}
+
+// start sends the headers, and the CSV's header row
+func (rw *RowWriter) start() error {
+	if rw.started {
+		return nil
+	}
+
+	rw.started = true
+
+	rw.w.Header().Set("Access-Control-Allow-Origin", "*")
+	rw.w.Header().Set("Access-Control-Allow-Methods", "GET")
+	rw.w.Header().Set("Vary", "Accept")
+
+	if rw.format == FORMAT_CSV {
+		rw.w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		rw.w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", rw.name+".csv"))
+		rw.csv = csv.NewWriter(rw.w)
+
+		return rw.csv.Write(rw.header)
+	}
+
+	rw.w.Header().Set("Content-Type", "application/x-ndjson")
+	rw.json = json.NewEncoder(rw.w)
+
+	return nil
+}
+
+// Err wraps err in ErrRowsSent if the response has started
+func (rw *RowWriter) Err(err error) error {
+	if err == nil || !rw.started {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", ErrRowsSent, err)
+}
+
+// Write sends one row, record for CSV and v for NDJSON
+func (rw *RowWriter) Write(record []string, v any) error {
+	err := rw.start()
+
+	if err != nil {
+		return err
+	}
+
+	if rw.csv != nil {
+		err = rw.csv.Write(record)
+	} else {
+		err = rw.json.Encode(v)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	rw.rows++
+
+	if rw.rows%ROWS_PER_FLUSH == 0 {
+		return rw.Flush()
+	}
+
+	return nil
+}
+
+// Flush sends everything written so far
+func (rw *RowWriter) Flush() error {
+	if err := rw.start(); err != nil {
+		return err
+	}
+
+	if rw.csv != nil {
+		rw.csv.Flush()
+
+		if err := rw.csv.Error(); err != nil {
+			return err
+		}
+	}
+
+	err := rw.rc.Flush()
+
+	if err == http.ErrNotSupported {
+		return nil
+	}
+
+	return err
+}
+
+// EscapeCSVCell stops spreadsheets from treating text from server operators or
+// players as a formula by prefixing cells that start like one with '. Cells
+// that already start with ' are prefixed too so UnescapeCSVCell can undo it.
+func EscapeCSVCell(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r'", rune(cell[0])) {
+		return "'" + cell
+	}
+
+	return cell
+}
+
+// UnescapeCSVCell reverses EscapeCSVCell
+func UnescapeCSVCell(cell string) string {
+	return strings.TrimPrefix(cell, "'")
+}
+
+func formatNullFloat(value null.Float) string {
+	if !value.Valid {
+		return ""
+	}
+
+	return strconv.FormatFloat(value.Float64, 'f', -1, 64)
+}
+
+var SERVER_CSV_HEADER = []string{"guid", "name", "host", "port", "online", "degraded", "rtt", "last_seen", "last_checked", "uptime_24h", "uptime_7d", "uptime_30d", "uptime_90d", "uptime_all"}
+
+func serverRecord(s api.ServerAPIResponseServer) []string {
+	record := []string{
+		EscapeCSVCell(s.GUID),
+		EscapeCSVCell(s.Name),
+		EscapeCSVCell(s.Address.Host),
+		EscapeCSVCell(s.Address.Port),
+		"",
+		strconv.FormatBool(s.Status.IsDegraded),
+		"",
+		s.Status.LastSeen.String,
+		s.Status.LastChecked,
+	}
+
+	if s.Status.IsOnline.Valid {
+		record[4] = strconv.FormatBool(s.Status.IsOnline.Bool)
+	}
+
+	if s.Status.RTT.Valid {
+		record[6] = strconv.FormatInt(s.Status.RTT.Int64, 10)
+	}
+
+	for _, key := range api.UPTIME_SUMMARY_KEYS {
+		record = append(record, formatNullFloat(s.UptimeSummary.Get(key)))
+	}
+
+	return record
+}
+
+// WriteServers streams the listed servers that match filter as CSV or NDJSON
+// as they're read
+func WriteServers(w http.ResponseWriter, db *sql.DB, format string, filter api.ServerFilter) error {
+	rw := NewRowWriter(w, format, "servers", SERVER_CSV_HEADER)
+
+	err := api.EachServer(db, filter, func(s api.ServerAPIResponseServer) error {
+		return rw.Write(serverRecord(s), s)
+	})
+
+	if err != nil {
+		return rw.Err(err)
+	}
+
+	return rw.Err(rw.Flush())
+}
+
+var UPTIME_CSV_HEADER = []string{"date", "uptime", "n", "rtt_min", "rtt_max", "rtt_mean"}
+
+// WriteUptimes streams a server's uptimes as CSV or NDJSON
+func WriteUptimes(w http.ResponseWriter, format string, uptimes api.UptimeResult) error {
+	rw := NewRowWriter(w, format, "uptimes", UPTIME_CSV_HEADER)
+
+	for _, u := range uptimes.Uptimes {
+		record := []string{
+			u.Date,
+			strconv.FormatFloat(u.Uptime, 'f', -1, 64),
+			strconv.Itoa(u.N),
+			strconv.Itoa(u.RTT.Min),
+			strconv.Itoa(u.RTT.Max),
+			strconv.Itoa(u.RTT.Mean),
+		}
+
+		if err := rw.Write(record, u); err != nil {
+			return rw.Err(err)
+		}
+	}
+
+	return rw.Err(rw.Flush())
+}
+
+var STATUS_CSV_HEADER = []string{"status", "created_at", "rtt", "message"}
+
+// WriteStatuses streams a page of a server's checks as CSV or NDJSON as
+// they're read. As there's nowhere to put the next page's cursor, it's linked
+// to from a Link header instead.
+func WriteStatuses(w http.ResponseWriter, r *http.Request, db *sql.DB, server_id int, q api.StatusQuery, format string) error {
+	rw := NewRowWriter(w, format, "statuses", STATUS_CSV_HEADER)
+
+	err := api.EachStatus(r.Context(), db, server_id, q, func(next null.String) error {
+		if next.Valid {
+			values := r.URL.Query()
+			values.Set("cursor", next.String)
+			link := url.URL{Path: r.URL.Path, RawQuery: values.Encode()}
+
+			// Deprecated v1 routes already link to their successor
+			w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"next\"", link.String()))
+		}
+
+		return nil
+	}, func(s api.StatusApiStatusItem) error {
+		return rw.Write([]string{s.Status, s.CreatedAt, strconv.Itoa(s.RTT), EscapeCSVCell(s.Message)}, s)
+	})
+
+	if err != nil {
+		return rw.Err(err)
+	}
+
+	return rw.Err(rw.Flush())
+}
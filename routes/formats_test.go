@@ -0,0 +1,209 @@
+package routes
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"monitor/api"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	cases := []struct {
+		target string
+		accept string
+		format string
+	}{
+		{"/", "", FORMAT_JSON},
+		{"/", "*/*", FORMAT_JSON},
+		{"/", "text/html", FORMAT_JSON},
+		{"/", "text/csv", FORMAT_CSV},
+		{"/", "application/x-ndjson", FORMAT_NDJSON},
+		{"/", "application/ndjson", FORMAT_NDJSON},
+		{"/", "application/json;q=0.5, text/csv", FORMAT_CSV},
+		{"/", "text/csv;q=0.2, application/x-ndjson;q=0.8", FORMAT_NDJSON},
+		{"/", "text/csv;q=0", FORMAT_JSON},
+		{"/?format=csv", "application/x-ndjson", FORMAT_CSV},
+		{"/?format=json", "text/csv", FORMAT_JSON},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.target, nil)
+		r.Header.Set("Accept", c.accept)
+
+		format, err := NegotiateFormat(r)
+
+		assert.NoError(t, err, c)
+		assert.Equal(t, c.format, format, c)
+	}
+
+	_, err := NegotiateFormat(httptest.NewRequest("GET", "/?format=xml", nil))
+	assert.Error(t, err)
+}
+
+func TestV2StreamsCSV(t *testing.T) {
+	db, mux := NewTestV2(t)
+
+	for i, created_at := range []int64{100, 200, 300} {
+		_, err := db.Exec("INSERT INTO statuses (server_id, created_at, status, rtt, message) VALUES (1, ?, ?, 40, ?)", created_at, i != 1, "said \"hi\", then left")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/v2/servers", nil)
+	req.Header.Set("Accept", "text/csv")
+	mux.ServeHTTP(res, req)
+
+	rows, err := csv.NewReader(res.Body).ReadAll()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "text/csv; charset=utf-8", res.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept", res.Header().Get("Vary"))
+	assert.Equal(t, SERVER_CSV_HEADER, rows[0])
+	assert.Len(t, rows, 2)
+	assert.Equal(t, "levistras-guid", rows[1][0])
+
+	res = GetTestJSON(t, mux, "/api/v2/servers/Levistras/statuses?format=csv&limit=2", nil)
+	rows, err = csv.NewReader(res.Body).ReadAll()
+
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		STATUS_CSV_HEADER,
+		{"UP", "1970-01-01T00:05:00Z", "40", "said \"hi\", then left"},
+		{"DOWN", "1970-01-01T00:03:20Z", "40", "said \"hi\", then left"},
+	}, rows)
+
+	// The cursor has nowhere to go in CSV so it's linked to instead
+	link := res.Header().Get("Link")
+
+	assert.True(t, strings.HasPrefix(link, "</api/v2/servers/Levistras/statuses?cursor="), link)
+	assert.True(t, strings.HasSuffix(link, `>; rel="next"`), link)
+	assert.Contains(t, link, "format=csv")
+}
+
+func TestEscapeCSVCell(t *testing.T) {
+	cases := map[string]string{
+		"":                     "",
+		"Levistras":            "Levistras",
+		"=HYPERLINK(\"evil\")": "'=HYPERLINK(\"evil\")",
+		"+1":                   "'+1",
+		"-1":                   "'-1",
+		"@SUM(A1)":             "'@SUM(A1)",
+		"\t=1":                 "'\t=1",
+		"a=b":                  "a=b",
+		"'quoted'":             "''quoted'",
+	}
+
+	for cell, expected := range cases {
+		assert.Equal(t, expected, EscapeCSVCell(cell), cell)
+		assert.Equal(t, cell, UnescapeCSVCell(EscapeCSVCell(cell)), cell)
+	}
+}
+
+func TestV2EscapesCSVFormulas(t *testing.T) {
+	db, mux := NewTestV2(t)
+
+	_, err := db.Exec("UPDATE servers SET name = '=cmd()'")
+	assert.NoError(t, err)
+	_, err = db.Exec("INSERT INTO statuses (server_id, created_at, status, rtt, message) VALUES (1, 100, 0, 0, '@SUM(A1)')")
+	assert.NoError(t, err)
+
+	res := GetTestJSON(t, mux, "/api/v2/servers?format=csv", nil)
+	rows, err := csv.NewReader(res.Body).ReadAll()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "'=cmd()", rows[1][1])
+
+	res = GetTestJSON(t, mux, "/api/v2/servers/levistras-guid/statuses?format=csv", nil)
+	rows, err = csv.NewReader(res.Body).ReadAll()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "'@SUM(A1)", rows[1][3])
+
+	// JSON is left as it is
+	var statuses api.StatusApiResponse
+	GetTestJSON(t, mux, "/api/v2/servers/levistras-guid/statuses", &statuses)
+	assert.Equal(t, "@SUM(A1)", statuses.Statuses[0].Message)
+}
+
+func TestV2StreamedPagesMatchJSON(t *testing.T) {
+	db, mux := NewTestV2(t)
+
+	for i := int64(0); i < 5; i++ {
+		_, err := db.Exec("INSERT INTO statuses (server_id, created_at, status, rtt, message) VALUES (1, ?, 1, 40, '')", 100+i)
+		assert.NoError(t, err)
+	}
+
+	for _, limit := range []string{"1", "4", "5", "6"} {
+		var page api.StatusApiResponse
+		GetTestJSON(t, mux, "/api/v2/servers/Levistras/statuses?limit="+limit, &page)
+
+		res := GetTestJSON(t, mux, "/api/v2/servers/Levistras/statuses?format=ndjson&limit="+limit, nil)
+		lines := strings.Split(strings.TrimSpace(res.Body.String()), "\n")
+
+		assert.Len(t, lines, page.Count, limit)
+
+		if page.NextCursor.Valid {
+			assert.Contains(t, res.Header().Get("Link"), "cursor="+page.NextCursor.String, limit)
+		} else {
+			assert.Empty(t, res.Header().Get("Link"), limit)
+		}
+	}
+}
+
+func TestV2StreamingErrors(t *testing.T) {
+	db, mux := NewTestV2(t)
+
+	_, err := db.Exec("DROP TABLE statuses")
+	assert.NoError(t, err)
+
+	// Errors before any rows are sent get an error response
+	var body APIError
+	res := GetTestJSON(t, mux, "/api/v2/servers/Levistras/statuses?format=csv", &body)
+
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+	assert.Equal(t, "internal_error", body.Error.Code)
+}
+
+func TestV2StreamsNDJSON(t *testing.T) {
+	db, mux := NewTestV2(t)
+
+	for _, created_at := range []int64{100, 200, 300} {
+		_, err := db.Exec("INSERT INTO statuses (server_id, created_at, status, rtt, message) VALUES (1, ?, 1, 40, '')", created_at)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res := GetTestJSON(t, mux, "/api/v2/servers/Levistras/statuses?format=ndjson", nil)
+	lines := strings.Split(strings.TrimSpace(res.Body.String()), "\n")
+
+	assert.Equal(t, "application/x-ndjson", res.Header().Get("Content-Type"))
+	assert.Empty(t, res.Header().Get("Link"))
+	assert.Len(t, lines, 3)
+
+	var status map[string]any
+
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &status))
+	assert.Equal(t, "1970-01-01T00:05:00Z", status["created_at"])
+}
+
+func TestV2RejectsUnknownFormats(t *testing.T) {
+	_, mux := NewTestV2(t)
+
+	for _, path := range []string{"/api/v2/servers?format=xml", "/api/v2/servers/Levistras/statuses?format=xml", "/api/v2/servers/Levistras/uptimes?format=xml"} {
+		var body APIError
+		res := GetTestJSON(t, mux, path, &body)
+
+		assert.Equal(t, http.StatusBadRequest, res.Code, path)
+		assert.Equal(t, "bad_request", body.Error.Code, path)
+	}
+}
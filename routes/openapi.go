@@ -0,0 +1,421 @@
+package routes
+
+import (
+	"fmt"
+	"maps"
+	"monitor/api"
+	"monitor/lib"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/guregu/null.v4"
+)
+
+// OpenAPI is an OpenAPI 3 document, with only as much of the spec as we need
+type OpenAPI struct {
+	OpenAPI    string                                 `json:"openapi"`
+	Info       OpenAPIInfo                            `json:"info"`
+	Paths      map[string]map[string]OpenAPIOperation `json:"paths"`
+	Components OpenAPIComponents                      `json:"components"`
+}
+
+type OpenAPIInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Version     string `json:"version"`
+}
+
+type OpenAPIComponents struct {
+	Schemas map[string]*Schema `json:"schemas"`
+}
+
+type OpenAPIOperation struct {
+	OperationID string                     `json:"operationId"`
+	Summary     string                     `json:"summary"`
+	Tags        []string                   `json:"tags"`
+	Deprecated  bool                       `json:"deprecated,omitempty"`
+	Parameters  []OpenAPIParameter         `json:"parameters,omitempty"`
+	Responses   map[string]OpenAPIResponse `json:"responses"`
+}
+
+type OpenAPIParameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type OpenAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]OpenAPIMediaType `json:"content,omitempty"`
+}
+
+type OpenAPIMediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Schema is an OpenAPI 3.0 schema object
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Minimum              *int               `json:"minimum,omitempty"`
+	Maximum              *int               `json:"maximum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+}
+
+// EventsResponse is the body of /api/v2/servers/{id}/events
+type EventsResponse struct {
+	Count  int         `json:"count"`
+	Events []lib.Event `json:"events"`
+}
+
+// RoutesResponse is the body of /api/
+type RoutesResponse struct {
+	Routes  []string `json:"routes"`
+	OpenAPI string   `json:"openapi"`
+}
+
+const (
+	OPENAPI_PATH = "/api/openapi.json"
+	OPENAPI_V2   = "v2"
+	OPENAPI_V1   = "v1 (deprecated)"
+)
+
+var (
+	nullableTypes = map[reflect.Type]Schema{
+		reflect.TypeOf(null.String{}): {Type: "string", Nullable: true},
+		reflect.TypeOf(null.Bool{}):   {Type: "boolean", Nullable: true},
+		reflect.TypeOf(null.Int{}):    {Type: "integer", Nullable: true},
+		reflect.TypeOf(null.Float{}):  {Type: "number", Nullable: true},
+		reflect.TypeOf(time.Time{}):   {Type: "string", Format: "date-time"},
+	}
+
+	timeDescription = "An RFC 3339 timestamp or YYYY-MM-DD date"
+)
+
+// Schema returns a schema for values of t as encoding/json would marshal
+// them. Structs are added to the document's components and referred to.
+func (doc *OpenAPI) Schema(t reflect.Type) *Schema {
+	if s, ok := nullableTypes[t]; ok {
+		return &s
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := doc.Schema(t.Elem())
+		s.Nullable = true
+
+		return s
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: doc.Schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object"}
+	case reflect.Struct:
+		if _, ok := doc.Components.Schemas[t.Name()]; !ok {
+			// Reserve the name first in case the struct refers to itself
+			doc.Components.Schemas[t.Name()] = &Schema{}
+			*doc.Components.Schemas[t.Name()] = *doc.structSchema(t)
+		}
+
+		return &Schema{Ref: "#/components/schemas/" + t.Name()}
+	}
+
+	return &Schema{}
+}
+
+// structSchema lists a struct's JSON fields, including those of embedded
+// structs. Fields without omitempty are always present so they're required.
+func (doc *OpenAPI) structSchema(t reflect.Type) *Schema {
+	closed := false
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}, AdditionalProperties: &closed}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			embedded := doc.structSchema(field.Type)
+
+			for key, value := range embedded.Properties {
+				s.Properties[key] = value
+			}
+
+			s.Required = append(s.Required, embedded.Required...)
+
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		s.Properties[name] = doc.Schema(field.Type)
+
+		if !slices.Contains(strings.Split(options, ","), "omitempty") {
+			s.Required = append(s.Required, name)
+		}
+	}
+
+	slices.Sort(s.Required)
+
+	return s
+}
+
+func jsonResponse(doc *OpenAPI, description string, v any) OpenAPIResponse {
+	return OpenAPIResponse{
+		Description: description,
+		Content: map[string]OpenAPIMediaType{
+			"application/json": {Schema: doc.Schema(reflect.TypeOf(v))},
+		},
+	}
+}
+
+// listed lets a list operation respond with CSV or NDJSON, one item per row or
+// line, as well as JSON
+func listed(doc *OpenAPI, op OpenAPIOperation, item any) OpenAPIOperation {
+	op.Parameters = append(slices.Clone(op.Parameters), param("format", "query", "Respond with JSON, CSV or NDJSON. Overrides the Accept header.", enum(FORMAT_JSON, FORMAT_CSV, FORMAT_NDJSON)))
+
+	ok := op.Responses["200"]
+	content := maps.Clone(ok.Content)
+	content["text/csv"] = OpenAPIMediaType{Schema: &Schema{Type: "string"}}
+	content["application/x-ndjson"] = OpenAPIMediaType{Schema: doc.Schema(reflect.TypeOf(item))}
+	ok.Content = content
+
+	op.Responses = maps.Clone(op.Responses)
+	op.Responses["200"] = ok
+
+	return op
+}
+
+func param(name string, in string, description string, schema *Schema) OpenAPIParameter {
+	return OpenAPIParameter{Name: name, In: in, Description: description, Required: in == "path", Schema: schema}
+}
+
+func enum(values ...string) *Schema {
+	return &Schema{Type: "string", Enum: values}
+}
+
+func limitSchema(max int) *Schema {
+	least := 1
+
+	return &Schema{Type: "integer", Minimum: &least, Maximum: &max}
+}
+
+// NewOpenAPI describes every API route
+func NewOpenAPI() *OpenAPI {
+	doc := &OpenAPI{
+		OpenAPI: "3.0.3",
+		Info: OpenAPIInfo{
+			Title:       "AC Server Monitor",
+			Description: "Status and historical uptime information for Asheron's Call private servers",
+			Version:     "2",
+		},
+		Paths:      map[string]map[string]OpenAPIOperation{},
+		Components: OpenAPIComponents{Schemas: map[string]*Schema{}},
+	}
+
+	id := param("id", "path", "The server's GUID from the community server list or its name", &Schema{Type: "string"})
+	name := param("name", "path", "The server's name", &Schema{Type: "string"})
+	from := param("from", "query", timeDescription+". Defaults to 14 days before to.", &Schema{Type: "string"})
+	to := param("to", "query", timeDescription+". Defaults to now.", &Schema{Type: "string"})
+	granularity := param("granularity", "query", "How to bucket the range", enum(api.GRANULARITY_HOUR, api.GRANULARITY_DAY, api.GRANULARITY_WEEK, api.GRANULARITY_MONTH))
+	rttGranularity := param("granularity", "query", "How to bucket the range", enum(api.GRANULARITY_HOUR, api.GRANULARITY_DAY))
+
+	serverParams := []OpenAPIParameter{
+		param("emu", "query", "Only list servers running this emulator", &Schema{Type: "string"}),
+		param("type", "query", "Only list servers of this type, e.g., PvE", &Schema{Type: "string"}),
+		param("online", "query", "Only list servers that are up or down", &Schema{Type: "boolean"}),
+		param("q", "query", "Only list servers whose name or description contains this", &Schema{Type: "string"}),
+		param("sort", "query", "Sort by name, uptime (over 30 days or a window), mean RTT over the last 24 hours or when servers were last seen", enum(append(slices.Clone(api.SERVER_SORT_KEYS), api.UPTIME_SUMMARY_KEYS...)...)),
+	}
+
+	statusParams := []OpenAPIParameter{
+		param("cursor", "query", "The next_cursor from the previous page", &Schema{Type: "string"}),
+		param("from", "query", timeDescription+". Only checks at or after this are returned.", &Schema{Type: "string"}),
+		param("to", "query", timeDescription+". Only checks before this are returned.", &Schema{Type: "string"}),
+		param("status", "query", "Only return checks that succeeded (up) or failed (down)", enum("up", "down")),
+		param("limit", "query", "How many checks to return", limitSchema(api.MAX_STATUSES)),
+	}
+
+	v2Errors := map[string]OpenAPIResponse{
+		"400": jsonResponse(doc, "Invalid parameters", APIError{}),
+		"404": jsonResponse(doc, "No such server", APIError{}),
+		"500": jsonResponse(doc, "Something went wrong", APIError{}),
+	}
+
+	v2 := func(id string, summary string, params []OpenAPIParameter, v any) OpenAPIOperation {
+		responses := map[string]OpenAPIResponse{"200": jsonResponse(doc, summary, v)}
+
+		for code, response := range v2Errors {
+			responses[code] = response
+		}
+
+		return OpenAPIOperation{OperationID: id, Summary: summary, Tags: []string{OPENAPI_V2}, Parameters: params, Responses: responses}
+	}
+
+	v1 := func(id string, summary string, params []OpenAPIParameter, v any) OpenAPIOperation {
+		return OpenAPIOperation{
+			OperationID: id,
+			Summary:     summary,
+			Tags:        []string{OPENAPI_V1},
+			Deprecated:  true,
+			Parameters:  params,
+			Responses: map[string]OpenAPIResponse{
+				"200": jsonResponse(doc, summary, v),
+				"400": {Description: "Invalid parameters"},
+				"404": {Description: "No such server"},
+			},
+		}
+	}
+
+	get := func(path string, op OpenAPIOperation) {
+		doc.Paths[path] = map[string]OpenAPIOperation{"get": op}
+	}
+
+	get("/api/v2/servers", listed(doc, v2("listServers", "Listed servers and their statuses", serverParams, api.ServerAPIResponse{}), api.ServerAPIResponseServer{}))
+	get("/api/v2/servers/{id}", v2("getServer", "A server, including its details from the server list", []OpenAPIParameter{id}, api.ServerDetail{}))
+	get("/api/v2/servers/{id}/statuses", listed(doc, v2("listStatuses", "A server's checks, newest first", append([]OpenAPIParameter{id}, statusParams...), api.StatusApiResponse{}), api.StatusApiStatusItem{}))
+	get("/api/v2/servers/{id}/uptimes", listed(doc, v2("getUptimes", "A server's uptime over time", []OpenAPIParameter{id, from, to, granularity}, api.UptimeResult{}), api.UptimeApiItem{}))
+	get("/api/v2/servers/{id}/rtt", v2("getRTT", "Percentiles of a server's round trip times for successful checks", []OpenAPIParameter{id, from, to, rttGranularity}, api.RTTResult{}))
+	get("/api/v2/servers/{id}/slo", v2("getServerSLO", "A server's uptime objective, attainment and error budget", []OpenAPIParameter{id}, api.SLOApiResponse{}))
+	get("/api/v2/servers/{id}/incidents", v2("listIncidents", "A server's outages and degraded periods, newest first", []OpenAPIParameter{id, param("limit", "query", "How many incidents to return", limitSchema(api.MAX_INCIDENTS))}, api.IncidentApiResponse{}))
+	get("/api/v2/servers/{id}/events", v2("listEvents", "A server's state changes, newest first", []OpenAPIParameter{id, param("limit", "query", "How many events to return", limitSchema(lib.FEED_SIZE))}, EventsResponse{}))
+	get("/api/v2/slo", v2("listSLOs", "Every server's uptime objective, attainment and error budget", nil, api.SLOApiResponse{}))
+
+	get("/api/export", OpenAPIOperation{
+		OperationID: "export",
+		Summary:     "One table's history for a date range, for publishing datasets",
+		Tags:        []string{OPENAPI_V2},
+		Parameters: []OpenAPIParameter{
+			{Name: "table", In: "query", Description: "What to export. Every server is exported, whatever the range, along with checks in the range and incidents that overlap it.", Required: true, Schema: enum(api.EXPORT_TABLES...)},
+			param("from", "query", timeDescription+fmt.Sprintf(". Defaults to %d days before to.", api.DEFAULT_EXPORT_DAYS), &Schema{Type: "string"}),
+			param("to", "query", timeDescription+". Defaults to now.", &Schema{Type: "string"}),
+			param("format", "query", "Respond with NDJSON, CSV or Parquet. Overrides the Accept header.", enum(EXPORT_FORMATS...)),
+		},
+		Responses: map[string]OpenAPIResponse{
+			"200": {
+				Description: fmt.Sprintf("The table's rows, oldest first. At most %d days can be exported at once.", MAX_EXPORT_DAYS),
+				Content: map[string]OpenAPIMediaType{
+					"application/x-ndjson": {Schema: &Schema{OneOf: []*Schema{
+						doc.Schema(reflect.TypeOf(api.ExportServer{})),
+						doc.Schema(reflect.TypeOf(api.ExportStatus{})),
+						doc.Schema(reflect.TypeOf(api.ExportIncident{})),
+					}}},
+					"text/csv":         {Schema: &Schema{Type: "string"}},
+					PARQUET_MEDIA_TYPE: {Schema: &Schema{Type: "string", Format: "binary"}},
+				},
+			},
+			"400": jsonResponse(doc, "Invalid parameters", APIError{}),
+		},
+	})
+
+	get("/api/stream", OpenAPIOperation{
+		OperationID: "stream",
+		Summary:     "Server-sent events for each check as it finishes (check) and each state change (change)",
+		Tags:        []string{OPENAPI_V2},
+		Parameters: []OpenAPIParameter{
+			param("Last-Event-ID", "header", "The ID of the last message received, to get anything missed since", &Schema{Type: "string"}),
+			param("lastEventId", "query", "The same as Last-Event-ID for clients that can't set headers", &Schema{Type: "string"}),
+		},
+		Responses: map[string]OpenAPIResponse{
+			"200": {Description: "An event stream", Content: map[string]OpenAPIMediaType{"text/event-stream": {Schema: &Schema{Type: "string"}}}},
+			"400": {Description: "Invalid Last-Event-ID"},
+		},
+	})
+
+	get("/api/", OpenAPIOperation{
+		OperationID: "listRoutes",
+		Summary:     "Every API route",
+		Tags:        []string{OPENAPI_V2},
+		Responses:   map[string]OpenAPIResponse{"200": jsonResponse(doc, "Every API route", RoutesResponse{})},
+	})
+
+	get(OPENAPI_PATH, OpenAPIOperation{
+		OperationID: "getOpenAPI",
+		Summary:     "This document",
+		Tags:        []string{OPENAPI_V2},
+		Responses: map[string]OpenAPIResponse{
+			"200": {Description: "An OpenAPI 3 document", Content: map[string]OpenAPIMediaType{"application/json": {Schema: &Schema{Type: "object"}}}},
+		},
+	})
+
+	get("/api/servers/", listed(doc, v1("listServersV1", "Listed servers and their statuses", serverParams, api.ServerAPIResponse{}), api.ServerAPIResponseServer{}))
+	get("/api/uptimes/{name}", listed(doc, v1("getUptimesV1", "A server's uptime over time", []OpenAPIParameter{name, from, to, granularity}, api.UptimeResult{}), api.UptimeApiItem{}))
+	get("/api/statuses/{name}", listed(doc, v1("listStatusesV1", "A server's checks, newest first", append([]OpenAPIParameter{name}, statusParams...), api.StatusApiResponse{}), api.StatusApiStatusItem{}))
+	get("/api/rtt/{name}", v1("getRTTV1", "Percentiles of a server's round trip times for successful checks", []OpenAPIParameter{name, from, to, rttGranularity}, api.RTTResult{}))
+	get("/api/slo", v1("listSLOsV1", "Every server's uptime objective, attainment and error budget", nil, api.SLOApiResponse{}))
+	get("/api/slo/{name}", v1("getServerSLOV1", "A server's uptime objective, attainment and error budget", []OpenAPIParameter{name}, api.SLOApiResponse{}))
+
+	return doc
+}
+
+// Routes lists the documented paths, sorted with deprecated ones last
+func (doc *OpenAPI) Routes() []string {
+	var routes []string
+
+	for path := range doc.Paths {
+		routes = append(routes, path)
+	}
+
+	slices.SortFunc(routes, func(a string, b string) int {
+		if doc.Paths[a]["get"].Deprecated != doc.Paths[b]["get"].Deprecated {
+			if doc.Paths[a]["get"].Deprecated {
+				return 1
+			}
+
+			return -1
+		}
+
+		return strings.Compare(a, b)
+	})
+
+	return routes
+}
+
+// OpenAPIHandler serves the OpenAPI document
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, NewOpenAPI())
+}
+
+// RoutesHandler lists every API route at /api/
+func RoutesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, RoutesResponse{Routes: NewOpenAPI().Routes(), OpenAPI: OPENAPI_PATH})
+}
+
+// DocsHandler serves a page at /api/docs describing every route, with forms to
+// try them out
+func DocsHandler(w http.ResponseWriter, r *http.Request) {
+	doc := NewOpenAPI()
+
+	lib.RenderTemplate(w, "api.html", struct {
+		Doc    *OpenAPI
+		Routes []string
+	}{
+		Doc:    doc,
+		Routes: doc.Routes(),
+	})
+}
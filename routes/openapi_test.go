@@ -0,0 +1,244 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"monitor/api"
+	"monitor/lib"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ValidateTestSchema returns everything about v, decoded from JSON, that
+// doesn't match schema
+func ValidateTestSchema(doc *OpenAPI, schema *Schema, v any, at string) []string {
+	if schema.Ref != "" {
+		return ValidateTestSchema(doc, doc.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")], v, at)
+	}
+
+	if schema.OneOf != nil {
+		matches := 0
+
+		for _, option := range schema.OneOf {
+			if len(ValidateTestSchema(doc, option, v, at)) == 0 {
+				matches++
+			}
+		}
+
+		if matches != 1 {
+			return []string{fmt.Sprintf("%s matches %d of its oneOf schemas, not 1", at, matches)}
+		}
+
+		return nil
+	}
+
+	if v == nil {
+		if schema.Nullable {
+			return nil
+		}
+
+		return []string{at + " is null"}
+	}
+
+	var problems []string
+
+	switch value := v.(type) {
+	case map[string]any:
+		if schema.Type != "object" {
+			return []string{fmt.Sprintf("%s is an object, not %s", at, schema.Type)}
+		}
+
+		for _, key := range schema.Required {
+			if _, ok := value[key]; !ok {
+				problems = append(problems, fmt.Sprintf("%s.%s is missing", at, key))
+			}
+		}
+
+		for key, item := range value {
+			property, ok := schema.Properties[key]
+
+			if !ok {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					problems = append(problems, fmt.Sprintf("%s.%s isn't in the spec", at, key))
+				}
+
+				continue
+			}
+
+			problems = append(problems, ValidateTestSchema(doc, property, item, at+"."+key)...)
+		}
+	case []any:
+		if schema.Type != "array" {
+			return []string{fmt.Sprintf("%s is an array, not %s", at, schema.Type)}
+		}
+
+		for i, item := range value {
+			problems = append(problems, ValidateTestSchema(doc, schema.Items, item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case string:
+		if schema.Type != "string" {
+			return []string{fmt.Sprintf("%s is a string, not %s", at, schema.Type)}
+		}
+
+		if schema.Enum != nil && !slices.Contains(schema.Enum, value) {
+			problems = append(problems, fmt.Sprintf("%s is %q, which isn't one of %v", at, value, schema.Enum))
+		}
+	case float64:
+		if schema.Type != "number" && (schema.Type != "integer" || value != math.Trunc(value)) {
+			return []string{fmt.Sprintf("%s is %v, not %s", at, value, schema.Type)}
+		}
+	case bool:
+		if schema.Type != "boolean" {
+			return []string{fmt.Sprintf("%s is a boolean, not %s", at, schema.Type)}
+		}
+	}
+
+	return problems
+}
+
+// AssertTestMatchesSpec checks a response against the spec for the route
+// and status code
+func AssertTestMatchesSpec(t *testing.T, doc *OpenAPI, path string, route string, status int, body []byte) {
+	response, ok := doc.Paths[route]["get"].Responses[fmt.Sprint(status)]
+
+	if !assert.True(t, ok, "%s has no %d response in the spec", route, status) {
+		return
+	}
+
+	var v any
+
+	if err := json.Unmarshal(body, &v); err != nil {
+		t.Fatalf("%s returned invalid JSON: %s", path, body)
+	}
+
+	problems := ValidateTestSchema(doc, response.Content["application/json"].Schema, v, "body")
+	assert.Empty(t, problems, path)
+}
+
+func TestOpenAPIDescribesEveryRoute(t *testing.T) {
+	doc := NewOpenAPI()
+
+	for pattern := range (V2{}).Routes() {
+		method, path, _ := strings.Cut(pattern, " ")
+		_, ok := doc.Paths[path][strings.ToLower(method)]
+
+		assert.True(t, ok, "%s isn't in the spec", pattern)
+	}
+
+	for _, schema := range doc.Components.Schemas {
+		for name, property := range schema.Properties {
+			assert.True(t, property.Ref != "" || property.Type != "", "%s has no type", name)
+		}
+	}
+}
+
+func TestHandlersMatchOpenAPI(t *testing.T) {
+	db, mux := NewTestV2(t)
+	doc := NewOpenAPI()
+	now := time.Now().UTC()
+
+	// Give every list something in it so the items are checked too
+	for i := range 6 {
+		_, err := db.Exec("INSERT INTO statuses (server_id, created_at, status, rtt, message) VALUES (1, ?, ?, 50, '')", now.Add(-time.Duration(i)*time.Hour).Unix(), i != 2)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// And a server without any checks so empty lists are checked
+	_, err := db.Exec(`INSERT INTO servers (guid, name, description, emu, host, port, type, is_listed, created_at, updated_at)
+		VALUES ('empty-guid', 'Empty', '', '', '', '', '', 1, 0, 0)`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	then := now.Add(-2 * time.Hour).Unix()
+
+	if _, err := lib.StartIncident(tx, 1, "outage", then, "Timeout"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := lib.EndIncident(tx, 1, "outage", then+3600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lib.RecordEvent(tx, 1, "down", then, sql.NullInt64{}, "Timeout"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for path := range doc.Paths {
+		if !strings.HasPrefix(path, "/api/v2/") {
+			continue
+		}
+
+		for _, id := range []string{"levistras-guid", "empty-guid"} {
+			url := strings.ReplaceAll(path, "{id}", id)
+			res := GetTestJSON(t, mux, url, nil)
+
+			assert.Equal(t, http.StatusOK, res.Code, url)
+			AssertTestMatchesSpec(t, doc, url, path, res.Code, res.Body.Bytes())
+		}
+
+		if strings.Contains(path, "{id}") {
+			url := strings.ReplaceAll(path, "{id}", "nope")
+			res := GetTestJSON(t, mux, url, nil)
+
+			assert.Equal(t, http.StatusNotFound, res.Code, url)
+			AssertTestMatchesSpec(t, doc, url, path, res.Code, res.Body.Bytes())
+		}
+	}
+
+	// Streamed lists have one item per line
+	for path, ops := range doc.Paths {
+		ndjson, ok := ops["get"].Responses["200"].Content["application/x-ndjson"]
+
+		if !ok || !strings.HasPrefix(path, "/api/v2/") {
+			continue
+		}
+
+		url := strings.ReplaceAll(path, "{id}", "levistras-guid") + "?format=ndjson"
+		res := GetTestJSON(t, mux, url, nil)
+		lines := strings.Split(strings.TrimSpace(res.Body.String()), "\n")
+
+		assert.Equal(t, http.StatusOK, res.Code, url)
+		assert.NotEmpty(t, lines, url)
+
+		for i, line := range lines {
+			var v any
+
+			if err := json.Unmarshal([]byte(line), &v); err != nil {
+				t.Fatalf("%s returned invalid JSON on line %d: %s", url, i+1, line)
+			}
+
+			assert.Empty(t, ValidateTestSchema(doc, ndjson.Schema, v, fmt.Sprintf("line %d", i+1)), url)
+		}
+	}
+
+	// Paged and filtered statuses have the same shape
+	res := GetTestJSON(t, mux, "/api/v2/servers/Levistras/statuses?limit=1&status=down", nil)
+	AssertTestMatchesSpec(t, doc, "statuses?status=down", "/api/v2/servers/{id}/statuses", res.Code, res.Body.Bytes())
+	assert.Contains(t, res.Body.String(), `"next_cursor": null`)
+
+	var servers api.ServerAPIResponse
+	GetTestJSON(t, mux, "/api/v2/servers?online=false", &servers)
+	assert.Equal(t, 0, servers.Count)
+}
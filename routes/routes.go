@@ -1,4 +1,479 @@
 package routes
 
-// TODO: I'd like to move all the routes here but I'm not sure how
-//       best to do that.
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"monitor/api"
+	"monitor/lib"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How many incidents and events are returned when no limit is given
+const DEFAULT_LIMIT = 50
+
+// V2 serves /api/v2. Servers are identified by the GUID from the community
+// server list, which doesn't change when a server is renamed, or by name for
+// convenience. Errors are always returned as an APIError.
+type V2 struct {
+	DB        *sql.DB
+	SLOConfig api.SLOConfig
+}
+
+// APIError is the body of every v2 error response
+type APIError struct {
+	Error APIErrorDetail `json:"error"`
+}
+
+type APIErrorDetail struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Routes maps each v2 route's pattern to its handler. Every route must be
+// described by NewOpenAPI.
+func (v V2) Routes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"GET /api/v2/servers":                v.Servers,
+		"GET /api/v2/servers/{id}":           v.Server,
+		"GET /api/v2/servers/{id}/statuses":  v.Statuses,
+		"GET /api/v2/servers/{id}/uptimes":   v.Uptimes,
+		"GET /api/v2/servers/{id}/rtt":       v.RTT,
+		"GET /api/v2/servers/{id}/slo":       v.SLO,
+		"GET /api/v2/servers/{id}/incidents": v.Incidents,
+		"GET /api/v2/servers/{id}/events":    v.Events,
+		"GET /api/v2/slo":                    v.SLO,
+		"GET /api/export":                    v.Export,
+	}
+}
+
+// Register adds the v2 routes to mux
+func (v V2) Register(mux *http.ServeMux) {
+	for pattern, handler := range v.Routes() {
+		mux.Handle(pattern, lib.LogReq(handler))
+	}
+
+	mux.Handle("/api/v2/", lib.LogReq(v.NotFound))
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	output, err := json.MarshalIndent(data, "", "  ")
+
+	if err != nil {
+		log.Printf("Failed to encode response: %s", err)
+		status = http.StatusInternalServerError
+		output = []byte(`{"error": {"status": 500, "code": "internal_error", "message": "Failed to encode response"}}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Length")
+
+	w.WriteHeader(status)
+	w.Write(output)
+}
+
+// writeError sends an APIError. Internal errors are logged and replaced with
+// a generic message so query details aren't leaked.
+func writeError(w http.ResponseWriter, status int, err error) {
+	message := err.Error()
+
+	if status >= 500 {
+		log.Printf("Error serving v2 API request: %s", err)
+		message = "Something went wrong on our end"
+	}
+
+	code := strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+
+	if status == http.StatusInternalServerError {
+		code = "internal_error"
+	}
+
+	writeJSON(w, status, APIError{Error: APIErrorDetail{Status: status, Code: code, Message: message}})
+}
+
+// logRowsError logs a failure to stream rows. It's too late to send an error by
+// then, as the status and some rows have likely been sent already.
+func logRowsError(err error) {
+	if err != nil {
+		log.Printf("Error streaming rows: %s", err)
+	}
+}
+
+// finishRows handles a failure to stream rows from a RowWriter. Before the
+// response has started it gets an error response like any other, but after
+// that it's aborted so clients can tell it was cut short.
+func finishRows(w http.ResponseWriter, err error) {
+	if err == nil {
+		return
+	}
+
+	if errors.Is(err, ErrRowsSent) {
+		logRowsError(err)
+		panic(http.ErrAbortHandler)
+	}
+
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+// ResolveServer finds a server's ID from its GUID or, failing that, its name,
+// returning zero if there's no such server
+func ResolveServer(db *sql.DB, key string) (int, error) {
+	id, err := api.GetServerIdByGUID(db, key)
+
+	if err != nil || id != 0 {
+		return id, err
+	}
+
+	return api.GetServerIdByName(db, key)
+}
+
+// server resolves the {id} in the path, writing an error and returning zero
+// if it can't
+func (v V2) server(w http.ResponseWriter, r *http.Request) int {
+	key := r.PathValue("id")
+	id, err := ResolveServer(v.DB, key)
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return 0
+	}
+
+	if id == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no server with GUID or name %q", key))
+		return 0
+	}
+
+	return id
+}
+
+// parseLimit reads the limit parameter, which defaults to DEFAULT_LIMIT
+func parseLimit(values url.Values, max int) (int, error) {
+	value := values.Get("limit")
+
+	if value == "" {
+		return min(DEFAULT_LIMIT, max), nil
+	}
+
+	limit, err := strconv.Atoi(value)
+
+	if err != nil || limit < 1 || limit > max {
+		return 0, fmt.Errorf("limit must be a number from 1 to %d", max)
+	}
+
+	return limit, nil
+}
+
+func (v V2) NotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, fmt.Errorf("no route for %s %s", r.Method, r.URL.Path))
+}
+
+func (v V2) Servers(w http.ResponseWriter, r *http.Request) {
+	filter, err := api.ParseServerFilter(r.URL.Query())
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	format, err := NegotiateFormat(r)
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	done := lib.TimeQuery(r.Context(), "servers")
+
+	if format != FORMAT_JSON {
+		err := WriteServers(w, v.DB, format, filter)
+		done()
+		finishRows(w, err)
+		return
+	}
+
+	data, err := api.Servers(v.DB, filter)
+	done()
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, data)
+}
+
+func (v V2) Server(w http.ResponseWriter, r *http.Request) {
+	id := v.server(w, r)
+
+	if id == 0 {
+		return
+	}
+
+	row, err := api.Server(v.DB, id)
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	done := lib.TimeQuery(r.Context(), "server")
+	server, err := api.ServerStatus(v.DB, id)
+	done()
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	data := api.ServerDetail{
+		ServerAPIResponseServer: server,
+		Description:             row.Description,
+		Emulator:                row.Emulator,
+		Type:                    row.Type,
+		WebsiteURL:              row.WebsiteURL,
+		DiscordURL:              row.DiscordURL,
+	}
+
+	writeJSON(w, http.StatusOK, data)
+}
+
+// Statuses serves a page of a server's checks, newest first
+func (v V2) Statuses(w http.ResponseWriter, r *http.Request) {
+	id := v.server(w, r)
+
+	if id == 0 {
+		return
+	}
+
+	status_query, err := api.ParseStatusQuery(r.URL.Query())
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	format, err := NegotiateFormat(r)
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	done := lib.TimeQuery(r.Context(), "statuses")
+
+	if format != FORMAT_JSON {
+		err := WriteStatuses(w, r, v.DB, id, status_query, format)
+		done()
+		finishRows(w, err)
+		return
+	}
+
+	data, err := api.Statuses(v.DB, id, status_query)
+	done()
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, data)
+}
+
+func (v V2) Uptimes(w http.ResponseWriter, r *http.Request) {
+	id := v.server(w, r)
+
+	if id == 0 {
+		return
+	}
+
+	uptime_range, err := api.ParseUptimeRange(r.URL.Query(), time.Now().UTC())
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	format, err := NegotiateFormat(r)
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	name, err := api.GetServerNameById(v.DB, id)
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	done := lib.TimeQuery(r.Context(), "uptime")
+	data, err := api.Uptime(v.DB, id, name, uptime_range)
+	done()
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if format != FORMAT_JSON {
+		finishRows(w, WriteUptimes(w, format, data))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, data)
+}
+
+func (v V2) RTT(w http.ResponseWriter, r *http.Request) {
+	id := v.server(w, r)
+
+	if id == 0 {
+		return
+	}
+
+	rtt_range, err := api.ParseUptimeRange(r.URL.Query(), time.Now().UTC())
+
+	if err == nil {
+		err = api.ValidateRTTRange(rtt_range)
+	}
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	name, err := api.GetServerNameById(v.DB, id)
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	done := lib.TimeQuery(r.Context(), "rtt_percentiles")
+	data, err := api.RTTPercentiles(v.DB, id, name, rtt_range)
+	done()
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, data)
+}
+
+// SLO serves every server's SLO at /api/v2/slo or one server's
+func (v V2) SLO(w http.ResponseWriter, r *http.Request) {
+	var id int
+
+	if r.PathValue("id") != "" {
+		id = v.server(w, r)
+
+		if id == 0 {
+			return
+		}
+	}
+
+	done := lib.TimeQuery(r.Context(), "slos")
+	data, err := api.SLOs(v.DB, v.SLOConfig, id, time.Now().UTC())
+	done()
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, data)
+}
+
+func (v V2) Incidents(w http.ResponseWriter, r *http.Request) {
+	id := v.server(w, r)
+
+	if id == 0 {
+		return
+	}
+
+	limit, err := parseLimit(r.URL.Query(), api.MAX_INCIDENTS)
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	done := lib.TimeQuery(r.Context(), "incidents")
+	data, err := api.Incidents(v.DB, id, limit, time.Now().UTC())
+	done()
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, data)
+}
+
+// Events serves a server's most recent state changes, newest first, in the
+// same format as webhooks
+func (v V2) Events(w http.ResponseWriter, r *http.Request) {
+	id := v.server(w, r)
+
+	if id == 0 {
+		return
+	}
+
+	limit, err := parseLimit(r.URL.Query(), lib.FEED_SIZE)
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	done := lib.TimeQuery(r.Context(), "events")
+	events, err := lib.RecentEvents(v.DB, id, limit)
+	done()
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if events == nil {
+		events = []lib.Event{}
+	}
+
+	writeJSON(w, http.StatusOK, EventsResponse{Count: len(events), Events: events})
+}
+
+// Deprecated marks a v1 route's responses as deprecated, linking to the v2
+// route that successor returns for the request
+func Deprecated(h http.Handler, successor func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor(r)))
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ServerSuccessor returns the v2 route for v1 routes that take a server name
+// after prefix, e.g., /api/uptimes/:name is /api/v2/servers/:name/uptimes
+func ServerSuccessor(prefix string, suffix string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		name := strings.TrimPrefix(r.URL.Path, prefix)
+
+		if name == "" {
+			return "/api/v2/servers"
+		}
+
+		return "/api/v2/servers/" + url.PathEscape(name) + suffix
+	}
+}
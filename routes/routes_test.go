@@ -0,0 +1,198 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"monitor/api"
+	"monitor/lib"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// NewTestV2 serves the v2 API from a database with one server, Levistras,
+// whose GUID is "levistras-guid"
+func NewTestV2(t *testing.T) (*sql.DB, *http.ServeMux) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "monitor.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	if err := lib.AutoMigrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	lib.UpdateServersTable(db, lib.ServerList{Servers: []lib.ServerListItem{
+		{ID: "levistras-guid", Name: "Levistras", Emu: "ACE", Type: "PvE"},
+	}})
+
+	mux := http.NewServeMux()
+	V2{DB: db, SLOConfig: api.SLOConfig{Default: 99, WindowDays: 30}}.Register(mux)
+
+	return db, mux
+}
+
+func GetTestJSON(t *testing.T, mux *http.ServeMux, path string, v any) *httptest.ResponseRecorder {
+	res := httptest.NewRecorder()
+	mux.ServeHTTP(res, httptest.NewRequest("GET", path, nil))
+
+	if v != nil {
+		if err := json.Unmarshal(res.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s returned invalid JSON: %s", path, res.Body.String())
+		}
+	}
+
+	return res
+}
+
+func TestV2ResolvesServers(t *testing.T) {
+	_, mux := NewTestV2(t)
+
+	for _, key := range []string{"levistras-guid", "Levistras"} {
+		var server api.ServerDetail
+		res := GetTestJSON(t, mux, "/api/v2/servers/"+key, &server)
+
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "levistras-guid", server.GUID)
+		assert.Equal(t, "Levistras", server.Name)
+		assert.Equal(t, "ACE", server.Emulator)
+	}
+
+	var servers api.ServerAPIResponse
+	GetTestJSON(t, mux, "/api/v2/servers?emu=ace&q=levi", &servers)
+	assert.Equal(t, 1, servers.Count)
+
+	GetTestJSON(t, mux, "/api/v2/servers?type=PvP", &servers)
+	assert.Equal(t, 0, servers.Count)
+
+	var incidents api.IncidentApiResponse
+	res := GetTestJSON(t, mux, "/api/v2/servers/levistras-guid/incidents", &incidents)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "Levistras", incidents.ServerName)
+	assert.Empty(t, incidents.Incidents)
+}
+
+func TestV2UnlistedServer(t *testing.T) {
+	db, mux := NewTestV2(t)
+	lib.UpdateServersTable(db, lib.ServerList{})
+
+	var servers api.ServerAPIResponse
+	GetTestJSON(t, mux, "/api/v2/servers", &servers)
+	assert.Equal(t, 0, servers.Count)
+
+	var server api.ServerDetail
+	res := GetTestJSON(t, mux, "/api/v2/servers/levistras-guid", &server)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "levistras-guid", server.GUID)
+	assert.Equal(t, "Levistras", server.Name)
+	assert.False(t, server.Active)
+}
+
+func TestV2ServersQueryErrors(t *testing.T) {
+	db, mux := NewTestV2(t)
+
+	_, err := db.Exec("DROP TABLE statuses_hourly")
+	assert.NoError(t, err)
+
+	for _, path := range []string{"/api/v2/servers", "/api/v2/servers/Levistras"} {
+		var body APIError
+		res := GetTestJSON(t, mux, path, &body)
+
+		assert.Equal(t, http.StatusInternalServerError, res.Code, path)
+		assert.Equal(t, "internal_error", body.Error.Code, path)
+	}
+}
+
+func TestV2Errors(t *testing.T) {
+	_, mux := NewTestV2(t)
+
+	cases := []struct {
+		path   string
+		status int
+		code   string
+	}{
+		{"/api/v2/servers/nope", 404, "not_found"},
+		{"/api/v2/servers/nope/uptimes", 404, "not_found"},
+		{"/api/v2/servers/Levistras/uptimes?granularity=year", 400, "bad_request"},
+		{"/api/v2/servers/Levistras/incidents?limit=1000", 400, "bad_request"},
+		{"/api/v2/servers/Levistras/statuses?cursor=nope", 400, "bad_request"},
+		{"/api/v2/servers?sort=players", 400, "bad_request"},
+		{"/api/v2/nope", 404, "not_found"},
+	}
+
+	for _, c := range cases {
+		var body APIError
+		res := GetTestJSON(t, mux, c.path, &body)
+
+		assert.Equal(t, c.status, res.Code, c.path)
+		assert.Equal(t, "application/json", res.Header().Get("Content-Type"), c.path)
+		assert.Equal(t, c.status, body.Error.Status, c.path)
+		assert.Equal(t, c.code, body.Error.Code, c.path)
+		assert.NotEmpty(t, body.Error.Message, c.path)
+	}
+}
+
+func TestDeprecated(t *testing.T) {
+	handler := Deprecated(http.NotFoundHandler(), ServerSuccessor("/api/uptimes/", "/uptimes"))
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/api/uptimes/Morning%20Thaw", nil))
+
+	assert.Equal(t, "true", res.Header().Get("Deprecation"))
+	assert.Equal(t, `</api/v2/servers/Morning%20Thaw/uptimes>; rel="successor-version"`, res.Header().Get("Link"))
+}
+
+func TestV2StatusesPages(t *testing.T) {
+	db, mux := NewTestV2(t)
+
+	// Two checks share a second to make sure paging doesn't skip either
+	for i, created_at := range []int64{100, 200, 200, 300, 400} {
+		_, err := db.Exec("INSERT INTO statuses (server_id, created_at, status) VALUES (1, ?, ?)", created_at, i%2)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var seen []string
+	path := "/api/v2/servers/Levistras/statuses?limit=2"
+
+	for {
+		var page api.StatusApiResponse
+		res := GetTestJSON(t, mux, path, &page)
+
+		assert.Equal(t, http.StatusOK, res.Code)
+
+		for _, s := range page.Statuses {
+			seen = append(seen, s.CreatedAt+" "+s.Status)
+		}
+
+		if !page.NextCursor.Valid {
+			break
+		}
+
+		path = "/api/v2/servers/Levistras/statuses?limit=2&cursor=" + page.NextCursor.String
+	}
+
+	assert.Equal(t, []string{
+		"1970-01-01T00:06:40Z DOWN",
+		"1970-01-01T00:05:00Z UP",
+		"1970-01-01T00:03:20Z DOWN",
+		"1970-01-01T00:03:20Z UP",
+		"1970-01-01T00:01:40Z DOWN",
+	}, seen)
+
+	var failures api.StatusApiResponse
+	GetTestJSON(t, mux, "/api/v2/servers/Levistras/statuses?status=down&from=1970-01-01T00:02:00Z", &failures)
+
+	assert.Equal(t, 2, failures.Count)
+	assert.False(t, failures.NextCursor.Valid)
+}
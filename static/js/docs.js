@@ -0,0 +1,31 @@
+// Fills path parameters into the URL of each "Try it" form on /api/docs and
+// leaves empty parameters out of the query string
+(function () {
+  document.querySelectorAll("form.try-it").forEach(function (form) {
+    form.addEventListener("submit", function (event) {
+      event.preventDefault();
+
+      var path = form.getAttribute("data-path");
+      var query = new URLSearchParams();
+
+      form.querySelectorAll("[name]").forEach(function (field) {
+        if (field.value === "") {
+          return;
+        }
+
+        if (field.getAttribute("data-in") === "path") {
+          path = path.replace(
+            "{" + field.name + "}",
+            encodeURIComponent(field.value)
+          );
+        } else {
+          query.set(field.name, field.value);
+        }
+      });
+
+      var search = query.toString();
+
+      window.location = path + (search ? "?" + search : "");
+    });
+  });
+})();
@@ -0,0 +1,73 @@
+// Updates the status squares on the index page as checks finish, using the
+// server-sent events from /api/stream
+(function () {
+  if (!window.EventSource) {
+    return;
+  }
+
+  var COLORS = {
+    up: "rgba(0, 200 , 0, 1)",
+    degraded: "rgba(230, 130, 0, 1)",
+    down: "rgba(220, 0, 0, 1)",
+  };
+
+  function setStatus(guid, state, keepDegraded) {
+    var square = document.querySelector(
+      '.server-status[data-guid="' + CSS.escape(guid) + '"] svg'
+    );
+
+    if (!square) {
+      return;
+    }
+
+    if (keepDegraded && square.getAttribute("aria-labelledby") === "degraded") {
+      return;
+    }
+
+    square.setAttribute("aria-labelledby", state);
+    square.querySelector("rect").setAttribute("fill", COLORS[state]);
+  }
+
+  var checks = document.querySelector('[data-live="checks"]');
+  var lastUpdated = document.querySelector('[data-live="last-updated"]');
+
+  // EventSource sends Last-Event-ID itself when it reconnects
+  var source = new EventSource("/api/stream");
+
+  // Checks say whether a server is up, down or degraded. Changes arrive
+  // straight after the check that caused them and only matter for servers
+  // that went down or came back up, which mustn't undo a degraded check.
+  function update(e) {
+    var data = JSON.parse(e.data);
+
+    if (e.type === "change") {
+      if (data.kind === "down") {
+        setStatus(data.server.guid, "down");
+      } else if (data.kind === "up") {
+        setStatus(data.server.guid, "up", true);
+      }
+
+      return;
+    }
+
+    setStatus(
+      data.server.guid,
+      !data.up ? "down" : data.degraded ? "degraded" : "up"
+    );
+
+    if (checks) {
+      var count = parseInt(checks.textContent.replace(/,/g, ""), 10);
+
+      if (!isNaN(count)) {
+        checks.textContent = (count + 1).toLocaleString("en-US");
+      }
+    }
+
+    if (lastUpdated) {
+      lastUpdated.textContent = "just now";
+    }
+  }
+
+  source.addEventListener("check", update);
+  source.addEventListener("change", update);
+})();